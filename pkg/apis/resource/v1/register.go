@@ -24,8 +24,31 @@ import (
 	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
+// GroupName is the group of these objects
+const GroupName = resource.GroupName
+
+// plural resource names of these objects, as the paths of their APIs and in RBAC rules
+const (
+	NetworksResource        = "networks"
+	UsingIPsResource        = "usingips"
+	LastReservedIPsResource = "lastreservedips"
+)
+
+// kinds of these objects
+const (
+	NetworkKind        = "Network"
+	UsingIPKind        = "UsingIP"
+	LastReservedIPKind = "LastReservedIP"
+)
+
 // SchemeGroupVersion is group version used to register these objects
-var SchemeGroupVersion = schema.GroupVersion{Group: resource.GroupName, Version: "v1"}
+var SchemeGroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1"}
+
+// GroupVersionResource takes an unqualified resource and returns it qualified by SchemeGroupVersion,
+// e.g. as a dynamic client or informer needs
+func GroupVersionResource(resource string) schema.GroupVersionResource {
+	return SchemeGroupVersion.WithResource(resource)
+}
 
 // Kind takes an unqualified kind and returns back a Group qualified GroupKind
 func Kind(kind string) schema.GroupKind {
@@ -0,0 +1,76 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package v1_test
+
+import (
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/scheme"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestGroupVersionResource(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	tests := []struct {
+		resource string
+		list     func() error
+	}{
+		{v1.NetworksResource, func() error {
+			_, err := client.ResourceV1().Networks().List(metav1.ListOptions{})
+			return err
+		}},
+		{v1.UsingIPsResource, func() error {
+			_, err := client.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+			return err
+		}},
+		{v1.LastReservedIPsResource, func() error {
+			_, err := client.ResourceV1().LastReservedIPs().List(metav1.ListOptions{})
+			return err
+		}},
+	}
+	for _, test := range tests {
+		client.ClearActions()
+		if err := test.list(); err != nil {
+			t.Errorf("test %s fails: %v", test.resource, err)
+			continue
+		}
+		actions := client.Actions()
+		if len(actions) != 1 || actions[0].GetResource() != v1.GroupVersionResource(test.resource) {
+			t.Errorf("test %s fails: expected %v but got %v", test.resource, v1.GroupVersionResource(test.resource), actions)
+		}
+	}
+}
+
+func TestKinds(t *testing.T) {
+	tests := []struct {
+		kind   string
+		object runtime.Object
+	}{
+		{v1.NetworkKind, &v1.Network{}},
+		{v1.UsingIPKind, &v1.UsingIP{}},
+		{v1.LastReservedIPKind, &v1.LastReservedIP{}},
+	}
+	for _, test := range tests {
+		gvks, _, err := scheme.Scheme.ObjectKinds(test.object)
+		if err != nil || len(gvks) != 1 || gvks[0] != v1.SchemeGroupVersion.WithKind(test.kind) {
+			t.Errorf("test %s fails: got %v %v", test.kind, gvks, err)
+		}
+	}
+}
@@ -36,6 +36,11 @@ type Network struct {
 // NetworkSpec is the spec for a network resource
 type NetworkSpec struct {
 	Pools []Pool `json:"pools"`
+	// DefaultPool is the pool allocations name no pool for, it is preferred by network-scoped allocation
+	DefaultPool string `json:"defaultPool,omitempty"`
+	// PoolPolicy decides the order network-scoped allocation tries pools in, one of LeastUtilized,
+	// by weight if empty
+	PoolPolicy string `json:"poolPolicy,omitempty"`
 }
 
 // Pool is a part of network spec which includes some network-related info
@@ -45,7 +50,39 @@ type Pool struct {
 	PoolEnd   string `json:"poolEnd,omitempty"`
 	Gateway   string `json:"gateway,omitempty"`
 	Subnet    string `json:"subnet,omitempty"`
-	VlanId    *int32 `json:"vlanId,omitempty"`
+	// VlanId must be in [1, 4094] but not in [1006, 1024], see types.ValidateNetworkCRD,
+	// 0 means untagged the same as unset
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:validation:Maximum=4094
+	VlanId *int32 `json:"vlanId,omitempty"`
+	// Weight prefers pools with higher weight in network-scoped allocation
+	Weight int32 `json:"weight,omitempty"`
+	// Strategy is the allocation strategy of pool, one of StableHash and Random, sequential if empty
+	Strategy string `json:"strategy,omitempty"`
+	// ReserveFirst is the count of first usable ips of subnet never allocated
+	ReserveFirst int32 `json:"reserveFirst,omitempty"`
+	// ReserveLast is the count of last usable ips of subnet never allocated
+	ReserveLast int32 `json:"reserveLast,omitempty"`
+	// MTU is the mtu of interfaces configured with ips of pool, unset if zero
+	MTU int32 `json:"mtu,omitempty"`
+	// SecondaryGateways are gateways of HA setups besides Gateway, which is the primary one
+	SecondaryGateways []string `json:"secondaryGateways,omitempty"`
+	// Disabled stops new allocations from the pool, the ips in use are kept
+	Disabled bool `json:"disabled,omitempty"`
+	// PointToPoint makes a /31 or /127 subnet allocate both of its ips
+	PointToPoint bool `json:"pointToPoint,omitempty"`
+	// Descending makes allocation scan from PoolEnd down to PoolStart
+	Descending bool `json:"descending,omitempty"`
+	// AllowGatewayAllocation lets gateways be reserved explicitly, e.g. by a router pod, they are never allocated
+	AllowGatewayAllocation bool `json:"allowGatewayAllocation,omitempty"`
+	// ExclusiveOwner leases the whole pool to one tenant, no one else can allocate from it
+	ExclusiveOwner string `json:"exclusiveOwner,omitempty"`
+	// Labels group pools for selection, e.g. by rack or zone, they are not object labels
+	Labels map[string]string `json:"labels,omitempty"`
+	// Description tells humans what pool is for, e.g. its purpose and owner team
+	Description string `json:"description,omitempty"`
+	// Generation tells pools recreated with the same name apart, using ips of earlier generations are stale
+	Generation int64 `json:"generation,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -72,10 +109,15 @@ type LastReservedIP struct {
 	Spec LastReservedIPSpec `json:"spec"`
 }
 
-// LastReservedIPSpec is the spec for a last-reserved-ip resource
+// LastReservedIPSpec is the spec for a last-reserved-ip resource,
+// IP and PoolName record the latest reservation of the whole network,
+// while Pools records the last reserved ip of each pool by pool name
 type LastReservedIPSpec struct {
-	IP       string `json:"ip,omitempty"`
-	PoolName string `json:"poolName,omitempty"`
+	IP       string            `json:"ip,omitempty"`
+	PoolName string            `json:"poolName,omitempty"`
+	Pools    map[string]string `json:"pools,omitempty"`
+	// Network is the network the cursors belong to, empty for legacy records
+	Network string `json:"network,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
@@ -102,12 +144,29 @@ type UsingIP struct {
 	Spec UsingIPSpec `json:"spec"`
 }
 
-// UsingIPSpec is the spec for an using IP resource
+// UsingIPSpec is the spec for an using IP resource, which is owned either by
+// a pod or, when pod name and namespace are empty, by a free-form owner like a VIP
 type UsingIPSpec struct {
 	PodName      string `json:"podName,omitempty"`
 	PodNamespace string `json:"podNamespace,omitempty"`
 	Network      string `json:"network,omitempty"`
 	Pool         string `json:"pool,omitempty"`
+	Owner        string `json:"owner,omitempty"`
+	// MAC binds the ip to a nic, so that the nic always gets the same ip
+	MAC string `json:"mac,omitempty"`
+	// NodeName is the node where the owner of ip runs, for debugging only
+	NodeName string `json:"nodeName,omitempty"`
+	// Metadata is opaque context of the owner persisted along with the ip, e.g. interface name
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ContainerID and IfName are the CNI_CONTAINERID and CNI_IFNAME of the CNI ADD reserving the ip
+	ContainerID string `json:"containerID,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	// PoolGeneration is the generation of the pool when the ip was reserved
+	PoolGeneration int64 `json:"poolGeneration,omitempty"`
+	// Priority lets reservations of higher priority preempt this one when its pool is exhausted
+	Priority int32 `json:"priority,omitempty"`
+	// Protected keeps the ip from being released unless forced, e.g. for critical vips
+	Protected bool `json:"protected,omitempty"`
 }
 
 // +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
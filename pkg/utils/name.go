@@ -17,26 +17,96 @@
 package utils
 
 import (
-	"regexp"
+	"encoding/hex"
+	"fmt"
+	"net"
 	"strings"
+
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
 const (
-	DNSLabelRFC1123 = `^[a-zA-Z0-9][-a-zA-Z0-9]{0,62}$`
+	DNSLabelRFC1123 = `^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`
+
+	// HexNamePrefix marks names encoded by HexNameEncoder, legacy dashed names never start with it
+	HexNamePrefix = "ip-"
 )
 
+// NameEncoder converts ips to kubernetes object names and back
+type NameEncoder interface {
+	Encode(ip net.IP) string
+	Decode(name string) (net.IP, error)
+}
+
+// DashedNameEncoder is the legacy scheme replacing dots of ipv4 with dashes,
+// ipv6 addresses it can not express fall back to the hex scheme
+type DashedNameEncoder struct{}
+
+func (DashedNameEncoder) Encode(ip net.IP) string {
+	return ToKubeNameSafe(ip)
+}
+
+func (DashedNameEncoder) Decode(name string) (net.IP, error) {
+	return DecodeName(name)
+}
+
+// HexNameEncoder encodes the 16-byte form of an ip as hex behind HexNamePrefix,
+// which is collision-free for both ipv4 and ipv6
+type HexNameEncoder struct{}
+
+func (HexNameEncoder) Encode(ip net.IP) string {
+	return HexNamePrefix + hex.EncodeToString(ip.To16())
+}
+
+func (HexNameEncoder) Decode(name string) (net.IP, error) {
+	return DecodeName(name)
+}
+
+// DecodeName decodes a name of any known scheme back to ip
+func DecodeName(name string) (net.IP, error) {
+	if strings.HasPrefix(name, HexNamePrefix) {
+		b, err := hex.DecodeString(strings.TrimPrefix(name, HexNamePrefix))
+		if err != nil || len(b) != net.IPv6len {
+			return nil, fmt.Errorf("name %s is not a valid hex encoded ip", name)
+		}
+		return net.IP(b), nil
+	}
+
+	ip := net.ParseIP(strings.Replace(name, "-", ".", -1))
+	if ip == nil {
+		return nil, fmt.Errorf("name %s is not a valid dashed ip", name)
+	}
+	return ip, nil
+}
+
+// ToKubeName replaces dots with dashes blindly, input which is not an ipv4 address
+// produces a name of no scheme, use ToKubeNameSafe with typed ips instead
 func ToKubeName(IP string) string {
 	return strings.Replace(IP, ".", "-", -1)
 }
 
+// ToKubeNameSafe encodes ipv4 addresses in the dashed scheme like ToKubeName, and ipv6 ones
+// in the hex scheme which the dashed one can not express, empty if ip is not a valid ip
+func ToKubeNameSafe(ip net.IP) string {
+	switch {
+	case ip.To4() != nil:
+		return ToKubeName(ip.To4().String())
+	case len(ip) == net.IPv6len:
+		return HexNameEncoder{}.Encode(ip)
+	}
+	return ""
+}
+
+// ToIP decodes a name of any known scheme, names of no known scheme fall back to the dashed one
 func ToIP(kubeName string) string {
+	if ip, err := DecodeName(kubeName); err == nil {
+		return ip.String()
+	}
 	return strings.Replace(kubeName, "-", ".", -1)
 }
 
+// IsKubeName checks str is a DNS-1123 label as apiserver accepts it, lowercase
+// alphanumerics and '-' which neither starts nor ends it, at most 63 characters
 func IsKubeName(str string) bool {
-	matched, err := regexp.MatchString(DNSLabelRFC1123, str)
-	if err != nil {
-		return false
-	}
-	return matched
+	return len(validation.IsDNS1123Label(str)) == 0
 }
@@ -16,7 +16,10 @@
 
 package utils
 
-import "testing"
+import (
+	"net"
+	"testing"
+)
 
 func TestToKubeName(t *testing.T) {
 	IP := "192.168.0.1"
@@ -28,6 +31,37 @@ func TestToKubeName(t *testing.T) {
 	}
 }
 
+func TestToKubeNameSafe(t *testing.T) {
+	tests := []struct {
+		input string
+		name  string
+	}{
+		{"192.168.0.1", "192-168-0-1"},
+		{"::ffff:192.168.0.1", "192-168-0-1"},
+		{"fd00::1", "ip-fd000000000000000000000000000001"},
+		{"192-168-0-1", ""},
+		{"node.example.com", ""},
+		{"", ""},
+	}
+
+	for _, test := range tests {
+		name := ToKubeNameSafe(net.ParseIP(test.input))
+		if name != test.name {
+			t.Errorf("test %q fails: expected %q but got %q", test.input, test.name, name)
+		}
+		if len(name) == 0 {
+			continue
+		}
+		if ip, err := DecodeName(name); err != nil || !ip.Equal(net.ParseIP(test.input)) {
+			t.Errorf("test %q fails: %s is decoded as %v %v", test.input, name, ip, err)
+		}
+	}
+
+	if name := ToKubeNameSafe(net.IP{192, 168, 0}); name != "" {
+		t.Errorf("ip of invalid length should not be encoded, got %q", name)
+	}
+}
+
 func TestToIP(t *testing.T) {
 	IP := "192-168-0-1"
 
@@ -40,7 +74,9 @@ func TestToIP(t *testing.T) {
 func TestIsKubeName(t *testing.T) {
 	testMap := map[string]bool{
 		"aksksle":       true,
-		"A-wkeli0k-234": true,
+		"a-wkeli0k-234": true,
+		"A-wkeli0k-234": false,
+		"wkeli0k-":      false,
 		"-Esklen":       false,
 		"A-lsk-ek=323":  false,
 	}
@@ -51,3 +87,48 @@ func TestIsKubeName(t *testing.T) {
 		}
 	}
 }
+
+func TestNameEncoder(t *testing.T) {
+	tests := []struct {
+		encoder NameEncoder
+		ip      string
+		name    string
+	}{
+		{DashedNameEncoder{}, "192.168.0.1", "192-168-0-1"},
+		{DashedNameEncoder{}, "fd00::1", "ip-fd000000000000000000000000000001"},
+		{HexNameEncoder{}, "192.168.0.1", "ip-00000000000000000000ffffc0a80001"},
+		{HexNameEncoder{}, "fd00::1", "ip-fd000000000000000000000000000001"},
+	}
+
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		name := test.encoder.Encode(ip)
+		if name != test.name {
+			t.Errorf("expected %s encoded as %s but got %s", test.ip, test.name, name)
+		}
+		if !IsKubeName(name) {
+			t.Errorf("name %s is not a valid kube name", name)
+		}
+
+		decoded, err := test.encoder.Decode(name)
+		if err != nil || !decoded.Equal(ip) {
+			t.Errorf("expected %s decoded as %s but got %s %v", name, test.ip, decoded, err)
+		}
+		if ToIP(name) != test.ip {
+			t.Errorf("expected ToIP of %s to be %s but got %s", name, test.ip, ToIP(name))
+		}
+	}
+}
+
+func TestDecodeName(t *testing.T) {
+	// old dashed names are still decoded
+	if ip, err := DecodeName("192-168-0-1"); err != nil || !ip.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("fail to decode legacy name: %s %v", ip, err)
+	}
+
+	for _, name := range []string{"ip-zz", "ip-c0a80001", "not-an-ip"} {
+		if _, err := DecodeName(name); err == nil {
+			t.Errorf("invalid name %s should not be decoded", name)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package store
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var LoggerAudit = logrus.WithFields(logrus.Fields{"component": "audit"})
+
+const (
+	AuditActionReserve = "reserve"
+	AuditActionRelease = "release"
+)
+
+// AuditEntry records who got or gave back which ip when
+type AuditEntry struct {
+	Time         time.Time `json:"time"`
+	Action       string    `json:"action"`
+	IP           string    `json:"ip"`
+	Network      string    `json:"network,omitempty"`
+	Pool         string    `json:"pool,omitempty"`
+	PodNamespace string    `json:"podNamespace,omitempty"`
+	PodName      string    `json:"podName,omitempty"`
+	Owner        string    `json:"owner,omitempty"`
+}
+
+// AuditSink receives an entry for every reservation and release of an IPAMStore,
+// a sink must never block or fail the operation it records
+type AuditSink interface {
+	RecordReserve(entry *AuditEntry)
+	RecordRelease(entry *AuditEntry)
+}
+
+// NopAuditSink drops all entries, it is the default sink of stores
+type NopAuditSink struct{}
+
+func (NopAuditSink) RecordReserve(*AuditEntry) {}
+
+func (NopAuditSink) RecordRelease(*AuditEntry) {}
+
+// JSONLinesAuditSink appends every entry as a line of json to its writer
+type JSONLinesAuditSink struct {
+	sync.Mutex
+
+	encoder *json.Encoder
+}
+
+func NewJSONLinesAuditSink(w io.Writer) *JSONLinesAuditSink {
+	return &JSONLinesAuditSink{
+		encoder: json.NewEncoder(w),
+	}
+}
+
+// NewFileAuditSink opens path for appending and returns a json lines sink writing to it
+func NewFileAuditSink(path string) (*JSONLinesAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONLinesAuditSink(f), nil
+}
+
+func (s *JSONLinesAuditSink) RecordReserve(entry *AuditEntry) {
+	entry.Action = AuditActionReserve
+	s.record(entry)
+}
+
+func (s *JSONLinesAuditSink) RecordRelease(entry *AuditEntry) {
+	entry.Action = AuditActionRelease
+	s.record(entry)
+}
+
+func (s *JSONLinesAuditSink) record(entry *AuditEntry) {
+	s.Lock()
+	defer s.Unlock()
+
+	if err := s.encoder.Encode(entry); err != nil {
+		LoggerAudit.Errorf("fail to record audit entry %+v: %v", entry, err)
+	}
+}
@@ -0,0 +1,55 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONLinesAuditSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	sink := NewJSONLinesAuditSink(buf)
+
+	now := time.Now().UTC().Truncate(time.Second)
+	sink.RecordReserve(&AuditEntry{Time: now, IP: "192.168.0.10", Pool: "pool", PodNamespace: "default", PodName: "pod"})
+	sink.RecordRelease(&AuditEntry{Time: now, IP: "192.168.0.10"})
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 lines but got %d: %s", len(lines), buf.String())
+	}
+
+	entry := AuditEntry{}
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatalf("fail to decode audit line %s: %v", lines[0], err)
+	}
+	if entry.Action != AuditActionReserve || entry.IP != "192.168.0.10" || entry.Pool != "pool" ||
+		entry.PodNamespace != "default" || entry.PodName != "pod" || !entry.Time.Equal(now) {
+		t.Errorf("unexpected reserve entry %+v", entry)
+	}
+
+	if err := json.Unmarshal([]byte(lines[1]), &entry); err != nil {
+		t.Fatalf("fail to decode audit line %s: %v", lines[1], err)
+	}
+	if entry.Action != AuditActionRelease {
+		t.Errorf("unexpected release entry %+v", entry)
+	}
+}
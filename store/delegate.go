@@ -0,0 +1,36 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package store
+
+import (
+	"net"
+
+	"github.com/mars1024/kube-ipam/types"
+)
+
+// DelegatedAllocator picks ips for an IPAMStore in place of its built-in scan, so that
+// ip selection can be left to an external system while the store keeps the bookkeeping
+type DelegatedAllocator interface {
+	// PickIP returns a free ip of pool, used holds the string form of all ips in use
+	// of the network, ErrPoolExhausted is returned if there is none
+	PickIP(pool *types.Pool, used map[string]struct{}) (net.IP, error)
+}
+
+// PostReserveHook is called with every using ip an IPAMStore has just created, so that side effects
+// like programming switches or updating dns go along with reservations, if it returns an error the
+// using ip is deleted again and the reservation fails with the error
+type PostReserveHook func(usingIP *types.UsingIP) error
@@ -0,0 +1,133 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// ErrPoolExhausted is returned when there is no free ip left in a pool
+var ErrPoolExhausted = errors.New("no free ip left in pool")
+
+// PoolDisabledError is returned when allocating from a pool which is disabled
+type PoolDisabledError struct {
+	Network string
+	Pool    string
+}
+
+func (e *PoolDisabledError) Error() string {
+	return fmt.Sprintf("pool %s of network %s is disabled for new allocations", e.Pool, e.Network)
+}
+
+// QuotaExceededError is returned when a namespace already holds its quota of ips in a network
+type QuotaExceededError struct {
+	Network   string
+	Namespace string
+	Quota     int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("namespace %s has used up its quota of %d ips in network %s", e.Namespace, e.Quota, e.Network)
+}
+
+// NetworkInUseError is returned when deleting a network which still has using ips
+type NetworkInUseError struct {
+	Network string
+	// UsingIPs is the count of using ips referencing the network
+	UsingIPs int
+}
+
+func (e *NetworkInUseError) Error() string {
+	return fmt.Sprintf("network %s with %d using ips is not allowed to be deleted", e.Network, e.UsingIPs)
+}
+
+// PoolInUseError is returned when deleting a pool which still has live using ips
+type PoolInUseError struct {
+	Network string
+	Pool    string
+	// UsingIPs is the count of live using ips of the pool
+	UsingIPs int
+}
+
+func (e *PoolInUseError) Error() string {
+	return fmt.Sprintf("pool %s of network %s with %d using ips is not allowed to be deleted", e.Pool, e.Network, e.UsingIPs)
+}
+
+// ProtectedIPError is returned when releasing protected ips without force, the others are released
+type ProtectedIPError struct {
+	IPs []net.IP
+}
+
+func (e *ProtectedIPError) Error() string {
+	ips := make([]string, 0, len(e.IPs))
+	for _, ip := range e.IPs {
+		ips = append(ips, ip.String())
+	}
+	return fmt.Sprintf("ips %s are protected from release", strings.Join(ips, ", "))
+}
+
+// UnknownIPError is returned by strict releases of an ip which is in no pool and has no using ip
+type UnknownIPError struct {
+	IP net.IP
+}
+
+func (e *UnknownIPError) Error() string {
+	return fmt.Sprintf("ip %s is in no pool and not in use", e.IP)
+}
+
+// ReservationRejection is the reason why a reservation is not allowed
+type ReservationRejection string
+
+const (
+	// RejectNotFound means the network or pool does not exist
+	RejectNotFound ReservationRejection = "NotFound"
+	// RejectOutOfRange means the ip is outside the range of pool
+	RejectOutOfRange ReservationRejection = "OutOfRange"
+	// RejectGateway means the ip is a gateway of pool
+	RejectGateway ReservationRejection = "Gateway"
+	// RejectReserved means the ip is reserved by the reserved-ip policy of pool
+	RejectReserved ReservationRejection = "Reserved"
+	// RejectInUse means the ip is held by an using ip already
+	RejectInUse ReservationRejection = "InUse"
+)
+
+// ReservationError is returned by ValidateReservation telling why ip can not be reserved
+type ReservationError struct {
+	Reason  ReservationRejection
+	Network string
+	Pool    string
+	IP      net.IP
+}
+
+func (e *ReservationError) Error() string {
+	switch e.Reason {
+	case RejectNotFound:
+		return fmt.Sprintf("pool %s of network %s is not found", e.Pool, e.Network)
+	case RejectOutOfRange:
+		return fmt.Sprintf("ip %s is out of the range of pool %s of network %s", e.IP, e.Pool, e.Network)
+	case RejectGateway:
+		return fmt.Sprintf("ip %s is a gateway of pool %s of network %s", e.IP, e.Pool, e.Network)
+	case RejectReserved:
+		return fmt.Sprintf("ip %s is reserved by the policy of pool %s of network %s", e.IP, e.Pool, e.Network)
+	case RejectInUse:
+		return fmt.Sprintf("ip %s of pool %s of network %s is in use", e.IP, e.Pool, e.Network)
+	}
+	return fmt.Sprintf("ip %s can not be reserved in pool %s of network %s: %s", e.IP, e.Pool, e.Network, e.Reason)
+}
@@ -0,0 +1,514 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+// Package fake provides an IPAMStore for unit tests of its consumers,
+// which records all calls and returns programmed outcomes instead of keeping any state
+package fake
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+)
+
+var _ store.IPAMStore = &Store{}
+
+// Call is a recorded invocation of a method of the fake store
+type Call struct {
+	Method string
+	Args   []interface{}
+}
+
+// Store is a fake IPAMStore, failures injected by Fail are returned by the method
+// named, and other calls succeed with the results set in fields before use
+type Store struct {
+	// IP is returned by successful allocations
+	IP net.IP
+	// Pool is returned as the pool of successful network-scoped allocations
+	Pool string
+	// Network is returned by GetNetwork and ListNetworks if not nil, its pools by ListPoolsWithStats
+	// and ListPoolsByLabel
+	Network *types.Network
+
+	lock     sync.Mutex
+	calls    []Call
+	failures map[string]error
+}
+
+// NewStore returns a fake store without any failure injected
+func NewStore() *Store {
+	return &Store{failures: make(map[string]error)}
+}
+
+// Fail makes method return err from now on, a nil err clears the failure
+func (s *Store) Fail(method string, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.failures == nil {
+		s.failures = make(map[string]error)
+	}
+	if err == nil {
+		delete(s.failures, method)
+		return
+	}
+	s.failures[method] = err
+}
+
+// Calls returns all recorded calls in order
+func (s *Store) Calls() []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Call(nil), s.calls...)
+}
+
+// CallsOf returns the recorded calls of method in order
+func (s *Store) CallsOf(method string) []Call {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var calls []Call
+	for _, call := range s.calls {
+		if call.Method == method {
+			calls = append(calls, call)
+		}
+	}
+	return calls
+}
+
+// Reset forgets all recorded calls and injected failures
+func (s *Store) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls = nil
+	s.failures = make(map[string]error)
+}
+
+// invoke records the call of method and returns its injected failure
+func (s *Store) invoke(method string, args ...interface{}) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.calls = append(s.calls, Call{Method: method, Args: args})
+	return s.failures[method]
+}
+
+func (s *Store) CreateNetwork(name string) error {
+	return s.invoke("CreateNetwork", name)
+}
+
+func (s *Store) DeleteNetwork(name string) error {
+	return s.invoke("DeleteNetwork", name)
+}
+
+func (s *Store) RenameNetwork(oldName, newName string) error {
+	return s.invoke("RenameNetwork", oldName, newName)
+}
+
+func (s *Store) GetNetwork(name string) (*types.Network, error) {
+	if err := s.invoke("GetNetwork", name); err != nil {
+		return nil, err
+	}
+	return s.Network.DeepCopy(), nil
+}
+
+func (s *Store) ListNetworks() ([]*types.Network, error) {
+	if err := s.invoke("ListNetworks"); err != nil {
+		return nil, err
+	}
+	if s.Network == nil {
+		return nil, nil
+	}
+	return []*types.Network{s.Network.DeepCopy()}, nil
+}
+
+func (s *Store) GetLastReservedIP(name string) (*types.LastReservedIP, error) {
+	return nil, s.invoke("GetLastReservedIP", name)
+}
+
+func (s *Store) ListLastReservedIPs() (map[string]*types.LastReservedIP, error) {
+	return nil, s.invoke("ListLastReservedIPs")
+}
+
+func (s *Store) CompactLastReservedIP(name string) error {
+	return s.invoke("CompactLastReservedIP", name)
+}
+
+func (s *Store) SetDefaultPool(network, pool string) error {
+	return s.invoke("SetDefaultPool", network, pool)
+}
+
+func (s *Store) SnapshotNetwork(name string) (*types.NetworkSnapshot, error) {
+	if err := s.invoke("SnapshotNetwork", name); err != nil {
+		return nil, err
+	}
+	return &types.NetworkSnapshot{Network: s.Network.DeepCopy(), Used: map[string]struct{}{}}, nil
+}
+
+func (s *Store) AddPool(network string, pool *types.Pool) error {
+	return s.invoke("AddPool", network, pool)
+}
+
+func (s *Store) UpdatePool(network string, pool *types.Pool) error {
+	return s.invoke("UpdatePool", network, pool)
+}
+
+func (s *Store) AddOrUpdatePool(network string, pool *types.Pool) error {
+	return s.invoke("AddOrUpdatePool", network, pool)
+}
+
+func (s *Store) DelPool(network, pool string) (*store.DelPoolResult, error) {
+	if err := s.invoke("DelPool", network, pool); err != nil {
+		return nil, err
+	}
+	return &store.DelPoolResult{}, nil
+}
+
+func (s *Store) ReconcileNetwork(desired *types.Network) error {
+	return s.invoke("ReconcileNetwork", desired)
+}
+
+func (s *Store) CountPool(network, pool string) (int, int, error) {
+	return 0, 0, s.invoke("CountPool", network, pool)
+}
+
+func (s *Store) PoolStats(network, pool string) (types.PoolStats, error) {
+	return types.PoolStats{}, s.invoke("PoolStats", network, pool)
+}
+
+func (s *Store) NetworkCapacity(network string) (int, int, int, error) {
+	return 0, 0, 0, s.invoke("NetworkCapacity", network)
+}
+
+func (s *Store) SimulateCapacity(pool *types.Pool) (store.CapacityPlan, error) {
+	return store.CapacityPlan{}, s.invoke("SimulateCapacity", pool)
+}
+
+func (s *Store) OldestAllocation(network, pool string) (*types.UsingIP, time.Time, error) {
+	return nil, time.Time{}, s.invoke("OldestAllocation", network, pool)
+}
+
+func (s *Store) ListPoolsWithStats(network string) ([]types.PoolStat, error) {
+	if err := s.invoke("ListPoolsWithStats", network); err != nil {
+		return nil, err
+	}
+	if s.Network == nil {
+		return nil, nil
+	}
+	pools := make([]types.PoolStat, 0, len(s.Network.Pools))
+	for _, pool := range s.Network.DeepCopy().Pools {
+		pools = append(pools, types.PoolStat{Pool: pool})
+	}
+	return pools, nil
+}
+
+func (s *Store) FreeRanges(network, pool string) ([]*net.IPNet, error) {
+	return nil, s.invoke("FreeRanges", network, pool)
+}
+
+func (s *Store) ListPoolsByLabel(network string, selector map[string]string) ([]*types.Pool, error) {
+	if err := s.invoke("ListPoolsByLabel", network, selector); err != nil {
+		return nil, err
+	}
+	if s.Network == nil {
+		return nil, nil
+	}
+	var pools []*types.Pool
+	for _, pool := range s.Network.DeepCopy().Pools {
+		if pool.MatchesLabels(selector) {
+			pools = append(pools, pool)
+		}
+	}
+	return pools, nil
+}
+
+func (s *Store) ResolveIP(network string, ip net.IP) (*types.Pool, error) {
+	return nil, s.invoke("ResolveIP", network, ip)
+}
+
+func (s *Store) Allocate(network, pool, namespace, name string) (net.IP, error) {
+	if err := s.invoke("Allocate", network, pool, namespace, name); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) AllocateWithFilter(network, pool, namespace, name string, blocked func(net.IP) bool) (net.IP, error) {
+	if err := s.invoke("AllocateWithFilter", network, pool, namespace, name); err != nil {
+		return nil, err
+	}
+	if blocked != nil && blocked(s.IP) {
+		return nil, store.ErrPoolExhausted
+	}
+	return s.IP, nil
+}
+
+func (s *Store) AllocateFromNetwork(network, namespace, name string) (string, net.IP, error) {
+	if err := s.invoke("AllocateFromNetwork", network, namespace, name); err != nil {
+		return "", nil, err
+	}
+	return s.Pool, s.IP, nil
+}
+
+func (s *Store) Hold(network, pool, token string) (net.IP, error) {
+	if err := s.invoke("Hold", network, pool, token); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) Commit(token, namespace, name string) error {
+	return s.invoke("Commit", token, namespace, name)
+}
+
+func (s *Store) Drop(token string) error {
+	return s.invoke("Drop", token)
+}
+
+func (s *Store) AllocatePreferFamily(network, namespace, name string, prefer store.FamilyPreference) (net.IP, string, error) {
+	if err := s.invoke("AllocatePreferFamily", network, namespace, name, prefer); err != nil {
+		return nil, "", err
+	}
+	return s.IP, s.Pool, nil
+}
+
+func (s *Store) AllocateBlock(network, pool string, prefixLen int, owner string) (*net.IPNet, error) {
+	if err := s.invoke("AllocateBlock", network, pool, prefixLen, owner); err != nil {
+		return nil, err
+	}
+	bits := 8 * net.IPv6len
+	if s.IP.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return &net.IPNet{IP: s.IP, Mask: net.CIDRMask(prefixLen, bits)}, nil
+}
+
+func (s *Store) AllocateSticky(network, pool, namespace, name string, previous net.IP) (net.IP, error) {
+	if err := s.invoke("AllocateSticky", network, pool, namespace, name, previous); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) AllocateByMAC(network, pool, mac string) (net.IP, error) {
+	if err := s.invoke("AllocateByMAC", network, pool, mac); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) PeekNext(network, pool string) (net.IP, error) {
+	if err := s.invoke("PeekNext", network, pool); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) AllocateFromRange(network, pool string, start, end net.IP, owner string) (net.IP, error) {
+	if err := s.invoke("AllocateFromRange", network, pool, start, end, owner); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) AllocateInCIDR(network string, cidr *net.IPNet, owner string) (net.IP, string, error) {
+	if err := s.invoke("AllocateInCIDR", network, cidr, owner); err != nil {
+		return nil, "", err
+	}
+	return s.IP, s.Pool, nil
+}
+
+func (s *Store) AllocateOnNode(network, pool, namespace, name, node string) (net.IP, error) {
+	if err := s.invoke("AllocateOnNode", network, pool, namespace, name, node); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) ReserveOnNode(network, pool, namespace, name, node string, ip net.IP) (bool, error) {
+	if err := s.invoke("ReserveOnNode", network, pool, namespace, name, node, ip); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ReserveWithMetadata(network, pool, namespace, name string, ip net.IP, metadata map[string]string) (bool, error) {
+	if err := s.invoke("ReserveWithMetadata", network, pool, namespace, name, ip, metadata); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ReserveWithContainer(network, pool, namespace, name, containerID, ifName string, ip net.IP) (bool, error) {
+	if err := s.invoke("ReserveWithContainer", network, pool, namespace, name, containerID, ifName, ip); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ValidateReservation(network, pool string, ip net.IP) error {
+	return s.invoke("ValidateReservation", network, pool, ip)
+}
+
+func (s *Store) Reserve(network, pool, namespace, name string, ip net.IP) (bool, error) {
+	if err := s.invoke("Reserve", network, pool, namespace, name, ip); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ReserveIdempotent(network, pool, key, namespace, name string) (net.IP, error) {
+	if err := s.invoke("ReserveIdempotent", network, pool, key, namespace, name); err != nil {
+		return nil, err
+	}
+	return s.IP, nil
+}
+
+func (s *Store) ReserveWithPreemption(network, pool, namespace, name string, priority int32) (net.IP, *types.UsingIP, error) {
+	if err := s.invoke("ReserveWithPreemption", network, pool, namespace, name, priority); err != nil {
+		return nil, nil, err
+	}
+	return s.IP, nil, nil
+}
+
+func (s *Store) ReserveInPool(pool *types.Pool, network, namespace, name string, ip net.IP) (bool, error) {
+	if err := s.invoke("ReserveInPool", pool, network, namespace, name, ip); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ReserveWithResult(network, pool, namespace, name string, ip net.IP) (*store.ReserveResult, error) {
+	if err := s.invoke("ReserveWithResult", network, pool, namespace, name, ip); err != nil {
+		return nil, err
+	}
+	return &store.ReserveResult{Reserved: true}, nil
+}
+
+func (s *Store) ReserveStatic(network, pool string, ip net.IP, owner string) error {
+	return s.invoke("ReserveStatic", network, pool, ip, owner)
+}
+
+func (s *Store) Release(ip net.IP) error {
+	return s.invoke("Release", ip)
+}
+
+func (s *Store) ReleaseAndWait(ctx context.Context, ip net.IP) error {
+	return s.invoke("ReleaseAndWait", ip)
+}
+
+func (s *Store) ReleaseIfOwnedBy(ip net.IP, namespace, name string) (bool, error) {
+	if err := s.invoke("ReleaseIfOwnedBy", ip, namespace, name); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func (s *Store) ReleaseByName(network, pool, namespace, name string) error {
+	return s.invoke("ReleaseByName", network, pool, namespace, name)
+}
+
+func (s *Store) ReleaseAll(network, pool string, force bool) (int, error) {
+	return 0, s.invoke("ReleaseAll", network, pool, force)
+}
+
+func (s *Store) SetProtected(ip net.IP, protected bool) error {
+	return s.invoke("SetProtected", ip, protected)
+}
+
+func (s *Store) ReleaseStaleGeneration(network, pool string) (int, error) {
+	if err := s.invoke("ReleaseStaleGeneration", network, pool); err != nil {
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (s *Store) ReleaseByContainer(containerID, ifName string) error {
+	return s.invoke("ReleaseByContainer", containerID, ifName)
+}
+
+func (s *Store) ReserveWholePool(network, pool, owner string) error {
+	return s.invoke("ReserveWholePool", network, pool, owner)
+}
+
+func (s *Store) ReleaseWholePool(network, pool, owner string) error {
+	return s.invoke("ReleaseWholePool", network, pool, owner)
+}
+
+func (s *Store) RecanonicalizeNetwork(name string) error {
+	return s.invoke("RecanonicalizeNetwork", name)
+}
+
+func (s *Store) DrainPool(network, pool string, target func(ip net.IP) (toNetwork, toPool string, ok bool)) (*store.DrainReport, error) {
+	if err := s.invoke("DrainPool", network, pool); err != nil {
+		return nil, err
+	}
+	return &store.DrainReport{Failed: map[string]string{}}, nil
+}
+
+func (s *Store) Rebalance(network string, maxMoves int) (*store.RebalanceReport, error) {
+	if err := s.invoke("Rebalance", network, maxMoves); err != nil {
+		return nil, err
+	}
+	return &store.RebalanceReport{Failed: map[string]string{}}, nil
+}
+
+func (s *Store) SwapIPs(ipA, ipB net.IP) error {
+	return s.invoke("SwapIPs", ipA, ipB)
+}
+
+func (s *Store) ReconcileReservations(desired []store.Reservation) (int, int, error) {
+	if err := s.invoke("ReconcileReservations", desired); err != nil {
+		return 0, 0, err
+	}
+	return len(desired), 0, nil
+}
+
+func (s *Store) GetUsingIP(ip net.IP) (*types.UsingIP, error) {
+	return nil, s.invoke("GetUsingIP", ip)
+}
+
+func (s *Store) ListUsingIPsByNode(node string) ([]*types.UsingIP, error) {
+	return nil, s.invoke("ListUsingIPsByNode", node)
+}
+
+func (s *Store) StreamUsingIPs(ctx context.Context) <-chan *types.UsingIP {
+	_ = s.invoke("StreamUsingIPs")
+	ch := make(chan *types.UsingIP)
+	close(ch)
+	return ch
+}
+
+func (s *Store) MigrateNames() (int, error) {
+	return 0, s.invoke("MigrateNames")
+}
+
+func (s *Store) IPsForPod(namespace, name string) ([]net.IP, error) {
+	return nil, s.invoke("IPsForPod", namespace, name)
+}
+
+func (s *Store) LookupIP(ip net.IP) (*types.IPInfo, error) {
+	if err := s.invoke("LookupIP", ip); err != nil {
+		return nil, err
+	}
+	return &types.IPInfo{IP: ip}, nil
+}
@@ -0,0 +1,74 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package fake
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+func TestStore_Calls(t *testing.T) {
+	s := NewStore()
+	s.IP = net.ParseIP("192.168.0.10")
+
+	ip, err := s.Allocate("network", "pool", "default", "pod")
+	if err != nil || !ip.Equal(s.IP) {
+		t.Fatalf("expected %s but got %s %v", s.IP, ip, err)
+	}
+	if err := s.Release(ip); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+
+	expected := []Call{
+		{Method: "Allocate", Args: []interface{}{"network", "pool", "default", "pod"}},
+		{Method: "Release", Args: []interface{}{ip}},
+	}
+	if calls := s.Calls(); !reflect.DeepEqual(calls, expected) {
+		t.Errorf("expected calls %+v but got %+v", expected, calls)
+	}
+	if calls := s.CallsOf("Release"); len(calls) != 1 {
+		t.Errorf("expected 1 call of Release but got %d", len(calls))
+	}
+
+	s.Reset()
+	if calls := s.Calls(); len(calls) != 0 {
+		t.Errorf("calls should be forgotten after reset but got %+v", calls)
+	}
+}
+
+func TestStore_Fail(t *testing.T) {
+	s := NewStore()
+	s.Fail("Reserve", store.ErrPoolExhausted)
+
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.10")); reserved || err != store.ErrPoolExhausted {
+		t.Errorf("expected injected failure but got %v %v", reserved, err)
+	}
+	if err := s.ReserveStatic("network", "pool", net.ParseIP("192.168.0.10"), "owner"); err != nil {
+		t.Errorf("failure of Reserve should not affect other methods: %v", err)
+	}
+	if calls := s.CallsOf("Reserve"); len(calls) != 1 {
+		t.Errorf("failed calls should be recorded too, got %d", len(calls))
+	}
+
+	s.Fail("Reserve", nil)
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.10")); !reserved || err != nil {
+		t.Errorf("expected reserved after failure is cleared but got %v %v", reserved, err)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+
+	"github.com/mars1024/kube-ipam/types"
+)
+
+// kinds of advisories reported by Advisories
+const (
+	AdvisoryPoolNearlyFull  = "pool-nearly-full"
+	AdvisoryVLANsNearlyUsed = "vlans-nearly-used"
+)
+
+const (
+	defaultPoolUsageThreshold = 90
+	defaultFreeVLANsThreshold = 16
+)
+
+// Advisory is a warning that a network is running out of ips or vlans
+type Advisory struct {
+	Kind    string
+	Network string
+	Pool    string
+	Message string
+}
+
+func (a Advisory) String() string {
+	return fmt.Sprintf("%s in network %s: %s", a.Kind, a.Network, a.Message)
+}
+
+// Advisories summarizes pools of network whose usage reaches the usage threshold in percent
+// of their capacity, and the vlans left if no more than the free vlans threshold, vlans are
+// counted over pools of all networks since they share the L2 domain
+func (s *Store) Advisories(networkName string) []Advisory {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		LoggerStore.Warnf("network %s is not in cache, no advisory", networkName)
+		return nil
+	}
+
+	advisories := make([]Advisory, 0)
+	for _, pool := range network.Pools {
+		capacity := pool.Capacity()
+		stats := poolStats(pool, s.cache.AllocatedCount(networkName, pool.Name))
+		if capacity == 0 || stats.Used*100 < capacity*s.poolUsageThreshold {
+			continue
+		}
+		advisories = append(advisories, Advisory{
+			Kind:    AdvisoryPoolNearlyFull,
+			Network: networkName,
+			Pool:    pool.Name,
+			Message: fmt.Sprintf("pool %s is %d%% full, %d of %d ips are used", pool.Name, stats.Used*100/capacity, stats.Used, capacity),
+		})
+	}
+
+	if free := s.freeVLANs(); free <= s.freeVLANsThreshold {
+		advisories = append(advisories, Advisory{
+			Kind:    AdvisoryVLANsNearlyUsed,
+			Network: networkName,
+			Message: fmt.Sprintf("only %d free vlans are left", free),
+		})
+	}
+	return advisories
+}
+
+// freeVLANs counts valid vlan ids not tagged on any pool of cached networks
+func (s *Store) freeVLANs() int {
+	used := make(map[int32]bool)
+	for _, network := range s.cache.ListNetworks() {
+		for _, pool := range network.Pools {
+			if pool.VlanID != nil && types.IsValidVlanID(*pool.VlanID) {
+				used[*pool.VlanID] = true
+			}
+		}
+	}
+
+	free := 0
+	for id := int32(1); id <= 4094; id++ {
+		if types.IsValidVlanID(id) && !used[id] {
+			free++
+		}
+	}
+	return free
+}
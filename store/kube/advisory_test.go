@@ -0,0 +1,78 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestStore_Advisories(t *testing.T) {
+	vlan := func(id int32) *int32 { return &id }
+	full := newTestPool("full", "192.168.0.10", "192.168.0.19")
+	full.VlanId = vlan(100)
+	half := newTestPool("half", "192.168.0.20", "192.168.0.29")
+	half.VlanId = vlan(200)
+
+	newObjects := func() []runtime.Object {
+		objs := []runtime.Object{newNetwork("network", full, half)}
+		for i := 10; i < 27; i++ {
+			pool := "full"
+			if i >= 20 {
+				pool = "half"
+			}
+			if i == 18 || i == 19 {
+				continue
+			}
+			usingIP := newUsingIP(fmt.Sprintf("192-168-0-%d", i), fmt.Sprintf("pod%d", i))
+			usingIP.Spec.PodNamespace, usingIP.Spec.Network, usingIP.Spec.Pool = "default", "network", pool
+			objs = append(objs, usingIP)
+		}
+		return objs
+	}
+
+	// 8 of 10 ips of full and 7 of half are used, 2 of 4075 valid vlans are tagged
+	tests := []struct {
+		name      string
+		poolUsage int
+		freeVLANs int
+		expected  []string
+	}{
+		{"pool over threshold", 80, 16, []string{AdvisoryPoolNearlyFull + "/full"}},
+		{"both pools over threshold", 70, 16, []string{AdvisoryPoolNearlyFull + "/full", AdvisoryPoolNearlyFull + "/half"}},
+		{"vlans at threshold", 90, 4073, []string{AdvisoryVLANsNearlyUsed + "/"}},
+		{"all below thresholds", 90, 4072, []string{}},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, []Option{WithAdvisoryThresholds(test.poolUsage, test.freeVLANs)}, newObjects()...)
+		waitForCache(t, func() bool {
+			return s.cache.GetNetwork("network") != nil && len(s.cache.ListUsingIPs()) == 15
+		})
+
+		advisories := make([]string, 0)
+		for _, advisory := range s.Advisories("network") {
+			advisories = append(advisories, advisory.Kind+"/"+advisory.Pool)
+		}
+		if !reflect.DeepEqual(advisories, test.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.expected, advisories)
+		}
+		stop()
+	}
+}
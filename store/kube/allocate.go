@@ -0,0 +1,635 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// Allocate reserves the first free ip of pool after the last reserved ip of network
+func (s *Store) Allocate(network, pool, namespace, name string) (net.IP, error) {
+	return s.AllocateWithFilter(network, pool, namespace, name, nil)
+}
+
+// AllocateWithFilter works like Allocate, and additionally skips all ips which blocked returns true for
+func (s *Store) AllocateWithFilter(networkName, poolName, namespace, name string, blocked func(net.IP) bool) (net.IP, error) {
+	ip, err := s.allocate(networkName, poolName, namespace, name, blocked)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+// AllocateSticky works like Allocate, but prefers previous if it is still free,
+// which keeps a restarted pod on its former ip on a best-effort basis
+func (s *Store) AllocateSticky(networkName, poolName, namespace, name string, previous net.IP) (net.IP, error) {
+	if previous != nil {
+		reserved, err := s.reservePrevious(networkName, poolName, namespace, name, previous)
+		if err != nil {
+			s.failures.record(networkName, poolName, err)
+			return nil, err
+		}
+		if reserved {
+			return previous, nil
+		}
+	}
+	return s.AllocateWithFilter(networkName, poolName, namespace, name, nil)
+}
+
+// AllocateByMAC returns the ip of network bound to mac, or binds a free ip of pool to
+// mac if there is none yet, so that the same nic always gets the same ip
+func (s *Store) AllocateByMAC(networkName, poolName, mac string) (net.IP, error) {
+	ip, err := s.allocateByMAC(networkName, poolName, mac)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+func (s *Store) allocateByMAC(networkName, poolName, mac string) (net.IP, error) {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, newValidationError("mac %s is invalid: %v", mac, err)
+	}
+	mac = hw.String()
+
+	defer s.networkLocks.LockKey(networkName)()
+
+	if bound := s.cache.GetUsingIPByMAC(networkName, mac); bound != nil {
+		if bound.Pool != poolName {
+			return nil, newValidationError("mac %s is bound to ip %s of pool %s", mac, bound.IP, bound.Pool)
+		}
+		return bound.IP, nil
+	}
+
+	template := &resourcev1.UsingIP{
+		Spec: resourcev1.UsingIPSpec{
+			Network: networkName,
+			Pool:    poolName,
+			MAC:     mac,
+		},
+	}
+	return s.allocateUsingIP(template, mac, nil)
+}
+
+// reservePrevious reserves previous if it is free in pool, the last reserved ip is
+// kept since previous is not picked by scanning
+func (s *Store) reservePrevious(networkName, poolName, namespace, name string, previous net.IP) (bool, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	pool, err := s.getAllocatablePool(networkName, poolName)
+	if err != nil {
+		return false, err
+	}
+	switch {
+	case !pool.IsAllocatable(previous):
+		return false, nil
+	case s.cache.IsIPUsing(previous.String()):
+		return false, nil
+	}
+
+	return s.reserveUsingIP(previous, newPodUsingIP(networkName, poolName, namespace, name))
+}
+
+// peekOwner is the owner of the using ip template PeekNext picks an ip for
+const peekOwner = "peek"
+
+// PeekNext returns the ip which the next Allocate from pool would pick without reserving it,
+// stable hash pools are refused since their pick depends on the identity of the pod
+func (s *Store) PeekNext(networkName, poolName string) (net.IP, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	pool, err := s.getAllocatablePool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	switch pool.Strategy {
+	case types.StrategyStableHash:
+		return nil, newValidationError("next ip of stable hash pool %s depends on the pod identity", poolName)
+	case types.StrategyRandom:
+		return nil, newValidationError("next ip of random pool %s is not predictable", poolName)
+	}
+
+	// a dry run picks exactly like Allocate, and never writes the using ip or the last reserved ip
+	return s.DryRun().store.allocateUsingIP(newOwnerUsingIP(networkName, poolName, peekOwner), "", nil)
+}
+
+// AllocateOnNode works like Allocate, and additionally records node where the pod runs
+func (s *Store) AllocateOnNode(networkName, poolName, namespace, name, node string) (net.IP, error) {
+	ip, err := s.allocateOnNode(networkName, poolName, namespace, name, node)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+// ReserveIdempotent allocates an ip of pool for pod namespace/name like Allocate, and records key
+// on its using ip, so that retries with the same key return the same ip instead of allocating
+// another one, even from a restarted process, key must be a valid label value
+func (s *Store) ReserveIdempotent(networkName, poolName, key, namespace, name string) (net.IP, error) {
+	ip, err := s.reserveIdempotent(networkName, poolName, key, namespace, name)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+func (s *Store) reserveIdempotent(networkName, poolName, key, namespace, name string) (net.IP, error) {
+	if len(key) == 0 {
+		return nil, newValidationError("idempotency key is required")
+	}
+	if msgs := validation.IsValidLabelValue(key); len(msgs) > 0 {
+		return nil, newValidationError("idempotency key %q is invalid: %s", key, strings.Join(msgs, ", "))
+	}
+	defer s.networkLocks.LockKey(networkName)()
+
+	// the api is listed instead of cache so that a reservation just made is never missed
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{
+		LabelSelector: IdempotencyKeyLabel + "=" + key,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list using ips of idempotency key %s: %v", key, err)
+	}
+	for i := range usingIPs.Items {
+		usingIP := &usingIPs.Items[i]
+		if _, quarantined := quarantinedAt(usingIP); quarantined {
+			continue
+		}
+		spec := usingIP.Spec
+		if spec.Network != networkName || spec.Pool != poolName || spec.PodNamespace != namespace || spec.PodName != name {
+			return nil, newValidationError("idempotency key %s is used by the reservation of %s/%s in pool %s of network %s",
+				key, spec.PodNamespace, spec.PodName, spec.Pool, spec.Network)
+		}
+		return utils.DecodeName(usingIP.Name)
+	}
+
+	template := newPodUsingIP(networkName, poolName, namespace, name)
+	template.Labels = map[string]string{IdempotencyKeyLabel: key}
+	return s.allocateUsingIP(template, podKey(namespace, name), nil)
+}
+
+func (s *Store) allocateOnNode(networkName, poolName, namespace, name, node string) (net.IP, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	template := newPodUsingIP(networkName, poolName, namespace, name)
+	template.Spec.NodeName = node
+	return s.allocateUsingIP(template, podKey(namespace, name), nil)
+}
+
+func (s *Store) allocate(networkName, poolName, namespace, name string, blocked func(net.IP) bool) (net.IP, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	if len(poolName) == 0 {
+		var err error
+		if poolName, err = s.defaultPoolOf(networkName); err != nil {
+			return nil, err
+		}
+	}
+	return s.allocateUsingIP(newPodUsingIP(networkName, poolName, namespace, name), podKey(namespace, name), blocked)
+}
+
+// allocateUsingIP reserves the first free ip of the pool of template for it, key is the
+// identity hashed by stable hash pools, the network lock must be held
+func (s *Store) allocateUsingIP(template *resourcev1.UsingIP, key string, blocked func(net.IP) bool) (net.IP, error) {
+	networkName, poolName := template.Spec.Network, template.Spec.Pool
+	pool, err := s.getAllocatablePool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if s.delegate != nil {
+		return s.allocateDelegated(pool, template, blocked)
+	}
+	// a full pool fails fast instead of scanning its whole range, which may be huge
+	if s.cache.AllocatedCount(networkName, pool.Name) >= pool.Capacity() {
+		return nil, store.ErrPoolExhausted
+	}
+
+	// scan starts after the last reserved ip of this pool
+	var cursor net.IP
+	if last := s.lastReservedIPOf(networkName, poolName); pool.Contains(last) {
+		cursor = last
+	}
+
+	// stable hash and random pools start from the ip hashed from pod identity or a random one instead
+	candidate := pool.Following(cursor)
+	switch pool.Strategy {
+	case types.StrategyStableHash:
+		candidate = pool.StableIP(key)
+	case types.StrategyRandom:
+		candidate = s.random.ip(pool)
+	}
+
+	// a round over the whole range covers all gateways inside it
+	for i := pool.Size(); i > 0; i, candidate = i-1, pool.Following(candidate) {
+		switch {
+		case !pool.IsAllocatable(candidate):
+			continue
+		case s.cache.IsIPUsing(candidate.String()):
+			continue
+		case blocked != nil && blocked(candidate):
+			continue
+		}
+
+		// the last reserved ip is moved to candidate even if the scan wraps around to
+		// an earlier ip, or a later one of descending pools, so that the next scan starts right after it
+		reserved, err := s.reservePod(candidate, template.DeepCopy())
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			if cmp := bytes.Compare(candidate.To16(), cursor.To16()); cursor != nil && (cmp == 0 || cmp < 0 != pool.Descending) {
+				LoggerStore.Debugf("allocation of pool %s wraps around to %s after %s", poolName, candidate, cursor)
+			}
+			return candidate, nil
+		}
+	}
+
+	return nil, store.ErrPoolExhausted
+}
+
+// allocateDelegated reserves the ip picked by the delegated allocator for template,
+// the network lock must be held
+func (s *Store) allocateDelegated(pool *types.Pool, template *resourcev1.UsingIP, blocked func(net.IP) bool) (net.IP, error) {
+	used := make(map[string]struct{})
+	if snapshot := s.cache.SnapshotNetwork(template.Spec.Network); snapshot != nil {
+		used = snapshot.Used
+	}
+	ip, err := s.delegate.PickIP(pool.DeepCopy(), used)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case ip == nil || !pool.Contains(ip):
+		return nil, newValidationError("ip %s picked by delegate is not in pool %s", ip, pool.Name)
+	case !pool.IsAllocatable(ip), blocked != nil && blocked(ip):
+		return nil, newValidationError("ip %s picked by delegate is not allocatable in pool %s", ip, pool.Name)
+	}
+	reserved, err := s.reservePod(ip, template.DeepCopy())
+	if err != nil {
+		return nil, err
+	}
+	if !reserved {
+		return nil, newValidationError("ip %s picked by delegate is already in use", ip)
+	}
+	return ip, nil
+}
+
+// AllocateFromNetwork reserves a free ip from the pools of network in descending weight order,
+// pools of the same weight are tried in their order in network
+func (s *Store) AllocateFromNetwork(networkName, namespace, name string) (string, net.IP, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		err := newValidationError("network %s is not in cache", networkName)
+		s.failures.record(networkName, "", err)
+		return "", nil, err
+	}
+
+	s.sortPools(network)
+	return s.allocateFromPools(networkName, network.Pools, namespace, name)
+}
+
+// AllocatePreferFamily reserves a free ip for pod namespace/name like AllocateFromNetwork, with the
+// pools of the preferred ip family tried before those of the other, the ip is returned with its pool
+func (s *Store) AllocatePreferFamily(networkName, namespace, name string, prefer store.FamilyPreference) (net.IP, string, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		err := newValidationError("network %s is not in cache", networkName)
+		s.failures.record(networkName, "", err)
+		return nil, "", err
+	}
+	if prefer != store.PreferIPv4 && prefer != store.PreferIPv6 {
+		err := newValidationError("ip family preference %q is unknown", prefer)
+		s.failures.record(networkName, "", err)
+		return nil, "", err
+	}
+
+	s.sortPools(network)
+	v4, v6 := network.PoolsByFamily()
+	preferred, other := v4, v6
+	if prefer == store.PreferIPv6 {
+		preferred, other = v6, v4
+	}
+	pools := append(preferred, other...)
+	poolName, ip, err := s.allocateFromPools(networkName, pools, namespace, name)
+	return ip, poolName, err
+}
+
+// sortPools orders the pools of network for network-scoped allocation, the default pool
+// first, and the rest by weight or free ips as the pool policy of network decides
+func (s *Store) sortPools(network *types.Network) {
+	pools := network.Pools
+	free := make(map[string]int, len(pools))
+	if network.PoolPolicy == types.PoolPolicyLeastUtilized {
+		for _, pool := range pools {
+			free[pool.Name] = pool.Capacity() - s.cache.AllocatedCount(network.Name, pool.Name)
+		}
+	}
+	sort.SliceStable(pools, func(i, j int) bool {
+		if isDefault := pools[i].Name == network.DefaultPool; isDefault != (pools[j].Name == network.DefaultPool) {
+			return isDefault
+		}
+		if free[pools[i].Name] != free[pools[j].Name] {
+			return free[pools[i].Name] > free[pools[j].Name]
+		}
+		return pools[i].Weight > pools[j].Weight
+	})
+}
+
+// allocateFromPools reserves a free ip from the first of pools which has one, disabled pools are skipped
+func (s *Store) allocateFromPools(networkName string, pools []*types.Pool, namespace, name string) (string, net.IP, error) {
+	for _, pool := range pools {
+		if pool.Disabled {
+			continue
+		}
+		ip, err := s.allocate(networkName, pool.Name, namespace, name, nil)
+		switch {
+		case err == store.ErrPoolExhausted:
+			continue
+		case err != nil:
+			s.failures.record(networkName, pool.Name, err)
+			return "", nil, err
+		}
+		return pool.Name, ip, nil
+	}
+
+	s.failures.record(networkName, "", store.ErrPoolExhausted)
+	return "", nil, store.ErrPoolExhausted
+}
+
+// AllocateFromRange reserves the first free ip of [start, end] for owner, the window must be
+// inside pool, the last reserved ip is left untouched like ReserveStatic
+func (s *Store) AllocateFromRange(networkName, poolName string, start, end net.IP, owner string) (net.IP, error) {
+	ip, err := s.allocateFromRange(networkName, poolName, start, end, owner)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+func (s *Store) allocateFromRange(networkName, poolName string, start, end net.IP, owner string) (net.IP, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	pool, err := s.getAllocatablePool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !pool.Contains(start) || !pool.Contains(end):
+		return nil, newValidationError("range [%s, %s] is not inside pool %s", start, end, poolName)
+	case ip.Cmp(start, end) > 0:
+		return nil, newValidationError("range start %s is after its end %s", start, end)
+	}
+
+	for cur := start; ip.Cmp(cur, end) <= 0; cur = ip.NextIP(cur) {
+		if !pool.IsAllocatable(cur) || s.cache.IsIPUsing(cur.String()) {
+			continue
+		}
+		reserved, err := s.reserveUsingIP(cur, newOwnerUsingIP(networkName, poolName, owner))
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return cur, nil
+		}
+	}
+	return nil, store.ErrPoolExhausted
+}
+
+// AllocateInCIDR reserves a free ip inside cidr for owner from the first pool of network
+// overlapping it which has one, the ip is returned along with its pool, the last reserved
+// ip is left untouched like AllocateFromRange
+func (s *Store) AllocateInCIDR(networkName string, cidr *net.IPNet, owner string) (net.IP, string, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		err := newValidationError("network %s is not in cache", networkName)
+		s.failures.record(networkName, "", err)
+		return nil, "", err
+	}
+	if cidr == nil {
+		err := newValidationError("cidr is required")
+		s.failures.record(networkName, "", err)
+		return nil, "", err
+	}
+
+	overlapped := false
+	for _, pool := range network.Pools {
+		start, end, ok := pool.IntersectCIDR(cidr)
+		if !ok || pool.Disabled {
+			continue
+		}
+		overlapped = true
+		ip, err := s.allocateFromRange(networkName, pool.Name, start, end, owner)
+		switch {
+		case err == store.ErrPoolExhausted:
+			continue
+		case err != nil:
+			s.failures.record(networkName, pool.Name, err)
+			return nil, "", err
+		}
+		return ip, pool.Name, nil
+	}
+
+	if !overlapped {
+		err := newValidationError("cidr %s overlaps no enabled pool of network %s", cidr, networkName)
+		s.failures.record(networkName, "", err)
+		return nil, "", err
+	}
+	s.failures.record(networkName, "", store.ErrPoolExhausted)
+	return nil, "", store.ErrPoolExhausted
+}
+
+// AllocateBlock reserves all ips of the first free block of prefixLen aligned to its size
+// within pool for owner, and returns the block in CIDR form
+func (s *Store) AllocateBlock(networkName, poolName string, prefixLen int, owner string) (*net.IPNet, error) {
+	block, err := s.allocateBlock(networkName, poolName, prefixLen, owner)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return block, err
+}
+
+func (s *Store) allocateBlock(networkName, poolName string, prefixLen int, owner string) (*net.IPNet, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	pool, err := s.getAllocatablePool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Subnet.IP.To4() == nil {
+		return nil, newValidationError("block allocation is only for ipv4 pool, but pool %s is not", poolName)
+	}
+	ones, bits := pool.Subnet.Mask.Size()
+	if prefixLen < ones || prefixLen > bits {
+		return nil, newValidationError("prefix length %d is out of range [%d, %d] of pool %s", prefixLen, ones, bits, poolName)
+	}
+
+	size := uint64(1) << uint(bits-prefixLen)
+	start, end := uint64(ipToUint32(pool.PoolStart)), uint64(ipToUint32(pool.PoolEnd))
+	for base := (start + size - 1) &^ (size - 1); base+size-1 <= end; base += size {
+		block := make([]net.IP, 0, size)
+		for i := uint64(0); i < size; i++ {
+			block = append(block, uint32ToIP(uint32(base+i)))
+		}
+		if !s.isBlockFree(pool, block) {
+			continue
+		}
+
+		reserved, err := s.reserveBlock(networkName, poolName, owner, block)
+		if err != nil {
+			return nil, err
+		}
+		if reserved {
+			return &net.IPNet{IP: block[0], Mask: net.CIDRMask(prefixLen, bits)}, nil
+		}
+	}
+
+	return nil, store.ErrPoolExhausted
+}
+
+func (s *Store) isBlockFree(pool *types.Pool, block []net.IP) bool {
+	for _, ip := range block {
+		if !pool.IsAllocatable(ip) || s.cache.IsIPUsing(ip.String()) {
+			return false
+		}
+	}
+	return true
+}
+
+// reserveBlock reserves all ips of block, the ips already reserved are
+// released again if any of them fails
+func (s *Store) reserveBlock(networkName, poolName, owner string, block []net.IP) (bool, error) {
+	for i, ip := range block {
+		reserved, err := s.reserveUsingIP(ip, newOwnerUsingIP(networkName, poolName, owner))
+		if err == nil && reserved {
+			continue
+		}
+
+		// a partially reserved block was never handed out, so it is not quarantined
+		for _, reservedIP := range block[:i] {
+			if releaseErr := s.releaseUsingIP(reservedIP, nil, false); releaseErr != nil {
+				LoggerStore.Errorf("fail to release ip %s of partially reserved block: %v", reservedIP, releaseErr)
+			}
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	return binary.BigEndian.Uint32(ip.To4())
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// defaultPoolOf returns the default pool of network for allocations naming no pool
+func (s *Store) defaultPoolOf(networkName string) (string, error) {
+	networkCache := s.cache.GetNetwork(networkName)
+	if networkCache == nil {
+		return "", newValidationError("network %s is not in cache", networkName)
+	}
+	if len(networkCache.DefaultPool) == 0 {
+		return "", newValidationError("pool is required as network %s has no default pool", networkName)
+	}
+	return networkCache.DefaultPool, nil
+}
+
+func (s *Store) getPool(networkName, poolName string) (*types.Pool, error) {
+	networkCache := s.cache.GetNetwork(networkName)
+	if networkCache == nil {
+		return nil, newValidationError("network %s is not in cache", networkName)
+	}
+
+	if pool, ok := networkCache.PoolByName(poolName); ok {
+		return pool, nil
+	}
+	return nil, newValidationError("network %s does not have pool %s", networkName, poolName)
+}
+
+// getAllocatablePool works like getPool, and rejects pools disabled for new allocations
+func (s *Store) getAllocatablePool(networkName, poolName string) (*types.Pool, error) {
+	pool, err := s.getPool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	if pool.Disabled {
+		return nil, &store.PoolDisabledError{Network: networkName, Pool: poolName}
+	}
+	return pool, nil
+}
+
+// checkPoolEnabled rejects reserving into pool if it is disabled, pools missing from
+// cache are left to apiserver like before
+func (s *Store) checkPoolEnabled(networkName, poolName string) error {
+	if network := s.cache.GetNetwork(networkName); network != nil {
+		if pool := network.GetPool(poolName); pool != nil && pool.Disabled {
+			return &store.PoolDisabledError{Network: networkName, Pool: poolName}
+		}
+	}
+	return nil
+}
+
+// checkReservable works like checkPoolEnabled, and additionally rejects reserving a gateway
+// of pool unless the pool allows gateway allocation
+func (s *Store) checkReservable(networkName, poolName string, ip net.IP) error {
+	if err := s.checkPoolEnabled(networkName, poolName); err != nil {
+		return err
+	}
+	if network := s.cache.GetNetwork(networkName); network != nil {
+		if pool := network.GetPool(poolName); pool != nil && pool.IsGateway(ip) && !pool.IsGatewayReservable(ip) {
+			return newValidationError("ip %s is a gateway of pool %s", ip, poolName)
+		}
+	}
+	return nil
+}
+
+// lockedRand serializes picks from a rand source, which is not safe for concurrent use,
+// allocations of different networks may pick at the same time
+type lockedRand struct {
+	lock sync.Mutex
+	rand *rand.Rand
+}
+
+func newLockedRand(source rand.Source) *lockedRand {
+	return &lockedRand{rand: rand.New(source)}
+}
+
+// ip picks a random ip within range of pool
+func (r *lockedRand) ip(pool *types.Pool) net.IP {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return pool.RandomIP(r.rand)
+}
@@ -0,0 +1,1108 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestPool(name, start, end string) v1.Pool {
+	return v1.Pool{
+		Name:      name,
+		PoolStart: start,
+		PoolEnd:   end,
+		Gateway:   "192.168.0.1",
+		Subnet:    "192.168.0.0/24",
+	}
+}
+
+func TestStore_Allocate(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+
+	for _, expected := range []string{"192.168.0.10", "192.168.0.11"} {
+		ip, err := s.Allocate("network", "pool", "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s but got %s", expected, ip)
+		}
+	}
+
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted but got %v", err)
+	}
+}
+
+func TestStore_AllocateWithFilter(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+
+	blocked := func(ip net.IP) bool {
+		return ip.Equal(net.ParseIP("192.168.0.10"))
+	}
+	ip, err := s.AllocateWithFilter("network", "pool", "default", "pod", blocked)
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.0.11")) {
+		t.Errorf("expected 192.168.0.11 but got %s", ip)
+	}
+}
+
+func TestStore_AllocateBlock(t *testing.T) {
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newUsingIP("192-168-0-13", "pod1"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing("192.168.0.13")
+	})
+
+	// 192.168.0.8/30 is out of pool range and 192.168.0.12/30 is partially used
+	block, err := s.AllocateBlock("network", "pool", 30, "nested-containers")
+	if err != nil {
+		t.Fatalf("fail to allocate block: %v", err)
+	}
+	if block.String() != "192.168.0.16/30" {
+		t.Fatalf("expected block 192.168.0.16/30 but got %s", block)
+	}
+	if !block.IP.Equal(block.IP.Mask(block.Mask)) {
+		t.Errorf("block %s is not aligned", block)
+	}
+	for _, ip := range []string{"192.168.0.16", "192.168.0.17", "192.168.0.18", "192.168.0.19"} {
+		waitForCache(t, func() bool {
+			return s.cache.IsIPUsing(ip)
+		})
+		if usingIP := s.cache.GetUsingIP(ip); usingIP.Owner != "nested-containers" {
+			t.Errorf("unexpected record of ip %s %+v", ip, usingIP)
+		}
+	}
+
+	if _, err := s.AllocateBlock("network", "pool", 30, "nested-containers"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted but got %v", err)
+	}
+	if _, err := s.AllocateBlock("network", "pool", 23, "nested-containers"); err == nil {
+		t.Errorf("block larger than subnet should be rejected")
+	}
+}
+
+func TestStore_AllocatePerPoolCursor(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("pool1", "192.168.0.10", "192.168.0.20"),
+		newTestPool("pool2", "192.168.0.30", "192.168.0.40")))
+	defer stop()
+
+	allocate := func(pool, expected string) {
+		ip, err := s.Allocate("network", pool, "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate from %s: %v", pool, err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("expected %s from %s but got %s", expected, pool, ip)
+		}
+		waitForCache(t, func() bool {
+			lri := s.cache.GetLastReservedIP("network")
+			return lri != nil && lri.ForPool(pool).Equal(ip)
+		})
+	}
+
+	allocate("pool1", "192.168.0.10")
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	allocate("pool2", "192.168.0.30")
+	// pool1 advances its own cursor even though pool2 reserved the latest ip
+	allocate("pool1", "192.168.0.11")
+	allocate("pool2", "192.168.0.31")
+}
+
+func TestStore_AllocateReservedPolicy(t *testing.T) {
+	// the fake watcher can not buffer a whole /24, so both ends are covered by two pools
+	head := newTestPool("head", "192.168.0.1", "192.168.0.6")
+	tail := newTestPool("tail", "192.168.0.250", "192.168.0.254")
+	for _, pool := range []*v1.Pool{&head, &tail} {
+		pool.ReserveFirst = 1
+		pool.ReserveLast = 2
+	}
+	s, stop := newTestStore(t, newNetwork("network", head, tail))
+	defer stop()
+
+	tests := []struct {
+		pool      string
+		capacity  int
+		allocated []string
+	}{
+		{"head", 5, []string{"192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6"}},
+		{"tail", 3, []string{"192.168.0.250", "192.168.0.251", "192.168.0.252"}},
+	}
+	for _, test := range tests {
+		capacity, _, err := s.CountPool("network", test.pool)
+		if err != nil {
+			t.Fatalf("test %s fails: %v", test.pool, err)
+		}
+		if capacity != test.capacity {
+			t.Errorf("test %s fails: expected capacity %d but got %d", test.pool, test.capacity, capacity)
+		}
+
+		for _, expected := range test.allocated {
+			ip, err := s.Allocate("network", test.pool, "default", "pod")
+			if err != nil {
+				t.Fatalf("test %s fails: %v", test.pool, err)
+			}
+			if !ip.Equal(net.ParseIP(expected)) {
+				t.Errorf("test %s fails: expected %s but got %s", test.pool, expected, ip)
+			}
+			waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+		}
+		if _, err := s.Allocate("network", test.pool, "default", "pod"); err != store.ErrPoolExhausted {
+			t.Errorf("test %s fails: expected pool exhausted but got %v", test.pool, err)
+		}
+	}
+
+	if err := s.ReserveStatic("network", "tail", net.ParseIP("192.168.0.254"), "owner"); err == nil {
+		t.Errorf("reserved ip 192.168.0.254 should not be reserved statically")
+	}
+}
+
+func TestStore_AllocateSticky(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	tests := []struct {
+		name     string
+		pod      string
+		previous string
+		expected string
+	}{
+		{"previous free", "pod1", "192.168.0.15", "192.168.0.15"},
+		{"previous taken", "pod2", "192.168.0.15", "192.168.0.10"},
+		{"previous out of pool", "pod3", "192.168.0.30", "192.168.0.11"},
+		{"no previous", "pod4", "", "192.168.0.12"},
+	}
+	for _, test := range tests {
+		ip, err := s.AllocateSticky("network", "pool", "default", test.pod, net.ParseIP(test.previous))
+		if err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if !ip.Equal(net.ParseIP(test.expected)) {
+			t.Errorf("test %s fails: expected %s but got %s", test.name, test.expected, ip)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	}
+}
+
+func TestStore_AllocateSecondaryGateways(t *testing.T) {
+	pool := newTestPool("pool", "192.168.0.1", "192.168.0.4")
+	pool.SecondaryGateways = []string{"192.168.0.2"}
+	s, stop := newTestStore(t, newNetwork("network", pool))
+	defer stop()
+
+	for _, expected := range []string{"192.168.0.3", "192.168.0.4"} {
+		ip, err := s.Allocate("network", "pool", "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s but got %s", expected, ip)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	}
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("both gateways should be excluded, expected pool exhausted but got %v", err)
+	}
+	if err := s.ReserveStatic("network", "pool", net.ParseIP("192.168.0.2"), "owner"); err == nil {
+		t.Errorf("secondary gateway should not be reserved statically")
+	}
+}
+
+func TestStore_AllocateWrap(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.14")))
+	defer stop()
+
+	allocate := func(expected string) {
+		ip, err := s.Allocate("network", "pool", "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate %s: %v", expected, err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("expected %s but got %s", expected, ip)
+		}
+		waitForCache(t, func() bool {
+			lri := s.cache.GetLastReservedIP("network")
+			return s.cache.IsIPUsing(ip.String()) && lri != nil && lri.ForPool("pool").Equal(ip)
+		})
+	}
+	release := func(addr string) {
+		if err := s.Release(net.ParseIP(addr)); err != nil {
+			t.Fatalf("fail to release %s: %v", addr, err)
+		}
+		waitForCache(t, func() bool { return !s.cache.IsIPUsing(addr) })
+	}
+
+	for _, expected := range []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13", "192.168.0.14"} {
+		allocate(expected)
+	}
+
+	// the scan wraps around from the tail, and the cursor moves back with it
+	release("192.168.0.11")
+	allocate("192.168.0.11")
+	release("192.168.0.13")
+	release("192.168.0.10")
+	allocate("192.168.0.13")
+	allocate("192.168.0.10")
+}
+
+func TestStore_AllocateFromNetwork(t *testing.T) {
+	light := newTestPool("light", "192.168.0.10", "192.168.0.11")
+	heavy := newTestPool("heavy", "192.168.0.30", "192.168.0.31")
+	heavy.Weight = 10
+	medium := newTestPool("medium", "192.168.0.50", "192.168.0.50")
+	medium.Weight = 5
+	s, stop := newTestStore(t, newNetwork("network", light, heavy, medium))
+	defer stop()
+
+	for _, expected := range []string{"heavy", "heavy", "medium", "light", "light"} {
+		pool, _, err := s.AllocateFromNetwork("network", "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate from network: %v", err)
+		}
+		if pool != expected {
+			t.Errorf("expected allocation from pool %s but got %s", expected, pool)
+		}
+	}
+	if _, _, err := s.AllocateFromNetwork("network", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected network exhausted but got %v", err)
+	}
+}
+
+func TestStore_AllocatePreferFamily(t *testing.T) {
+	v4 := newTestPool("v4", "192.168.0.10", "192.168.0.11")
+	v6 := v1.Pool{
+		Name:      "v6",
+		PoolStart: "fd00::10",
+		PoolEnd:   "fd00::11",
+		Gateway:   "fd00::1",
+		Subnet:    "fd00::/64",
+	}
+	s, stop := newTestStoreWithOptions(t, []Option{WithNameEncoder(utils.HexNameEncoder{})}, newNetwork("network", v4, v6))
+	defer stop()
+	waitForCache(t, func() bool {
+		network := s.cache.GetNetwork("network")
+		return network != nil && len(network.Pools) == 2
+	})
+
+	// each family is preferred until exhausted, then the other one is fallen back to
+	for i, expected := range []struct {
+		prefer store.FamilyPreference
+		pool   string
+	}{
+		{store.PreferIPv6, "v6"},
+		{store.PreferIPv4, "v4"},
+		{store.PreferIPv6, "v6"},
+		{store.PreferIPv6, "v4"},
+	} {
+		ip, pool, err := s.AllocatePreferFamily("network", "default", fmt.Sprintf("pod%d", i), expected.prefer)
+		if err != nil {
+			t.Fatalf("allocation %d fail to allocate preferring %s: %v", i, expected.prefer, err)
+		}
+		if pool != expected.pool {
+			t.Errorf("allocation %d expected from pool %s but got %s with ip %s", i, expected.pool, pool, ip)
+		}
+	}
+	if _, _, err := s.AllocatePreferFamily("network", "default", "pod", store.PreferIPv4); err != store.ErrPoolExhausted {
+		t.Errorf("expected network exhausted but got %v", err)
+	}
+	if _, _, err := s.AllocatePreferFamily("network", "default", "pod", "IPv5"); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error for unknown family but got %v", err)
+	}
+}
+
+func TestStore_AllocateLeastUtilized(t *testing.T) {
+	small := newTestPool("small", "192.168.0.10", "192.168.0.12")
+	large := newTestPool("large", "192.168.0.30", "192.168.0.35")
+	large.Weight = 10
+	network := newNetwork("network", small, large)
+	network.Spec.PoolPolicy = string(types.PoolPolicyLeastUtilized)
+	busy := newUsingIP("192-168-0-30", "busy")
+	busy.Spec.Network, busy.Spec.Pool = "network", "large"
+	busy2 := newUsingIP("192-168-0-31", "busy2")
+	busy2.Spec.Network, busy2.Spec.Pool = "network", "large"
+	s, stop := newTestStore(t, network, busy, busy2)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "large") == 2 })
+
+	// large has 4 free ips and small 3, so that allocations alternate once large is down to 3
+	for i, expected := range []string{"large", "large", "small", "large", "small", "large", "small"} {
+		pool, _, err := s.AllocateFromNetwork("network", "default", fmt.Sprintf("pod%d", i))
+		if err != nil {
+			t.Fatalf("fail to allocate from network: %v", err)
+		}
+		if pool != expected {
+			t.Errorf("allocation %d expected from pool %s but got %s", i, expected, pool)
+		}
+		used := s.cache.UsedCount("network", "small") + s.cache.UsedCount("network", "large")
+		waitForCache(t, func() bool {
+			return s.cache.UsedCount("network", "small")+s.cache.UsedCount("network", "large") == used+1
+		})
+	}
+	if _, _, err := s.AllocateFromNetwork("network", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected network exhausted but got %v", err)
+	}
+}
+
+func TestStore_AllocateLeastUtilizedGatewayRecord(t *testing.T) {
+	// both pools have 3 allocatable ips, the record on the gateway of first takes none of them
+	first := newTestPool("first", "192.168.0.1", "192.168.0.4")
+	second := newTestPool("second", "192.168.0.10", "192.168.0.12")
+	network := newNetwork("network", first, second)
+	network.Spec.PoolPolicy = string(types.PoolPolicyLeastUtilized)
+	gateway := newUsingIP("192-168-0-1", "gateway")
+	gateway.Spec.Network, gateway.Spec.Pool = "network", "first"
+	s, stop := newTestStore(t, network, gateway)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "first") == 1 })
+
+	pool, _, err := s.AllocateFromNetwork("network", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to allocate from network: %v", err)
+	}
+	if pool != "first" {
+		t.Errorf("pools with the same free ips should keep their order but got %s", pool)
+	}
+}
+
+func TestStore_DefaultPool(t *testing.T) {
+	heavy := newTestPool("heavy", "192.168.0.30", "192.168.0.30")
+	heavy.Weight = 10
+	s, stop := newTestStore(t, newNetwork("network", heavy, newTestPool("default", "192.168.0.10", "192.168.0.10")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if _, err := s.Allocate("network", "", "default", "pod1"); failureReason(err) != FailureValidation {
+		t.Errorf("allocation naming no pool should fail without default pool but got %v", err)
+	}
+	if err := s.SetDefaultPool("network", "missing"); failureReason(err) != FailureValidation {
+		t.Errorf("default pool naming no pool should be rejected but got %v", err)
+	}
+	if err := s.SetDefaultPool("network", "default"); err != nil {
+		t.Fatalf("fail to set default pool: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network").DefaultPool == "default" })
+
+	// the default pool is preferred over heavier ones
+	pool, ip, err := s.AllocateFromNetwork("network", "default", "pod1")
+	if err != nil || pool != "default" || !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("expected allocation from default pool but got %s %s %v", pool, ip, err)
+	}
+	pool, _, err = s.AllocateFromNetwork("network", "default", "pod2")
+	if err != nil || pool != "heavy" {
+		t.Errorf("expected fallback to pool heavy once default is exhausted but got %s %v", pool, err)
+	}
+
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing("192.168.0.10") })
+	if ip, err := s.Allocate("network", "", "default", "pod3"); err != nil || !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("allocation naming no pool should use default pool but got %s %v", ip, err)
+	}
+
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing("192.168.0.10") })
+	if _, err := s.DelPool("network", "default"); err == nil {
+		t.Errorf("deleting the default pool should be rejected")
+	}
+	if err := s.SetDefaultPool("network", ""); err != nil {
+		t.Fatalf("fail to clear default pool: %v", err)
+	}
+	waitForCache(t, func() bool { return len(s.cache.GetNetwork("network").DefaultPool) == 0 })
+	if _, err := s.DelPool("network", "default"); err != nil {
+		t.Errorf("fail to delete pool which is no longer the default: %v", err)
+	}
+}
+
+func TestStore_AllocateStableHash(t *testing.T) {
+	pool := v1.Pool{
+		Name:      "pool",
+		PoolStart: "fd00::10",
+		PoolEnd:   "fd00::ffff",
+		Gateway:   "fd00::1",
+		Subnet:    "fd00::/64",
+		Strategy:  string(types.StrategyStableHash),
+	}
+	s, stop := newTestStoreWithOptions(t, []Option{WithNameEncoder(utils.HexNameEncoder{})}, newNetwork("network", pool))
+	defer stop()
+	waitForCache(t, func() bool {
+		network := s.cache.GetNetwork("network")
+		return network != nil && len(network.Pools) == 1
+	})
+
+	ip, err := s.Allocate("network", "pool", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing(ip.String())
+	})
+	if err := s.Release(ip); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return !s.cache.IsIPUsing(ip.String())
+	})
+
+	// the same pod gets the same ip again
+	again, err := s.Allocate("network", "pool", "default", "pod")
+	if err != nil || !again.Equal(ip) {
+		t.Fatalf("expected stable ip %s but got %s %v", ip, again, err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing(ip.String())
+	})
+
+	// the pod falls back to the next free ip once its stable ip is taken by another
+	if err := s.Release(ip); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return !s.cache.IsIPUsing(ip.String())
+	})
+	if reserved, err := s.Reserve("network", "pool", "default", "other", ip); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing(ip.String())
+	})
+	fallback, err := s.Allocate("network", "pool", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if expected := s.cache.GetNetwork("network").Pools[0].Next(ip); !fallback.Equal(expected) {
+		t.Errorf("expected fallback ip %s but got %s", expected, fallback)
+	}
+}
+
+func TestStore_AllocateByMAC(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("pool1", "192.168.0.10", "192.168.0.20"),
+		newTestPool("pool2", "192.168.0.30", "192.168.0.40")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	first, err := s.AllocateByMAC("network", "pool1", "02:42:ac:11:00:02")
+	if err != nil {
+		t.Fatalf("fail to allocate by mac: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetUsingIPByMAC("network", "02:42:ac:11:00:02") != nil })
+
+	tests := []struct {
+		name     string
+		pool     string
+		mac      string
+		expected net.IP
+		invalid  bool
+	}{
+		{"same mac", "pool1", "02:42:ac:11:00:02", first, false},
+		{"same mac in another form", "pool1", "02-42-AC-11-00-02", first, false},
+		{"another mac", "pool1", "02:42:ac:11:00:03", net.ParseIP("192.168.0.11"), false},
+		{"bound in another pool", "pool2", "02:42:ac:11:00:02", nil, true},
+		{"malformed mac", "pool1", "02:42:ac:11:00", nil, true},
+	}
+	for _, test := range tests {
+		ip, err := s.AllocateByMAC("network", test.pool, test.mac)
+		if test.invalid {
+			if failureReason(err) != FailureValidation {
+				t.Errorf("test %s fails: expected validation error but got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if !ip.Equal(test.expected) {
+			t.Errorf("test %s fails: expected %s but got %s", test.name, test.expected, ip)
+		}
+	}
+}
+
+func TestStore_AllocateDisabledPool(t *testing.T) {
+	disabled := newTestPool("disabled", "192.168.0.10", "192.168.0.20")
+	disabled.Disabled = true
+	disabled.Weight = 10
+	existing := newUsingIP("192-168-0-10", "pod")
+	existing.Spec.PodNamespace = "default"
+	existing.Spec.Network = "network"
+	existing.Spec.Pool = "disabled"
+	s, stop := newTestStore(t,
+		newNetwork("network", disabled, newTestPool("enabled", "192.168.0.30", "192.168.0.40")),
+		existing)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.10")
+	})
+
+	// network-scoped allocation skips the disabled pool despite its weight
+	pool, ip, err := s.AllocateFromNetwork("network", "default", "pod1")
+	if err != nil || pool != "enabled" || !ip.Equal(net.ParseIP("192.168.0.30")) {
+		t.Errorf("expected 192.168.0.30 of pool enabled but got %s of pool %s, %v", ip, pool, err)
+	}
+
+	tests := []struct {
+		name string
+		call func() error
+	}{
+		{"allocate", func() error {
+			_, err := s.Allocate("network", "disabled", "default", "pod2")
+			return err
+		}},
+		{"reserve", func() error {
+			_, err := s.Reserve("network", "disabled", "default", "pod2", net.ParseIP("192.168.0.11"))
+			return err
+		}},
+		{"reserve static", func() error {
+			return s.ReserveStatic("network", "disabled", net.ParseIP("192.168.0.11"), "vip")
+		}},
+		{"allocate block", func() error {
+			_, err := s.AllocateBlock("network", "disabled", 30, "owner")
+			return err
+		}},
+		{"allocate by mac", func() error {
+			_, err := s.AllocateByMAC("network", "disabled", "02:42:ac:11:00:02")
+			return err
+		}},
+	}
+	for _, test := range tests {
+		if _, ok := test.call().(*store.PoolDisabledError); !ok {
+			t.Errorf("test %s fails: expected pool disabled error", test.name)
+		}
+	}
+
+	// ips in use are untouched by disabling
+	if usingIP := s.cache.GetUsingIP("192.168.0.10"); usingIP == nil || usingIP.Pool != "disabled" {
+		t.Errorf("expected 192.168.0.10 still in use in pool disabled but got %+v", usingIP)
+	}
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Errorf("fail to release ip of disabled pool: %v", err)
+	}
+}
+
+func TestStore_AllocateLastReservedIPWrites(t *testing.T) {
+	sequential := newTestPool("pool", "192.168.0.10", "192.168.0.20")
+	stableHash := v1.Pool{
+		Name:      "pool",
+		PoolStart: "fd00::10",
+		PoolEnd:   "fd00::ffff",
+		Gateway:   "fd00::1",
+		Subnet:    "fd00::/64",
+		Strategy:  string(types.StrategyStableHash),
+	}
+
+	tests := []struct {
+		name   string
+		pool   v1.Pool
+		writes bool
+	}{
+		{"sequential", sequential, true},
+		{"stable hash", stableHash, false},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, []Option{WithNameEncoder(utils.HexNameEncoder{})}, newNetwork("network", test.pool))
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+		var writes int32
+		s.resourceClient.(*fake.Clientset).PrependReactor("*", "lastreservedips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			if action.GetVerb() == "create" || action.GetVerb() == "update" {
+				atomic.AddInt32(&writes, 1)
+			}
+			return false, nil, nil
+		})
+		for _, pod := range []string{"pod1", "pod2"} {
+			if _, err := s.Allocate("network", "pool", "default", pod); err != nil {
+				t.Fatalf("test %s fails: %v", test.name, err)
+			}
+		}
+		if wrote := atomic.LoadInt32(&writes) > 0; wrote != test.writes {
+			t.Errorf("test %s fails: expected last reserved ip written %v but got %d writes", test.name, test.writes, writes)
+		}
+		stop()
+	}
+}
+
+func TestStore_AllocatePointToPoint(t *testing.T) {
+	pool := v1.Pool{Name: "link", Subnet: "10.0.0.0/31", PointToPoint: true}
+	s, stop := newTestStore(t, newNetwork("network", pool))
+	defer stop()
+	waitForCache(t, func() bool {
+		network := s.cache.GetNetwork("network")
+		return network != nil && len(network.Pools) == 1
+	})
+
+	for _, expected := range []string{"10.0.0.0", "10.0.0.1"} {
+		ip, err := s.Allocate("network", "link", "default", "pod-"+expected)
+		if err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s but got %s", expected, ip)
+		}
+	}
+	if _, err := s.Allocate("network", "link", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted but got %v", err)
+	}
+}
+
+func TestStore_AllocateDescending(t *testing.T) {
+	pool := newTestPool("pool", "192.168.0.10", "192.168.0.12")
+	pool.Descending = true
+	s, stop := newTestStore(t, newNetwork("network", pool), newUsingIP("192-168-0-11", "pod1"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing("192.168.0.11")
+	})
+
+	// the highest free ip comes first, and used ones are skipped downwards
+	for _, expected := range []string{"192.168.0.12", "192.168.0.10"} {
+		ip, err := s.Allocate("network", "pool", "default", "pod-"+expected)
+		if err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		if !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s but got %s", expected, ip)
+		}
+	}
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted but got %v", err)
+	}
+}
+
+// fixedAllocator always picks ip, and remembers the used set it is given
+type fixedAllocator struct {
+	ip   net.IP
+	used map[string]struct{}
+}
+
+func (a *fixedAllocator) PickIP(pool *types.Pool, used map[string]struct{}) (net.IP, error) {
+	a.used = used
+	return a.ip, nil
+}
+
+func TestStore_AllocateDelegated(t *testing.T) {
+	delegate := &fixedAllocator{ip: net.ParseIP("192.168.0.15")}
+	s, stop := newTestStoreWithOptions(t, []Option{WithDelegatedAllocator(delegate)},
+		newNetwork("network", newTestPool("pool", "192.168.0.1", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, err := s.Allocate("network", "pool", "default", "pod1")
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if !ip.Equal(delegate.ip) {
+		t.Errorf("expected %s picked by delegate but got %s", delegate.ip, ip)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.15") })
+	if usingIP := s.cache.GetUsingIP("192.168.0.15"); usingIP.PodName != "pod1" || usingIP.Pool != "pool" {
+		t.Errorf("expected 192.168.0.15 recorded for pod1 in pool but got %+v", usingIP)
+	}
+
+	tests := []struct {
+		name string
+		ip   string
+	}{
+		{"in use", "192.168.0.15"},
+		{"out of pool", "192.168.0.30"},
+		{"gateway", "192.168.0.1"},
+	}
+	for _, test := range tests {
+		delegate.ip = net.ParseIP(test.ip)
+		if _, err := s.Allocate("network", "pool", "default", "pod2"); failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation error but got %v", test.name, err)
+		}
+	}
+	if _, used := delegate.used["192.168.0.15"]; !used {
+		t.Errorf("expected delegate to see 192.168.0.15 in use but got %v", delegate.used)
+	}
+}
+
+func TestStore_PeekNext(t *testing.T) {
+	stableHash := newTestPool("hash", "192.168.0.30", "192.168.0.40")
+	stableHash.Strategy = string(types.StrategyStableHash)
+	network := newNetwork("network", newTestPool("pool", "192.168.0.1", "192.168.0.5"), stableHash)
+
+	tests := []struct {
+		name    string
+		options []Option
+	}{
+		{"sequential", nil},
+		{"delegated", []Option{WithDelegatedAllocator(&fixedAllocator{ip: net.ParseIP("192.168.0.4")})}},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, test.options, network.DeepCopy())
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+		for i := 0; i < 2; i++ {
+			peeked, err := s.PeekNext("network", "pool")
+			if err != nil {
+				t.Fatalf("test %s fails: fail to peek: %v", test.name, err)
+			}
+			if again, _ := s.PeekNext("network", "pool"); !again.Equal(peeked) {
+				t.Errorf("test %s fails: peeking twice gives %s and %s", test.name, peeked, again)
+			}
+			if lri := s.cache.GetLastReservedIP("network"); lri != nil && lri.ForPool("pool").Equal(peeked) {
+				t.Errorf("test %s fails: last reserved ip is moved to peeked %s", test.name, peeked)
+			}
+
+			ip, err := s.Allocate("network", "pool", "default", fmt.Sprintf("pod%d", i))
+			if err != nil || !ip.Equal(peeked) {
+				t.Errorf("test %s fails: peeked %s but allocated %s: %v", test.name, peeked, ip, err)
+			}
+			waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+
+			// the delegate picks a fixed ip, so that it can not be allocated twice
+			if test.options != nil {
+				break
+			}
+		}
+
+		if _, err := s.PeekNext("network", "hash"); failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation error for stable hash pool but got %v", test.name, err)
+		}
+		stop()
+	}
+}
+
+func TestStore_AllocateFromRange(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.1", "192.168.0.50")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	start, end := net.ParseIP("192.168.0.20"), net.ParseIP("192.168.0.22")
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.21")); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.21") })
+
+	for _, expected := range []string{"192.168.0.20", "192.168.0.22"} {
+		ip, err := s.AllocateFromRange("network", "pool", start, end, "rack1")
+		if err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("expected %s in window but got %s: %v", expected, ip, err)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(expected) })
+		if usingIP := s.cache.GetUsingIP(expected); usingIP.Owner != "rack1" {
+			t.Errorf("expected %s owned by rack1 but got %+v", expected, usingIP)
+		}
+	}
+
+	tests := []struct {
+		name  string
+		start string
+		end   string
+		check func(error) bool
+	}{
+		{"exhausted", "192.168.0.20", "192.168.0.22", func(err error) bool { return err == store.ErrPoolExhausted }},
+		{"out of pool", "192.168.0.45", "192.168.0.60", func(err error) bool { return failureReason(err) == FailureValidation }},
+		{"reversed", "192.168.0.30", "192.168.0.25", func(err error) bool { return failureReason(err) == FailureValidation }},
+	}
+	for _, test := range tests {
+		if ip, err := s.AllocateFromRange("network", "pool", net.ParseIP(test.start), net.ParseIP(test.end), "rack1"); !test.check(err) {
+			t.Errorf("test %s fails: unexpected %s: %v", test.name, ip, err)
+		}
+	}
+}
+
+func TestStore_AllocateInCIDR(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("low", "192.168.0.10", "192.168.0.70"),
+		newTestPool("high", "192.168.0.100", "192.168.0.150")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	_, cidr, _ := net.ParseCIDR("192.168.0.64/26")
+	for i := 0; i < 8; i++ {
+		ip, poolName, err := s.AllocateInCIDR("network", cidr, "vip")
+		if err != nil {
+			t.Fatalf("fail to allocate in cidr: %v", err)
+		}
+		pool, _ := s.cache.GetNetwork("network").PoolByName(poolName)
+		if !cidr.Contains(ip) || pool == nil || !pool.IsAllocatable(ip) {
+			t.Fatalf("allocated ip %s should be in both %s and pool %s", ip, cidr, poolName)
+		}
+		// low is exhausted within cidr after 192.168.0.64 to 192.168.0.70
+		if expected := map[bool]string{true: "low", false: "high"}[i < 7]; poolName != expected {
+			t.Errorf("allocation %d expected from pool %s but got %s", i, expected, poolName)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	}
+
+	_, outside, _ := net.ParseCIDR("192.168.0.192/26")
+	if _, _, err := s.AllocateInCIDR("network", outside, "vip"); failureReason(err) != FailureValidation {
+		t.Errorf("cidr overlapping no pool should be rejected but got %v", err)
+	}
+	_, v6, _ := net.ParseCIDR("fd00::/64")
+	if _, _, err := s.AllocateInCIDR("network", v6, "vip"); failureReason(err) != FailureValidation {
+		t.Errorf("cidr of another family should be rejected but got %v", err)
+	}
+}
+
+func TestStore_AllocateSkipsGateway(t *testing.T) {
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		inRange bool
+	}{
+		{"gateway in window", "192.168.0.1", "192.168.0.4", true},
+		{"gateway outside window", "192.168.0.10", "192.168.0.12", false},
+	}
+	for _, test := range tests {
+		s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", test.start, test.end)))
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+		pool, _ := s.cache.GetNetwork("network").PoolByName("pool")
+		if pool.GatewayInRange() != test.inRange {
+			t.Errorf("test %s fails: expected gateway in range %v", test.name, test.inRange)
+		}
+
+		for {
+			ip, err := s.Allocate("network", "pool", "default", "pod")
+			if err == store.ErrPoolExhausted {
+				break
+			}
+			if err != nil {
+				t.Fatalf("test %s fails: %v", test.name, err)
+			}
+			if pool.IsGateway(ip) {
+				t.Errorf("test %s fails: gateway %s is allocated", test.name, ip)
+			}
+			waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+		}
+		stop()
+	}
+}
+
+func TestStore_ReserveIdempotent(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	first, err := s.ReserveIdempotent("network", "pool", "request-1", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to reserve: %v", err)
+	}
+	second, err := s.ReserveIdempotent("network", "pool", "request-1", "default", "pod")
+	if err != nil || !second.Equal(first) {
+		t.Fatalf("expected retry to return %s but got %s: %v", first, second, err)
+	}
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil || len(list.Items) != 1 {
+		t.Fatalf("expected exactly one using ip but got %v: %v", list, err)
+	}
+	if key := list.Items[0].Labels[IdempotencyKeyLabel]; key != "request-1" {
+		t.Errorf("expected idempotency key request-1 but got %q", key)
+	}
+
+	other, err := s.ReserveIdempotent("network", "pool", "request-2", "default", "pod")
+	if err != nil || other.Equal(first) {
+		t.Errorf("expected a new ip for another key but got %s: %v", other, err)
+	}
+
+	tests := []struct {
+		name      string
+		key       string
+		namespace string
+		pod       string
+	}{
+		{"empty key", "", "default", "pod"},
+		{"invalid key", "not a label value", "default", "pod"},
+		{"key of another pod", "request-1", "default", "other"},
+	}
+	for _, test := range tests {
+		if ip, err := s.ReserveIdempotent("network", "pool", test.key, test.namespace, test.pod); failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation error but got %s: %v", test.name, ip, err)
+		}
+	}
+}
+
+func TestStore_AllocateRandomSeeded(t *testing.T) {
+	pool := newTestPool("pool", "192.168.0.10", "192.168.0.250")
+	pool.Strategy = string(types.StrategyRandom)
+	allocateSeeded := func(seed int64) []string {
+		s, stop := newTestStoreWithOptions(t, []Option{WithRandSource(rand.NewSource(seed))}, newNetwork("network", pool))
+		defer stop()
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+		var ips []string
+		for i := 0; i < 10; i++ {
+			ip, err := s.Allocate("network", "pool", "default", fmt.Sprintf("pod%d", i))
+			if err != nil {
+				t.Fatalf("fail to allocate with seed %d: %v", seed, err)
+			}
+			waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+			ips = append(ips, ip.String())
+		}
+		if _, err := s.PeekNext("network", "pool"); failureReason(err) != FailureValidation {
+			t.Errorf("expected peeking a random pool to be refused but got %v", err)
+		}
+		return ips
+	}
+
+	first, second := allocateSeeded(42), allocateSeeded(42)
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the same sequence for the same seed but got %v and %v", first, second)
+	}
+	if other := allocateSeeded(7); reflect.DeepEqual(first, other) {
+		t.Errorf("expected another sequence for another seed but got %v", other)
+	}
+	sequential := []string{"192.168.0.10", "192.168.0.11", "192.168.0.12"}
+	if reflect.DeepEqual(first[:3], sequential) {
+		t.Errorf("expected random picks but got %v", first)
+	}
+}
+
+func TestStore_NamespaceQuota(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithNamespaceQuota(2)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newNetwork("other", newTestPool("pool", "192.168.0.30", "192.168.0.40")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil && s.cache.GetNetwork("other") != nil })
+
+	for i := 0; i < 2; i++ {
+		if _, err := s.Allocate("network", "pool", "tenant", fmt.Sprintf("pod%d", i)); err != nil {
+			t.Fatalf("allocation %d within quota fails: %v", i, err)
+		}
+	}
+
+	_, err := s.Allocate("network", "pool", "tenant", "pod2")
+	if quotaErr, ok := err.(*store.QuotaExceededError); !ok || quotaErr.Namespace != "tenant" || quotaErr.Quota != 2 {
+		t.Fatalf("expected quota of tenant to be exceeded but got %v", err)
+	}
+	if reason := failureReason(err); reason != FailureQuota {
+		t.Errorf("expected failure reason %s but got %s", FailureQuota, reason)
+	}
+	if _, err := s.Reserve("network", "pool", "tenant", "pod2", net.ParseIP("192.168.0.20")); err == nil {
+		t.Errorf("expected reserving beyond quota to be rejected")
+	}
+
+	// other namespaces and other networks are counted on their own
+	tests := []struct {
+		name      string
+		network   string
+		namespace string
+	}{
+		{"other namespace", "network", "default"},
+		{"other network", "other", "tenant"},
+	}
+	for _, test := range tests {
+		if _, err := s.Allocate(test.network, "pool", test.namespace, "pod"); err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+		}
+	}
+}
+
+func TestStore_PostReserveHook(t *testing.T) {
+	var hooked []string
+	hookErr := fmt.Errorf("switch unreachable")
+	hook := func(usingIP *types.UsingIP) error {
+		hooked = append(hooked, usingIP.IP.String())
+		if usingIP.PodName == "broken" {
+			return hookErr
+		}
+		return nil
+	}
+	s, stop := newTestStoreWithOptions(t, []Option{WithPostReserveHook(hook)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, err := s.Allocate("network", "pool", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if !reflect.DeepEqual(hooked, []string{ip.String()}) {
+		t.Errorf("expected hook called with %s but got %v", ip, hooked)
+	}
+
+	if _, err := s.Reserve("network", "pool", "default", "broken", net.ParseIP("192.168.0.15")); err == nil {
+		t.Fatalf("expected reservation to fail with hook")
+	}
+	if len(hooked) != 2 || hooked[1] != "192.168.0.15" {
+		t.Errorf("expected hook called with 192.168.0.15 but got %v", hooked)
+	}
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-15", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("expected using ip rolled back but got %v", err)
+	}
+}
+
+// countingSource counts draws, which random pools take once at the start of every scan
+type countingSource struct {
+	rand.Source
+	draws int32
+}
+
+func (c *countingSource) Int63() int64 {
+	atomic.AddInt32(&c.draws, 1)
+	return c.Source.Int63()
+}
+
+func TestStore_AllocateFullPoolFailsFast(t *testing.T) {
+	pool := newTestPool("pool", "192.168.0.10", "192.168.0.13")
+	pool.Strategy = string(types.StrategyRandom)
+	source := &countingSource{Source: rand.NewSource(1)}
+	s, stop := newTestStoreWithOptions(t, []Option{WithRandSource(source)}, newNetwork("network", pool))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	for i := 0; i < 4; i++ {
+		ip, err := s.Allocate("network", "pool", "default", fmt.Sprintf("pod%d", i))
+		if err != nil {
+			t.Fatalf("fail to allocate %d: %v", i, err)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	}
+	if atomic.LoadInt32(&source.draws) == 0 {
+		t.Fatalf("expected scans of a random pool to draw from the source")
+	}
+
+	draws := atomic.LoadInt32(&source.draws)
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted but got %v", err)
+	}
+	if scanned := atomic.LoadInt32(&source.draws) - draws; scanned != 0 {
+		t.Errorf("expected allocation from a full pool to fail without a scan but it drew %d times", scanned)
+	}
+}
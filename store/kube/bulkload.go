@@ -0,0 +1,87 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/store"
+)
+
+// initialLoad buffers the adds informers deliver during initial sync, so that they are
+// applied to cache taking its lock once instead of once per object
+type initialLoad struct {
+	sync.Mutex
+
+	// loading is keyed by the kinds which are still in initial sync
+	loading         map[string]bool
+	networks        []*resourcev1.Network
+	lastReservedIPs []*resourcev1.LastReservedIP
+	usingIPs        []*resourcev1.UsingIP
+}
+
+func newInitialLoad() *initialLoad {
+	return &initialLoad{loading: map[string]bool{"network": true, "lastreservedip": true, "usingip": true}}
+}
+
+// buffer keeps obj to be bulk loaded, false is returned once initial sync is over
+func (l *initialLoad) buffer(obj interface{}) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	switch t := obj.(type) {
+	case *resourcev1.Network:
+		if l.loading["network"] {
+			l.networks = append(l.networks, t)
+			return true
+		}
+	case *resourcev1.LastReservedIP:
+		if l.loading["lastreservedip"] {
+			l.lastReservedIPs = append(l.lastReservedIPs, t)
+			return true
+		}
+	case *resourcev1.UsingIP:
+		if l.loading["usingip"] {
+			l.usingIPs = append(l.usingIPs, t)
+			return true
+		}
+	}
+	return false
+}
+
+// flushInitialLoad bulk loads the buffered adds into cache, it is called before any other event
+// is applied during initial sync to keep events of the same object in order, and with the kinds
+// whose informers have synced to switch them to applying every event on its own
+func (s *Store) flushInitialLoad(finished ...string) {
+	l := s.initialLoad
+	l.Lock()
+	defer l.Unlock()
+
+	for _, kind := range finished {
+		delete(l.loading, kind)
+	}
+	if len(l.networks) == 0 && len(l.lastReservedIPs) == 0 && len(l.usingIPs) == 0 {
+		return
+	}
+
+	added := s.cache.bulkLoad(l.networks, l.lastReservedIPs, l.usingIPs)
+	l.networks, l.lastReservedIPs, l.usingIPs = nil, nil, nil
+	for _, usingIP := range added {
+		s.broadcastUsingIP(store.AllocationReserved, usingIP)
+	}
+}
@@ -17,43 +17,120 @@
 package kube
 
 import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
 
 	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
 	"github.com/mars1024/kube-ipam/types"
 	"github.com/sirupsen/logrus"
+
+	apitypes "k8s.io/apimachinery/pkg/types"
 )
 
 var LoggerCache = logrus.WithFields(logrus.Fields{"component": "cache"})
 
+// maxUsingIPTombstones bounds the count of deleted using ips remembered by cache
+const maxUsingIPTombstones = 1024
+
 type Cache struct {
 	*sync.RWMutex
 
-	networks        map[string]*types.Network
-	usingIPs        map[string]string
+	networks map[string]*types.Network
+	// networkView holds a copy of networks replaced as a whole on every change, so that
+	// GetNetwork and ListNetworks, the hottest reads of CNI, take no cache lock
+	networkView atomic.Value
+	// usingIPs is keyed by the string form of ips, so that records of
+	// different name encoding schemes resolve to the same entry
+	usingIPs        map[string]*types.UsingIP
 	lastReservedIPs map[string]*types.LastReservedIP
+	// using mirrors the keys of usingIPs, so that IsIPUsing, the hottest read of
+	// allocation, takes no cache lock
+	using *ipSet
+
+	// podIPs indexes using ips by the namespace/name of their pods
+	podIPs map[string]map[string]struct{}
+	// macIPs indexes using ips by the network/mac they are bound to
+	macIPs map[string]string
+	// poolCounts counts using ips by the network/pool they are recorded in
+	poolCounts map[string]int
+	// allocatedCounts counts using ips on allocatable ips of the network/pool they are recorded in,
+	// and allocated maps each of those ips to the key it is counted under
+	allocatedCounts map[string]int
+	allocated       map[string]string
+
+	// provisionalUsingIPs is loaded from a snapshot and only consulted
+	// until informers have synced
+	provisionalUsingIPs map[string]string
+	// provisional is set while provisionalUsingIPs is loaded, accessed atomically
+	provisional int32
+
+	// tombstones remembers deleted using ips by name, so that stale adds
+	// arriving after a delete do not resurrect freed ips
+	tombstones     map[string]tombstone
+	tombstoneOrder []string
+}
+
+// tombstone is the identity of a using ip at its deletion
+type tombstone struct {
+	uid             apitypes.UID
+	resourceVersion uint64
 }
 
 func NewCache() *Cache {
-	return &Cache{
+	c := &Cache{
 		RWMutex:         new(sync.RWMutex),
 		networks:        make(map[string]*types.Network),
-		usingIPs:        make(map[string]string),
+		usingIPs:        make(map[string]*types.UsingIP),
+		using:           newIPSet(),
+		podIPs:          make(map[string]map[string]struct{}),
+		macIPs:          make(map[string]string),
+		poolCounts:      make(map[string]int),
+		allocatedCounts: make(map[string]int),
+		allocated:       make(map[string]string),
 		lastReservedIPs: make(map[string]*types.LastReservedIP),
+		tombstones:      make(map[string]tombstone),
 	}
+	c.networkView.Store(map[string]*types.Network{})
+	return c
 }
 
 func (c *Cache) addNetwork(network *v1.Network) {
 	c.Lock()
 	defer c.Unlock()
 
+	c.putNetwork(network)
+	c.publishNetworks()
+	LoggerCache.Debugf("add network %s %+v to cache", network.Name, network.Spec)
+}
+
+// putNetwork caches network, the lock must be held
+func (c *Cache) putNetwork(network *v1.Network) {
 	net, err := types.GetNetworkFromCRD(network)
 	if err != nil {
-		LoggerCache.Errorf("fail to add network %+v to cache : %s", network, err)
+		LoggerCache.Errorf("add network %s to cache partially : %s", network.Name, err)
 	}
-
 	c.networks[network.Name] = net
-	LoggerCache.Debugf("add network %s %+v to cache", network.Name, network.Spec)
+	c.recountAllocated(network.Name)
+}
+
+// publishNetworks replaces networkView with a copy of networks, cached networks are never
+// modified in place so that they are shared by the copy, the lock must be held
+func (c *Cache) publishNetworks() {
+	view := make(map[string]*types.Network, len(c.networks))
+	for name, network := range c.networks {
+		view[name] = network
+	}
+	c.networkView.Store(view)
+}
+
+// networksView returns the networks published last, which must not be modified
+func (c *Cache) networksView() map[string]*types.Network {
+	return c.networkView.Load().(map[string]*types.Network)
 }
 
 func (c *Cache) updateNetwork(network *v1.Network) {
@@ -62,15 +139,19 @@ func (c *Cache) updateNetwork(network *v1.Network) {
 
 	if network.DeletionTimestamp != nil {
 		delete(c.networks, network.Name)
+		c.recountAllocated(network.Name)
+		c.publishNetworks()
 		return
 	}
 
 	net, err := types.GetNetworkFromCRD(network)
 	if err != nil {
-		LoggerCache.Errorf("fail to update network %+v to cache : %s", network, err)
+		LoggerCache.Errorf("update network %s to cache partially : %s", network.Name, err)
 	}
 
 	c.networks[network.Name] = net
+	c.recountAllocated(network.Name)
+	c.publishNetworks()
 	LoggerCache.Debugf("update network %s %+v to cache", network.Name, network.Spec)
 }
 
@@ -79,42 +160,240 @@ func (c *Cache) deleteNetwork(network *v1.Network) {
 	defer c.Unlock()
 
 	delete(c.networks, network.Name)
+	c.recountAllocated(network.Name)
+	c.publishNetworks()
 	LoggerCache.Debugf("delete network %s %+v from cache", network.Name, network.Spec)
 }
 
-func (c *Cache) addUsingIP(usingIP *v1.UsingIP) {
+// addUsingIP caches usingIP, false is returned if it is stale and skipped
+func (c *Cache) addUsingIP(usingIP *v1.UsingIP) bool {
 	c.Lock()
 	defer c.Unlock()
 
-	c.usingIPs[usingIP.Name] = usingIP.Spec.PodName
+	if !c.putUsingIP(usingIP) {
+		return false
+	}
 	LoggerCache.Debugf("add using ip %s %+v to cache", usingIP.Name, usingIP.Spec)
+	return true
+}
+
+// putUsingIP works like addUsingIP, the lock must be held
+func (c *Cache) putUsingIP(usingIP *v1.UsingIP) bool {
+	if c.isStaleUsingIP(usingIP) {
+		LoggerCache.Debugf("skip stale using ip %s of resource version %s", usingIP.Name, usingIP.ResourceVersion)
+		return false
+	}
+	c.setUsingIP(types.GetUsingIPFromCRD(usingIP))
+	return true
 }
 
-func (c *Cache) updateUsingIP(usingIP *v1.UsingIP) {
+// bulkLoad caches all objects taking the lock once, which is how informers deliver the
+// objects of their initial lists, the using ips which are not stale are returned
+func (c *Cache) bulkLoad(networks []*v1.Network, lastReservedIPs []*v1.LastReservedIP, usingIPs []*v1.UsingIP) []*v1.UsingIP {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, network := range networks {
+		c.putNetwork(network)
+	}
+	c.publishNetworks()
+	for _, lastReservedIP := range lastReservedIPs {
+		c.putLastReservedIP(lastReservedIP)
+	}
+	added := make([]*v1.UsingIP, 0, len(usingIPs))
+	for _, usingIP := range usingIPs {
+		if c.putUsingIP(usingIP) {
+			added = append(added, usingIP)
+		}
+	}
+	LoggerCache.Debugf("bulk load %d networks, %d last reserved ips and %d using ips to cache",
+		len(networks), len(lastReservedIPs), len(added))
+	return added
+}
+
+// updateUsingIP caches usingIP, false is returned if it is being deleted or stale
+func (c *Cache) updateUsingIP(usingIP *v1.UsingIP) bool {
 	c.Lock()
 	defer c.Unlock()
 
 	if usingIP.DeletionTimestamp != nil {
-		delete(c.usingIPs, usingIP.Name)
+		c.removeUsingIP(usingIP.Name)
+		return false
+	}
+	if c.isStaleUsingIP(usingIP) {
+		LoggerCache.Debugf("skip stale using ip %s of resource version %s", usingIP.Name, usingIP.ResourceVersion)
+		return false
 	}
 
-	c.usingIPs[usingIP.Name] = usingIP.Spec.PodName
+	c.setUsingIP(types.GetUsingIPFromCRD(usingIP))
 	LoggerCache.Debugf("update using ip %s %+v to cache", usingIP.Name, usingIP.Spec)
+	return true
 }
 
 func (c *Cache) deleteUsingIP(usingIP *v1.UsingIP) {
 	c.Lock()
 	defer c.Unlock()
 
-	delete(c.usingIPs, usingIP.Name)
+	c.removeUsingIP(usingIP.Name)
+	c.addTombstone(usingIP)
 	LoggerCache.Debugf("delete using ip %s %+v from cache", usingIP.Name, usingIP.Spec)
 }
 
+// addTombstone remembers usingIP as deleted, the oldest tombstone is dropped
+// once there are too many, the lock must be held
+func (c *Cache) addTombstone(usingIP *v1.UsingIP) {
+	resourceVersion, err := strconv.ParseUint(usingIP.ResourceVersion, 10, 64)
+	if len(usingIP.UID) == 0 && err != nil {
+		return
+	}
+	if _, exists := c.tombstones[usingIP.Name]; !exists {
+		c.tombstoneOrder = append(c.tombstoneOrder, usingIP.Name)
+	}
+	c.tombstones[usingIP.Name] = tombstone{uid: usingIP.UID, resourceVersion: resourceVersion}
+
+	if len(c.tombstoneOrder) > maxUsingIPTombstones {
+		delete(c.tombstones, c.tombstoneOrder[0])
+		c.tombstoneOrder = c.tombstoneOrder[1:]
+	}
+}
+
+// isStaleUsingIP checks if usingIP was deleted already, which is the object of a
+// deleted uid or not newer than the deletion, the lock must be held
+func (c *Cache) isStaleUsingIP(usingIP *v1.UsingIP) bool {
+	deleted, exists := c.tombstones[usingIP.Name]
+	if !exists {
+		return false
+	}
+	if len(usingIP.UID) > 0 && usingIP.UID == deleted.uid {
+		return true
+	}
+
+	// resource versions are opaque, the ones not in integer form are not compared
+	resourceVersion, err := strconv.ParseUint(usingIP.ResourceVersion, 10, 64)
+	return err == nil && deleted.resourceVersion > 0 && resourceVersion <= deleted.resourceVersion
+}
+
+// setUsingIP caches usingIP and keeps the pod index in step, the lock must be held
+func (c *Cache) setUsingIP(usingIP *types.UsingIP) {
+	if usingIP.IP == nil {
+		LoggerCache.Errorf("using ip %s has an undecodable name, skip caching it", usingIP.Name)
+		return
+	}
+	ip := usingIP.IP.String()
+	// the ip is never missing from using while its record is replaced
+	c.using.add(ip)
+	c.removeUsingIPByKey(ip)
+
+	c.usingIPs[ip] = usingIP
+	c.poolCounts[poolKey(usingIP.Network, usingIP.Pool)]++
+	c.countAllocated(usingIP)
+	if len(usingIP.MAC) > 0 {
+		c.macIPs[macKey(usingIP.Network, usingIP.MAC)] = ip
+	}
+	if len(usingIP.PodName) == 0 {
+		return
+	}
+	key := podKey(usingIP.PodNamespace, usingIP.PodName)
+	if c.podIPs[key] == nil {
+		c.podIPs[key] = make(map[string]struct{})
+	}
+	c.podIPs[key][ip] = struct{}{}
+}
+
+// removeUsingIP forgets the using ip record with name, an entry of the same ip
+// cached from a record with another name is kept, the lock must be held
+func (c *Cache) removeUsingIP(name string) {
+	addr, err := utils.DecodeName(name)
+	if err != nil {
+		return
+	}
+	if old, exists := c.usingIPs[addr.String()]; exists && old.Name == name {
+		c.removeUsingIPByKey(addr.String())
+		c.using.remove(addr.String())
+	}
+}
+
+// removeUsingIPByKey drops the entry of ip from usingIPs and the indexes, ip is left
+// in using for callers to decide, the lock must be held
+func (c *Cache) removeUsingIPByKey(ip string) {
+	old, exists := c.usingIPs[ip]
+	if !exists {
+		return
+	}
+
+	delete(c.usingIPs, ip)
+	if key := poolKey(old.Network, old.Pool); c.poolCounts[key] > 1 {
+		c.poolCounts[key]--
+	} else {
+		delete(c.poolCounts, key)
+	}
+	c.uncountAllocated(ip)
+	if key := macKey(old.Network, old.MAC); len(old.MAC) > 0 && c.macIPs[key] == ip {
+		delete(c.macIPs, key)
+	}
+	key := podKey(old.PodNamespace, old.PodName)
+	delete(c.podIPs[key], ip)
+	if len(c.podIPs[key]) == 0 {
+		delete(c.podIPs, key)
+	}
+}
+
+// countAllocated counts usingIP under its pool if the ip is allocatable in it, the lock must be held
+func (c *Cache) countAllocated(usingIP *types.UsingIP) {
+	network := c.networks[usingIP.Network]
+	if network == nil {
+		return
+	}
+	if pool := network.GetPool(usingIP.Pool); pool == nil || !pool.IsAllocatable(usingIP.IP) {
+		return
+	}
+	key := poolKey(usingIP.Network, usingIP.Pool)
+	c.allocated[usingIP.IP.String()] = key
+	c.allocatedCounts[key]++
+}
+
+// uncountAllocated undoes countAllocated of the using ip of ip, the lock must be held
+func (c *Cache) uncountAllocated(ip string) {
+	key, counted := c.allocated[ip]
+	if !counted {
+		return
+	}
+	delete(c.allocated, ip)
+	if c.allocatedCounts[key] > 1 {
+		c.allocatedCounts[key]--
+	} else {
+		delete(c.allocatedCounts, key)
+	}
+}
+
+// recountAllocated counts the using ips of network again after its pools change, which scans
+// using ips but only happens on network changes, the lock must be held
+func (c *Cache) recountAllocated(networkName string) {
+	for _, usingIP := range c.usingIPs {
+		if usingIP.Network == networkName {
+			c.uncountAllocated(usingIP.IP.String())
+			c.countAllocated(usingIP)
+		}
+	}
+}
+
+func podKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
+func macKey(network, mac string) string {
+	return network + "/" + mac
+}
+
+func poolKey(network, pool string) string {
+	return network + "/" + pool
+}
+
 func (c *Cache) addLastReservedIP(lastReservedIP *v1.LastReservedIP) {
 	c.Lock()
 	defer c.Unlock()
 
-	c.lastReservedIPs[lastReservedIP.Name] = types.GetLastReservedIPFromCRD(lastReservedIP)
+	c.putLastReservedIP(lastReservedIP)
 	LoggerCache.Debugf("add last reserved ip %s %+v to cache", lastReservedIP.Name, lastReservedIP.Spec)
 }
 
@@ -127,10 +406,22 @@ func (c *Cache) updateLastReservedIP(lastReservedIP *v1.LastReservedIP) {
 		return
 	}
 
-	c.lastReservedIPs[lastReservedIP.Name] = types.GetLastReservedIPFromCRD(lastReservedIP)
+	c.putLastReservedIP(lastReservedIP)
 	LoggerCache.Debugf("update last reserved ip %s %+v to cache", lastReservedIP.Name, lastReservedIP.Spec)
 }
 
+// putLastReservedIP caches lastReservedIP, a malformed record is dropped from cache rather than
+// cached with nil cursors, so that allocation starts over instead of failing, the lock must be held
+func (c *Cache) putLastReservedIP(lastReservedIP *v1.LastReservedIP) {
+	lri, err := types.GetLastReservedIPFromCRD(lastReservedIP)
+	if err != nil {
+		LoggerCache.Errorf("skip caching invalid last reserved ip: %v", err)
+		delete(c.lastReservedIPs, lastReservedIP.Name)
+		return
+	}
+	c.lastReservedIPs[lastReservedIP.Name] = lri
+}
+
 func (c *Cache) deleteLastReservedIP(lastReservedIP *v1.LastReservedIP) {
 	c.Lock()
 	defer c.Unlock()
@@ -140,14 +431,45 @@ func (c *Cache) deleteLastReservedIP(lastReservedIP *v1.LastReservedIP) {
 }
 
 func (c *Cache) GetNetwork(networkName string) *types.Network {
+	if network, exists := c.networksView()[networkName]; exists {
+		return network.DeepCopy()
+	}
+	return nil
+}
+
+// SnapshotNetwork captures a copy of network along with the using ips of it
+// under a single read lock, nil if network is not in cache
+func (c *Cache) SnapshotNetwork(networkName string) *types.NetworkSnapshot {
 	c.RLock()
 	defer c.RUnlock()
 
-	if network, exists := c.networks[networkName]; exists {
-		// TODO: DeepCopy
-		return network
+	network, exists := c.networks[networkName]
+	if !exists {
+		return nil
 	}
-	return nil
+	snapshot := &types.NetworkSnapshot{
+		Network: network.DeepCopy(),
+		Used:    make(map[string]struct{}),
+	}
+	for ip, usingIP := range c.usingIPs {
+		if usingIP.Network == networkName {
+			snapshot.Used[ip] = struct{}{}
+		}
+	}
+	return snapshot
+}
+
+// ListNetworks returns copies of all networks sorted by name
+func (c *Cache) ListNetworks() []*types.Network {
+	view := c.networksView()
+	networks := make([]*types.Network, 0, len(view))
+	for _, network := range view {
+		networks = append(networks, network.DeepCopy())
+	}
+	sort.Slice(networks, func(i, j int) bool {
+		return networks[i].Name < networks[j].Name
+	})
+	return networks
 }
 
 func (c *Cache) GetLastReservedIP(networkName string) *types.LastReservedIP {
@@ -155,18 +477,153 @@ func (c *Cache) GetLastReservedIP(networkName string) *types.LastReservedIP {
 	defer c.RUnlock()
 
 	if lastReservedIP, exists := c.lastReservedIPs[networkName]; exists {
-		// TODO: DeepCopy
-		return lastReservedIP
+		return lastReservedIP.DeepCopy()
 	}
 	return nil
 }
 
-func (c *Cache) IsIPUsing(ip string) bool {
+// ListLastReservedIPs returns copies of all last reserved ips keyed by network name
+func (c *Cache) ListLastReservedIPs() map[string]*types.LastReservedIP {
 	c.RLock()
 	defer c.RUnlock()
 
-	if _, exists := c.usingIPs[ip]; exists {
+	lris := make(map[string]*types.LastReservedIP, len(c.lastReservedIPs))
+	for network, lri := range c.lastReservedIPs {
+		lris[network] = lri.DeepCopy()
+	}
+	return lris
+}
+
+// GetUsingIP returns a copy of the using ip, ip is in string form
+func (c *Cache) GetUsingIP(ip string) *types.UsingIP {
+	c.RLock()
+	defer c.RUnlock()
+
+	if usingIP, exists := c.usingIPs[ip]; exists {
+		return usingIP.DeepCopy()
+	}
+	return nil
+}
+
+// GetUsingIPByMAC returns a copy of the using ip of network bound to mac
+func (c *Cache) GetUsingIPByMAC(network, mac string) *types.UsingIP {
+	c.RLock()
+	defer c.RUnlock()
+
+	if ip, exists := c.macIPs[macKey(network, mac)]; exists {
+		return c.usingIPs[ip].DeepCopy()
+	}
+	return nil
+}
+
+// IPsForPod returns all ips reserved by a pod sorted
+func (c *Cache) IPsForPod(namespace, name string) []net.IP {
+	c.RLock()
+	defer c.RUnlock()
+
+	ips := make([]net.IP, 0, len(c.podIPs[podKey(namespace, name)]))
+	for ip := range c.podIPs[podKey(namespace, name)] {
+		ips = append(ips, append(net.IP(nil), c.usingIPs[ip].IP...))
+	}
+	sort.Slice(ips, func(i, j int) bool {
+		return bytes.Compare(ips[i].To16(), ips[j].To16()) < 0
+	})
+	return ips
+}
+
+// IsIPUsing checks if ip in string form is used
+func (c *Cache) IsIPUsing(ip string) bool {
+	if c.using.has(ip) {
 		return true
 	}
-	return false
+	if atomic.LoadInt32(&c.provisional) == 0 {
+		return false
+	}
+
+	c.RLock()
+	defer c.RUnlock()
+	_, exists := c.provisionalUsingIPs[ip]
+	return exists
+}
+
+// CountUsingIPs returns the count of using ips which fall inside pool
+func (c *Cache) CountUsingIPs(pool *types.Pool) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	count := 0
+	for _, usingIP := range c.usingIPs {
+		if pool.Contains(usingIP.IP) {
+			count++
+		}
+	}
+	return count
+}
+
+// UsedCount returns the count of using ips recorded in pool of network, unlike CountUsingIPs
+// it takes no scan, records are counted by the pools they name rather than the ranges they fall in
+func (c *Cache) UsedCount(networkName, poolName string) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.poolCounts[poolKey(networkName, poolName)]
+}
+
+// AllocatedCount returns the count of using ips recorded in pool of network which are allocatable
+// in it, unlike UsedCount it leaves out records on gateways or ips reserved by policy, it takes no
+// scan either as the count is kept in step with using ips and pools
+func (c *Cache) AllocatedCount(networkName, poolName string) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.allocatedCounts[poolKey(networkName, poolName)]
+}
+
+// CountUsingIPsOfNetwork returns the count of using ips referencing network
+func (c *Cache) CountUsingIPsOfNetwork(networkName string) int {
+	c.RLock()
+	defer c.RUnlock()
+
+	count := 0
+	for _, usingIP := range c.usingIPs {
+		if usingIP.Network == networkName {
+			count++
+		}
+	}
+	return count
+}
+
+// usingIPKeys returns the keys of all using ips sorted by ip, which is far smaller
+// than copies of the using ips for walking a large cache
+func (c *Cache) usingIPKeys() []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	usingIPs := make([]*types.UsingIP, 0, len(c.usingIPs))
+	for _, usingIP := range c.usingIPs {
+		usingIPs = append(usingIPs, usingIP)
+	}
+	sort.Slice(usingIPs, func(i, j int) bool {
+		return bytes.Compare(usingIPs[i].IP.To16(), usingIPs[j].IP.To16()) < 0
+	})
+	keys := make([]string, 0, len(usingIPs))
+	for _, usingIP := range usingIPs {
+		keys = append(keys, usingIP.IP.String())
+	}
+	return keys
+}
+
+// ListUsingIPs returns copies of all using ips sorted by ip
+func (c *Cache) ListUsingIPs() []*types.UsingIP {
+	c.RLock()
+	defer c.RUnlock()
+
+	usingIPs := make([]*types.UsingIP, 0, len(c.usingIPs))
+	for _, usingIP := range c.usingIPs {
+		usingIPs = append(usingIPs, usingIP.DeepCopy())
+	}
+	sort.Slice(usingIPs, func(i, j int) bool {
+		return bytes.Compare(usingIPs[i].IP.To16(), usingIPs[j].IP.To16()) < 0
+	})
+	return usingIPs
 }
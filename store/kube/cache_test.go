@@ -0,0 +1,561 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	apitypes "k8s.io/apimachinery/pkg/types"
+)
+
+func newUsingIP(name, podName string) *v1.UsingIP {
+	return &v1.UsingIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.UsingIPSpec{
+			PodName: podName,
+		},
+	}
+}
+
+func TestCache_Snapshot(t *testing.T) {
+	c := NewCache()
+	c.addUsingIP(newUsingIP("192-168-0-10", "pod1"))
+	c.addUsingIP(newUsingIP("192-168-0-11", "pod2"))
+
+	buf := &bytes.Buffer{}
+	if err := c.SaveSnapshot(buf); err != nil {
+		t.Fatalf("fail to save snapshot: %v", err)
+	}
+
+	// a fresh cache has not synced any using ip yet
+	provisional := NewCache()
+	if err := provisional.LoadSnapshot(buf); err != nil {
+		t.Fatalf("fail to load snapshot: %v", err)
+	}
+
+	tests := map[string]bool{
+		"192.168.0.10": true,
+		"192.168.0.11": true,
+		"192.168.0.12": false,
+	}
+	for ip, using := range tests {
+		if provisional.IsIPUsing(ip) != using {
+			t.Errorf("provisional cache expects ip %s using %v", ip, using)
+		}
+	}
+
+	// provisional ips are forgotten after caches have synced
+	provisional.addUsingIP(newUsingIP("192-168-0-11", "pod2"))
+	provisional.dropProvisional()
+	if provisional.IsIPUsing("192.168.0.10") {
+		t.Errorf("ip 192-168-0-10 should be dropped after sync")
+	}
+	if !provisional.IsIPUsing("192.168.0.11") {
+		t.Errorf("ip 192-168-0-11 should still be using after sync")
+	}
+}
+
+func TestCache_LoadSnapshotInvalid(t *testing.T) {
+	tests := []string{
+		"",
+		"not json",
+		`{"version":100,"usingIPs":{}}`,
+	}
+
+	for _, test := range tests {
+		if err := NewCache().LoadSnapshot(bytes.NewBufferString(test)); err == nil {
+			t.Errorf("invalid snapshot %q should not be loaded", test)
+		}
+	}
+}
+
+func TestCache_AddNetworkWithMalformedPool(t *testing.T) {
+	c := NewCache()
+	c.addNetwork(&v1.Network{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "network",
+		},
+		Spec: v1.NetworkSpec{
+			Pools: []v1.Pool{
+				{
+					Name:    "good",
+					Gateway: "192.168.0.1",
+					Subnet:  "192.168.0.0/24",
+				},
+				{
+					Name:    "malformed",
+					Gateway: "not an ip",
+					Subnet:  "192.168.1.0/24",
+				},
+			},
+		},
+	})
+
+	network := c.GetNetwork("network")
+	if network == nil || len(network.Pools) != 1 || network.Pools[0].Name != "good" {
+		t.Errorf("expected the good pool to be cached but got %+v", network)
+	}
+}
+
+func TestCache_MalformedLastReservedIP(t *testing.T) {
+	c := NewCache()
+	newLastReservedIP := func(ip string) *v1.LastReservedIP {
+		return &v1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: "network"},
+			Spec:       v1.LastReservedIPSpec{IP: ip, PoolName: "pool"},
+		}
+	}
+
+	c.addLastReservedIP(newLastReservedIP("not an ip"))
+	if lri := c.GetLastReservedIP("network"); lri != nil {
+		t.Errorf("malformed record should not be cached but got %+v", lri)
+	}
+	c.updateLastReservedIP(newLastReservedIP("192.168.0.10"))
+	if lri := c.GetLastReservedIP("network"); lri == nil || !lri.ForPool("pool").Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("valid record should be cached but got %+v", lri)
+	}
+	c.updateLastReservedIP(newLastReservedIP("192.168.0.300"))
+	if lri := c.GetLastReservedIP("network"); lri != nil {
+		t.Errorf("record turning malformed should be dropped but got %+v", lri)
+	}
+}
+
+func TestCache_IPsForPod(t *testing.T) {
+	c := NewCache()
+	newPodIP := func(name, namespace, pod string) *v1.UsingIP {
+		usingIP := newUsingIP(name, pod)
+		usingIP.Spec.PodNamespace = namespace
+		return usingIP
+	}
+
+	c.addUsingIP(newPodIP("192-168-0-11", "default", "pod1"))
+	c.addUsingIP(newPodIP("192-168-0-10", "default", "pod1"))
+	c.addUsingIP(newPodIP("192-168-0-12", "default", "pod2"))
+	c.addUsingIP(newPodIP("192-168-0-13", "other", "pod1"))
+
+	ips := c.IPsForPod("default", "pod1")
+	if len(ips) != 2 || !ips[0].Equal(net.ParseIP("192.168.0.10")) || !ips[1].Equal(net.ParseIP("192.168.0.11")) {
+		t.Errorf("unexpected ips of default/pod1: %v", ips)
+	}
+
+	// re-owned ip leaves the index of its former pod
+	c.updateUsingIP(newPodIP("192-168-0-11", "default", "pod2"))
+	if ips = c.IPsForPod("default", "pod2"); len(ips) != 2 {
+		t.Errorf("unexpected ips of default/pod2: %v", ips)
+	}
+
+	c.deleteUsingIP(newPodIP("192-168-0-10", "default", "pod1"))
+	if ips = c.IPsForPod("default", "pod1"); len(ips) != 0 {
+		t.Errorf("index of default/pod1 should be cleaned up but got %v", ips)
+	}
+	if len(c.podIPs) != 2 {
+		t.Errorf("index should only have 2 pods but got %d", len(c.podIPs))
+	}
+}
+
+func TestCache_UsedCount(t *testing.T) {
+	c := NewCache()
+	newPoolIP := func(name, network, pool string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.Network = network
+		usingIP.Spec.Pool = pool
+		usingIP.UID = apitypes.UID(name)
+		usingIP.ResourceVersion = "1"
+		return usingIP
+	}
+	expectCounts := func(step string, expected map[string]int) {
+		for key, count := range expected {
+			parts := strings.SplitN(key, "/", 2)
+			if used := c.UsedCount(parts[0], parts[1]); used != count {
+				t.Errorf("%s: expected %d using ips of %s but got %d", step, count, key, used)
+			}
+		}
+	}
+
+	c.addUsingIP(newPoolIP("192-168-0-10", "network", "a"))
+	c.addUsingIP(newPoolIP("192-168-0-11", "network", "a"))
+	c.addUsingIP(newPoolIP("192-168-0-12", "network", "b"))
+	c.addUsingIP(newPoolIP("192-168-0-13", "other", "a"))
+	expectCounts("add", map[string]int{"network/a": 2, "network/b": 1, "other/a": 1, "network/c": 0})
+
+	// updates of the same pool are not counted twice, moves shift the counts
+	c.updateUsingIP(newPoolIP("192-168-0-10", "network", "a"))
+	c.updateUsingIP(newPoolIP("192-168-0-11", "network", "b"))
+	expectCounts("update", map[string]int{"network/a": 1, "network/b": 2, "other/a": 1})
+
+	c.deleteUsingIP(newPoolIP("192-168-0-12", "network", "b"))
+	c.deleteUsingIP(newPoolIP("192-168-0-12", "network", "b"))
+	expectCounts("delete", map[string]int{"network/a": 1, "network/b": 1, "other/a": 1})
+
+	// a stale add after the delete is skipped by tombstone
+	c.addUsingIP(newPoolIP("192-168-0-12", "network", "b"))
+	expectCounts("stale add", map[string]int{"network/b": 1})
+
+	terminating := newPoolIP("192-168-0-13", "other", "a")
+	terminating.DeletionTimestamp = &metav1.Time{}
+	c.updateUsingIP(terminating)
+	expectCounts("terminating", map[string]int{"other/a": 0})
+	if len(c.poolCounts) != 2 {
+		t.Errorf("empty counts should be cleaned up but got %v", c.poolCounts)
+	}
+}
+
+func TestCache_AllocatedCount(t *testing.T) {
+	c := NewCache()
+	newPoolIP := func(name string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.Network, usingIP.Spec.Pool = "network", "pool"
+		return usingIP
+	}
+
+	// records cached before their network are counted once it arrives
+	c.addUsingIP(newPoolIP("192-168-0-10"))
+	if count := c.AllocatedCount("network", "pool"); count != 0 {
+		t.Errorf("expected nothing counted without network but got %d", count)
+	}
+	c.addNetwork(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	// the gateway is in use but never allocatable
+	c.addUsingIP(newPoolIP("192-168-0-1"))
+	c.addUsingIP(newPoolIP("192-168-0-11"))
+	if count := c.AllocatedCount("network", "pool"); count != 2 {
+		t.Errorf("expected 2 allocated ips but got %d", count)
+	}
+
+	// narrowing the pool leaves 192.168.0.11 out of its range
+	c.updateNetwork(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.10")))
+	if count := c.AllocatedCount("network", "pool"); count != 1 {
+		t.Errorf("expected 1 allocated ip after narrowing but got %d", count)
+	}
+	c.deleteUsingIP(newPoolIP("192-168-0-10"))
+	c.deleteUsingIP(newPoolIP("192-168-0-11"))
+	if count := c.AllocatedCount("network", "pool"); count != 0 || len(c.allocated) != 0 {
+		t.Errorf("expected nothing counted after deletes but got %d %v", count, c.allocated)
+	}
+}
+
+func TestCache_SnapshotNetwork(t *testing.T) {
+	c := NewCache()
+	narrow := newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20"))
+	wide := newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30"))
+	c.addNetwork(narrow)
+	usingIP := newUsingIP("192-168-0-25", "pod")
+	usingIP.Spec.Network = "network"
+
+	// the writer only uses 192.168.0.25 while the pool is wide enough to contain it
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			c.updateNetwork(wide)
+			c.addUsingIP(usingIP)
+			c.deleteUsingIP(usingIP)
+			c.updateNetwork(narrow)
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		snapshot := c.SnapshotNetwork("network")
+		for ip := range snapshot.Used {
+			if _, found := snapshot.Network.FindPoolForIP(net.ParseIP(ip)); !found {
+				t.Fatalf("used ip %s is out of pools %+v of the same snapshot", ip, snapshot.Network.Pools[0])
+			}
+		}
+	}
+	close(stopCh)
+	<-done
+
+	if c.SnapshotNetwork("missing") != nil {
+		t.Errorf("snapshot of a missing network should be nil")
+	}
+}
+
+func TestCache_StaleAddAfterDelete(t *testing.T) {
+	c := NewCache()
+	newVersionedIP := func(uid, resourceVersion string) *v1.UsingIP {
+		usingIP := newUsingIP("192-168-0-10", "pod")
+		usingIP.UID = apitypes.UID(uid)
+		usingIP.ResourceVersion = resourceVersion
+		return usingIP
+	}
+
+	c.addUsingIP(newVersionedIP("uid-1", "5"))
+	c.deleteUsingIP(newVersionedIP("uid-1", "6"))
+
+	tests := []struct {
+		name    string
+		usingIP *v1.UsingIP
+		using   bool
+	}{
+		{"older resource version", newVersionedIP("uid-1", "5"), false},
+		{"deleted uid", newVersionedIP("uid-1", "7"), false},
+		{"older resource version of another uid", newVersionedIP("uid-0", "4"), false},
+		{"re-created", newVersionedIP("uid-2", "8"), true},
+	}
+	for _, test := range tests {
+		c.addUsingIP(test.usingIP)
+		if using := c.IsIPUsing("192.168.0.10"); using != test.using {
+			t.Errorf("test %s fails: expected using %v but got %v", test.name, test.using, using)
+		}
+	}
+}
+
+// newInitialObjects returns objects like the initial lists of informers, with a stale using ip
+// remembered by tombstone in cache
+func newInitialObjects(count int) ([]*v1.Network, []*v1.LastReservedIP, []*v1.UsingIP) {
+	pool := newTestPool("pool", "10.0.0.2", "10.0.255.254")
+	pool.Gateway, pool.Subnet = "10.0.0.1", "10.0.0.0/16"
+	networks := []*v1.Network{newNetwork("network", pool)}
+	lastReservedIPs := []*v1.LastReservedIP{{
+		ObjectMeta: metav1.ObjectMeta{Name: "network"},
+		Spec:       v1.LastReservedIPSpec{Network: "network"},
+	}}
+	usingIPs := make([]*v1.UsingIP, 0, count)
+	for i := 0; i < count; i++ {
+		usingIP := newUsingIP(fmt.Sprintf("10-0-%d-%d", i/250, i%250+1), fmt.Sprintf("pod%d", i%(count/2+1)))
+		usingIP.Spec.Network = "network"
+		if i%3 == 0 {
+			usingIP.Spec.MAC = fmt.Sprintf("02:00:00:00:%02x:%02x", i/256, i%256)
+		}
+		usingIPs = append(usingIPs, usingIP)
+	}
+	return networks, lastReservedIPs, usingIPs
+}
+
+func TestCache_BulkLoad(t *testing.T) {
+	networks, lastReservedIPs, usingIPs := newInitialObjects(100)
+	stale := usingIPs[0].DeepCopy()
+	stale.UID = "deleted"
+
+	perEvent, bulk := NewCache(), NewCache()
+	for _, c := range []*Cache{perEvent, bulk} {
+		c.deleteUsingIP(stale)
+	}
+	usingIPs = append(usingIPs, stale)
+
+	for _, network := range networks {
+		perEvent.addNetwork(network)
+	}
+	for _, lastReservedIP := range lastReservedIPs {
+		perEvent.addLastReservedIP(lastReservedIP)
+	}
+	expectedAdded := 0
+	for _, usingIP := range usingIPs {
+		if perEvent.addUsingIP(usingIP) {
+			expectedAdded++
+		}
+	}
+	if added := bulk.bulkLoad(networks, lastReservedIPs, usingIPs); len(added) != expectedAdded {
+		t.Errorf("expected %d using ips added but got %d", expectedAdded, len(added))
+	}
+
+	if !reflect.DeepEqual(perEvent.networks, bulk.networks) {
+		t.Errorf("networks differ: %+v %+v", perEvent.networks, bulk.networks)
+	}
+	if !reflect.DeepEqual(perEvent.lastReservedIPs, bulk.lastReservedIPs) {
+		t.Errorf("last reserved ips differ: %+v %+v", perEvent.lastReservedIPs, bulk.lastReservedIPs)
+	}
+	if !reflect.DeepEqual(perEvent.usingIPs, bulk.usingIPs) {
+		t.Errorf("using ips differ: %d %d", len(perEvent.usingIPs), len(bulk.usingIPs))
+	}
+	if !reflect.DeepEqual(perEvent.podIPs, bulk.podIPs) || !reflect.DeepEqual(perEvent.macIPs, bulk.macIPs) {
+		t.Errorf("indexes differ: %+v %+v", perEvent.podIPs, bulk.podIPs)
+	}
+	for ip := range perEvent.usingIPs {
+		if !bulk.IsIPUsing(ip) {
+			t.Errorf("ip %s should be using after bulk load", ip)
+		}
+	}
+}
+
+func benchmarkCacheLoad(b *testing.B, load func(c *Cache, networks []*v1.Network, lastReservedIPs []*v1.LastReservedIP, usingIPs []*v1.UsingIP)) {
+	networks, lastReservedIPs, usingIPs := newInitialObjects(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c := NewCache()
+		// readers contend for the lock like allocations racing the initial sync
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					c.GetNetwork("network")
+				}
+			}
+		}()
+		load(c, networks, lastReservedIPs, usingIPs)
+		close(stop)
+	}
+}
+
+func BenchmarkCache_LoadPerEvent(b *testing.B) {
+	benchmarkCacheLoad(b, func(c *Cache, networks []*v1.Network, lastReservedIPs []*v1.LastReservedIP, usingIPs []*v1.UsingIP) {
+		for _, network := range networks {
+			c.addNetwork(network)
+		}
+		for _, lastReservedIP := range lastReservedIPs {
+			c.addLastReservedIP(lastReservedIP)
+		}
+		for _, usingIP := range usingIPs {
+			c.addUsingIP(usingIP)
+		}
+	})
+}
+
+func BenchmarkCache_BulkLoad(b *testing.B) {
+	benchmarkCacheLoad(b, func(c *Cache, networks []*v1.Network, lastReservedIPs []*v1.LastReservedIP, usingIPs []*v1.UsingIP) {
+		c.bulkLoad(networks, lastReservedIPs, usingIPs)
+	})
+}
+
+func TestCache_GetNetworkConsistent(t *testing.T) {
+	c := NewCache()
+	narrow := newNetwork("network", newTestPool("a", "192.168.0.10", "192.168.0.20"))
+	narrow.Spec.DefaultPool = "a"
+	wide := newNetwork("network",
+		newTestPool("a", "192.168.0.10", "192.168.0.20"),
+		newTestPool("b", "192.168.0.30", "192.168.0.40"))
+	wide.Spec.DefaultPool = "b"
+	c.addNetwork(narrow)
+
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			c.updateNetwork(wide)
+			c.updateNetwork(narrow)
+		}
+	}()
+	// using ips keep the cache lock busy, which readers of networks do not wait for
+	go func() {
+		defer wg.Done()
+		usingIP := newUsingIP("192-168-0-10", "pod")
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			c.addUsingIP(usingIP)
+			c.removeUsingIPLocked(usingIP.Name)
+		}
+	}()
+
+	for i := 0; i < 10000; i++ {
+		network := c.GetNetwork("network")
+		if network == nil || network.GetPool(network.DefaultPool) == nil {
+			t.Fatalf("inconsistent network %+v", network)
+		}
+		// copies are handed out, which never leak into cache
+		network.DefaultPool = "mutated"
+		if networks := c.ListNetworks(); len(networks) != 1 || networks[0].DefaultPool == "mutated" {
+			t.Fatalf("unexpected networks %+v", networks)
+		}
+	}
+	close(stopCh)
+	wg.Wait()
+
+	c.deleteNetwork(narrow)
+	if c.GetNetwork("network") != nil || len(c.ListNetworks()) != 0 {
+		t.Errorf("deleted network should be gone")
+	}
+}
+
+// removeUsingIPLocked is removeUsingIP taking the lock
+func (c *Cache) removeUsingIPLocked(name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.removeUsingIP(name)
+}
+
+// lockedGetNetwork is how cache read networks before networkView, kept as the reference
+func (c *Cache) lockedGetNetwork(networkName string) *types.Network {
+	c.RLock()
+	defer c.RUnlock()
+
+	if network, exists := c.networks[networkName]; exists {
+		return network.DeepCopy()
+	}
+	return nil
+}
+
+// benchmarkGetNetwork reads a network from all goroutines while using ips are written
+// in the background, like CNI reads networks while pods come and go
+func benchmarkGetNetwork(b *testing.B, get func(c *Cache, name string) *types.Network) {
+	c := NewCache()
+	c.addNetwork(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		usingIP := newUsingIP("192-168-0-10", "pod")
+		for {
+			select {
+			case <-stopCh:
+				return
+			default:
+			}
+			c.addUsingIP(usingIP)
+			c.removeUsingIPLocked(usingIP.Name)
+		}
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if get(c, "network") == nil {
+				b.Fatal("network is missing")
+			}
+		}
+	})
+	b.StopTimer()
+	close(stopCh)
+	<-done
+}
+
+func BenchmarkCache_GetNetwork(b *testing.B) {
+	benchmarkGetNetwork(b, (*Cache).GetNetwork)
+}
+
+func BenchmarkCache_GetNetworkLocked(b *testing.B) {
+	benchmarkGetNetwork(b, (*Cache).lockedGetNetwork)
+}
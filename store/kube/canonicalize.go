@@ -0,0 +1,83 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RecanonicalizeNetwork rewrites every pool of network in the form Canonicalize derives now,
+// e.g. filling start and end missing from records written before the rules changed. Pools
+// which fail to canonicalize, or whose canonical range leaves out live using ips of them,
+// are kept as is and reported together as an ErrorList after the others are written
+func (s *Store) RecanonicalizeNetwork(name string) error {
+	defer s.networkLocks.LockKey(name)()
+
+	network, err := s.resourceClient.ResourceV1().Networks().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("fail to get network %s: %v", name, err)
+	}
+
+	usingIPs := s.cache.ListUsingIPs()
+	networkClone := network.DeepCopy()
+	skipped := types.ErrorList{}
+	changed := false
+	for i, crd := range networkClone.Spec.Pools {
+		pool, err := types.PoolFromCRD(crd)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("pool %s is skipped: %v", crd.Name, err))
+			continue
+		}
+		canonical := pool.ToCRD()
+		if reflect.DeepEqual(canonical, crd) {
+			continue
+		}
+
+		// the records of pool are checked instead of those in its range, which is the question
+		var dropped []string
+		for _, usingIP := range usingIPs {
+			if usingIP.Network == name && usingIP.Pool == pool.Name && !pool.Contains(usingIP.IP) {
+				dropped = append(dropped, usingIP.IP.String())
+			}
+		}
+		if len(dropped) > 0 {
+			sort.Strings(dropped)
+			skipped = append(skipped, fmt.Errorf("pool %s is skipped: canonical range %s-%s drops live using ips %s",
+				pool.Name, pool.PoolStart, pool.PoolEnd, strings.Join(dropped, ", ")))
+			continue
+		}
+		networkClone.Spec.Pools[i] = canonical
+		changed = true
+	}
+	for _, err := range skipped {
+		LoggerStore.Warnf("recanonicalizing network %s: %v", name, err)
+	}
+
+	if changed && !s.dryRun {
+		if _, err := s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+			return fmt.Errorf("fail to update network %s: %v", name, err)
+		}
+	}
+	return skipped.ToError()
+}
@@ -0,0 +1,67 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"strings"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_RecanonicalizeNetwork(t *testing.T) {
+	missing := v1.Pool{Name: "missing", Gateway: "192.168.0.1", Subnet: "192.168.0.0/24"}
+	violating := v1.Pool{Name: "violating", PoolEnd: "192.168.1.100", Gateway: "192.168.1.1", Subnet: "192.168.1.0/24"}
+	canonical := v1.Pool{Name: "canonical", PoolStart: "192.168.2.10", PoolEnd: "192.168.2.20", Gateway: "192.168.2.1", Subnet: "192.168.2.0/24"}
+	// a live allocation of violating lies beyond the end it has now
+	usingIP := newUsingIP("192-168-1-200", "pod")
+	usingIP.Spec.PodNamespace, usingIP.Spec.Network, usingIP.Spec.Pool = "default", "network", "violating"
+	s, stop := newTestStore(t, newNetwork("network", missing, violating, canonical), usingIP)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.1.200")
+	})
+
+	err := s.RecanonicalizeNetwork("network")
+	errs, ok := err.(types.ErrorList)
+	if !ok || len(errs) != 1 || !strings.Contains(err.Error(), "pool violating is skipped") ||
+		!strings.Contains(err.Error(), "192.168.1.200") {
+		t.Fatalf("expected violating pool to be reported but got %v", err)
+	}
+
+	network, err := s.resourceClient.ResourceV1().Networks().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get network: %v", err)
+	}
+	expected := map[string][2]string{
+		"missing":   {"192.168.0.1", "192.168.0.254"},
+		"violating": {"", "192.168.1.100"},
+		"canonical": {"192.168.2.10", "192.168.2.20"},
+	}
+	for _, pool := range network.Spec.Pools {
+		if ends := expected[pool.Name]; pool.PoolStart != ends[0] || pool.PoolEnd != ends[1] {
+			t.Errorf("expected pool %s in %s-%s but got %s-%s", pool.Name, ends[0], ends[1], pool.PoolStart, pool.PoolEnd)
+		}
+	}
+
+	if err := s.RecanonicalizeNetwork("missing"); err == nil {
+		t.Errorf("recanonicalizing a missing network should fail")
+	}
+}
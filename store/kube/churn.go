@@ -0,0 +1,103 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+// defaultChurnHistory is the count of latest reservations and releases kept for churn rates
+const defaultChurnHistory = 4096
+
+type churnEvent struct {
+	time    time.Time
+	release bool
+}
+
+// churnRecorder keeps the times of the latest reservations and releases in a ring buffer, it sits
+// in front of the audit sink of store, which sees every reservation and release made by store
+type churnRecorder struct {
+	store.AuditSink
+
+	sync.Mutex
+	ring []churnEvent
+	next int
+	full bool
+}
+
+func newChurnRecorder(size int, sink store.AuditSink) *churnRecorder {
+	return &churnRecorder{
+		AuditSink: sink,
+		ring:      make([]churnEvent, size),
+	}
+}
+
+func (r *churnRecorder) RecordReserve(entry *store.AuditEntry) {
+	r.record(churnEvent{time: entry.Time})
+	r.AuditSink.RecordReserve(entry)
+}
+
+func (r *churnRecorder) RecordRelease(entry *store.AuditEntry) {
+	r.record(churnEvent{time: entry.Time, release: true})
+	r.AuditSink.RecordRelease(entry)
+}
+
+func (r *churnRecorder) record(event churnEvent) {
+	r.Lock()
+	defer r.Unlock()
+
+	if len(r.ring) == 0 {
+		return
+	}
+	r.ring[r.next] = event
+	r.next = (r.next + 1) % len(r.ring)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// count returns the reservations and releases recorded after since
+func (r *churnRecorder) count(since time.Time) (reserves, releases int) {
+	r.Lock()
+	defer r.Unlock()
+
+	events := r.ring[:r.next]
+	if r.full {
+		events = r.ring
+	}
+	for _, event := range events {
+		if !event.time.After(since) {
+			continue
+		}
+		if event.release {
+			releases++
+		} else {
+			reserves++
+		}
+	}
+	return reserves, releases
+}
+
+// ChurnRate returns the counts of reservations and releases made by store within the latest
+// window, which tells thrashing workloads apart, only the latest defaultChurnHistory of them
+// are kept so that the counts of long windows on busy stores are lower bounds
+func (s *Store) ChurnRate(window time.Duration) (reserves, releases int) {
+	return s.churn.count(time.Now().Add(-window))
+}
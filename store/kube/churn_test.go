@@ -0,0 +1,76 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+func TestChurnRecorder(t *testing.T) {
+	r := newChurnRecorder(4, store.NopAuditSink{})
+	now := time.Now()
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(-10 * time.Minute)})
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(-3 * time.Minute)})
+	r.RecordRelease(&store.AuditEntry{Time: now.Add(-2 * time.Minute)})
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(-30 * time.Second)})
+
+	tests := []struct {
+		since    time.Duration
+		reserves int
+		releases int
+	}{
+		{time.Minute, 1, 0},
+		{5 * time.Minute, 2, 1},
+		{time.Hour, 3, 1},
+	}
+	for _, test := range tests {
+		if reserves, releases := r.count(now.Add(-test.since)); reserves != test.reserves || releases != test.releases {
+			t.Errorf("window %s expects %d reserves %d releases but got %d %d",
+				test.since, test.reserves, test.releases, reserves, releases)
+		}
+	}
+
+	// the oldest event is overwritten once the ring is full
+	r.RecordRelease(&store.AuditEntry{Time: now})
+	if reserves, releases := r.count(now.Add(-time.Hour)); reserves != 2 || releases != 2 {
+		t.Errorf("expected 2 reserves 2 releases kept but got %d %d", reserves, releases)
+	}
+}
+
+func TestStore_ChurnRate(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	for i := 0; i < 3; i++ {
+		ip, err := s.Allocate("network", "pool", "default", "pod")
+		if err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		if i < 2 {
+			if err := s.Release(ip); err != nil {
+				t.Fatalf("fail to release: %v", err)
+			}
+		}
+	}
+	if reserves, releases := s.ChurnRate(time.Minute); reserves != 3 || releases != 2 {
+		t.Errorf("expected 3 reserves 2 releases but got %d %d", reserves, releases)
+	}
+}
@@ -0,0 +1,114 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"sync"
+)
+
+// cursorBuffer keeps last reserved ips not persisted yet, by network and pool, so that
+// rapid reservations cost one write per network and flush period instead of one each
+type cursorBuffer struct {
+	sync.Mutex
+	pending map[string]map[string]string
+}
+
+func newCursorBuffer() *cursorBuffer {
+	return &cursorBuffer{pending: make(map[string]map[string]string)}
+}
+
+func (b *cursorBuffer) set(network, pool, ip string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pending[network] == nil {
+		b.pending[network] = make(map[string]string)
+	}
+	b.pending[network][pool] = ip
+}
+
+// get returns the pending cursor of pool, nil if there is none
+func (b *cursorBuffer) get(network, pool string) net.IP {
+	b.Lock()
+	defer b.Unlock()
+
+	if ip, ok := b.pending[network][pool]; ok {
+		return net.ParseIP(ip)
+	}
+	return nil
+}
+
+// take returns all pending cursors and empties the buffer
+func (b *cursorBuffer) take() map[string]map[string]string {
+	b.Lock()
+	defer b.Unlock()
+
+	pending := b.pending
+	b.pending = make(map[string]map[string]string)
+	return pending
+}
+
+// restore puts cursors failed to persist back, unless newer ones are set meanwhile
+func (b *cursorBuffer) restore(network string, pools map[string]string) {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.pending[network] == nil {
+		b.pending[network] = make(map[string]string, len(pools))
+	}
+	for pool, ip := range pools {
+		if _, newer := b.pending[network][pool]; !newer {
+			b.pending[network][pool] = ip
+		}
+	}
+}
+
+// advanceLastReservedIP moves the cursor of pool to ip, at once or by the next flush if
+// cursors are persisted periodically, the network lock must be held
+func (s *Store) advanceLastReservedIP(networkName, poolName, ip string) error {
+	if s.cursorFlushPeriod > 0 {
+		s.cursors.set(networkName, poolName, ip)
+		return nil
+	}
+	return s.updateLastReservedIP(networkName, poolName, ip)
+}
+
+// lastReservedIPOf returns the cursor of pool where scans start after, pending ones first
+func (s *Store) lastReservedIPOf(networkName, poolName string) net.IP {
+	if ip := s.cursors.get(networkName, poolName); ip != nil {
+		return ip
+	}
+	if lri := s.cache.GetLastReservedIP(networkName); lri != nil {
+		return lri.ForPool(poolName)
+	}
+	return nil
+}
+
+// flushLastReservedIPs persists all pending cursors, those failed are retried by the next flush
+func (s *Store) flushLastReservedIPs() {
+	for network, pools := range s.cursors.take() {
+		func() {
+			defer s.networkLocks.LockKey(network)()
+
+			if err := s.updateLastReservedIPs(network, pools); err != nil {
+				LoggerStore.Errorf("fail to flush last reserved ips of network %s: %v", network, err)
+				s.cursors.restore(network, pools)
+			}
+		}()
+	}
+}
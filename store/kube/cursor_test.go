@@ -0,0 +1,156 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// countLastReservedIPWrites counts creates and updates of last reserved ips made through client
+func countLastReservedIPWrites(client *fake.Clientset) *int32 {
+	var writes int32
+	for _, verb := range []string{"create", "update"} {
+		client.PrependReactor(verb, "lastreservedips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			atomic.AddInt32(&writes, 1)
+			return false, nil, nil
+		})
+	}
+	return &writes
+}
+
+func TestStore_LastReservedIPFlushedOnShutdown(t *testing.T) {
+	stopCh := make(chan struct{})
+	client := newTestClientset(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")))
+	writes := countLastReservedIPWrites(client)
+	s := newStore(client, stopCh, WithLastReservedIPFlushPeriod(time.Hour))
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	// pending cursors keep scans sequential before they are persisted
+	for i, expected := range []string{"192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13"} {
+		ip, err := s.Allocate("network", "pool", "default", "pod"+expected)
+		if err != nil || ip.String() != expected {
+			t.Fatalf("allocation %d fails: expected %s but got %v %v", i, expected, ip, err)
+		}
+	}
+	if n := atomic.LoadInt32(writes); n != 0 {
+		t.Errorf("cursors should not be written before flush, got %d writes", n)
+	}
+
+	close(stopCh)
+	s.Close()
+	if n := atomic.LoadInt32(writes); n != 1 {
+		t.Errorf("cursors should be coalesced into one write on shutdown, got %d writes", n)
+	}
+	lri, err := s.resourceClient.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{})
+	if err != nil || lri.Spec.Pools["pool"] != "192.168.0.13" {
+		t.Errorf("the last cursor should be flushed, got %+v %v", lri, err)
+	}
+}
+
+func TestStore_LastReservedIPFlushedPeriodically(t *testing.T) {
+	stopCh := make(chan struct{})
+	client := newTestClientset(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")))
+	writes := countLastReservedIPWrites(client)
+	s := newStore(client, stopCh, WithLastReservedIPFlushPeriod(100*time.Millisecond))
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	defer func() {
+		close(stopCh)
+		s.Close()
+	}()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	const allocations = 10
+	for i := 0; i < allocations; i++ {
+		if _, err := s.Allocate("network", "pool", "default", fmt.Sprintf("pod%d", i)); err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+	}
+	waitForCache(t, func() bool {
+		lri := s.cache.GetLastReservedIP("network")
+		return lri != nil && lri.ForPool("pool").String() == "192.168.0.19"
+	})
+	if n := atomic.LoadInt32(writes); n >= allocations {
+		t.Errorf("cursors should be coalesced, got %d writes for %d allocations", n, allocations)
+	}
+}
+
+func TestStore_LastReservedIPCollision(t *testing.T) {
+	// a record of the same name left by another network, e.g. after renames, is never taken over
+	client := newTestClientset(
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")),
+		&v1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: "network"},
+			Spec:       v1.LastReservedIPSpec{Pools: map[string]string{"pool": "10.0.0.1"}, Network: "other"},
+		})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	s := newStore(client, stopCh)
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.GetLastReservedIP("network") != nil
+	})
+
+	if err := s.updateLastReservedIP("network", "pool", "192.168.0.10"); failureReason(err) != FailureValidation {
+		t.Errorf("expected collision to be refused but got %v", err)
+	}
+	if err := s.CompactLastReservedIP("network"); failureReason(err) != FailureValidation {
+		t.Errorf("expected compacting a collision to be refused but got %v", err)
+	}
+	lri, err := client.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{})
+	if err != nil || lri.Spec.Network != "other" || lri.Spec.Pools["pool"] != "10.0.0.1" {
+		t.Errorf("expected record of other network untouched but got %+v: %v", lri, err)
+	}
+	if problems := s.SelfCheck(); len(problems) != 1 || problems[0].Kind != ProblemCursorCollision {
+		t.Errorf("expected a cursor collision but got %v", problems)
+	}
+
+	// legacy records without network are adopted, new ones are written with it
+	for _, name := range []string{"legacy", "fresh"} {
+		if name == "legacy" {
+			if _, err := client.ResourceV1().LastReservedIPs().Create(&v1.LastReservedIP{
+				ObjectMeta: metav1.ObjectMeta{Name: name},
+				Spec:       v1.LastReservedIPSpec{Pools: map[string]string{"pool": "192.168.0.10"}},
+			}); err != nil {
+				t.Fatalf("fail to create legacy record: %v", err)
+			}
+		}
+		if err := s.updateLastReservedIP(name, "pool", "192.168.0.11"); err != nil {
+			t.Errorf("test %s fails: %v", name, err)
+			continue
+		}
+		lri, err := client.ResourceV1().LastReservedIPs().Get(name, metav1.GetOptions{})
+		if err != nil || lri.Spec.Network != name || lri.Spec.Pools["pool"] != "192.168.0.11" {
+			t.Errorf("test %s fails: expected record of network %s but got %+v: %v", name, name, lri, err)
+		}
+	}
+}
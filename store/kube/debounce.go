@@ -0,0 +1,107 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+	"time"
+)
+
+// debouncer coalesces rapid consecutive events of the same key,
+// only the latest event of a key within delay is applied
+type debouncer struct {
+	sync.Mutex
+
+	delay   time.Duration
+	pending map[string]func()
+	timers  map[string]*time.Timer
+	closed  bool
+}
+
+func newDebouncer(delay time.Duration) *debouncer {
+	return &debouncer{
+		delay:   delay,
+		pending: make(map[string]func()),
+		timers:  make(map[string]*time.Timer),
+	}
+}
+
+// Do schedules fn of key to be applied after delay, replacing any pending one of the same key,
+// fn is applied immediately if debouncing is disabled or the debouncer is closed
+func (d *debouncer) Do(key string, fn func()) {
+	d.Lock()
+	if d.delay <= 0 || d.closed {
+		d.Unlock()
+		fn()
+		return
+	}
+	defer d.Unlock()
+
+	if _, scheduled := d.pending[key]; !scheduled {
+		d.timers[key] = time.AfterFunc(d.delay, func() {
+			d.fire(key)
+		})
+	}
+	d.pending[key] = fn
+}
+
+func (d *debouncer) fire(key string) {
+	d.Lock()
+	fn, scheduled := d.pending[key]
+	delete(d.pending, key)
+	delete(d.timers, key)
+	d.Unlock()
+
+	if scheduled {
+		fn()
+	}
+}
+
+// Flush applies all pending events immediately
+func (d *debouncer) Flush() {
+	d.Lock()
+	pending := d.takePending()
+	d.Unlock()
+
+	for _, fn := range pending {
+		fn()
+	}
+}
+
+// Close stops the timers of all pending events and applies them immediately,
+// events after that are applied immediately as well
+func (d *debouncer) Close() {
+	d.Lock()
+	d.closed = true
+	pending := d.takePending()
+	d.Unlock()
+
+	for _, fn := range pending {
+		fn()
+	}
+}
+
+// takePending stops the timers of pending events and takes them over, the lock must be held
+func (d *debouncer) takePending() map[string]func() {
+	for _, timer := range d.timers {
+		timer.Stop()
+	}
+	pending := d.pending
+	d.pending = make(map[string]func())
+	d.timers = make(map[string]*time.Timer)
+	return pending
+}
@@ -0,0 +1,90 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDebouncer(t *testing.T) {
+	d := newDebouncer(50 * time.Millisecond)
+
+	var (
+		lock    sync.Mutex
+		applied int
+		last    int
+	)
+	events := 100
+	for i := 1; i <= events; i++ {
+		i := i
+		d.Do("key", func() {
+			lock.Lock()
+			defer lock.Unlock()
+			applied++
+			last = i
+		})
+	}
+
+	waitForCache(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return last == events
+	})
+	if applied >= events {
+		t.Errorf("expected fewer than %d applies but got %d", events, applied)
+	}
+}
+
+func TestDebouncer_Close(t *testing.T) {
+	d := newDebouncer(time.Hour)
+
+	var applied []string
+	d.Do("a", func() { applied = append(applied, "a") })
+	d.Do("b", func() { applied = append(applied, "b") })
+	d.Close()
+	if len(applied) != 2 || len(d.timers) != 0 || len(d.pending) != 0 {
+		t.Fatalf("expected pending events applied and timers stopped but got %v %d %d", applied, len(d.timers), len(d.pending))
+	}
+
+	// events after close are not scheduled anymore
+	d.Do("c", func() { applied = append(applied, "c") })
+	if len(applied) != 3 || len(d.timers) != 0 {
+		t.Errorf("expected event after close applied immediately but got %v", applied)
+	}
+}
+
+func TestStore_EventDebounce(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithEventDebounce(50 * time.Millisecond)})
+	defer stop()
+
+	old := newUsingIP("192-168-0-10", "pod0")
+	for i := 1; i <= 100; i++ {
+		cur := newUsingIP("192-168-0-10", fmt.Sprintf("pod%d", i))
+		cur.ResourceVersion = strconv.Itoa(i)
+		s.updateUsingIPInCache(old, cur)
+		old = cur
+	}
+
+	waitForCache(t, func() bool {
+		usingIP := s.cache.GetUsingIP("192.168.0.10")
+		return usingIP != nil && usingIP.PodName == "pod100"
+	})
+}
@@ -0,0 +1,149 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// DrainPool disables pool for new allocations, and then moves the using ip of every live
+// allocation in it to the network and pool picked by target, the ip itself is kept so that
+// owners are not disturbed, which requires the target pool to contain it, e.g. a pool
+// splitting the range of the drained one. Ips not migrated, either refused by target or
+// failing to move, are left in pool and reported, the pool stays disabled regardless
+func (s *Store) DrainPool(network, pool string, target func(ip net.IP) (toNetwork, toPool string, ok bool)) (*store.DrainReport, error) {
+	if err := s.disablePool(network, pool); err != nil {
+		return nil, err
+	}
+
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list using ips: %v", err)
+	}
+	sort.Slice(usingIPs.Items, func(i, j int) bool { return usingIPs.Items[i].Name < usingIPs.Items[j].Name })
+
+	report := &store.DrainReport{Failed: make(map[string]string)}
+	for i := range usingIPs.Items {
+		usingIP := &usingIPs.Items[i]
+		if usingIP.Spec.Network != network || usingIP.Spec.Pool != pool {
+			continue
+		}
+		if _, quarantined := quarantinedAt(usingIP); quarantined {
+			continue
+		}
+		ip, err := utils.DecodeName(usingIP.Name)
+		if err != nil {
+			report.Failed[usingIP.Name] = err.Error()
+			continue
+		}
+
+		toNetwork, toPool, ok := target(ip)
+		if !ok {
+			report.Failed[ip.String()] = "no target is picked"
+			continue
+		}
+		if err := s.migrateUsingIP(usingIP.Name, ip, network, pool, toNetwork, toPool); err != nil {
+			report.Failed[ip.String()] = err.Error()
+			continue
+		}
+		report.Migrated = append(report.Migrated, ip)
+	}
+
+	LoggerStore.Infof("pool %s of network %s drained, %d using ips migrated, %d left",
+		pool, network, len(report.Migrated), len(report.Failed))
+	return report, nil
+}
+
+// disablePool stops new allocations from pool, and returns once it is cached
+func (s *Store) disablePool(network, pool string) error {
+	defer s.networkLocks.LockKey(network)()
+
+	if _, err := s.getPool(network, pool); err != nil {
+		return err
+	}
+	return s.patchPool(network, pool, func(p *resourcev1.Pool) {
+		p.Disabled = true
+	}, func(p *types.Pool) bool {
+		return p.Disabled
+	})
+}
+
+// migrateUsingIP moves the using ip of ip from pool to toPool of toNetwork, when both
+// networks are locked so that the target can not change meanwhile
+func (s *Store) migrateUsingIP(name string, ip net.IP, network, pool, toNetwork, toPool string) error {
+	// networks are locked in order so that concurrent drains can not deadlock
+	first, second := network, toNetwork
+	if second < first {
+		first, second = second, first
+	}
+	defer s.networkLocks.LockKey(first)()
+	if second != first {
+		defer s.networkLocks.LockKey(second)()
+	}
+
+	target, err := s.getAllocatablePool(toNetwork, toPool)
+	if err != nil {
+		return err
+	}
+	if !target.IsAllocatable(ip) {
+		return newValidationError("ip %s is not allocatable in pool %s of network %s", ip, toPool, toNetwork)
+	}
+
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	usingIP, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	// the using ip may be released or moved since it is listed
+	if usingIP.Spec.Network != network || usingIP.Spec.Pool != pool {
+		return fmt.Errorf("using ip %s is no longer in pool %s of network %s", name, pool, network)
+	}
+	if err := s.checkLease(&resourcev1.UsingIPSpec{
+		Network: toNetwork, Pool: toPool, Owner: usingIP.Spec.Owner, PodNamespace: usingIP.Spec.PodNamespace,
+	}); err != nil {
+		return err
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	usingIP = usingIP.DeepCopy()
+	usingIP.Spec.Network = toNetwork
+	usingIP.Spec.Pool = toPool
+	if usingIP.Labels == nil {
+		usingIP.Labels = make(map[string]string, 2)
+	}
+	for key, value := range map[string]string{NetworkLabel: toNetwork, PoolLabel: toPool} {
+		if len(validation.IsValidLabelValue(value)) == 0 {
+			usingIP.Labels[key] = value
+		} else {
+			delete(usingIP.Labels, key)
+		}
+	}
+	_, err = client.Update(usingIP)
+	return err
+}
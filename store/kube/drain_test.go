@@ -0,0 +1,83 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_DrainPool(t *testing.T) {
+	newDrainUsingIP := func(name, podName string) *v1.UsingIP {
+		usingIP := newUsingIP(name, podName)
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = "old"
+		return usingIP
+	}
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("old", "192.168.0.10", "192.168.0.20")),
+		newNetwork("other", newTestPool("new", "192.168.0.10", "192.168.0.15")),
+		newDrainUsingIP("192-168-0-10", "pod1"),
+		newDrainUsingIP("192-168-0-18", "pod2"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.GetNetwork("other") != nil && len(s.cache.ListUsingIPs()) == 2
+	})
+
+	// both are sent to the new pool, which only contains the first one
+	report, err := s.DrainPool("network", "old", func(ip net.IP) (string, string, bool) {
+		return "other", "new", true
+	})
+	if err != nil {
+		t.Fatalf("fail to drain pool: %v", err)
+	}
+	if len(report.Migrated) != 1 || !report.Migrated[0].Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("expected 192.168.0.10 migrated but got %v", report.Migrated)
+	}
+	if _, failed := report.Failed["192.168.0.18"]; !failed || len(report.Failed) != 1 {
+		t.Errorf("expected 192.168.0.18 failed but got %v", report.Failed)
+	}
+
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	testCases := []struct {
+		name     string
+		network  string
+		pool     string
+		migrated bool
+	}{
+		{"192-168-0-10", "other", "new", true},
+		{"192-168-0-18", "network", "old", false},
+	}
+	for _, tc := range testCases {
+		usingIP, err := client.Get(tc.name, metav1.GetOptions{})
+		if err != nil || usingIP.Spec.Network != tc.network || usingIP.Spec.Pool != tc.pool {
+			t.Errorf("test %s fails: expected in %s/%s but got %+v %v", tc.name, tc.network, tc.pool, usingIP, err)
+			continue
+		}
+		if tc.migrated && (usingIP.Labels[NetworkLabel] != tc.network || usingIP.Labels[PoolLabel] != tc.pool) {
+			t.Errorf("test %s fails: expected labels of %s/%s but got %v", tc.name, tc.network, tc.pool, usingIP.Labels)
+		}
+	}
+
+	if _, err := s.Allocate("network", "old", "default", "pod3"); failureReason(err) != FailureValidation {
+		t.Errorf("drained pool should be disabled, got %v", err)
+	}
+}
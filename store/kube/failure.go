@@ -0,0 +1,139 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+	"k8s.io/apimachinery/pkg/api/errors"
+)
+
+// reasons of failed allocations
+const (
+	FailureExhausted  = "exhausted"
+	FailureValidation = "validation"
+	FailureConflict   = "conflict"
+	FailureAPIError   = "api-error"
+	FailureQuota      = "quota"
+)
+
+// defaultFailureHistory is the count of latest failures kept by store
+const defaultFailureHistory = 64
+
+// Failure describes a failed allocation
+type Failure struct {
+	Time    time.Time
+	Reason  string
+	Network string
+	Pool    string
+	Error   string
+}
+
+// validationError marks errors caused by invalid arguments or missing resources
+type validationError struct {
+	error
+}
+
+func newValidationError(format string, args ...interface{}) error {
+	return validationError{fmt.Errorf(format, args...)}
+}
+
+// failureReason categorizes err of a failed allocation
+func failureReason(err error) string {
+	switch err.(type) {
+	case validationError, *store.PoolDisabledError, *store.ReservationError:
+		return FailureValidation
+	case *store.QuotaExceededError:
+		return FailureQuota
+	}
+
+	switch {
+	case err == store.ErrPoolExhausted:
+		return FailureExhausted
+	case errors.IsConflict(err) || errors.IsAlreadyExists(err):
+		return FailureConflict
+	}
+	return FailureAPIError
+}
+
+// failureRecorder counts failures by reason and keeps the latest ones in a ring buffer
+type failureRecorder struct {
+	sync.Mutex
+	counts map[string]uint64
+	ring   []Failure
+	next   int
+	full   bool
+}
+
+func newFailureRecorder(size int) *failureRecorder {
+	return &failureRecorder{
+		counts: make(map[string]uint64),
+		ring:   make([]Failure, size),
+	}
+}
+
+func (r *failureRecorder) record(network, pool string, err error) {
+	failure := Failure{
+		Time:    time.Now(),
+		Reason:  failureReason(err),
+		Network: network,
+		Pool:    pool,
+		Error:   err.Error(),
+	}
+	LoggerStore.Debugf("allocation from pool %s of network %s fails for %s: %v", pool, network, failure.Reason, err)
+
+	r.Lock()
+	defer r.Unlock()
+
+	r.counts[failure.Reason]++
+	if len(r.ring) == 0 {
+		return
+	}
+	r.ring[r.next] = failure
+	r.next = (r.next + 1) % len(r.ring)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// FailureCounts returns the count of failed allocations by reason,
+// which is meant to be exported as a counter labeled by reason
+func (s *Store) FailureCounts() map[string]uint64 {
+	s.failures.Lock()
+	defer s.failures.Unlock()
+
+	counts := make(map[string]uint64, len(s.failures.counts))
+	for reason, count := range s.failures.counts {
+		counts[reason] = count
+	}
+	return counts
+}
+
+// LastFailures returns the latest failed allocations, the oldest first
+func (s *Store) LastFailures() []Failure {
+	s.failures.Lock()
+	defer s.failures.Unlock()
+
+	r := s.failures
+	if !r.full {
+		return append([]Failure(nil), r.ring[:r.next]...)
+	}
+	return append(append([]Failure(nil), r.ring[r.next:]...), r.ring[:r.next]...)
+}
@@ -0,0 +1,92 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestStore_Failures(t *testing.T) {
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.10")),
+		newUsingIP("192-168-0-10", "pod"),
+		newNetwork("other", newTestPool("pool", "192.168.0.20", "192.168.0.30")))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("other") != nil && s.cache.IsIPUsing("192.168.0.10")
+	})
+
+	var createErr error
+	s.resourceClient.(*fake.Clientset).PrependReactor("create", "usingips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return createErr != nil, nil, createErr
+	})
+
+	tests := []struct {
+		reason    string
+		network   string
+		pool      string
+		createErr error
+	}{
+		{FailureExhausted, "network", "pool", nil},
+		{FailureValidation, "network", "missing", nil},
+		{FailureConflict, "other", "pool", errors.NewConflict(v1.Resource("usingips"), "192-168-0-20", nil)},
+		{FailureAPIError, "other", "pool", errors.NewInternalError(fmt.Errorf("etcd is unavailable"))},
+	}
+	for _, test := range tests {
+		createErr = test.createErr
+		if _, err := s.Allocate(test.network, test.pool, "default", "pod"); err == nil {
+			t.Errorf("test %s fails: allocation should fail", test.reason)
+		}
+	}
+
+	counts := s.FailureCounts()
+	failures := s.LastFailures()
+	if len(failures) != len(tests) {
+		t.Fatalf("expected %d failures but got %d", len(tests), len(failures))
+	}
+	for i, test := range tests {
+		if counts[test.reason] != 1 {
+			t.Errorf("test %s fails: expected count 1 but got %d", test.reason, counts[test.reason])
+		}
+		if failures[i].Reason != test.reason || failures[i].Network != test.network || failures[i].Pool != test.pool {
+			t.Errorf("test %s fails: unexpected failure %+v", test.reason, failures[i])
+		}
+	}
+}
+
+func TestFailureRecorder_Ring(t *testing.T) {
+	r := newFailureRecorder(2)
+	s := &Store{failures: r}
+	for _, pool := range []string{"pool1", "pool2", "pool3"} {
+		r.record("network", pool, errors.NewInternalError(fmt.Errorf("etcd is unavailable")))
+	}
+
+	failures := s.LastFailures()
+	if len(failures) != 2 || failures[0].Pool != "pool2" || failures[1].Pool != "pool3" {
+		t.Errorf("expected the latest 2 failures oldest first but got %+v", failures)
+	}
+	if counts := s.FailureCounts(); counts[FailureAPIError] != 3 {
+		t.Errorf("expected count 3 but got %d", counts[FailureAPIError])
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+// defaultIPHistory is the count of latest owners kept per ip
+const defaultIPHistory = 8
+
+// defaultHistoryIPs is the count of ips whose owners are kept, those recorded least recently
+// are forgotten first
+const defaultHistoryIPs = 65536
+
+// OwnershipRecord is an owner of an ip, ReleasedAt is zero while the ip is still held,
+// and ReservedAt is zero if the reservation was made before store started
+type OwnershipRecord struct {
+	Network      string
+	Pool         string
+	PodNamespace string
+	PodName      string
+	Owner        string
+	ReservedAt   time.Time
+	ReleasedAt   time.Time
+}
+
+// historyRecorder keeps the latest owners of ips, like churnRecorder it sits in front
+// of the audit sink of store, once maxIPs ips are tracked the one recorded least recently
+// is forgotten, so that memory stays bounded however many addresses pass through
+type historyRecorder struct {
+	store.AuditSink
+
+	sync.Mutex
+	size    int
+	maxIPs  int
+	records map[string][]OwnershipRecord
+	// order holds the tracked ips, the most recently recorded first
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newHistoryRecorder(size, maxIPs int, sink store.AuditSink) *historyRecorder {
+	return &historyRecorder{
+		AuditSink: sink,
+		size:      size,
+		maxIPs:    maxIPs,
+		records:   make(map[string][]OwnershipRecord),
+		order:     list.New(),
+		elements:  make(map[string]*list.Element),
+	}
+}
+
+func (r *historyRecorder) RecordReserve(entry *store.AuditEntry) {
+	record := newOwnershipRecord(entry)
+	record.ReservedAt = entry.Time
+	r.Lock()
+	r.append(entry.IP, record)
+	r.Unlock()
+
+	r.AuditSink.RecordReserve(entry)
+}
+
+func (r *historyRecorder) RecordRelease(entry *store.AuditEntry) {
+	r.Lock()
+	records := r.records[entry.IP]
+	if last := len(records) - 1; last >= 0 && records[last].ReleasedAt.IsZero() {
+		records[last].ReleasedAt = entry.Time
+		r.touch(entry.IP)
+	} else {
+		record := newOwnershipRecord(entry)
+		record.ReleasedAt = entry.Time
+		r.append(entry.IP, record)
+	}
+	r.Unlock()
+
+	r.AuditSink.RecordRelease(entry)
+}
+
+// append must be called with the lock held, the oldest record of ip is dropped once it has size
+func (r *historyRecorder) append(ip string, record OwnershipRecord) {
+	if r.size <= 0 || r.maxIPs <= 0 {
+		return
+	}
+	records := append(r.records[ip], record)
+	if len(records) > r.size {
+		records = append([]OwnershipRecord(nil), records[len(records)-r.size:]...)
+	}
+	r.records[ip] = records
+	r.touch(ip)
+}
+
+// touch must be called with the lock held, it marks ip as the most recently recorded
+// and forgets the least recently recorded ip once more than maxIPs are tracked
+func (r *historyRecorder) touch(ip string) {
+	if element, exists := r.elements[ip]; exists {
+		r.order.MoveToFront(element)
+		return
+	}
+	r.elements[ip] = r.order.PushFront(ip)
+	if r.order.Len() > r.maxIPs {
+		oldest := r.order.Remove(r.order.Back()).(string)
+		delete(r.elements, oldest)
+		delete(r.records, oldest)
+	}
+}
+
+func newOwnershipRecord(entry *store.AuditEntry) OwnershipRecord {
+	return OwnershipRecord{
+		Network:      entry.Network,
+		Pool:         entry.Pool,
+		PodNamespace: entry.PodNamespace,
+		PodName:      entry.PodName,
+		Owner:        entry.Owner,
+	}
+}
+
+// IPHistory returns the latest owners of ip reserved or released by store, the oldest first,
+// at most defaultIPHistory of them are kept for the latest defaultHistoryIPs ips and nothing
+// survives a restart, so that the audit sink is the one to check for the full history
+func (s *Store) IPHistory(ip net.IP) []OwnershipRecord {
+	s.history.Lock()
+	defer s.history.Unlock()
+
+	return append([]OwnershipRecord(nil), s.history.records[ip.String()]...)
+}
@@ -0,0 +1,105 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+func TestHistoryRecorder(t *testing.T) {
+	r := newHistoryRecorder(2, 2, store.NopAuditSink{})
+	now := time.Now()
+	// a release without reservation was reserved before store started
+	r.RecordRelease(&store.AuditEntry{Time: now, IP: "192.168.0.10", Owner: "old"})
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(time.Second), IP: "192.168.0.10", Owner: "a"})
+	if records := r.records["192.168.0.10"]; len(records) != 2 || !records[0].ReservedAt.IsZero() || records[0].Owner != "old" ||
+		!records[1].ReleasedAt.IsZero() || records[1].Owner != "a" {
+		t.Errorf("expected release of old and reservation of a but got %+v", records)
+	}
+
+	// the oldest record is dropped once ip has two
+	r.RecordRelease(&store.AuditEntry{Time: now.Add(2 * time.Second), IP: "192.168.0.10", Owner: "a"})
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(3 * time.Second), IP: "192.168.0.10", Owner: "b"})
+	records := r.records["192.168.0.10"]
+	if len(records) != 2 || records[0].Owner != "a" || records[1].Owner != "b" {
+		t.Fatalf("expected records of a and b but got %+v", records)
+	}
+	if !records[0].ReleasedAt.Equal(now.Add(2 * time.Second)) {
+		t.Errorf("expected a released at %s but got %s", now.Add(2*time.Second), records[0].ReleasedAt)
+	}
+}
+
+func TestHistoryRecorder_MaxIPs(t *testing.T) {
+	r := newHistoryRecorder(2, 2, store.NopAuditSink{})
+	now := time.Now()
+	r.RecordReserve(&store.AuditEntry{Time: now, IP: "192.168.0.10", Owner: "a"})
+	r.RecordReserve(&store.AuditEntry{Time: now, IP: "192.168.0.11", Owner: "b"})
+	// releasing .10 makes it the most recently recorded, so that .11 is forgotten for .12
+	r.RecordRelease(&store.AuditEntry{Time: now.Add(time.Second), IP: "192.168.0.10", Owner: "a"})
+	r.RecordReserve(&store.AuditEntry{Time: now.Add(time.Second), IP: "192.168.0.12", Owner: "c"})
+
+	if len(r.records) != 2 || r.order.Len() != 2 || len(r.elements) != 2 {
+		t.Fatalf("expected 2 ips tracked but got %d %d %d", len(r.records), r.order.Len(), len(r.elements))
+	}
+	for ip, tracked := range map[string]bool{"192.168.0.10": true, "192.168.0.11": false, "192.168.0.12": true} {
+		if _, exists := r.records[ip]; exists != tracked {
+			t.Errorf("expected ip %s tracked %v", ip, tracked)
+		}
+	}
+}
+
+func TestStore_IPHistory(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.10")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip := net.ParseIP("192.168.0.10")
+	for _, pod := range []string{"pod1", "pod2"} {
+		if _, err := s.Allocate("network", "pool", "default", pod); err != nil {
+			t.Fatalf("fail to allocate for %s: %v", pod, err)
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+		if err := s.Release(ip); err != nil {
+			t.Fatalf("fail to release %s: %v", ip, err)
+		}
+		waitForCache(t, func() bool { return !s.cache.IsIPUsing(ip.String()) })
+	}
+	if err := s.ReserveStatic("network", "pool", ip, "vip"); err != nil {
+		t.Fatalf("fail to reserve %s: %v", ip, err)
+	}
+
+	history := s.IPHistory(ip)
+	if len(history) != 3 {
+		t.Fatalf("expected 3 owners of %s but got %+v", ip, history)
+	}
+	for i, expected := range []struct{ pod, owner string }{{"pod1", ""}, {"pod2", ""}, {"", "vip"}} {
+		record := history[i]
+		if record.PodName != expected.pod || record.Owner != expected.owner || record.Network != "network" || record.Pool != "pool" {
+			t.Errorf("record %d expected of %q %q but got %+v", i, expected.pod, expected.owner, record)
+		}
+		if record.ReservedAt.IsZero() || (i < 2) == record.ReleasedAt.IsZero() || i < 2 && record.ReleasedAt.Before(record.ReservedAt) {
+			t.Errorf("record %d has unexpected timestamps %+v", i, record)
+		}
+	}
+	if history := s.IPHistory(net.ParseIP("192.168.0.11")); len(history) != 0 {
+		t.Errorf("expected no history of an ip never reserved but got %+v", history)
+	}
+}
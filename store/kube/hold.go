@@ -0,0 +1,253 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	// defaultHoldTimeout is how long a held ip is kept uncommitted by default
+	defaultHoldTimeout = 30 * time.Second
+
+	// minHoldSweepPeriod bounds how often holds are swept, so that a tiny hold timeout
+	// does not make the sweeper spin
+	minHoldSweepPeriod = 10 * time.Millisecond
+
+	// holdOwnerPrefix prefixes the token of a hold to make the owner of its using ip
+	holdOwnerPrefix = "hold/"
+)
+
+// Hold reserves an ip of pool tentatively under token, e.g. while a pod is being scheduled,
+// the hold is either finalized by Commit or given up by Drop, or else released once it has
+// been kept for the hold timeout, token must be a valid label value. Holds are allowed in leased
+// pools, whose lease is checked against the pod the hold is committed to
+func (s *Store) Hold(networkName, poolName, token string) (net.IP, error) {
+	ip, err := s.hold(networkName, poolName, token)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, err
+}
+
+func (s *Store) hold(networkName, poolName, token string) (net.IP, error) {
+	if err := validateHoldToken(token); err != nil {
+		return nil, err
+	}
+	defer s.networkLocks.LockKey(networkName)()
+
+	held, err := s.getHold(token)
+	if err != nil {
+		return nil, err
+	}
+	if held != nil {
+		return nil, newValidationError("hold token %s is already used in pool %s of network %s",
+			token, held.Spec.Pool, held.Spec.Network)
+	}
+
+	template := newOwnerUsingIP(networkName, poolName, holdOwnerPrefix+token)
+	template.Labels = map[string]string{HoldTokenLabel: token}
+	template.Annotations = map[string]string{
+		HeldUntilAnnotation: time.Now().Add(s.holdTimeout).Format(time.RFC3339Nano),
+	}
+	return s.allocateUsingIP(template, holdOwnerPrefix+token, nil)
+}
+
+// Commit hands the ip held under token over to pod namespace/name, an expired hold can not be
+// committed, and the pod is checked like any reservation, against leases and namespace quota
+func (s *Store) Commit(token, namespace, name string) error {
+	if err := validateHoldToken(token); err != nil {
+		return err
+	}
+	if len(namespace) == 0 || len(name) == 0 {
+		return newValidationError("pod is required to commit hold %s", token)
+	}
+	held, err := s.getHold(token)
+	if err != nil {
+		return err
+	}
+	if held == nil {
+		return newValidationError("no ip is held by token %s", token)
+	}
+	if heldUntil, _ := heldUntil(held); !time.Now().Before(heldUntil) {
+		return newValidationError("hold %s has expired", token)
+	}
+	ip, err := utils.DecodeName(held.Name)
+	if err != nil {
+		return err
+	}
+	defer s.networkLocks.LockKey(held.Spec.Network)()
+
+	committed := held.DeepCopy()
+	committed.Spec.Owner = ""
+	committed.Spec.PodNamespace = namespace
+	committed.Spec.PodName = name
+	delete(committed.Labels, HoldTokenLabel)
+	delete(committed.Annotations, HeldUntilAnnotation)
+	if err := validateOwner(&committed.Spec); err != nil {
+		return err
+	}
+	if err := s.checkLease(&committed.Spec); err != nil {
+		return err
+	}
+	if err := s.checkNamespaceQuota(&committed.Spec); err != nil {
+		return err
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	// the resource version guards against the hold being dropped or swept after the get above
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Update(committed); err != nil {
+		return fmt.Errorf("fail to commit hold %s to %s/%s: %v", token, namespace, name, err)
+	}
+
+	// the hold is released to the pod as far as the audit trail is concerned
+	now := time.Now()
+	s.auditSink.RecordRelease(&store.AuditEntry{
+		Time:    now,
+		IP:      ip.String(),
+		Network: held.Spec.Network,
+		Pool:    held.Spec.Pool,
+		Owner:   held.Spec.Owner,
+	})
+	s.auditSink.RecordReserve(&store.AuditEntry{
+		Time:         now,
+		IP:           ip.String(),
+		Network:      held.Spec.Network,
+		Pool:         held.Spec.Pool,
+		PodNamespace: namespace,
+		PodName:      name,
+	})
+	return nil
+}
+
+// Drop releases the ip held under token, nothing is done if token holds none
+func (s *Store) Drop(token string) error {
+	if err := validateHoldToken(token); err != nil {
+		return err
+	}
+	held, err := s.getHold(token)
+	if err != nil || held == nil {
+		return err
+	}
+	return s.releaseHold(held)
+}
+
+// getHold returns the using ip held under token, nil if there is none, the api is listed
+// instead of cache so that a hold just made is never missed
+func (s *Store) getHold(token string) (*resourcev1.UsingIP, error) {
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{
+		LabelSelector: HoldTokenLabel + "=" + token,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list using ips of hold token %s: %v", token, err)
+	}
+	for i := range usingIPs.Items {
+		if _, quarantined := quarantinedAt(&usingIPs.Items[i]); !quarantined {
+			return &usingIPs.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// releaseHold releases the ip of held, unless it has been committed or re-created since
+func (s *Store) releaseHold(held *resourcev1.UsingIP) error {
+	ip, err := utils.DecodeName(held.Name)
+	if err != nil {
+		return err
+	}
+	err = s.release(ip, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &held.UID},
+	})
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		return err
+	}
+	return nil
+}
+
+// holdSweepPeriod is half of the hold timeout, but never below minHoldSweepPeriod
+func (s *Store) holdSweepPeriod() time.Duration {
+	if period := s.holdTimeout / 2; period > minHoldSweepPeriod {
+		return period
+	}
+	return minHoldSweepPeriod
+}
+
+// sweepHolds releases held ips whose hold timeout has elapsed without commit
+func (s *Store) sweepHolds() {
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{LabelSelector: HoldTokenLabel})
+	if err != nil {
+		LoggerStore.Warnf("fail to list using ips to sweep holds: %v", err)
+		return
+	}
+
+	now := time.Now()
+	expired := make([]*resourcev1.UsingIP, 0)
+	for i := range usingIPs.Items {
+		if heldUntil, held := heldUntil(&usingIPs.Items[i]); held && !now.Before(heldUntil) {
+			expired = append(expired, &usingIPs.Items[i])
+		}
+	}
+	// failures are logged one by one, the aggregated error has nothing more
+	_ = parallelize(s.bulkParallelism, len(expired), func(i int) error {
+		if err := s.releaseHold(expired[i]); err != nil {
+			LoggerStore.Warnf("fail to release expired hold %s: %v", expired[i].Labels[HoldTokenLabel], err)
+			return err
+		}
+		LoggerStore.Debugf("hold %s of using ip %s has expired", expired[i].Labels[HoldTokenLabel], expired[i].Name)
+		return nil
+	})
+}
+
+// heldUntil returns when the hold of usingIP expires if it is held and not quarantined,
+// a malformed timestamp is treated as expired long ago so that the ip is not held forever
+func heldUntil(usingIP *resourcev1.UsingIP) (time.Time, bool) {
+	value, ok := usingIP.Annotations[HeldUntilAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	if _, quarantined := quarantinedAt(usingIP); quarantined {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, true
+	}
+	return until, true
+}
+
+func validateHoldToken(token string) error {
+	if len(token) == 0 {
+		return newValidationError("hold token is required")
+	}
+	if msgs := validation.IsValidLabelValue(token); len(msgs) > 0 {
+		return newValidationError("hold token %q is invalid: %s", token, strings.Join(msgs, ", "))
+	}
+	return nil
+}
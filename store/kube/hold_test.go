@@ -0,0 +1,163 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_HoldCommit(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, err := s.Hold("network", "pool", "token")
+	if err != nil {
+		t.Fatalf("fail to hold: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	if _, err := s.Hold("network", "pool", "token"); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error holding with a token in use but got %v", err)
+	}
+
+	if err := s.Commit("token", "default", "pod"); err != nil {
+		t.Fatalf("fail to commit: %v", err)
+	}
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(ip), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get using ip: %v", err)
+	}
+	if usingIP.Spec.PodNamespace != "default" || usingIP.Spec.PodName != "pod" || len(usingIP.Spec.Owner) > 0 {
+		t.Errorf("expected %s owned by default/pod but got %+v", ip, usingIP.Spec)
+	}
+	if _, held := heldUntil(usingIP); held || len(usingIP.Labels[HoldTokenLabel]) > 0 {
+		t.Errorf("expected %s no longer held but got %v %v", ip, usingIP.Labels, usingIP.Annotations)
+	}
+	waitForCache(t, func() bool { return len(s.cache.IPsForPod("default", "pod")) == 1 })
+	history := s.IPHistory(ip)
+	if len(history) != 2 || history[0].Owner != "hold/token" || history[0].ReleasedAt.IsZero() ||
+		history[1].PodName != "pod" || !history[1].ReleasedAt.IsZero() {
+		t.Errorf("expected the hold released to pod in history but got %+v", history)
+	}
+
+	// the token is free again once committed, and the ip is kept by the pod
+	if err := s.Commit("token", "default", "other"); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error committing a token holding nothing but got %v", err)
+	}
+	if err := s.Drop("token"); err != nil {
+		t.Errorf("expected dropping a token holding nothing to be a no-op but got %v", err)
+	}
+	if !s.cache.IsIPUsing(ip.String()) {
+		t.Errorf("expected committed ip %s kept", ip)
+	}
+}
+
+func TestStore_HoldDrop(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.10")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, err := s.Hold("network", "pool", "token")
+	if err != nil {
+		t.Fatalf("fail to hold: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err == nil {
+		t.Errorf("expected held ip %s not allocated to others", ip)
+	}
+
+	if err := s.Drop("token"); err != nil {
+		t.Fatalf("fail to drop: %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing(ip.String()) })
+	if err := s.Commit("token", "default", "pod"); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error committing a dropped hold but got %v", err)
+	}
+	if allocated, err := s.Allocate("network", "pool", "default", "pod"); err != nil || !allocated.Equal(ip) {
+		t.Errorf("expected dropped ip %s allocated but got %s: %v", ip, allocated, err)
+	}
+}
+
+func TestStore_HoldExpiry(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithHoldTimeout(200 * time.Millisecond)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, err := s.Hold("network", "pool", "token")
+	if err != nil {
+		t.Fatalf("fail to hold: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+
+	time.Sleep(200 * time.Millisecond)
+	if err := s.Commit("token", "default", "pod"); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error committing an expired hold but got %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing(ip.String()) })
+	if _, err := s.Hold("network", "pool", "token"); err != nil {
+		t.Errorf("expected token reusable once its hold expires but got %v", err)
+	}
+}
+
+func TestStore_HoldCommitQuota(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithNamespaceQuota(1)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if _, err := s.Allocate("network", "pool", "default", "pod1"); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if _, err := s.Hold("network", "pool", "token"); err != nil {
+		t.Fatalf("fail to hold: %v", err)
+	}
+	if _, ok := s.Commit("token", "default", "pod2").(*store.QuotaExceededError); !ok {
+		t.Errorf("expected commit beyond namespace quota refused")
+	}
+	if err := s.Commit("token", "other", "pod2"); err != nil {
+		t.Errorf("fail to commit to a namespace under quota: %v", err)
+	}
+}
+
+func TestStore_HoldTimeoutMustBePositive(t *testing.T) {
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		stopCh := make(chan struct{})
+		s := newStore(newTestClientset(), stopCh, WithHoldTimeout(timeout))
+		if err := s.Run(); err == nil {
+			t.Errorf("expected hold timeout %s refused", timeout)
+		}
+		close(stopCh)
+	}
+
+	// the sweeper never spins however small the timeout is
+	for timeout, period := range map[time.Duration]time.Duration{
+		time.Nanosecond:     minHoldSweepPeriod,
+		3 * time.Nanosecond: minHoldSweepPeriod,
+		time.Minute:         30 * time.Second,
+	} {
+		s := newStore(newTestClientset(), nil, WithHoldTimeout(timeout))
+		if got := s.holdSweepPeriod(); got != period {
+			t.Errorf("hold timeout %s expects sweep period %s but got %s", timeout, period, got)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+)
+
+// ipSetShards is the count of independently locked shards of ipSet
+const ipSetShards = 32
+
+// ipSet is a set of ips in string form sharded by hash, so that lookups of different
+// ips rarely contend with each other or with writes
+type ipSet struct {
+	shards [ipSetShards]ipSetShard
+}
+
+type ipSetShard struct {
+	sync.RWMutex
+	ips map[string]struct{}
+}
+
+func newIPSet() *ipSet {
+	s := &ipSet{}
+	for i := range s.shards {
+		s.shards[i].ips = make(map[string]struct{})
+	}
+	return s
+}
+
+// shard hashes ip by fnv-1a inline, which allocates nothing unlike hash/fnv
+func (s *ipSet) shard(ip string) *ipSetShard {
+	h := uint32(2166136261)
+	for i := 0; i < len(ip); i++ {
+		h ^= uint32(ip[i])
+		h *= 16777619
+	}
+	return &s.shards[h%ipSetShards]
+}
+
+func (s *ipSet) add(ip string) {
+	shard := s.shard(ip)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.ips[ip] = struct{}{}
+}
+
+func (s *ipSet) remove(ip string) {
+	shard := s.shard(ip)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.ips, ip)
+}
+
+func (s *ipSet) has(ip string) bool {
+	shard := s.shard(ip)
+	shard.RLock()
+	defer shard.RUnlock()
+	_, exists := shard.ips[ip]
+	return exists
+}
@@ -0,0 +1,142 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lockedIPSet is how cache looked up using ips before ipSet, kept as the reference
+type lockedIPSet struct {
+	sync.RWMutex
+	ips map[string]struct{}
+}
+
+func (s *lockedIPSet) add(ip string) {
+	s.Lock()
+	defer s.Unlock()
+	s.ips[ip] = struct{}{}
+}
+
+func (s *lockedIPSet) remove(ip string) {
+	s.Lock()
+	defer s.Unlock()
+	delete(s.ips, ip)
+}
+
+func (s *lockedIPSet) has(ip string) bool {
+	s.RLock()
+	defer s.RUnlock()
+	_, exists := s.ips[ip]
+	return exists
+}
+
+type ipSetInterface interface {
+	add(ip string)
+	remove(ip string)
+	has(ip string) bool
+}
+
+func TestIPSet(t *testing.T) {
+	set := newIPSet()
+	reference := &lockedIPSet{ips: make(map[string]struct{})}
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 10000; i++ {
+		ip := fmt.Sprintf("10.0.%d.%d", random.Intn(4), random.Intn(256))
+		switch random.Intn(3) {
+		case 0:
+			set.add(ip)
+			reference.add(ip)
+		case 1:
+			set.remove(ip)
+			reference.remove(ip)
+		}
+		if set.has(ip) != reference.has(ip) {
+			t.Fatalf("ip set disagrees with map on %s after %d operations", ip, i)
+		}
+	}
+}
+
+func TestCache_IsIPUsingDuringUpdate(t *testing.T) {
+	c := NewCache()
+	c.addUsingIP(newUsingIP("192-168-0-10", "pod"))
+
+	// replacing the record must never make the ip look free
+	var stop int32
+	wg := sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; atomic.LoadInt32(&stop) == 0; i++ {
+			c.updateUsingIP(newUsingIP("192-168-0-10", fmt.Sprintf("pod%d", i%2)))
+		}
+	}()
+	for i := 0; i < 100000; i++ {
+		if !c.IsIPUsing("192.168.0.10") {
+			t.Errorf("ip looks free while its record is updated")
+			break
+		}
+	}
+	atomic.StoreInt32(&stop, 1)
+	wg.Wait()
+
+	c.deleteUsingIP(newUsingIP("192-168-0-10", "pod"))
+	if c.IsIPUsing("192.168.0.10") {
+		t.Errorf("ip should be free once its record is deleted")
+	}
+}
+
+// benchmarkIPSet checks ips from all goroutines while one in every writeRatio operations writes
+func benchmarkIPSet(b *testing.B, set ipSetInterface) {
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.0.%d.%d", i/256, i%256)
+		set.add(ips[i])
+	}
+	const writeRatio = 16
+
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine walks the ips from its own offset without sharing a counter
+		n := uint32(atomic.AddInt64(&seed, 1) * 97)
+		for pb.Next() {
+			n++
+			ip := ips[n%uint32(len(ips))]
+			switch {
+			case n%writeRatio == 0:
+				set.remove(ip)
+			case n%writeRatio == 1:
+				set.add(ip)
+			default:
+				set.has(ip)
+			}
+		}
+	})
+}
+
+func BenchmarkIPSet_Sharded(b *testing.B) {
+	benchmarkIPSet(b, newIPSet())
+}
+
+func BenchmarkIPSet_Locked(b *testing.B) {
+	benchmarkIPSet(b, &lockedIPSet{ips: make(map[string]struct{})})
+}
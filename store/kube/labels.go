@@ -0,0 +1,42 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+// keys of labels and annotations set by store on its objects, so that operators can
+// select and filter them
+const (
+	// NetworkLabel and PoolLabel are set on every using ip created by store
+	NetworkLabel = "resource.k8s.io/network"
+	PoolLabel    = "resource.k8s.io/pool"
+
+	// IdempotencyKeyLabel is the key of the reservation made by ReserveIdempotent
+	IdempotencyKeyLabel = "resource.k8s.io/idempotency-key"
+
+	// ManagedByLabel marks using ips managed by ReconcileReservations
+	ManagedByLabel = "resource.k8s.io/managed-by"
+	// ManagedByReconciler is the value of ManagedByLabel set by ReconcileReservations
+	ManagedByReconciler = "kube-ipam-reservations"
+
+	// QuarantinedAtAnnotation marks a released using ip kept out of allocation until its
+	// cool-down elapses, the value is the release time in RFC3339
+	QuarantinedAtAnnotation = "resource.k8s.io/quarantined-at"
+
+	// HoldTokenLabel is the token of the tentative reservation made by Hold
+	HoldTokenLabel = "resource.k8s.io/hold-token"
+	// HeldUntilAnnotation is when the hold expires unless committed, the value is in RFC3339
+	HeldUntilAnnotation = "resource.k8s.io/held-until"
+)
@@ -0,0 +1,152 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// poolSyncTimeout bounds waiting for a patched pool to be cached, which reservations check against
+const poolSyncTimeout = 10 * time.Second
+
+// ReserveWholePool leases pool exclusively to owner, which is either the owner of using ips or
+// the namespace of pods, so that no one else can allocate from the pool until ReleaseWholePool,
+// the pool must not have any ip in use by others
+func (s *Store) ReserveWholePool(network, pool, owner string) error {
+	if len(owner) == 0 {
+		return newValidationError("owner is required to lease pool %s", pool)
+	}
+	defer s.networkLocks.LockKey(network)()
+
+	leased, err := s.getPool(network, pool)
+	if err != nil {
+		return err
+	}
+	if leased.ExclusiveOwner == owner {
+		return nil
+	}
+	if len(leased.ExclusiveOwner) > 0 {
+		return newValidationError("pool %s of network %s is already leased to %s", pool, network, leased.ExclusiveOwner)
+	}
+
+	// the api is listed instead of cache so that reservations just made are not missed
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("fail to list using ips: %v", err)
+	}
+	var others []string
+	for i := range usingIPs.Items {
+		spec := &usingIPs.Items[i].Spec
+		if spec.Network != network || spec.Pool != pool {
+			continue
+		}
+		if _, quarantined := quarantinedAt(&usingIPs.Items[i]); !quarantined && !leaseHeldBy(owner, spec) {
+			others = append(others, usingIPs.Items[i].Name)
+		}
+	}
+	if len(others) > 0 {
+		return newValidationError("pool %s of network %s has using ips of others: %s", pool, network, strings.Join(others, ", "))
+	}
+
+	return s.patchPool(network, pool, func(p *resourcev1.Pool) {
+		p.ExclusiveOwner = owner
+	}, func(p *types.Pool) bool {
+		return p.ExclusiveOwner == owner
+	})
+}
+
+// ReleaseWholePool ends the lease of pool held by owner, restoring normal allocation
+func (s *Store) ReleaseWholePool(network, pool, owner string) error {
+	defer s.networkLocks.LockKey(network)()
+
+	leased, err := s.getPool(network, pool)
+	if err != nil {
+		return err
+	}
+	if leased.ExclusiveOwner != owner {
+		return newValidationError("pool %s of network %s is not leased to %s", pool, network, owner)
+	}
+	return s.patchPool(network, pool, func(p *resourcev1.Pool) {
+		p.ExclusiveOwner = ""
+	}, func(p *types.Pool) bool {
+		return len(p.ExclusiveOwner) == 0
+	})
+}
+
+// patchPool must be called with the network lock held, it applies mutate to the crd of pool
+// and returns once synced holds for the cached pool, so that no reservation made after it
+// can miss the change
+func (s *Store) patchPool(network, pool string, mutate func(*resourcev1.Pool), synced func(*types.Pool) bool) error {
+	if s.dryRun {
+		return nil
+	}
+	client := s.resourceClient.ResourceV1().Networks()
+	crd, err := client.Get(network, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	crd = crd.DeepCopy()
+	for i := range crd.Spec.Pools {
+		if crd.Spec.Pools[i].Name == pool {
+			mutate(&crd.Spec.Pools[i])
+		}
+	}
+	if _, err := client.Update(crd); err != nil {
+		return fmt.Errorf("fail to update pool %s of network %s: %v", pool, network, err)
+	}
+
+	err = wait.PollImmediate(cacheWaitInterval, poolSyncTimeout, func() (bool, error) {
+		cached, err := s.getPool(network, pool)
+		return err == nil && synced(cached), nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail to wait for pool %s of network %s to be cached: %v", pool, network, err)
+	}
+	return nil
+}
+
+// checkLease rejects reserving into a pool leased to someone else, pools missing from cache
+// are left to apiserver like checkPoolEnabled does. Peeks reserve nothing and pick the same ip
+// for anyone, and holds are made on behalf of the pod committing them, so that both pass
+// and the lease is checked against the pod by Commit instead
+func (s *Store) checkLease(spec *resourcev1.UsingIPSpec) error {
+	if s.dryRun && spec.Owner == peekOwner || strings.HasPrefix(spec.Owner, holdOwnerPrefix) {
+		return nil
+	}
+	network := s.cache.GetNetwork(spec.Network)
+	if network == nil {
+		return nil
+	}
+	pool := network.GetPool(spec.Pool)
+	if pool == nil || len(pool.ExclusiveOwner) == 0 || leaseHeldBy(pool.ExclusiveOwner, spec) {
+		return nil
+	}
+	return newValidationError("pool %s of network %s is leased exclusively to %s", spec.Pool, spec.Network, pool.ExclusiveOwner)
+}
+
+// leaseHeldBy checks if an using ip of spec belongs to the tenant owner
+func leaseHeldBy(owner string, spec *resourcev1.UsingIPSpec) bool {
+	return spec.Owner == owner || spec.PodNamespace == owner
+}
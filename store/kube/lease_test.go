@@ -0,0 +1,105 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+)
+
+func TestStore_ReserveWholePool(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if err := s.ReserveWholePool("network", "pool", "tenant"); err != nil {
+		t.Fatalf("fail to lease pool: %v", err)
+	}
+	if err := s.ReserveWholePool("network", "pool", "other"); failureReason(err) != FailureValidation {
+		t.Errorf("pool leased to others should not be leased again, got %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		allocate func() (net.IP, error)
+		allowed  bool
+	}{
+		{"pod of tenant namespace", func() (net.IP, error) {
+			return s.Allocate("network", "pool", "tenant", "pod")
+		}, true},
+		{"owner of tenant", func() (net.IP, error) {
+			return s.AllocateFromRange("network", "pool", net.ParseIP("192.168.0.15"), net.ParseIP("192.168.0.20"), "tenant")
+		}, true},
+		{"pod of others", func() (net.IP, error) {
+			return s.Allocate("network", "pool", "default", "pod")
+		}, false},
+		{"reserve of others", func() (net.IP, error) {
+			ip := net.ParseIP("192.168.0.18")
+			if _, err := s.Reserve("network", "pool", "default", "pod", ip); err != nil {
+				return nil, err
+			}
+			return ip, nil
+		}, false},
+	}
+	for _, tc := range testCases {
+		ip, err := tc.allocate()
+		if tc.allowed != (err == nil) {
+			t.Errorf("test %s fails: expected allowed %v but got %v %v", tc.name, tc.allowed, ip, err)
+		}
+	}
+
+	if err := s.ReleaseWholePool("network", "pool", "other"); failureReason(err) != FailureValidation {
+		t.Errorf("lease should only be released by its owner, got %v", err)
+	}
+	if err := s.ReleaseWholePool("network", "pool", "tenant"); err != nil {
+		t.Fatalf("fail to release lease: %v", err)
+	}
+	if _, err := s.Allocate("network", "pool", "default", "pod"); err != nil {
+		t.Errorf("allocation should be normal once lease is released: %v", err)
+	}
+
+	// a lease can not be taken over ips in use by others
+	if err := s.ReserveWholePool("network", "pool", "tenant"); failureReason(err) != FailureValidation {
+		t.Errorf("pool with using ips of others should not be leased, got %v", err)
+	}
+}
+
+func TestStore_LeasedPoolPeekAndHold(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+	if err := s.ReserveWholePool("network", "pool", "tenant"); err != nil {
+		t.Fatalf("fail to lease pool: %v", err)
+	}
+
+	if ip, err := s.PeekNext("network", "pool"); err != nil || !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("expected peek of leased pool to see 192.168.0.10 but got %s: %v", ip, err)
+	}
+
+	// holds pass, and the lease is checked against the pod committing them
+	for _, token := range []string{"a", "b"} {
+		if _, err := s.Hold("network", "pool", token); err != nil {
+			t.Fatalf("fail to hold %s in leased pool: %v", token, err)
+		}
+	}
+	if err := s.Commit("a", "default", "pod"); failureReason(err) != FailureValidation {
+		t.Errorf("expected commit to a pod of others refused by lease but got %v", err)
+	}
+	if err := s.Commit("b", "tenant", "pod"); err != nil {
+		t.Errorf("fail to commit hold to a pod of tenant: %v", err)
+	}
+}
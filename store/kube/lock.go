@@ -0,0 +1,63 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import "sync"
+
+// keyedMutex hands out one mutex per key, so that operations on
+// different keys never block each other, the mutex of a key is
+// forgotten once nobody holds or waits for it
+type keyedMutex struct {
+	sync.Mutex
+
+	locks map[string]*refMutex
+}
+
+// refMutex is a mutex with the count of its holders and waiters
+type refMutex struct {
+	sync.Mutex
+	refs int
+}
+
+func newKeyedMutex() *keyedMutex {
+	return &keyedMutex{
+		locks: make(map[string]*refMutex),
+	}
+}
+
+// LockKey acquires the mutex of key and returns a function releasing it
+func (k *keyedMutex) LockKey(key string) func() {
+	k.Lock()
+	lock, exists := k.locks[key]
+	if !exists {
+		lock = new(refMutex)
+		k.locks[key] = lock
+	}
+	lock.refs++
+	k.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+
+		k.Lock()
+		if lock.refs--; lock.refs == 0 {
+			delete(k.locks, key)
+		}
+		k.Unlock()
+	}
+}
@@ -0,0 +1,125 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const (
+	// IPInfoMetric is the info metric of every using ip, labeled by its owner and where it belongs
+	IPInfoMetric = "kube_ipam_ip_info"
+	// IPInfoLimitedMetric is 1 if per-ip series are dropped for exceeding the cardinality limit
+	IPInfoLimitedMetric = "kube_ipam_ip_info_limited"
+
+	// DefaultIPInfoLimit is the default cardinality limit of IPInfoMetric
+	DefaultIPInfoLimit = 10000
+)
+
+// IPInfoCollector exposes using ips of the cache as per-ip info metrics on scrape, in the
+// Prometheus text format, it is opt-in as the cardinality grows with allocations
+type IPInfoCollector struct {
+	store *Store
+	limit int
+}
+
+// NewIPInfoCollector returns a collector of the using ips of s, no per-ip series are emitted
+// once there are more using ips than limit, DefaultIPInfoLimit is used if limit is not positive
+func NewIPInfoCollector(s *Store, limit int) *IPInfoCollector {
+	if limit <= 0 {
+		limit = DefaultIPInfoLimit
+	}
+	return &IPInfoCollector{store: s, limit: limit}
+}
+
+// ServeHTTP makes the collector a scrape endpoint
+func (c *IPInfoCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := c.Collect(w); err != nil {
+		LoggerStore.Errorf("fail to write ip info metrics: %v", err)
+	}
+}
+
+// Collect writes the metrics to w
+func (c *IPInfoCollector) Collect(w io.Writer) error {
+	usingIPs := c.store.cache.ListUsingIPs()
+	limited := len(usingIPs) > c.limit
+	if limited {
+		LoggerStore.Warnf("%d using ips exceed the limit %d of ip info metrics, no per-ip series are emitted",
+			len(usingIPs), c.limit)
+		usingIPs = nil
+	}
+
+	buf := bufio.NewWriter(w)
+	fmt.Fprintf(buf, "# HELP %s Using ip labeled by its network, pool and owner.\n", IPInfoMetric)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", IPInfoMetric)
+	for _, usingIP := range usingIPs {
+		fmt.Fprintf(buf, "%s{ip=\"%s\",network=\"%s\",pool=\"%s\",namespace=\"%s\",pod=\"%s\",owner=\"%s\"} 1\n",
+			IPInfoMetric, usingIP.IP, escapeLabelValue(usingIP.Network), escapeLabelValue(usingIP.Pool),
+			escapeLabelValue(usingIP.PodNamespace), escapeLabelValue(usingIP.PodName), escapeLabelValue(usingIP.Owner))
+	}
+
+	value := 0
+	if limited {
+		value = 1
+	}
+	fmt.Fprintf(buf, "# HELP %s Whether per-ip series are dropped for exceeding the cardinality limit.\n", IPInfoLimitedMetric)
+	fmt.Fprintf(buf, "# TYPE %s gauge\n", IPInfoLimitedMetric)
+	fmt.Fprintf(buf, "%s %d\n", IPInfoLimitedMetric, value)
+	return buf.Flush()
+}
+
+// objectCounter counts objects by resource
+type objectCounter struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+func newObjectCounter() *objectCounter {
+	return &objectCounter{counts: make(map[string]uint64)}
+}
+
+func (c *objectCounter) inc(resource string) {
+	c.Lock()
+	defer c.Unlock()
+	c.counts[resource]++
+}
+
+// UnexpectedObjectCounts returns the count of informer objects of unexpected types by resource,
+// which is meant to be exported as a counter labeled by resource
+func (s *Store) UnexpectedObjectCounts() map[string]uint64 {
+	s.unexpectedObjects.Lock()
+	defer s.unexpectedObjects.Unlock()
+
+	counts := make(map[string]uint64, len(s.unexpectedObjects.counts))
+	for resource, count := range s.unexpectedObjects.counts {
+		counts[resource] = count
+	}
+	return counts
+}
+
+// labelValueEscaper escapes label values as the text format requires
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(value string) string {
+	return labelValueEscaper.Replace(value)
+}
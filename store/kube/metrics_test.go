@@ -0,0 +1,131 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestIPInfoCollector(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if _, err := s.Allocate("network", "pool", "default", "pod1"); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if _, err := s.Allocate("network", "pool", "default", `pod"2`); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	waitForCache(t, func() bool { return len(s.cache.ListUsingIPs()) == 2 })
+
+	testCases := []struct {
+		name     string
+		limit    int
+		contains []string
+		excludes []string
+	}{
+		{
+			name:  "under limit",
+			limit: 2,
+			contains: []string{
+				`kube_ipam_ip_info{ip="192.168.0.10",network="network",pool="pool",namespace="default",pod="pod1",owner=""} 1`,
+				`kube_ipam_ip_info{ip="192.168.0.11",network="network",pool="pool",namespace="default",pod="pod\"2",owner=""} 1`,
+				"kube_ipam_ip_info_limited 0",
+			},
+		},
+		{
+			name:     "over limit",
+			limit:    1,
+			contains: []string{"kube_ipam_ip_info_limited 1"},
+			excludes: []string{"kube_ipam_ip_info{"},
+		},
+	}
+	for _, tc := range testCases {
+		buf := &bytes.Buffer{}
+		if err := NewIPInfoCollector(s, tc.limit).Collect(buf); err != nil {
+			t.Errorf("test %s fails: %v", tc.name, err)
+			continue
+		}
+		for _, line := range tc.contains {
+			if !strings.Contains(buf.String(), line+"\n") {
+				t.Errorf("test %s fails: expected %s in\n%s", tc.name, line, buf.String())
+			}
+		}
+		for _, line := range tc.excludes {
+			if strings.Contains(buf.String(), line) {
+				t.Errorf("test %s fails: unexpected %s in\n%s", tc.name, line, buf.String())
+			}
+		}
+	}
+
+	recorder := httptest.NewRecorder()
+	NewIPInfoCollector(s, 0).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain") ||
+		!strings.Contains(recorder.Body.String(), "kube_ipam_ip_info_limited 0") {
+		t.Errorf("unexpected scrape response %q: %s", recorder.Header().Get("Content-Type"), recorder.Body.String())
+	}
+}
+
+func TestStore_UnexpectedObjects(t *testing.T) {
+	usingIP := newUsingIP("192-168-0-10", "pod")
+	usingIP.Spec.Network, usingIP.Spec.Pool = "network", "pool"
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")), usingIP)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.10") })
+
+	network := newNetwork("network")
+	lastReservedIP := &v1.LastReservedIP{}
+	lastReservedIP.Name = "network"
+	handlers := []struct {
+		resource string
+		valid    interface{}
+		add      func(obj interface{})
+		update   func(oldObj, newObj interface{})
+		delete   func(obj interface{})
+	}{
+		{"networks", network, s.addNetworkToCache, s.updateNetworkInCache, s.deleteNetworkFromCache},
+		{"lastreservedips", lastReservedIP, s.addLastReservedIPToCache, s.updateLastReservedIPInCache, s.deleteLastReservedIPFromCache},
+		{"usingips", usingIP, s.addUsingIPToCache, s.updateUsingIPInCache, s.deleteUsingIPFromCache},
+	}
+	for _, h := range handlers {
+		// a string stands in for an object of version skew
+		wrong := interface{}("malformed")
+		h.add(wrong)
+		h.update(wrong, h.valid)
+		h.update(h.valid, wrong)
+		h.delete(wrong)
+		h.delete(cache.DeletedFinalStateUnknown{Key: "malformed", Obj: wrong})
+
+		if count := s.UnexpectedObjectCounts()[h.resource]; count != 5 {
+			t.Errorf("expected 5 unexpected objects of %s but got %d", h.resource, count)
+		}
+	}
+
+	if network := s.cache.GetNetwork("network"); network == nil || len(network.Pools) != 1 {
+		t.Errorf("expected network untouched but got %+v", network)
+	}
+	if !s.cache.IsIPUsing("192.168.0.10") || len(s.cache.ListUsingIPs()) != 1 {
+		t.Errorf("expected using ips untouched but got %+v", s.cache.ListUsingIPs())
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+)
+
+// Option configures an optional behavior of Store
+type Option func(*Store)
+
+// WithSnapshotFile makes store load a provisional using ip set from file before
+// informers sync, and save the using ip set to file every period after that,
+// period must be positive or Run fails
+func WithSnapshotFile(path string, period time.Duration) Option {
+	return func(s *Store) {
+		s.snapshotFile = path
+		s.snapshotPeriod = period
+	}
+}
+
+// WithAuditSink makes store record every reservation and release into sink
+func WithAuditSink(sink store.AuditSink) Option {
+	return func(s *Store) {
+		s.auditSink = sink
+	}
+}
+
+// WithEventDebounce makes store coalesce informer events of the same object arriving
+// within delay, so that only the latest one is applied to cache
+func WithEventDebounce(delay time.Duration) Option {
+	return func(s *Store) {
+		s.events = newDebouncer(delay)
+	}
+}
+
+// WithNameEncoder makes store name new using ip records with enc, records named
+// by other schemes are still recognized
+func WithNameEncoder(enc utils.NameEncoder) Option {
+	return func(s *Store) {
+		s.names = enc
+	}
+}
+
+// WithReleaseQuarantine makes store keep a released ip out of allocation for coolDown
+// before its using ip record is actually deleted by a background sweeper
+func WithReleaseQuarantine(coolDown time.Duration) Option {
+	return func(s *Store) {
+		s.quarantine = coolDown
+	}
+}
+
+// WithHoldTimeout sets how long an ip held by Hold is kept before it is released unless committed,
+// it must be positive or Run fails
+func WithHoldTimeout(timeout time.Duration) Option {
+	return func(s *Store) {
+		s.holdTimeout = timeout
+	}
+}
+
+// WithStrictRelease makes Release fail with a *store.UnknownIPError instead of deleting by name
+// if the ip is in no cached pool and has no using ip, which catches bugs of callers at the cost
+// of cleaning up orphans of deleted pools
+func WithStrictRelease() Option {
+	return func(s *Store) {
+		s.strictRelease = true
+	}
+}
+
+// WithCaseInsensitivePoolNames makes AddPool reject a pool whose name differs from
+// an existing one of the network only in case
+func WithCaseInsensitivePoolNames() Option {
+	return func(s *Store) {
+		s.caseInsensitivePoolNames = true
+	}
+}
+
+// WithBulkParallelism limits how many api calls of bulk operations, e.g. releasing orphans,
+// deleting stale reservations and sweeping quarantine, run at the same time
+func WithBulkParallelism(workers int) Option {
+	return func(s *Store) {
+		s.bulkParallelism = workers
+	}
+}
+
+// WithAdvisoryThresholds makes Advisories warn about pools used by at least poolUsage percent
+// of their capacity, and when no more than freeVLANs vlans are left
+func WithAdvisoryThresholds(poolUsage, freeVLANs int) Option {
+	return func(s *Store) {
+		s.poolUsageThreshold = poolUsage
+		s.freeVLANsThreshold = freeVLANs
+	}
+}
+
+// WithLastReservedIPFlushPeriod makes store persist last reserved ips about every period and on
+// shutdown instead of once per reservation, cursors not flushed before a crash only make the
+// next scans start earlier, scans still skip ips in use
+func WithLastReservedIPFlushPeriod(period time.Duration) Option {
+	return func(s *Store) {
+		s.cursorFlushPeriod = period
+	}
+}
+
+// WithDelegatedAllocator makes store ask allocator for the ip of every allocation instead
+// of scanning pools itself, the ips picked are still validated and recorded by store
+func WithDelegatedAllocator(allocator store.DelegatedAllocator) Option {
+	return func(s *Store) {
+		s.delegate = allocator
+	}
+}
+
+// WithRandSource makes random pools pick their first candidates from source, so that
+// the same seed yields the same allocation sequence, e.g. for tests
+func WithRandSource(source rand.Source) Option {
+	return func(s *Store) {
+		s.random = newLockedRand(source)
+	}
+}
+
+// WithNamespaceQuota limits the ips pods of each namespace may hold in a network to quota,
+// reservations beyond it fail with store.QuotaExceededError
+func WithNamespaceQuota(quota int) Option {
+	return func(s *Store) {
+		s.namespaceQuota = quota
+	}
+}
+
+// WithSubnetHostBitsMasked makes pools added or updated with host bits set in their subnets, e.g.
+// 192.168.0.5/24, take the network address of the subnet instead of being rejected
+func WithSubnetHostBitsMasked() Option {
+	return func(s *Store) {
+		s.maskSubnetHostBits = true
+	}
+}
+
+// WithPostReserveHook makes store call hook with every using ip it has just created, a reservation
+// is rolled back and fails if hook returns an error
+func WithPostReserveHook(hook store.PostReserveHook) Option {
+	return func(s *Store) {
+		s.postReserve = hook
+	}
+}
@@ -0,0 +1,63 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+
+	"github.com/mars1024/kube-ipam/types"
+)
+
+// defaultBulkParallelism is how many api calls of a bulk operation run at the same time by default
+const defaultBulkParallelism = 4
+
+// parallelize calls fn for every index in [0, items) with at most workers calls running at
+// the same time, all items are processed and their errors are returned together
+func parallelize(workers, items int, fn func(i int) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > items {
+		workers = items
+	}
+
+	indexes := make(chan int, items)
+	for i := 0; i < items; i++ {
+		indexes <- i
+	}
+	close(indexes)
+
+	lock := sync.Mutex{}
+	errs := types.ErrorList{}
+	wg := sync.WaitGroup{}
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if err := fn(i); err != nil {
+					lock.Lock()
+					errs = append(errs, err)
+					lock.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return errs.ToError()
+}
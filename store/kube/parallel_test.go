@@ -0,0 +1,81 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/types"
+)
+
+func TestParallelize(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		items   int
+	}{
+		{"fewer workers than items", 3, 20},
+		{"more workers than items", 10, 4},
+		{"no item", 3, 0},
+		{"invalid workers", 0, 5},
+	}
+	for _, test := range tests {
+		var running, peak, processed int32
+		seen := make([]int32, test.items)
+		err := parallelize(test.workers, test.items, func(i int) error {
+			current := atomic.AddInt32(&running, 1)
+			defer atomic.AddInt32(&running, -1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if current <= old || atomic.CompareAndSwapInt32(&peak, old, current) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+
+			atomic.AddInt32(&seen[i], 1)
+			atomic.AddInt32(&processed, 1)
+			if i%2 == 1 {
+				return fmt.Errorf("item %d fails", i)
+			}
+			return nil
+		})
+
+		limit := int32(test.workers)
+		if limit < 1 {
+			limit = 1
+		}
+		if peak > limit {
+			t.Errorf("test %s fails: expected at most %d concurrent calls but got %d", test.name, limit, peak)
+		}
+		if int(processed) != test.items {
+			t.Errorf("test %s fails: expected %d items processed but got %d", test.name, test.items, processed)
+		}
+		for i, count := range seen {
+			if count != 1 {
+				t.Errorf("test %s fails: item %d is processed %d times", test.name, i, count)
+			}
+		}
+		errs, _ := err.(types.ErrorList)
+		if len(errs) != test.items/2 {
+			t.Errorf("test %s fails: expected %d errors but got %v", test.name, test.items/2, err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReserveWithPreemption allocates an ip of pool for pod namespace/name with priority like Allocate,
+// and if pool is exhausted, takes over the ip of the pod allocation with the lowest priority below
+// it, the preempted using ip is returned so that its owner can be told, it is nil if a free ip is
+// allocated. Only pods are preempted, never free-form owners, macs or reservations.
+// The victim loses its ip at once instead of being quarantined, since the ip is handed over
+// within the same update, which the resource version guards against concurrent changes.
+func (s *Store) ReserveWithPreemption(networkName, poolName, namespace, name string, priority int32) (net.IP, *types.UsingIP, error) {
+	ip, victim, err := s.reserveWithPreemption(networkName, poolName, namespace, name, priority)
+	if err != nil {
+		s.failures.record(networkName, poolName, err)
+	}
+	return ip, victim, err
+}
+
+func (s *Store) reserveWithPreemption(networkName, poolName, namespace, name string, priority int32) (net.IP, *types.UsingIP, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	template := newPodUsingIP(networkName, poolName, namespace, name)
+	template.Spec.Priority = priority
+	ip, err := s.allocateUsingIP(template, podKey(namespace, name), nil)
+	if err != store.ErrPoolExhausted {
+		return ip, nil, err
+	}
+
+	victim := s.pickPreemptionVictim(networkName, poolName, priority)
+	if victim == nil {
+		return nil, nil, store.ErrPoolExhausted
+	}
+	if s.dryRun {
+		return victim.IP, victim, nil
+	}
+
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	usingIP, err := client.Get(victim.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail to get using ip %s to preempt: %v", victim.Name, err)
+	}
+	// the record may have changed since it was cached
+	if _, quarantined := quarantinedAt(usingIP); quarantined || !isPreemptible(types.GetUsingIPFromCRD(usingIP), priority) {
+		return nil, nil, fmt.Errorf("using ip %s is no longer preemptible", victim.Name)
+	}
+	victim = types.GetUsingIPFromCRD(usingIP)
+
+	preempted := usingIP.DeepCopy()
+	setUsingIPOwner(preempted, template)
+	delete(preempted.Labels, IdempotencyKeyLabel)
+	if pool, err := s.getPool(networkName, poolName); err == nil {
+		preempted.Spec.PoolGeneration = pool.Generation
+	}
+	if _, err := client.Update(preempted); err != nil {
+		return nil, nil, fmt.Errorf("fail to preempt ip %s of %s/%s: %v", victim.IP, victim.PodNamespace, victim.PodName, err)
+	}
+
+	now := time.Now()
+	s.auditSink.RecordRelease(&store.AuditEntry{
+		Time:         now,
+		IP:           victim.IP.String(),
+		Network:      networkName,
+		Pool:         poolName,
+		PodNamespace: victim.PodNamespace,
+		PodName:      victim.PodName,
+	})
+	s.auditSink.RecordReserve(&store.AuditEntry{
+		Time:         now,
+		IP:           victim.IP.String(),
+		Network:      networkName,
+		Pool:         poolName,
+		PodNamespace: namespace,
+		PodName:      name,
+	})
+	LoggerStore.Infof("ip %s of %s/%s with priority %d preempted by %s/%s with priority %d",
+		victim.IP, victim.PodNamespace, victim.PodName, victim.Priority, namespace, name, priority)
+	return victim.IP, victim, nil
+}
+
+// pickPreemptionVictim returns the pod allocation of pool with the lowest priority below priority,
+// the lowest ip among those of the same priority, nil if there is none
+func (s *Store) pickPreemptionVictim(networkName, poolName string, priority int32) *types.UsingIP {
+	var victim *types.UsingIP
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.Network != networkName || usingIP.Pool != poolName || !isPreemptible(usingIP, priority) {
+			continue
+		}
+		if victim == nil || usingIP.Priority < victim.Priority ||
+			usingIP.Priority == victim.Priority && bytes.Compare(usingIP.IP.To16(), victim.IP.To16()) < 0 {
+			victim = usingIP
+		}
+	}
+	return victim
+}
+
+// isPreemptible checks that usingIP is held by a pod with lower priority than priority, protected
+// ips are never preempted
+func isPreemptible(usingIP *types.UsingIP, priority int32) bool {
+	return usingIP.IP != nil && len(usingIP.PodName) > 0 && len(usingIP.PodNamespace) > 0 &&
+		usingIP.Priority < priority && !usingIP.Protected
+}
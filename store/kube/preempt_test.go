@@ -0,0 +1,93 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/store"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_ReserveWithPreemption(t *testing.T) {
+	newPriorityUsingIP := func(name, podName string, priority int32) *v1.UsingIP {
+		usingIP := newUsingIP(name, podName)
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = "pool"
+		usingIP.Spec.Priority = priority
+		return usingIP
+	}
+	vip := newUsingIP("192-168-0-12", "")
+	vip.Spec.Network = "network"
+	vip.Spec.Pool = "pool"
+	vip.Spec.Owner = "vip"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.12")),
+		newPriorityUsingIP("192-168-0-10", "pod1", 5),
+		newPriorityUsingIP("192-168-0-11", "pod2", 1),
+		vip)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.12") })
+
+	// neither pods of the same priority nor free-form owners are preempted
+	if _, _, err := s.ReserveWithPreemption("network", "pool", "default", "pod3", 1); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted without preemptible victim but got %v", err)
+	}
+
+	ip, victim, err := s.ReserveWithPreemption("network", "pool", "default", "pod3", 10)
+	if err != nil {
+		t.Fatalf("fail to reserve with preemption: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.0.11")) || victim == nil || victim.PodName != "pod2" {
+		t.Errorf("expected ip 192.168.0.11 preempted from pod2 but got %s from %+v", ip, victim)
+	}
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-11", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get using ip: %v", err)
+	}
+	if usingIP.Spec.PodName != "pod3" || usingIP.Spec.Priority != 10 {
+		t.Errorf("expected using ip owned by pod3 with priority 10 but got %+v", usingIP.Spec)
+	}
+	waitForCache(t, func() bool { return s.cache.GetUsingIP("192.168.0.11").PodName == "pod3" })
+
+	// pod1 is the only one left below priority 6
+	if ip, victim, err := s.ReserveWithPreemption("network", "pool", "default", "pod4", 6); err != nil || victim == nil || victim.PodName != "pod1" {
+		t.Errorf("expected pod1 preempted but got %s from %+v: %v", ip, victim, err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetUsingIP("192.168.0.10").PodName == "pod4" })
+	if _, _, err := s.ReserveWithPreemption("network", "pool", "default", "pod5", 6); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted once no lower priority is left but got %v", err)
+	}
+}
+
+func TestStore_ReserveWithPreemptionFree(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip, victim, err := s.ReserveWithPreemption("network", "pool", "default", "pod1", 3)
+	if err != nil || victim != nil || !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("expected free ip 192.168.0.10 without preemption but got %s from %+v: %v", ip, victim, err)
+	}
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-10", metav1.GetOptions{})
+	if err != nil || usingIP.Spec.Priority != 3 {
+		t.Errorf("expected priority 3 recorded but got %+v: %v", usingIP, err)
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/mars1024/kube-ipam/store"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SetProtected marks the using ip of ip as protected or not, a protected ip is skipped by
+// Release, ReleaseByName and ReleaseAll unless the latter is forced
+func (s *Store) SetProtected(ip net.IP, protected bool) error {
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	usingIP, err := client.Get(s.usingIPName(ip), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return newValidationError("ip %s is not in use", ip)
+	}
+	if err != nil {
+		return fmt.Errorf("fail to get using ip of %s: %v", ip, err)
+	}
+	if _, quarantined := quarantinedAt(usingIP); quarantined {
+		return newValidationError("ip %s is released already", ip)
+	}
+	if usingIP.Spec.Protected == protected || s.dryRun {
+		return nil
+	}
+
+	usingIP = usingIP.DeepCopy()
+	usingIP.Spec.Protected = protected
+	if _, err := client.Update(usingIP); err != nil {
+		return fmt.Errorf("fail to update protection of ip %s: %v", ip, err)
+	}
+	return nil
+}
+
+// ReleaseAll releases every ip held in pool of network and returns the count released,
+// protected ips are skipped and reported by a store.ProtectedIPError unless force is set
+func (s *Store) ReleaseAll(networkName, poolName string, force bool) (int, error) {
+	var protected []net.IP
+	released := 0
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.Network != networkName || usingIP.Pool != poolName ||
+			len(usingIP.PodName) == 0 && len(usingIP.Owner) == 0 && len(usingIP.MAC) == 0 {
+			continue
+		}
+		if usingIP.Protected && !force {
+			protected = append(protected, usingIP.IP)
+			continue
+		}
+		if usingIP.Protected {
+			LoggerStore.Warnf("force releasing protected ip %s of %s in network %s", usingIP.IP, usingIP.Name, networkName)
+		}
+		if err := s.release(usingIP.IP, nil); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return released, err
+		}
+		released++
+	}
+	if len(protected) > 0 {
+		return released, &store.ProtectedIPError{IPs: protected}
+	}
+	return released, nil
+}
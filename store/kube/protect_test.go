@@ -0,0 +1,86 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/store"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_ReleaseProtected(t *testing.T) {
+	newPoolUsingIP := func(name, podName string) *v1.UsingIP {
+		usingIP := newUsingIP(name, podName)
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = "pool"
+		return usingIP
+	}
+	vip := newUsingIP("192-168-0-12", "")
+	vip.Spec.Network, vip.Spec.Pool, vip.Spec.Owner = "network", "pool", "vip"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newPoolUsingIP("192-168-0-10", "pod1"),
+		newPoolUsingIP("192-168-0-11", "pod1"),
+		vip)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.12") })
+
+	if err := s.SetProtected(net.ParseIP("192.168.0.15"), true); failureReason(err) != FailureValidation {
+		t.Errorf("protecting a free ip should be rejected but got %v", err)
+	}
+	for _, ip := range []string{"192.168.0.11", "192.168.0.12"} {
+		if err := s.SetProtected(net.ParseIP(ip), true); err != nil {
+			t.Fatalf("fail to protect ip %s: %v", ip, err)
+		}
+	}
+	waitForCache(t, func() bool {
+		return s.cache.GetUsingIP("192.168.0.11").Protected && s.cache.GetUsingIP("192.168.0.12").Protected
+	})
+
+	if _, ok := s.Release(net.ParseIP("192.168.0.12")).(*store.ProtectedIPError); !ok {
+		t.Errorf("releasing a protected ip should be refused")
+	}
+	err := s.ReleaseByName("network", "pool", "default", "pod1")
+	if protectedErr, ok := err.(*store.ProtectedIPError); !ok || len(protectedErr.IPs) != 1 || !protectedErr.IPs[0].Equal(net.ParseIP("192.168.0.11")) {
+		t.Errorf("expected 192.168.0.11 reported as protected but got %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing("192.168.0.10") })
+
+	released, err := s.ReleaseAll("network", "pool", false)
+	if protectedErr, ok := err.(*store.ProtectedIPError); !ok || len(protectedErr.IPs) != 2 || released != 0 {
+		t.Errorf("expected both protected ips to survive release all but got %d released: %v", released, err)
+	}
+	for _, name := range []string{"192-168-0-11", "192-168-0-12"} {
+		if _, err := s.resourceClient.ResourceV1().UsingIPs().Get(name, metav1.GetOptions{}); err != nil {
+			t.Errorf("protected using ip %s should be kept but got %v", name, err)
+		}
+	}
+
+	if released, err := s.ReleaseAll("network", "pool", true); err != nil || released != 2 {
+		t.Errorf("expected 2 ips released by force but got %d: %v", released, err)
+	}
+	for _, name := range []string{"192-168-0-11", "192-168-0-12"} {
+		if _, err := s.resourceClient.ResourceV1().UsingIPs().Get(name, metav1.GetOptions{}); !errors.IsNotFound(err) {
+			t.Errorf("using ip %s should be released by force but got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"time"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quarantineUsingIP marks using ip name as released at now instead of deleting it, the
+// pod, owner and mac are cleared so that it is not reported as used by anyone
+func (s *Store) quarantineUsingIP(name string, options *metav1.DeleteOptions) error {
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	usingIP, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if _, quarantined := quarantinedAt(usingIP); quarantined {
+		return errors.NewNotFound(resourcev1.Resource(resourcev1.UsingIPsResource), name)
+	}
+	if options != nil && options.Preconditions != nil && options.Preconditions.UID != nil &&
+		*options.Preconditions.UID != usingIP.UID {
+		return errors.NewConflict(resourcev1.Resource(resourcev1.UsingIPsResource), name, nil)
+	}
+
+	usingIP = usingIP.DeepCopy()
+	if usingIP.Annotations == nil {
+		usingIP.Annotations = make(map[string]string, 1)
+	}
+	usingIP.Annotations[QuarantinedAtAnnotation] = time.Now().Format(time.RFC3339Nano)
+	usingIP.Spec.PodNamespace = ""
+	usingIP.Spec.PodName = ""
+	usingIP.Spec.Owner = ""
+	usingIP.Spec.MAC = ""
+	usingIP.Spec.NodeName = ""
+	usingIP.Spec.Metadata = nil
+	usingIP.Spec.ContainerID = ""
+	usingIP.Spec.IfName = ""
+	usingIP.Spec.Priority = 0
+	usingIP.Spec.Protected = false
+	delete(usingIP.Labels, IdempotencyKeyLabel)
+	delete(usingIP.Labels, HoldTokenLabel)
+	delete(usingIP.Annotations, HeldUntilAnnotation)
+	_, err = client.Update(usingIP)
+	return err
+}
+
+// sweepQuarantine deletes quarantined using ips whose cool-down has elapsed
+func (s *Store) sweepQuarantine() {
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		LoggerStore.Warnf("fail to list using ips to sweep quarantine: %v", err)
+		return
+	}
+
+	now := time.Now()
+	expired := make([]*resourcev1.UsingIP, 0)
+	for i := range list.Items {
+		releasedAt, quarantined := quarantinedAt(&list.Items[i])
+		if quarantined && now.Sub(releasedAt) >= s.quarantine {
+			expired = append(expired, &list.Items[i])
+		}
+	}
+	// failures are logged one by one, the aggregated error has nothing more
+	_ = parallelize(s.bulkParallelism, len(expired), func(i int) error {
+		usingIP := expired[i]
+		// the precondition guards against deleting a re-created using ip
+		err := s.deleteUsingIP(usingIP.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &usingIP.UID},
+		})
+		if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+			LoggerStore.Warnf("fail to delete quarantined using ip %s: %v", usingIP.Name, err)
+			return err
+		}
+		LoggerStore.Debugf("quarantine of using ip %s is over", usingIP.Name)
+		return nil
+	})
+}
+
+// quarantinedAt returns when usingIP was released if it is quarantined, a malformed
+// timestamp is treated as released long ago so that the record is not kept forever
+func quarantinedAt(usingIP *resourcev1.UsingIP) (time.Time, bool) {
+	value, ok := usingIP.Annotations[QuarantinedAtAnnotation]
+	if !ok {
+		return time.Time{}, false
+	}
+	releasedAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return time.Time{}, true
+	}
+	return releasedAt, true
+}
@@ -0,0 +1,93 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_ReleaseQuarantine(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithReleaseQuarantine(300 * time.Millisecond)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	released, err := s.Allocate("network", "pool", "default", "a")
+	if err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if _, err := s.Allocate("network", "pool", "default", "b"); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	waitForCache(t, func() bool { return len(s.cache.IPsForPod("default", "a")) == 1 })
+	if err := s.Release(released); err != nil {
+		t.Fatalf("fail to release %s: %v", released, err)
+	}
+	waitForCache(t, func() bool {
+		usingIP := s.cache.GetUsingIP(released.String())
+		return usingIP == nil || len(usingIP.PodName) == 0
+	})
+
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(released), metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected quarantined using ip of %s but got %v", released, err)
+	}
+	if _, quarantined := quarantinedAt(usingIP); !quarantined {
+		t.Errorf("expected %s quarantined but got annotations %v", released, usingIP.Annotations)
+	}
+	if err := s.Release(released); err == nil {
+		t.Errorf("expected releasing a quarantined ip to fail")
+	}
+	if _, err := s.Allocate("network", "pool", "default", "c"); err != store.ErrPoolExhausted {
+		t.Errorf("expected pool exhausted during cool-down but got %v", err)
+	}
+
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing(released.String()) })
+	ip, err := s.Allocate("network", "pool", "default", "c")
+	if err != nil {
+		t.Fatalf("fail to allocate after cool-down: %v", err)
+	}
+	if !ip.Equal(released) {
+		t.Errorf("expected %s after cool-down but got %s", released, ip)
+	}
+}
+
+func TestStore_ReleaseQuarantineBlockRollback(t *testing.T) {
+	s, stop := newTestStoreWithOptions(t, []Option{WithReleaseQuarantine(time.Hour)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	// a partially reserved block is dropped at once instead of quarantined
+	if _, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.11")); err != nil {
+		t.Fatalf("fail to reserve: %v", err)
+	}
+	block := []net.IP{net.ParseIP("192.168.0.10"), net.ParseIP("192.168.0.11")}
+	if reserved, _ := s.reserveBlock("network", "pool", "owner", block); reserved {
+		t.Fatalf("expected block not reserved")
+	}
+	_, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(block[0]), metav1.GetOptions{})
+	if err == nil {
+		t.Errorf("expected %s deleted without quarantine", block[0])
+	}
+}
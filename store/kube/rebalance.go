@@ -0,0 +1,171 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"sort"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Rebalance evens out the utilization of the enabled pools of network, e.g. after pools are added,
+// by moving allocations of the most utilized pool to the least utilized one, one by one, until
+// another move would not make them closer or maxMoves allocations are moved. The most recently
+// created allocations are moved first, and each of them gets a new ip of the target pool before
+// the old one is released, so that owners have to pick the new ip up. Protected ips, holds and
+// ips managed by reservations are never moved, failed moves are reported and left in place.
+func (s *Store) Rebalance(networkName string, maxMoves int) (*store.RebalanceReport, error) {
+	if maxMoves <= 0 {
+		return nil, newValidationError("max moves %d of rebalancing must be positive", maxMoves)
+	}
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		return nil, newValidationError("network %s is not in cache", networkName)
+	}
+
+	// the api is listed instead of cache so that allocations just made are counted
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list using ips: %v", err)
+	}
+	used := make(map[string]int)
+	movable := make(map[string][]*resourcev1.UsingIP)
+	for i := range usingIPs.Items {
+		usingIP := &usingIPs.Items[i]
+		if usingIP.Spec.Network != networkName {
+			continue
+		}
+		if _, quarantined := quarantinedAt(usingIP); quarantined {
+			continue
+		}
+		used[usingIP.Spec.Pool]++
+		if isMovable(usingIP) {
+			movable[usingIP.Spec.Pool] = append(movable[usingIP.Spec.Pool], usingIP)
+		}
+	}
+	for _, candidates := range movable {
+		sort.SliceStable(candidates, func(i, j int) bool {
+			if !candidates[i].CreationTimestamp.Equal(&candidates[j].CreationTimestamp) {
+				return candidates[j].CreationTimestamp.Before(&candidates[i].CreationTimestamp)
+			}
+			return candidates[i].Name > candidates[j].Name
+		})
+	}
+	capacity := make(map[string]int)
+	for _, pool := range network.Pools {
+		if !pool.Disabled && pool.Capacity() > 0 {
+			capacity[pool.Name] = pool.Capacity()
+		}
+	}
+
+	report := &store.RebalanceReport{Failed: make(map[string]string)}
+	for len(report.Moved) < maxMoves {
+		hot, cold := mostAndLeastUtilized(capacity, used, movable)
+		// a move is only worth it if the target is still no more utilized than the source after it
+		if len(hot) == 0 || len(cold) == 0 || (used[cold]+1)*capacity[hot] > (used[hot]-1)*capacity[cold] {
+			break
+		}
+
+		usingIP := movable[hot][0]
+		movable[hot] = movable[hot][1:]
+		move, err := s.moveUsingIP(usingIP, cold)
+		if err != nil {
+			report.Failed[usingIP.Name] = err.Error()
+			continue
+		}
+		used[hot]--
+		used[cold]++
+		report.Moved = append(report.Moved, *move)
+	}
+
+	LoggerStore.Infof("network %s rebalanced, %d allocations moved, %d failed", networkName, len(report.Moved), len(report.Failed))
+	return report, nil
+}
+
+// mostAndLeastUtilized picks the most utilized pool with movable allocations and the least
+// utilized pool, ties are broken by names so that rebalancing is deterministic
+func mostAndLeastUtilized(capacity, used map[string]int, movable map[string][]*resourcev1.UsingIP) (hot, cold string) {
+	pools := make([]string, 0, len(capacity))
+	for pool := range capacity {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		if len(movable[pool]) > 0 && (len(hot) == 0 || used[pool]*capacity[hot] > used[hot]*capacity[pool]) {
+			hot = pool
+		}
+		if used[pool] < capacity[pool] && (len(cold) == 0 || used[pool]*capacity[cold] < used[cold]*capacity[pool]) {
+			cold = pool
+		}
+	}
+	if hot == cold {
+		return "", ""
+	}
+	return hot, cold
+}
+
+// isMovable checks if the allocation of usingIP may be moved to another pool
+func isMovable(usingIP *resourcev1.UsingIP) bool {
+	if usingIP.Spec.Protected || usingIP.Labels[ManagedByLabel] == ManagedByReconciler {
+		return false
+	}
+	_, held := heldUntil(usingIP)
+	return !held
+}
+
+// moveUsingIP allocates an ip of toPool for the owner of usingIP and then releases the ip of usingIP,
+// the new ip is deleted again if the old one fails to be released, e.g. as it is released meanwhile
+func (s *Store) moveUsingIP(usingIP *resourcev1.UsingIP, toPool string) (*store.RebalanceMove, error) {
+	from, err := utils.DecodeName(usingIP.Name)
+	if err != nil {
+		return nil, err
+	}
+	networkName := usingIP.Spec.Network
+	defer s.networkLocks.LockKey(networkName)()
+
+	template := &resourcev1.UsingIP{Spec: resourcev1.UsingIPSpec{Network: networkName, Pool: toPool}}
+	setUsingIPOwner(template, usingIP)
+	key := usingIP.Spec.Owner
+	if len(usingIP.Spec.PodName) > 0 {
+		key = podKey(usingIP.Spec.PodNamespace, usingIP.Spec.PodName)
+	}
+	to, err := s.allocateUsingIP(template, key, nil)
+	if err != nil {
+		return nil, fmt.Errorf("fail to allocate from pool %s: %v", toPool, err)
+	}
+
+	// the precondition guards against releasing the ip of another owner reserved since it was listed
+	err = s.release(from, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &usingIP.UID},
+	})
+	if err != nil {
+		if rollbackErr := s.deleteUsingIP(s.usingIPName(to), nil); rollbackErr != nil {
+			LoggerStore.Errorf("fail to roll back ip %s allocated to replace %s: %v", to, from, rollbackErr)
+		}
+		return nil, fmt.Errorf("fail to release ip %s: %v", from, err)
+	}
+
+	LoggerStore.Infof("allocation of %s moved from ip %s of pool %s to ip %s of pool %s",
+		usingIPOwner(&usingIP.Spec), from, usingIP.Spec.Pool, to, toPool)
+	return &store.RebalanceMove{FromPool: usingIP.Spec.Pool, FromIP: from, ToPool: toPool, ToIP: to}, nil
+}
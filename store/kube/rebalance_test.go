@@ -0,0 +1,83 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestStore_Rebalance(t *testing.T) {
+	objs := []runtime.Object{newNetwork("network",
+		newTestPool("hot", "192.168.0.10", "192.168.0.19"),
+		newTestPool("cold", "192.168.0.30", "192.168.0.39"))}
+	created := time.Now().Add(-time.Hour)
+	for i := 0; i < 6; i++ {
+		usingIP := newUsingIP(fmt.Sprintf("192-168-0-1%d", i), fmt.Sprintf("pod%d", i))
+		usingIP.Spec.PodNamespace, usingIP.Spec.Network, usingIP.Spec.Pool = "default", "network", "hot"
+		usingIP.CreationTimestamp = metav1.NewTime(created.Add(time.Duration(i) * time.Minute))
+		// the newest one is protected and never moved
+		usingIP.Spec.Protected = i == 5
+		objs = append(objs, usingIP)
+	}
+	s, stop := newTestStore(t, objs...)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "hot") == 6 })
+
+	if _, err := s.Rebalance("network", 0); failureReason(err) != FailureValidation {
+		t.Errorf("expected validation error without moves allowed but got %v", err)
+	}
+
+	report, err := s.Rebalance("network", 2)
+	if err != nil {
+		t.Fatalf("fail to rebalance: %v", err)
+	}
+	if len(report.Moved) != 2 || len(report.Failed) != 0 {
+		t.Fatalf("expected 2 moves but got %+v", report)
+	}
+	for i, from := range []string{"192.168.0.14", "192.168.0.13"} {
+		move := report.Moved[i]
+		if !move.FromIP.Equal(net.ParseIP(from)) || move.FromPool != "hot" || move.ToPool != "cold" {
+			t.Errorf("move %d expected from %s of hot to cold but got %+v", i, from, move)
+		}
+	}
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "cold") == 2 })
+	if ips := s.cache.IPsForPod("default", "pod4"); len(ips) != 1 || !ips[0].Equal(report.Moved[0].ToIP) {
+		t.Errorf("expected pod4 holding %s but got %v", report.Moved[0].ToIP, ips)
+	}
+
+	// one more move balances the pools at 3 each
+	report, err = s.Rebalance("network", 10)
+	if err != nil {
+		t.Fatalf("fail to rebalance: %v", err)
+	}
+	if len(report.Moved) != 1 || !report.Moved[0].FromIP.Equal(net.ParseIP("192.168.0.12")) {
+		t.Errorf("expected 192.168.0.12 moved alone but got %+v", report)
+	}
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "cold") == 3 })
+	if report, err := s.Rebalance("network", 10); err != nil || len(report.Moved) != 0 {
+		t.Errorf("expected balanced pools left untouched but got %+v: %v", report, err)
+	}
+	if !s.cache.IsIPUsing("192.168.0.15") {
+		t.Errorf("expected protected ip 192.168.0.15 kept")
+	}
+}
@@ -0,0 +1,188 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"strings"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/types"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ReconcileOrphans finds using ips which fall in no current pool of their network,
+// e.g. after a pool shrinks or is deleted, and releases them as well if release is set
+func (s *Store) ReconcileOrphans(release bool) ([]*types.UsingIP, error) {
+	orphans := make([]*types.UsingIP, 0)
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if network := s.cache.GetNetwork(usingIP.Network); network != nil {
+			if _, found := network.FindPoolForIP(usingIP.IP); found {
+				continue
+			}
+		}
+		LoggerStore.Warnf("using ip %s is out of all pools of network %s", usingIP.IP, usingIP.Network)
+		orphans = append(orphans, usingIP)
+	}
+
+	if !release || s.dryRun {
+		return orphans, nil
+	}
+	err := parallelize(s.bulkParallelism, len(orphans), func(i int) error {
+		if err := s.release(orphans[i].IP, nil); err != nil && !errors.IsNotFound(err) {
+			return fmt.Errorf("fail to release orphan using ip %s: %v", orphans[i].IP, err)
+		}
+		return nil
+	})
+	return orphans, err
+}
+
+// networkPlan is what ReconcileNetwork changes, by pool names
+type networkPlan struct {
+	added   []string
+	updated []string
+	deleted []string
+}
+
+func (p *networkPlan) empty() bool {
+	return len(p.added) == 0 && len(p.updated) == 0 && len(p.deleted) == 0
+}
+
+// ReconcileNetwork makes the pools and default pool of network those of desired with a single write,
+// pools are added, updated and deleted under the rules of AddPool and UpdatePool, pools holding live
+// using ips are never deleted, all problems found are reported together as an ErrorList and nothing
+// is written if there is any, pools left unchanged are written back as they are
+func (s *Store) ReconcileNetwork(desired *types.Network) error {
+	if desired == nil {
+		return newValidationError("network is required to reconcile")
+	}
+	desired = desired.DeepCopy()
+	defer s.networkLocks.LockKey(desired.Name)()
+
+	errs := types.ErrorList{}
+	for _, pool := range desired.Pools {
+		if err := s.canonicalizePool(pool); err != nil {
+			if list, ok := err.(types.ErrorList); ok {
+				errs = append(errs, list...)
+			} else {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	if err := desired.ValidateWithOptions(types.ValidateOptions{CaseInsensitiveNames: s.caseInsensitivePoolNames}); err != nil {
+		return err
+	}
+	current := s.cache.GetNetwork(desired.Name)
+	if current == nil {
+		return fmt.Errorf("network %s is not in cache", desired.Name)
+	}
+
+	plan, err := planNetwork(current, desired, s.cache.ListUsingIPs())
+	if err != nil {
+		return err
+	}
+	if plan.empty() && current.DefaultPool == desired.DefaultPool && current.PoolPolicy == desired.PoolPolicy {
+		return nil
+	}
+
+	network, err := s.resourceClient.ResourceV1().Networks().Get(desired.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	unchanged := make(map[string]resourcev1.Pool, len(network.Spec.Pools))
+	for _, pool := range network.Spec.Pools {
+		unchanged[pool.Name] = pool
+	}
+	for _, name := range append(plan.added, plan.updated...) {
+		delete(unchanged, name)
+	}
+	networkClone := network.DeepCopy()
+	networkClone.Spec.Pools = make([]resourcev1.Pool, 0, len(desired.Pools))
+	for _, pool := range desired.Pools {
+		if crd, ok := unchanged[pool.Name]; ok {
+			networkClone.Spec.Pools = append(networkClone.Spec.Pools, crd)
+		} else {
+			networkClone.Spec.Pools = append(networkClone.Spec.Pools, pool.ToCRD())
+		}
+	}
+	networkClone.Spec.DefaultPool = desired.DefaultPool
+	networkClone.Spec.PoolPolicy = string(desired.PoolPolicy)
+	if s.dryRun {
+		return nil
+	}
+	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+		return fmt.Errorf("fail to update network %s: %v", desired.Name, err)
+	}
+	LoggerStore.Infof("network %s reconciled, pools added %v, updated %v, deleted %v",
+		desired.Name, plan.added, plan.updated, plan.deleted)
+	return nil
+}
+
+// planNetwork diffs the pools of desired against those of current, desired pools must be canonical,
+// and their generations are filled like AddPool and UpdatePool do, changes dropping or deleting
+// live using ips are reported together as an ErrorList
+func planNetwork(current, desired *types.Network, usingIPs []*types.UsingIP) (*networkPlan, error) {
+	plan := &networkPlan{}
+	errs := types.ErrorList{}
+	for _, pool := range desired.Pools {
+		old := current.GetPool(pool.Name)
+		if old == nil {
+			if pool.Generation == 0 {
+				pool.Generation = orphanedGeneration(usingIPs, desired.Name, pool.Name)
+			}
+			plan.added = append(plan.added, pool.Name)
+			continue
+		}
+
+		if pool.Generation == 0 {
+			pool.Generation = old.Generation
+		} else if pool.Generation < old.Generation {
+			errs = append(errs, fmt.Errorf("generation %d of pool %s is older than %d", pool.Generation, pool.Name, old.Generation))
+			continue
+		}
+		if old.Equal(pool) {
+			continue
+		}
+		var dropped []string
+		for _, usingIP := range usingIPs {
+			if usingIP.Network == desired.Name && old.Contains(usingIP.IP) && !pool.Contains(usingIP.IP) {
+				dropped = append(dropped, usingIP.IP.String())
+			}
+		}
+		if len(dropped) > 0 {
+			errs = append(errs, fmt.Errorf("new pool %s drops live using ips %s", pool.Name, strings.Join(dropped, ", ")))
+			continue
+		}
+		plan.updated = append(plan.updated, pool.Name)
+	}
+
+	for _, old := range current.Pools {
+		if desired.GetPool(old.Name) != nil {
+			continue
+		}
+		if live := liveUsingIPsOfPool(usingIPs, desired.Name, old.Name); len(live) > 0 {
+			errs = append(errs, fmt.Errorf("pool %s to delete holds live using ips %s", old.Name, strings.Join(live, ", ")))
+			continue
+		}
+		plan.deleted = append(plan.deleted, old.Name)
+	}
+	return plan, errs.ToError()
+}
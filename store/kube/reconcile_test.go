@@ -0,0 +1,152 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_ReconcileOrphans(t *testing.T) {
+	newNetworkUsingIP := func(name, network string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = network
+		usingIP.Spec.Pool = "pool"
+		return usingIP
+	}
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newNetworkUsingIP("192-168-0-10", "network"),
+		newNetworkUsingIP("192-168-0-30", "network"),
+		newNetworkUsingIP("192-168-0-11", "deleted"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return len(s.cache.ListUsingIPs()) == 3 && s.cache.GetNetwork("network") != nil
+	})
+
+	expected := []string{"192.168.0.11", "192.168.0.30"}
+	check := func(orphans []*types.UsingIP) {
+		if len(orphans) != len(expected) {
+			t.Fatalf("expected orphans %v but got %d", expected, len(orphans))
+		}
+		for i, orphan := range orphans {
+			if !orphan.IP.Equal(net.ParseIP(expected[i])) {
+				t.Errorf("expected orphan %s but got %s", expected[i], orphan.IP)
+			}
+		}
+	}
+
+	orphans, err := s.ReconcileOrphans(false)
+	if err != nil {
+		t.Fatalf("fail to reconcile orphans: %v", err)
+	}
+	check(orphans)
+	if len(s.cache.ListUsingIPs()) != 3 {
+		t.Errorf("orphans should be kept when release is not set")
+	}
+
+	orphans, err = s.ReconcileOrphans(true)
+	if err != nil {
+		t.Fatalf("fail to reconcile orphans: %v", err)
+	}
+	check(orphans)
+	waitForCache(t, func() bool {
+		usingIPs := s.cache.ListUsingIPs()
+		return len(usingIPs) == 1 && usingIPs[0].IP.Equal(net.ParseIP("192.168.0.10"))
+	})
+}
+
+func TestStore_ReconcileNetwork(t *testing.T) {
+	usingIP := newUsingIP("192-168-0-15", "pod")
+	usingIP.Spec.PodNamespace = "default"
+	usingIP.Spec.Network = "network"
+	usingIP.Spec.Pool = "changed"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("changed", "192.168.0.10", "192.168.0.20"), newTestPool("removed", "192.168.0.30", "192.168.0.40")),
+		usingIP)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.15") })
+
+	newDesired := func(pools ...v1.Pool) *types.Network {
+		network, err := types.GetNetworkFromCRD(newNetwork("network", pools...))
+		if err != nil {
+			t.Fatalf("fail to convert network: %v", err)
+		}
+		return network
+	}
+	updates := func() int {
+		count := 0
+		for _, action := range s.resourceClient.(*fake.Clientset).Actions() {
+			if action.Matches("update", "networks") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// live using ips are protected, and nothing is written
+	failures := []*types.Network{
+		newDesired(newTestPool("changed", "192.168.0.16", "192.168.0.20")),
+		newDesired(newTestPool("added", "192.168.0.10", "192.168.0.20")),
+	}
+	for _, desired := range failures {
+		if err := s.ReconcileNetwork(desired); err == nil {
+			t.Errorf("reconciling to %+v should fail", desired.Pools)
+		}
+	}
+	if updates() != 0 {
+		t.Fatalf("failed reconciles should write nothing but got %d updates", updates())
+	}
+
+	desired := newDesired(newTestPool("changed", "192.168.0.10", "192.168.0.25"), newTestPool("added", "192.168.0.50", "192.168.0.60"))
+	current := s.cache.GetNetwork("network")
+	plan, err := planNetwork(current, desired.DeepCopy(), s.cache.ListUsingIPs())
+	if err != nil {
+		t.Fatalf("fail to plan: %v", err)
+	}
+	if len(plan.added) != 1 || plan.added[0] != "added" || len(plan.updated) != 1 || plan.updated[0] != "changed" ||
+		len(plan.deleted) != 1 || plan.deleted[0] != "removed" {
+		t.Errorf("unexpected plan %+v", plan)
+	}
+
+	if err := s.ReconcileNetwork(desired); err != nil {
+		t.Fatalf("fail to reconcile network: %v", err)
+	}
+	if updates() != 1 {
+		t.Errorf("expected a single update but got %d", updates())
+	}
+	network, err := s.resourceClient.ResourceV1().Networks().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get network: %v", err)
+	}
+	pools := network.Spec.Pools
+	if len(pools) != 2 || pools[0].Name != "changed" || pools[0].PoolEnd != "192.168.0.25" || pools[1].Name != "added" {
+		t.Errorf("unexpected pools after reconcile %+v", pools)
+	}
+
+	// reconciling to the same state again writes nothing
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network").GetPool("added") != nil })
+	if err := s.ReconcileNetwork(desired); err != nil || updates() != 1 {
+		t.Errorf("reconciling an unchanged network should write nothing but got %d updates: %v", updates(), err)
+	}
+}
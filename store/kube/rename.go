@@ -0,0 +1,231 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"reflect"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// RenameNetwork recreates network oldName as newName and migrates all using ips and the last
+// reserved ip of it, changes already made are rolled back if any step fails
+func (s *Store) RenameNetwork(oldName, newName string) error {
+	if oldName == newName {
+		return fmt.Errorf("network %s can not be renamed to itself", oldName)
+	}
+	if err := validateNetworkName(newName); err != nil {
+		return err
+	}
+
+	// networks are locked in order so that concurrent renames can not deadlock
+	first, second := oldName, newName
+	if second < first {
+		first, second = second, first
+	}
+	defer s.networkLocks.LockKey(first)()
+	defer s.networkLocks.LockKey(second)()
+
+	client := s.resourceClient.ResourceV1()
+	network, err := client.Networks().Get(oldName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("fail to get network %s: %v", oldName, err)
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	var undo []func() error
+	rollback := func(cause error) error {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if err := undo[i](); err != nil {
+				LoggerStore.Errorf("fail to roll back renaming network %s to %s: %v", oldName, newName, err)
+			}
+		}
+		return fmt.Errorf("fail to rename network %s to %s: %v", oldName, newName, cause)
+	}
+
+	renamed := &resourcev1.Network{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        newName,
+			Labels:      network.Labels,
+			Annotations: network.Annotations,
+		},
+		Spec: *network.Spec.DeepCopy(),
+	}
+	if _, err := client.Networks().Create(renamed); err != nil {
+		return rollback(err)
+	}
+	undo = append(undo, func() error {
+		return client.Networks().Delete(newName, nil)
+	})
+
+	usingIPs, err := client.UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return rollback(err)
+	}
+	for i := range usingIPs.Items {
+		if usingIPs.Items[i].Spec.Network != oldName {
+			continue
+		}
+		usingIP := usingIPs.Items[i].DeepCopy()
+		usingIP.Spec.Network = newName
+		if _, labeled := usingIP.Labels[NetworkLabel]; labeled {
+			if len(validation.IsValidLabelValue(newName)) == 0 {
+				usingIP.Labels[NetworkLabel] = newName
+			} else {
+				delete(usingIP.Labels, NetworkLabel)
+			}
+		}
+		updated, err := client.UsingIPs().Update(usingIP)
+		if err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func() error {
+			reverted := updated.DeepCopy()
+			reverted.Spec.Network = oldName
+			if _, labeled := reverted.Labels[NetworkLabel]; labeled {
+				reverted.Labels[NetworkLabel] = oldName
+			}
+			_, err := client.UsingIPs().Update(reverted)
+			return err
+		})
+	}
+
+	lri, err := client.LastReservedIPs().Get(oldName, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err):
+		lri = nil
+	case err != nil:
+		return rollback(err)
+	default:
+		renamedLri := &resourcev1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: newName},
+			Spec:       *lri.Spec.DeepCopy(),
+		}
+		renamedLri.Spec.Network = newName
+		if _, err := client.LastReservedIPs().Create(renamedLri); err != nil {
+			return rollback(err)
+		}
+		undo = append(undo, func() error {
+			return client.LastReservedIPs().Delete(newName, nil)
+		})
+	}
+
+	// old records are deleted last, so that nothing is lost before all references are migrated
+	if lri != nil {
+		if err := client.LastReservedIPs().Delete(oldName, nil); err != nil && !errors.IsNotFound(err) {
+			return rollback(err)
+		}
+		undo = append(undo, func() error {
+			_, err := client.LastReservedIPs().Create(&resourcev1.LastReservedIP{
+				ObjectMeta: metav1.ObjectMeta{Name: oldName},
+				Spec:       *lri.Spec.DeepCopy(),
+			})
+			return err
+		})
+	}
+	if err := client.Networks().Delete(oldName, nil); err != nil && !errors.IsNotFound(err) {
+		return rollback(err)
+	}
+
+	return nil
+}
+
+// MigrateNames recreates the using ip records not named by the name encoder of store under the
+// names it encodes, and deletes the records of the old names, the count of records migrated is
+// returned. Specs, labels and annotations are kept, while creation times are those of the new
+// records. It is idempotent, a record left under both names by an earlier run is migrated again
+// without being recreated.
+func (s *Store) MigrateNames() (int, error) {
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return 0, fmt.Errorf("fail to list using ips: %v", err)
+	}
+
+	migrated := 0
+	for i := range list.Items {
+		usingIP := &list.Items[i]
+		addr, err := utils.DecodeName(usingIP.Name)
+		if err != nil {
+			LoggerStore.Warnf("skip migrating using ip %s of an undecodable name", usingIP.Name)
+			continue
+		}
+		if s.names.Encode(addr) == usingIP.Name {
+			continue
+		}
+		if s.dryRun {
+			migrated++
+			continue
+		}
+		ok, err := s.migrateName(usingIP, s.names.Encode(addr))
+		if err != nil {
+			return migrated, err
+		}
+		if ok {
+			migrated++
+		}
+	}
+	return migrated, nil
+}
+
+// migrateName recreates usingIP as name, false is returned if usingIP is gone in the meantime,
+// e.g. released, in which case the new record is deleted again
+func (s *Store) migrateName(usingIP *resourcev1.UsingIP, name string) (bool, error) {
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	migrated := &resourcev1.UsingIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      usingIP.Labels,
+			Annotations: usingIP.Annotations,
+		},
+		Spec: *usingIP.Spec.DeepCopy(),
+	}
+	if _, err := client.Create(migrated); errors.IsAlreadyExists(err) {
+		existing, err := client.Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("fail to get using ip %s: %v", name, err)
+		}
+		if !reflect.DeepEqual(existing.Spec, usingIP.Spec) {
+			return false, fmt.Errorf("using ip %s differs from %s of the same ip", name, usingIP.Name)
+		}
+	} else if err != nil {
+		return false, fmt.Errorf("fail to create using ip %s for %s: %v", name, usingIP.Name, err)
+	}
+
+	// only the record listed is deleted, one re-created in the meantime is left to its owner
+	err := client.Delete(usingIP.Name, &metav1.DeleteOptions{Preconditions: &metav1.Preconditions{UID: &usingIP.UID}})
+	switch {
+	case err == nil:
+		LoggerStore.Infof("migrate using ip %s to %s", usingIP.Name, name)
+		return true, nil
+	case errors.IsNotFound(err):
+		if err := client.Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+			return false, fmt.Errorf("fail to delete using ip %s of released %s: %v", name, usingIP.Name, err)
+		}
+		return false, nil
+	default:
+		return false, fmt.Errorf("fail to delete using ip %s migrated to %s: %v", usingIP.Name, name, err)
+	}
+}
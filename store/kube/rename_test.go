@@ -0,0 +1,188 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newRenameTestStore(t *testing.T) (*Store, func()) {
+	newNetworkUsingIP := func(name, network string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = network
+		usingIP.Spec.Pool = "pool"
+		return usingIP
+	}
+	return newTestStore(t,
+		newNetwork("old", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		&v1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: "old"},
+			Spec:       v1.LastReservedIPSpec{Pools: map[string]string{"pool": "192.168.0.11"}},
+		},
+		newNetworkUsingIP("192-168-0-10", "old"),
+		newNetworkUsingIP("192-168-0-11", "old"),
+		newNetworkUsingIP("192-168-0-12", "other"))
+}
+
+// networksOf returns the network of each using ip by name
+func networksOf(t *testing.T, s *Store) map[string]string {
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("fail to list using ips: %v", err)
+	}
+	networks := make(map[string]string, len(list.Items))
+	for _, usingIP := range list.Items {
+		networks[usingIP.Name] = usingIP.Spec.Network
+	}
+	return networks
+}
+
+func TestStore_RenameNetwork(t *testing.T) {
+	s, stop := newRenameTestStore(t)
+	defer stop()
+
+	if err := s.RenameNetwork("old", "new"); err != nil {
+		t.Fatalf("fail to rename network: %v", err)
+	}
+
+	client := s.resourceClient.ResourceV1()
+	network, err := client.Networks().Get("new", metav1.GetOptions{})
+	if err != nil || len(network.Spec.Pools) != 1 {
+		t.Errorf("renamed network should keep its pools, got %+v %v", network, err)
+	}
+	if _, err := client.Networks().Get("old", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("old network should be deleted, got %v", err)
+	}
+	lri, err := client.LastReservedIPs().Get("new", metav1.GetOptions{})
+	if err != nil || lri.Spec.Pools["pool"] != "192.168.0.11" || lri.Spec.Network != "new" {
+		t.Errorf("last reserved ip should be migrated, got %+v %v", lri, err)
+	}
+	if _, err := client.LastReservedIPs().Get("old", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("old last reserved ip should be deleted, got %v", err)
+	}
+
+	expected := map[string]string{"192-168-0-10": "new", "192-168-0-11": "new", "192-168-0-12": "other"}
+	for name, network := range networksOf(t, s) {
+		if expected[name] != network {
+			t.Errorf("test %s fails: expected network %s but got %s", name, expected[name], network)
+		}
+	}
+}
+
+func TestStore_RenameNetworkRollback(t *testing.T) {
+	s, stop := newRenameTestStore(t)
+	defer stop()
+
+	// migrating the second using ip fails, reverting the first one still works
+	s.resourceClient.(*fake.Clientset).PrependReactor("update", "usingips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		usingIP := action.(k8stesting.UpdateAction).GetObject().(*v1.UsingIP)
+		if usingIP.Name == "192-168-0-11" && usingIP.Spec.Network == "new" {
+			return true, nil, errors.NewInternalError(fmt.Errorf("etcd is unavailable"))
+		}
+		return false, nil, nil
+	})
+
+	if err := s.RenameNetwork("old", "new"); err == nil {
+		t.Fatalf("renaming should fail")
+	}
+
+	client := s.resourceClient.ResourceV1()
+	if _, err := client.Networks().Get("old", metav1.GetOptions{}); err != nil {
+		t.Errorf("old network should be kept: %v", err)
+	}
+	if _, err := client.Networks().Get("new", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("new network should be rolled back, got %v", err)
+	}
+	if _, err := client.LastReservedIPs().Get("old", metav1.GetOptions{}); err != nil {
+		t.Errorf("old last reserved ip should be kept: %v", err)
+	}
+
+	expected := map[string]string{"192-168-0-10": "old", "192-168-0-11": "old", "192-168-0-12": "other"}
+	for name, network := range networksOf(t, s) {
+		if expected[name] != network {
+			t.Errorf("test %s fails: expected network %s but got %s", name, expected[name], network)
+		}
+	}
+}
+
+func TestStore_MigrateNames(t *testing.T) {
+	hex := utils.HexNameEncoder{}
+	legacy := newUsingIP("192-168-0-10", "pod1")
+	legacy.Spec.PodNamespace = "default"
+	legacy.Spec.Network = "network"
+	legacy.Spec.Pool = "pool"
+	legacy.Labels = map[string]string{NetworkLabel: "network"}
+	// left under both names by an interrupted migration
+	interrupted := newUsingIP("192-168-0-11", "pod2")
+	interrupted.Spec.Network = "network"
+	interruptedCopy := interrupted.DeepCopy()
+	interruptedCopy.Name = hex.Encode(net.ParseIP("192.168.0.11"))
+	current := newUsingIP(hex.Encode(net.ParseIP("192.168.0.12")), "pod3")
+	s, stop := newTestStoreWithOptions(t, []Option{WithNameEncoder(hex)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		legacy, interrupted, interruptedCopy, current)
+	defer stop()
+
+	migrated, err := s.MigrateNames()
+	if err != nil {
+		t.Fatalf("fail to migrate names: %v", err)
+	}
+	if migrated != 2 {
+		t.Errorf("expected 2 using ips migrated but got %d", migrated)
+	}
+
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("fail to list using ips: %v", err)
+	}
+	names := make(map[string]v1.UsingIP, len(list.Items))
+	for _, usingIP := range list.Items {
+		names[usingIP.Name] = usingIP
+	}
+	expected := []string{
+		hex.Encode(net.ParseIP("192.168.0.10")),
+		hex.Encode(net.ParseIP("192.168.0.11")),
+		hex.Encode(net.ParseIP("192.168.0.12")),
+	}
+	if len(names) != len(expected) {
+		t.Errorf("expected only records of new names but got %v", names)
+	}
+	for _, name := range expected {
+		if _, exists := names[name]; !exists {
+			t.Errorf("expected using ip %s but it is missing", name)
+		}
+	}
+	if migratedIP := names[expected[0]]; !reflect.DeepEqual(migratedIP.Spec, legacy.Spec) || migratedIP.Labels[NetworkLabel] != "network" {
+		t.Errorf("expected spec and labels kept but got %+v", migratedIP)
+	}
+
+	if migrated, err := s.MigrateNames(); err != nil || migrated != 0 {
+		t.Errorf("expected nothing left to migrate but got %d: %v", migrated, err)
+	}
+}
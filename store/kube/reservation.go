@@ -0,0 +1,149 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// managedSyncTimeout bounds waiting for a deleted managed using ip to be dropped from cache
+var managedSyncTimeout = 10 * time.Second
+
+// ReconcileReservations makes the managed static reservations match desired, missing ones are
+// created and managed ones not desired anymore are deleted, using ips not managed are left untouched
+func (s *Store) ReconcileReservations(desired []store.Reservation) (int, int, error) {
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{
+		LabelSelector: ManagedByLabel + "=" + ManagedByReconciler,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("fail to list managed using ips: %v", err)
+	}
+	managed := make(map[string]*resourcev1.UsingIP, len(list.Items))
+	for i := range list.Items {
+		if ip, err := utils.DecodeName(list.Items[i].Name); err == nil {
+			managed[ip.String()] = &list.Items[i]
+		}
+	}
+
+	created, deleted := 0, 0
+	errs := types.ErrorList{}
+	wanted := make(map[string]bool, len(desired))
+	for _, reservation := range desired {
+		ip := reservation.IP.String()
+		wanted[ip] = true
+
+		// a managed using ip of another owner is recreated
+		if current, exists := managed[ip]; exists {
+			spec := current.Spec
+			if spec.Network == reservation.Network && spec.Pool == reservation.Pool && spec.Owner == reservation.Owner {
+				continue
+			}
+			if err := s.deleteManaged(current); err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			deleted++
+		}
+
+		if err := s.reserveManaged(reservation); err != nil {
+			errs = append(errs, fmt.Errorf("fail to reserve %s for %s: %v", ip, reservation.Owner, err))
+			continue
+		}
+		created++
+	}
+
+	stale := make([]*resourcev1.UsingIP, 0)
+	for ip, current := range managed {
+		if !wanted[ip] {
+			stale = append(stale, current)
+		}
+	}
+	var staleDeleted int32
+	err = parallelize(s.bulkParallelism, len(stale), func(i int) error {
+		if err := s.deleteManaged(stale[i]); err != nil {
+			return err
+		}
+		atomic.AddInt32(&staleDeleted, 1)
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err.(types.ErrorList)...)
+	}
+
+	return created, deleted + int(staleDeleted), errs.ToError()
+}
+
+func (s *Store) reserveManaged(reservation store.Reservation) error {
+	defer s.networkLocks.LockKey(reservation.Network)()
+
+	usingIP := newOwnerUsingIP(reservation.Network, reservation.Pool, reservation.Owner)
+	usingIP.Labels = map[string]string{ManagedByLabel: ManagedByReconciler}
+	return s.reserveStatic(reservation.IP, usingIP)
+}
+
+func (s *Store) deleteManaged(usingIP *resourcev1.UsingIP) error {
+	if s.dryRun {
+		return nil
+	}
+	ip, err := utils.DecodeName(usingIP.Name)
+	if err != nil {
+		return err
+	}
+
+	// the listed record is deleted by its own name which may be of another name encoding,
+	// the precondition guards against deleting a re-created using ip, and static reservations
+	// are not handed to pods so they are deleted without quarantine
+	err = s.deleteUsingIP(usingIP.Name, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &usingIP.UID},
+	})
+	switch {
+	case errors.IsNotFound(err):
+		// deleted by someone else in the meantime
+	case err != nil:
+		return fmt.Errorf("fail to delete managed using ip %s: %v", usingIP.Name, err)
+	default:
+		s.auditSink.RecordRelease(&store.AuditEntry{
+			Time:    time.Now(),
+			IP:      ip.String(),
+			Network: usingIP.Spec.Network,
+			Pool:    usingIP.Spec.Pool,
+			Owner:   usingIP.Spec.Owner,
+		})
+	}
+
+	// wait for the informer to drop it so that a recreation in the same pass is not seen as in use,
+	// the deletion is done anyway and a slow informer only fails such a recreation
+	err = wait.PollImmediate(cacheWaitInterval, managedSyncTimeout, func() (bool, error) {
+		cached := s.cache.GetUsingIP(ip.String())
+		return cached == nil || cached.Name != usingIP.Name, nil
+	})
+	if err != nil {
+		LoggerStore.Warnf("deletion of managed using ip %s is not cached yet: %v", usingIP.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,168 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_ReconcileReservations(t *testing.T) {
+	unmanaged := newUsingIP("192-168-0-15", "pod")
+	unmanaged.Spec.PodNamespace = "default"
+	unmanaged.Spec.Network = "network"
+	unmanaged.Spec.Pool = "pool"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		unmanaged)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.15")
+	})
+
+	reservation := func(ip, owner string) store.Reservation {
+		return store.Reservation{Network: "network", Pool: "pool", IP: net.ParseIP(ip), Owner: owner}
+	}
+	owners := func() map[string]string {
+		list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{
+			LabelSelector: ManagedByLabel + "=" + ManagedByReconciler,
+		})
+		if err != nil {
+			t.Fatalf("fail to list managed using ips: %v", err)
+		}
+		result := make(map[string]string, len(list.Items))
+		for _, usingIP := range list.Items {
+			result[usingIP.Name] = usingIP.Spec.Owner
+		}
+		return result
+	}
+
+	tests := []struct {
+		name    string
+		desired []store.Reservation
+		created int
+		deleted int
+		owners  map[string]string
+	}{
+		{
+			name:    "create",
+			desired: []store.Reservation{reservation("192.168.0.11", "a"), reservation("192.168.0.12", "b")},
+			created: 2,
+			owners:  map[string]string{"192-168-0-11": "a", "192-168-0-12": "b"},
+		},
+		{
+			name:    "idempotent",
+			desired: []store.Reservation{reservation("192.168.0.11", "a"), reservation("192.168.0.12", "b")},
+			owners:  map[string]string{"192-168-0-11": "a", "192-168-0-12": "b"},
+		},
+		{
+			name:    "change",
+			desired: []store.Reservation{reservation("192.168.0.12", "c"), reservation("192.168.0.13", "d")},
+			created: 2,
+			deleted: 2,
+			owners:  map[string]string{"192-168-0-12": "c", "192-168-0-13": "d"},
+		},
+	}
+
+	for _, test := range tests {
+		created, deleted, err := s.ReconcileReservations(test.desired)
+		if err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if created != test.created || deleted != test.deleted {
+			t.Errorf("test %s fails: expected %d created and %d deleted but got %d and %d",
+				test.name, test.created, test.deleted, created, deleted)
+		}
+		got := owners()
+		if len(got) != len(test.owners) {
+			t.Errorf("test %s fails: expected managed using ips %v but got %v", test.name, test.owners, got)
+		}
+		for name, owner := range test.owners {
+			if got[name] != owner {
+				t.Errorf("test %s fails: expected owner %s of %s but got %s", test.name, owner, name, got[name])
+			}
+		}
+		waitForCache(t, func() bool {
+			for _, r := range test.desired {
+				if !s.cache.IsIPUsing(r.IP.String()) {
+					return false
+				}
+			}
+			return len(s.cache.ListUsingIPs()) == len(test.desired)+1
+		})
+	}
+
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-15", metav1.GetOptions{}); err != nil {
+		t.Errorf("unmanaged using ip should be kept: %v", err)
+	}
+}
+
+func TestStore_ReconcileReservationsOtherEncoding(t *testing.T) {
+	// a managed using ip named in the hex scheme while the store uses the dashed one
+	hexed := newUsingIP("ip-00000000000000000000ffffc0a8000e", "")
+	hexed.Labels = map[string]string{ManagedByLabel: ManagedByReconciler}
+	hexed.Spec.Network = "network"
+	hexed.Spec.Pool = "pool"
+	hexed.Spec.Owner = "a"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		hexed)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.14")
+	})
+
+	created, deleted, err := s.ReconcileReservations([]store.Reservation{
+		{Network: "network", Pool: "pool", IP: net.ParseIP("192.168.0.14"), Owner: "b"},
+	})
+	if err != nil || created != 1 || deleted != 1 {
+		t.Fatalf("expected 1 created and 1 deleted but got %d and %d: %v", created, deleted, err)
+	}
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Get(hexed.Name, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("hex named using ip should be deleted but got %v", err)
+	}
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-14", metav1.GetOptions{})
+	if err != nil || usingIP.Spec.Owner != "b" {
+		t.Errorf("expected using ip recreated for b but got %+v %v", usingIP, err)
+	}
+}
+
+func TestStore_ReconcileReservationsSlowInformer(t *testing.T) {
+	defer func(timeout time.Duration) { managedSyncTimeout = timeout }(managedSyncTimeout)
+	managedSyncTimeout = 50 * time.Millisecond
+
+	// store is not run, so that the deletion never reaches its cache
+	managed := newUsingIP("192-168-0-11", "")
+	managed.Labels = map[string]string{ManagedByLabel: ManagedByReconciler}
+	managed.Spec.Network, managed.Spec.Pool, managed.Spec.Owner = "network", "pool", "a"
+	s := newStore(newTestClientset(managed), nil)
+	s.cache.addUsingIP(managed)
+
+	created, deleted, err := s.ReconcileReservations(nil)
+	if err != nil || created != 0 || deleted != 1 {
+		t.Errorf("expected 1 deleted without error but got %d and %d: %v", created, deleted, err)
+	}
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Get(managed.Name, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("managed using ip should be deleted but got %v", err)
+	}
+}
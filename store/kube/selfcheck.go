@@ -0,0 +1,222 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/types"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// kinds of problems found by SelfCheck
+const (
+	ProblemInvalidPool      = "invalid-pool"
+	ProblemOverlappingPools = "overlapping-pools"
+	ProblemOrphanUsingIP    = "orphan-using-ip"
+	ProblemDanglingCursor   = "dangling-cursor"
+	ProblemDuplicateUsingIP = "duplicate-using-ip"
+	ProblemCursorCollision  = "cursor-collision"
+)
+
+// Problem is a broken invariant of the cache found by SelfCheck
+type Problem struct {
+	Kind    string
+	Network string
+	Pool    string
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s in network %s: %s", p.Kind, p.Network, p.Message)
+}
+
+// SelfCheck verifies the invariants of cached networks, using ips and last reserved ips,
+// and reports every violation found, an empty list means the cache is consistent
+func (s *Store) SelfCheck() []Problem {
+	problems := make([]Problem, 0)
+	networks := make(map[string]*types.Network)
+	for _, network := range s.cache.ListNetworks() {
+		networks[network.Name] = network
+		problems = append(problems, checkPools(network)...)
+	}
+
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		var pool *types.Pool
+		if network := networks[usingIP.Network]; network != nil {
+			pool = network.GetPool(usingIP.Pool)
+		}
+		if pool == nil || !pool.Contains(usingIP.IP) {
+			problems = append(problems, Problem{
+				Kind:    ProblemOrphanUsingIP,
+				Network: usingIP.Network,
+				Pool:    usingIP.Pool,
+				Message: fmt.Sprintf("using ip %s is out of pool %s", usingIP.IP, usingIP.Pool),
+			})
+		}
+	}
+
+	for networkName, lri := range s.cache.ListLastReservedIPs() {
+		problems = append(problems, checkLastReservedIP(networks[networkName], networkName, lri)...)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].Kind != problems[j].Kind {
+			return problems[i].Kind < problems[j].Kind
+		}
+		return problems[i].Network < problems[j].Network
+	})
+	return problems
+}
+
+// CheckDuplicateUsingIPs lists using ips from apiserver and reports ips recorded by more than
+// one of them, e.g. under names of different encoders, which the cache can only keep one of
+func (s *Store) CheckDuplicateUsingIPs() ([]Problem, error) {
+	byIP, err := s.listUsingIPsByIP()
+	if err != nil {
+		return nil, err
+	}
+
+	problems := make([]Problem, 0)
+	for ip, records := range byIP {
+		if len(records) < 2 {
+			continue
+		}
+		owners := make([]string, 0, len(records))
+		for _, record := range records {
+			owners = append(owners, fmt.Sprintf("%s by %s", record.Name, usingIPOwner(&record.Spec)))
+		}
+		sort.Strings(owners)
+		problems = append(problems, Problem{
+			Kind:    ProblemDuplicateUsingIP,
+			Network: records[0].Spec.Network,
+			Pool:    records[0].Spec.Pool,
+			Message: fmt.Sprintf("ip %s is recorded %d times: %s", ip, len(records), strings.Join(owners, ", ")),
+		})
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		return problems[i].Message < problems[j].Message
+	})
+	return problems, nil
+}
+
+// listUsingIPsByIP groups the using ips in apiserver by the ips decoded from their names,
+// records with undecodable names are skipped
+func (s *Store) listUsingIPsByIP() (map[string][]*resourcev1.UsingIP, error) {
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fail to list using ips: %v", err)
+	}
+	byIP := make(map[string][]*resourcev1.UsingIP)
+	for i := range list.Items {
+		ip, err := utils.DecodeName(list.Items[i].Name)
+		if err != nil {
+			continue
+		}
+		byIP[ip.String()] = append(byIP[ip.String()], &list.Items[i])
+	}
+	return byIP, nil
+}
+
+// usingIPOwner describes who owns an using ip for humans
+func usingIPOwner(spec *resourcev1.UsingIPSpec) string {
+	switch {
+	case len(spec.PodName) > 0:
+		return fmt.Sprintf("pod %s/%s", spec.PodNamespace, spec.PodName)
+	case len(spec.Owner) > 0:
+		return fmt.Sprintf("owner %s", spec.Owner)
+	case len(spec.MAC) > 0:
+		return fmt.Sprintf("mac %s", spec.MAC)
+	}
+	return "nobody"
+}
+
+// checkPools reports pools of network which do not canonicalize or overlap each other
+func checkPools(network *types.Network) []Problem {
+	var problems []Problem
+	valid := make([]*types.Pool, 0, len(network.Pools))
+	for _, pool := range network.Pools {
+		if err := pool.DeepCopy().Canonicalize(); err != nil {
+			problems = append(problems, Problem{
+				Kind:    ProblemInvalidPool,
+				Network: network.Name,
+				Pool:    pool.Name,
+				Message: err.Error(),
+			})
+			continue
+		}
+		for _, p := range valid {
+			if pool.Overlaps(p) {
+				problems = append(problems, Problem{
+					Kind:    ProblemOverlappingPools,
+					Network: network.Name,
+					Pool:    pool.Name,
+					Message: fmt.Sprintf("pool %s overlaps pool %s", pool.Name, p.Name),
+				})
+			}
+		}
+		valid = append(valid, pool)
+	}
+	return problems
+}
+
+// checkLastReservedIP reports cursors of lri which do not index into a pool of network,
+// and lri itself if it is written for another network of the same record name
+func checkLastReservedIP(network *types.Network, networkName string, lri *types.LastReservedIP) []Problem {
+	if network == nil {
+		return []Problem{{
+			Kind:    ProblemDanglingCursor,
+			Network: networkName,
+			Message: "last reserved ip refers to a missing network",
+		}}
+	}
+	// the cursors of another network say nothing about pools of this one
+	if len(lri.Network) > 0 && lri.Network != networkName {
+		return []Problem{{
+			Kind:    ProblemCursorCollision,
+			Network: networkName,
+			Message: fmt.Sprintf("last reserved ip of network %s is written for network %s", networkName, lri.Network),
+		}}
+	}
+
+	var problems []Problem
+	cursors := make(map[string]net.IP, len(lri.Pools)+1)
+	for pool, ip := range lri.Pools {
+		cursors[pool] = ip
+	}
+	if len(lri.PoolName) > 0 {
+		cursors[lri.PoolName] = lri.IP
+	}
+	for poolName, ip := range cursors {
+		pool := network.GetPool(poolName)
+		if pool == nil || !pool.Contains(ip) {
+			problems = append(problems, Problem{
+				Kind:    ProblemDanglingCursor,
+				Network: networkName,
+				Pool:    poolName,
+				Message: fmt.Sprintf("last reserved ip %s is out of pool %s", ip, poolName),
+			})
+		}
+	}
+	return problems
+}
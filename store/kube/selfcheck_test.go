@@ -0,0 +1,171 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/types"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestStore_SelfCheck(t *testing.T) {
+	newPool := func(name, start, end string) *types.Pool {
+		pool, err := types.PoolFromCRD(newTestPool(name, start, end))
+		if err != nil {
+			t.Fatalf("fail to convert pool %s: %v", name, err)
+		}
+		return pool
+	}
+	typedNetwork := func(pools ...*types.Pool) *types.Network {
+		return &types.Network{Name: "network", Pools: pools}
+	}
+
+	tests := []struct {
+		name     string
+		network  *types.Network
+		usingIPs []*types.UsingIP
+		lri      *types.LastReservedIP
+		kinds    []string
+	}{
+		{
+			name:     "consistent",
+			network:  typedNetwork(newPool("pool", "192.168.0.10", "192.168.0.20")),
+			usingIPs: []*types.UsingIP{{Name: "192-168-0-10", IP: net.ParseIP("192.168.0.10"), Network: "network", Pool: "pool"}},
+			lri:      &types.LastReservedIP{Pools: map[string]net.IP{"pool": net.ParseIP("192.168.0.10")}, Network: "network"},
+		},
+		{
+			name: "invalid pool",
+			network: typedNetwork(func() *types.Pool {
+				pool := newPool("pool", "192.168.0.10", "192.168.0.20")
+				pool.PoolEnd = net.ParseIP("192.168.1.20")
+				return pool
+			}()),
+			kinds: []string{ProblemInvalidPool},
+		},
+		{
+			name:    "overlapping pools",
+			network: typedNetwork(newPool("pool1", "192.168.0.10", "192.168.0.20"), newPool("pool2", "192.168.0.15", "192.168.0.30")),
+			kinds:   []string{ProblemOverlappingPools},
+		},
+		{
+			name:    "using ip out of pool",
+			network: typedNetwork(newPool("pool", "192.168.0.10", "192.168.0.20")),
+			usingIPs: []*types.UsingIP{
+				{Name: "192-168-0-30", IP: net.ParseIP("192.168.0.30"), Network: "network", Pool: "pool"},
+				{Name: "192-168-0-11", IP: net.ParseIP("192.168.0.11"), Network: "network", Pool: "missing"},
+				{Name: "192-168-0-12", IP: net.ParseIP("192.168.0.12"), Network: "missing", Pool: "pool"},
+			},
+			kinds: []string{ProblemOrphanUsingIP, ProblemOrphanUsingIP, ProblemOrphanUsingIP},
+		},
+		{
+			name:    "dangling cursor",
+			network: typedNetwork(newPool("pool", "192.168.0.10", "192.168.0.20")),
+			lri: &types.LastReservedIP{Pools: map[string]net.IP{
+				"pool":    net.ParseIP("192.168.0.30"),
+				"missing": net.ParseIP("192.168.0.10"),
+			}},
+			kinds: []string{ProblemDanglingCursor, ProblemDanglingCursor},
+		},
+		{
+			name:    "cursor of another network",
+			network: typedNetwork(newPool("pool", "192.168.0.10", "192.168.0.20")),
+			lri: &types.LastReservedIP{
+				Pools:   map[string]net.IP{"pool": net.ParseIP("192.168.0.30")},
+				Network: "other",
+			},
+			kinds: []string{ProblemCursorCollision},
+		},
+	}
+	for _, test := range tests {
+		s := &Store{cache: NewCache()}
+		s.cache.networks[test.network.Name] = test.network
+		s.cache.publishNetworks()
+		for _, usingIP := range test.usingIPs {
+			s.cache.setUsingIP(usingIP)
+		}
+		if test.lri != nil {
+			s.cache.lastReservedIPs[test.network.Name] = test.lri
+		}
+
+		problems := s.SelfCheck()
+		if len(problems) != len(test.kinds) {
+			t.Errorf("test %s fails: expected %d problems but got %v", test.name, len(test.kinds), problems)
+			continue
+		}
+		for i, problem := range problems {
+			if problem.Kind != test.kinds[i] {
+				t.Errorf("test %s fails: expected problem %s but got %v", test.name, test.kinds[i], problem)
+			}
+		}
+	}
+
+	// a cursor of a network which is gone is dangling as well
+	s := &Store{cache: NewCache()}
+	s.cache.lastReservedIPs["gone"] = &types.LastReservedIP{}
+	if problems := s.SelfCheck(); len(problems) != 1 || problems[0].Kind != ProblemDanglingCursor {
+		t.Errorf("expected a dangling cursor of missing network but got %v", problems)
+	}
+}
+
+func TestStore_ForceReleaseDuplicates(t *testing.T) {
+	ip := net.ParseIP("192.168.0.10")
+	newPodUsingIP := func(name, podName string) *v1.UsingIP {
+		usingIP := newUsingIP(name, podName)
+		usingIP.Spec.PodNamespace, usingIP.Spec.Network, usingIP.Spec.Pool = "default", "network", "pool"
+		return usingIP
+	}
+	sink := &recordingAuditSink{}
+	s, stop := newTestStoreWithOptions(t, []Option{WithAuditSink(sink)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newPodUsingIP("192-168-0-10", "pod1"),
+		newPodUsingIP(utils.HexNameEncoder{}.Encode(ip), "pod2"),
+		newPodUsingIP("192-168-0-11", "pod3"))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.11") && s.cache.IsIPUsing(ip.String()) })
+
+	problems, err := s.CheckDuplicateUsingIPs()
+	if err != nil {
+		t.Fatalf("fail to check duplicates: %v", err)
+	}
+	if len(problems) != 1 || problems[0].Kind != ProblemDuplicateUsingIP ||
+		!strings.Contains(problems[0].Message, "pod default/pod1") || !strings.Contains(problems[0].Message, "pod default/pod2") {
+		t.Fatalf("expected one duplicate of %s but got %v", ip, problems)
+	}
+
+	if err := s.ForceRelease(ip); err != nil {
+		t.Fatalf("fail to force release: %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing(ip.String()) })
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("fail to list using ips: %v", err)
+	}
+	if len(list.Items) != 1 || list.Items[0].Name != "192-168-0-11" {
+		t.Errorf("expected only the record of 192.168.0.11 left but got %+v", list.Items)
+	}
+	if len(sink.releases) != 2 {
+		t.Errorf("expected both records audited as released but got %d", len(sink.releases))
+	}
+	if problems, _ := s.CheckDuplicateUsingIPs(); len(problems) != 0 {
+		t.Errorf("expected no duplicate after force release but got %v", problems)
+	}
+}
@@ -0,0 +1,116 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+const snapshotVersion = 2
+
+// snapshot is the serialized form of the using ip set in cache,
+// using ips are keyed by their string form since version 2
+type snapshot struct {
+	Version  int               `json:"version"`
+	UsingIPs map[string]string `json:"usingIPs"`
+}
+
+// SaveSnapshot serializes the using ip set of cache into w
+func (c *Cache) SaveSnapshot(w io.Writer) error {
+	c.RLock()
+	s := snapshot{
+		Version:  snapshotVersion,
+		UsingIPs: make(map[string]string, len(c.usingIPs)),
+	}
+	for ip, usingIP := range c.usingIPs {
+		s.UsingIPs[ip] = usingIP.PodName
+	}
+	c.RUnlock()
+
+	return json.NewEncoder(w).Encode(&s)
+}
+
+// LoadSnapshot loads a using ip set from r as a provisional cache,
+// which answers IsIPUsing until informers have synced
+func (c *Cache) LoadSnapshot(r io.Reader) error {
+	s := snapshot{}
+	if err := json.NewDecoder(r).Decode(&s); err != nil {
+		return fmt.Errorf("fail to decode snapshot: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("snapshot version %d is not supported", s.Version)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	c.provisionalUsingIPs = s.UsingIPs
+	atomic.StoreInt32(&c.provisional, 1)
+	LoggerCache.Debugf("load %d provisional using ips from snapshot", len(s.UsingIPs))
+	return nil
+}
+
+// dropProvisional removes the provisional using ip set once informers have synced
+func (c *Cache) dropProvisional() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.provisionalUsingIPs = nil
+	atomic.StoreInt32(&c.provisional, 0)
+}
+
+func (s *Store) loadSnapshotFile() error {
+	f, err := os.Open(s.snapshotFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	return s.cache.LoadSnapshot(f)
+}
+
+func (s *Store) saveSnapshotFile() {
+	// write to a temp file and rename it, so a crash never leaves a partial snapshot
+	f, err := ioutil.TempFile(filepath.Dir(s.snapshotFile), filepath.Base(s.snapshotFile))
+	if err != nil {
+		LoggerStore.Errorf("fail to create snapshot file: %v", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	if err = s.cache.SaveSnapshot(f); err != nil {
+		f.Close()
+		LoggerStore.Errorf("fail to save snapshot: %v", err)
+		return
+	}
+	if err = f.Close(); err != nil {
+		LoggerStore.Errorf("fail to save snapshot: %v", err)
+		return
+	}
+	if err = os.Rename(f.Name(), s.snapshotFile); err != nil {
+		LoggerStore.Errorf("fail to save snapshot: %v", err)
+	}
+}
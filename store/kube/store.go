@@ -17,8 +17,13 @@
 package kube
 
 import (
+	"context"
 	"fmt"
+	"math/rand"
 	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,6 +37,8 @@ import (
 
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/tools/cache"
 	"k8s.io/client-go/tools/clientcmd"
 )
@@ -42,18 +49,93 @@ var _ store.IPAMStore = &Store{}
 var LoggerStore = logrus.WithFields(logrus.Fields{"component": "store/kube"})
 
 type Store struct {
-	*sync.RWMutex
+	// networkLocks serializes mutations per network, reads go straight to cache
+	networkLocks *keyedMutex
 
 	resourceClient          versioned.Interface
 	resourceInformerFactory externalversions.SharedInformerFactory
 	resourceSynced          []cache.InformerSynced
-
-	stopEverything <-chan struct{}
+	// networkSynced is the first of resourceSynced, for readiness of networks alone
+	networkSynced cache.InformerSynced
+
+	// stopEverything is closed once either stopCh of NewStore is closed or Close is called
+	stopEverything chan struct{}
+	stopCh         <-chan struct{}
+	stopOnce       *sync.Once
+	// running tracks goroutines started by Run, which Close waits for
+	running   *sync.WaitGroup
+	informers []cache.SharedIndexInformer
+	// done is closed once informers have stopped after shutdown
+	done chan struct{}
 
 	cache *Cache
+
+	snapshotFile   string
+	snapshotPeriod time.Duration
+
+	auditSink store.AuditSink
+
+	// events coalesces informer events before they are applied to cache
+	events *debouncer
+
+	// failures counts failed allocations by reason and keeps the latest ones
+	failures *failureRecorder
+	// unexpectedObjects counts informer objects of unexpected types by resource
+	unexpectedObjects *objectCounter
+	// churn keeps the times of the latest reservations and releases, it wraps auditSink
+	churn *churnRecorder
+	// history keeps the latest owners of every ip, it wraps auditSink
+	history *historyRecorder
+
+	// names encodes ips into names of new using ip records
+	names utils.NameEncoder
+
+	// quarantine is how long a released ip is kept out of allocation, zero deletes at once
+	quarantine time.Duration
+	// strictRelease rejects releasing ips unknown to cache
+	strictRelease bool
+	// holdTimeout is how long an ip held by Hold is kept uncommitted
+	holdTimeout time.Duration
+
+	// delegate picks ips in place of the built-in scan if set
+	delegate store.DelegatedAllocator
+	// postReserve is called with every using ip created, its error rolls the reservation back
+	postReserve store.PostReserveHook
+
+	// random picks the first candidates of random pools
+	random *lockedRand
+
+	// cursors buffers last reserved ips persisted every cursorFlushPeriod, if it is positive
+	cursors           *cursorBuffer
+	cursorFlushPeriod time.Duration
+
+	// bulkParallelism limits concurrent api calls of bulk operations like reconciling
+	bulkParallelism int
+
+	// poolUsageThreshold and freeVLANsThreshold decide when Advisories warns
+	poolUsageThreshold int
+	freeVLANsThreshold int
+
+	// watchers receives allocation events applied to cache
+	watchers *watchHub
+	// utilization fires callbacks of pools crossing utilization thresholds
+	utilization *utilizationHub
+	// initialLoad buffers the objects of the initial lists of informers
+	initialLoad *initialLoad
+
+	// namespaceQuota limits the ips pods of each namespace hold in a network, zero is unlimited
+	namespaceQuota int
+
+	// caseInsensitivePoolNames makes AddPool reject names differing only in case
+	caseInsensitivePoolNames bool
+	// maskSubnetHostBits makes pools with host bits set in their subnets masked instead of rejected
+	maskSubnetHostBits bool
+
+	// dryRun makes mutations validate and select everything without writing to apiserver
+	dryRun bool
 }
 
-func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}) (*Store, error) {
+func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}, opts ...Option) (*Store, error) {
 	cfg, err := clientcmd.BuildConfigFromFlags(masterURL, kubeConfig)
 	if err != nil {
 		return nil, fmt.Errorf("fail to build kubernetes config: %v", err)
@@ -65,6 +147,10 @@ func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}) (*Store, err
 		return nil, fmt.Errorf("fail to new resource client: %v", err)
 	}
 
+	return newStore(resourceClient, stopCh, opts...), nil
+}
+
+func newStore(resourceClient versioned.Interface, stopCh <-chan struct{}, opts ...Option) *Store {
 	// create informer factory
 	resourceInformerFactory := externalversions.NewSharedInformerFactory(resourceClient, time.Second*30)
 
@@ -74,7 +160,8 @@ func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}) (*Store, err
 	usingIPInformer := resourceInformerFactory.Resource().V1().UsingIPs()
 
 	s := &Store{
-		RWMutex:                 new(sync.RWMutex),
+		networkLocks:            newKeyedMutex(),
+		random:                  newLockedRand(rand.NewSource(time.Now().UnixNano())),
 		resourceClient:          resourceClient,
 		resourceInformerFactory: resourceInformerFactory,
 		resourceSynced: []cache.InformerSynced{
@@ -82,9 +169,40 @@ func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}) (*Store, err
 			lastReservedIPInformer.Informer().HasSynced,
 			usingIPInformer.Informer().HasSynced,
 		},
-		stopEverything: stopCh,
-		cache:          NewCache(),
+		networkSynced:  networkInformer.Informer().HasSynced,
+		stopEverything: make(chan struct{}),
+		stopCh:         stopCh,
+		stopOnce:       &sync.Once{},
+		running:        &sync.WaitGroup{},
+		done:           make(chan struct{}),
+		informers: []cache.SharedIndexInformer{
+			networkInformer.Informer(),
+			lastReservedIPInformer.Informer(),
+			usingIPInformer.Informer(),
+		},
+		cache:             NewCache(),
+		auditSink:         store.NopAuditSink{},
+		events:            newDebouncer(0),
+		failures:          newFailureRecorder(defaultFailureHistory),
+		unexpectedObjects: newObjectCounter(),
+		names:             utils.DashedNameEncoder{},
+		watchers:          newWatchHub(),
+		utilization:       newUtilizationHub(),
+		initialLoad:       newInitialLoad(),
+		cursors:           newCursorBuffer(),
+
+		holdTimeout:        defaultHoldTimeout,
+		bulkParallelism:    defaultBulkParallelism,
+		poolUsageThreshold: defaultPoolUsageThreshold,
+		freeVLANsThreshold: defaultFreeVLANsThreshold,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.churn = newChurnRecorder(defaultChurnHistory, s.auditSink)
+	s.auditSink = s.churn
+	s.history = newHistoryRecorder(defaultIPHistory, defaultHistoryIPs, s.auditSink)
+	s.auditSink = s.history
 
 	// add handlers
 	LoggerStore.Info("Setting up event handlers")
@@ -106,225 +224,1396 @@ func NewStore(masterURL, kubeConfig string, stopCh <-chan struct{}) (*Store, err
 		DeleteFunc: s.deleteUsingIPFromCache,
 	})
 
-	return s, nil
+	return s
+}
+
+// DryRunStore is a view of store whose Reserve, Allocate and AddPool run all validations
+// and pick ips or changes as usual, but never write to apiserver, no other operation is
+// exposed so that nothing reached through the view mutates state or stops the store
+type DryRunStore struct {
+	store *Store
+}
+
+// DryRun returns a dry-run view of store
+func (s *Store) DryRun() *DryRunStore {
+	dryRun := *s
+	dryRun.dryRun = true
+	return &DryRunStore{store: &dryRun}
+}
+
+// Reserve works like Store.Reserve without creating the using ip
+func (d *DryRunStore) Reserve(network, pool, namespace, name string, ip net.IP) (bool, error) {
+	return d.store.Reserve(network, pool, namespace, name, ip)
+}
+
+// Allocate works like Store.Allocate without creating the using ip, the ip picked is returned
+func (d *DryRunStore) Allocate(network, pool, namespace, name string) (net.IP, error) {
+	return d.store.Allocate(network, pool, namespace, name)
+}
+
+// AddPool works like Store.AddPool without updating the network
+func (d *DryRunStore) AddPool(name string, pool *types.Pool) error {
+	return d.store.AddPool(name, pool)
+}
+
+// ResourceClient returns the client store talks to apiserver with, for operations store does not
+// expose, it is an escape hatch: writes made through it bypass the network locks, validations
+// and audit of store, and are only seen by store once they come back through informers
+func (s *Store) ResourceClient() versioned.Interface {
+	return s.resourceClient
 }
 
 func (s *Store) Run() error {
-	LoggerStore.Debug("starting resource informer factory")
-	go s.resourceInformerFactory.Start(s.stopEverything)
+	if s.holdTimeout <= 0 {
+		return fmt.Errorf("hold timeout %s must be positive", s.holdTimeout)
+	}
+	if len(s.snapshotFile) > 0 && s.snapshotPeriod <= 0 {
+		return fmt.Errorf("snapshot period %s must be positive", s.snapshotPeriod)
+	}
+	if len(s.snapshotFile) > 0 {
+		if err := s.loadSnapshotFile(); err != nil {
+			LoggerStore.Warnf("fail to load snapshot from %s, wait for caches to sync: %v", s.snapshotFile, err)
+		}
+	}
+
+	if s.stopCh != nil {
+		s.spawn(func() {
+			select {
+			case <-s.stopCh:
+				s.stop()
+			case <-s.stopEverything:
+			}
+		})
+	}
+
+	// informers are run one by one instead of by factory, so that Close can wait for them
+	LoggerStore.Debug("starting resource informers")
+	informers := &sync.WaitGroup{}
+	for _, informer := range s.informers {
+		informer := informer
+		informers.Add(1)
+		s.spawn(func() {
+			defer informers.Done()
+			informer.Run(s.stopEverything)
+		})
+	}
+
+	// non-blocking
+	s.spawn(func() {
+		<-s.stopEverything
+		LoggerStore.Info("kube store shutting down...")
+		informers.Wait()
+		// pending events are applied so that timers do not outlive store
+		s.events.Close()
+		s.watchers.close()
+		close(s.done)
+		LoggerStore.Info("kube store shut down")
+	})
 
 	LoggerStore.Info("waiting for caches to sync")
 	if ok := cache.WaitForCacheSync(s.stopEverything, s.resourceSynced...); !ok {
 		return fmt.Errorf("fail to sync caches")
 	}
+	s.flushInitialLoad("network", "lastreservedip", "usingip")
+	s.events.Flush()
+	s.cache.dropProvisional()
+
+	if len(s.snapshotFile) > 0 {
+		s.spawn(func() {
+			wait.Until(s.saveSnapshotFile, s.snapshotPeriod, s.stopEverything)
+		})
+	}
+	if s.quarantine > 0 {
+		s.spawn(func() {
+			wait.Until(s.sweepQuarantine, s.quarantine/2, s.stopEverything)
+		})
+	}
+	s.spawn(func() {
+		wait.Until(s.sweepHolds, s.holdSweepPeriod(), s.stopEverything)
+	})
+	if s.cursorFlushPeriod > 0 {
+		s.spawn(func() {
+			// replicas started together are jittered apart, and cursors left are flushed on shutdown
+			wait.JitterUntil(s.flushLastReservedIPs, s.cursorFlushPeriod, cursorFlushJitter, true, s.stopEverything)
+			s.flushLastReservedIPs()
+		})
+	}
+	return nil
+}
+
+// WaitForNetworks blocks until networks are cached, regardless of using ips and last reserved
+// ips, so that read queries of networks can be served before Run returns, it must be called
+// along with Run and returns an error once ctx is done or store stops before that
+func (s *Store) WaitForNetworks(ctx context.Context) error {
+	stopCh, returned := s.contextStopCh(ctx)
+	defer returned()
+
+	if !cache.WaitForCacheSync(stopCh, s.networkSynced) {
+		return fmt.Errorf("fail to sync networks")
+	}
+	s.flushInitialLoad("network")
+	// debounced network events are applied at once like Run does after all caches sync
+	s.events.Flush()
+	return nil
+}
+
+// contextStopCh returns a channel closed once ctx is done, store stops or the returned func is called,
+// the func must be called to release the goroutine behind
+func (s *Store) contextStopCh(ctx context.Context) (<-chan struct{}, func()) {
+	stopCh := make(chan struct{})
+	returned := make(chan struct{})
+	go func() {
+		defer close(stopCh)
+		select {
+		case <-ctx.Done():
+		case <-s.stopEverything:
+		case <-returned:
+		}
+	}()
+	return stopCh, func() { close(returned) }
+}
+
+// Done returns a channel which is closed once the store has shut down and its informers
+// have stopped, it is never closed if Run is not called
+func (s *Store) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close stops the store and waits for all goroutines started by Run to exit,
+// it is safe to be called more than once and along with closing stopCh of NewStore
+func (s *Store) Close() error {
+	s.stop()
+	s.running.Wait()
+	return nil
+}
+
+func (s *Store) stop() {
+	s.stopOnce.Do(func() {
+		close(s.stopEverything)
+	})
+}
+
+func (s *Store) spawn(fn func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		fn()
+	}()
+}
+
+func (s *Store) CreateNetwork(name string) error {
+	if err := validateNetworkName(name); err != nil {
+		return err
+	}
+	defer s.networkLocks.LockKey(name)()
+
+	if networkCache := s.cache.GetNetwork(name); networkCache != nil {
+		return fmt.Errorf("network %s already exists", name)
+	}
+
+	// create empty network
+	network := &resourcev1.Network{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+	}
+	if _, err := s.resourceClient.ResourceV1().Networks().Create(network); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// validateNetworkName checks name against DNS-1123 subdomain rules of cluster-scoped objects,
+// so that an invalid name fails clearly before reaching apiserver
+func validateNetworkName(name string) error {
+	if msgs := validation.IsDNS1123Subdomain(name); len(msgs) > 0 {
+		return newValidationError("network name %q is invalid: %s", name, strings.Join(msgs, ", "))
+	}
+	return nil
+}
+
+func (s *Store) DeleteNetwork(name string) error {
+	defer s.networkLocks.LockKey(name)()
+
+	networkCache := s.cache.GetNetwork(name)
+	if networkCache == nil {
+		return fmt.Errorf("network %s is not in cache", name)
+	}
+	if len(networkCache.Pools) > 0 {
+		return fmt.Errorf("network with %d pools is not allowed to be deleted", len(networkCache.Pools))
+	}
+	// using ips may outlive their pools, so they are checked on their own
+	if count := s.cache.CountUsingIPsOfNetwork(name); count > 0 {
+		return &store.NetworkInUseError{Network: name, UsingIPs: count}
+	}
+
+	client := s.resourceClient.ResourceV1()
+	if err := client.Networks().Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	// the last reserved ip is keyed by network name, it would be picked up by a new network of the name
+	if err := client.LastReservedIPs().Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("fail to delete last reserved ip of network %s: %v", name, err)
+	}
+
+	return nil
+}
+
+func (s *Store) GetNetwork(name string) (*types.Network, error) {
+	networkCache := s.cache.GetNetwork(name)
+	if networkCache == nil {
+		return nil, fmt.Errorf("network %s is not in cache", name)
+	}
+
+	return networkCache, nil
+}
+
+func (s *Store) ListNetworks() ([]*types.Network, error) {
+	return s.cache.ListNetworks(), nil
+}
+
+// SnapshotNetwork returns a consistent view of network and its used ips for custom allocators
+func (s *Store) SnapshotNetwork(name string) (*types.NetworkSnapshot, error) {
+	snapshot := s.cache.SnapshotNetwork(name)
+	if snapshot == nil {
+		return nil, fmt.Errorf("network %s is not in cache", name)
+	}
+	return snapshot, nil
+}
+
+// CompactLastReservedIP migrates the last reserved ip of network to per-pool cursors,
+// and drops cursors of pools which are removed or no longer contain them
+func (s *Store) CompactLastReservedIP(name string) error {
+	defer s.networkLocks.LockKey(name)()
+
+	network := s.cache.GetNetwork(name)
+	if network == nil {
+		return fmt.Errorf("network %s is not in cache", name)
+	}
+	lri, err := s.resourceClient.ResourceV1().LastReservedIPs().Get(name, metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil
+		}
+		return fmt.Errorf("fail to get last reserved ip %s: %v", name, err)
+	}
+	if err := checkLastReservedIPNetwork(lri, name); err != nil {
+		return err
+	}
+
+	newLri := lri.DeepCopy()
+	migrateLastReservedIP(newLri)
+	for poolName, ip := range newLri.Spec.Pools {
+		if pool := network.GetPool(poolName); pool == nil || !pool.Contains(net.ParseIP(ip)) {
+			delete(newLri.Spec.Pools, poolName)
+		}
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	if _, err := s.resourceClient.ResourceV1().LastReservedIPs().Update(newLri); err != nil {
+		return fmt.Errorf("fail to update last reserved ip %s: %v", name, err)
+	}
+	return nil
+}
+
+func (s *Store) GetLastReservedIP(name string) (*types.LastReservedIP, error) {
+	lriCache := s.cache.GetLastReservedIP(name)
+	if lriCache == nil {
+		return nil, fmt.Errorf("last reserved ip %s is not in cache", name)
+	}
+
+	return lriCache, nil
+}
+
+// ListLastReservedIPs returns the last reserved ips of all networks in cache keyed by network name,
+// which tells how far allocation has gone in each network
+func (s *Store) ListLastReservedIPs() (map[string]*types.LastReservedIP, error) {
+	return s.cache.ListLastReservedIPs(), nil
+}
+
+// SetDefaultPool makes pool the default of network for allocations naming no pool,
+// the pool must exist in network, and an empty pool clears the default
+func (s *Store) SetDefaultPool(networkName, poolName string) error {
+	defer s.networkLocks.LockKey(networkName)()
+
+	networkCache := s.cache.GetNetwork(networkName)
+	if networkCache == nil {
+		return newValidationError("network %s is not in cache", networkName)
+	}
+	if len(poolName) > 0 && networkCache.GetPool(poolName) == nil {
+		return newValidationError("network %s does not have pool %s", networkName, poolName)
+	}
+
+	network, err := s.resourceClient.ResourceV1().Networks().Get(networkName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if network.Spec.DefaultPool == poolName || s.dryRun {
+		return nil
+	}
+	networkClone := network.DeepCopy()
+	networkClone.Spec.DefaultPool = poolName
+	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *Store) AddPool(name string, pool *types.Pool) error {
+	defer s.networkLocks.LockKey(name)()
+
+	return s.addPool(name, pool)
+}
+
+// addPool must be called with the network lock held
+func (s *Store) addPool(name string, pool *types.Pool) error {
+	// check and canonicalize pool, all validation problems are reported at once
+	if err := s.canonicalizePool(pool); err != nil {
+		return err
+	}
+
+	// check existing and overlap for network
+	networkCache := s.cache.GetNetwork(name)
+	if networkCache == nil {
+		return fmt.Errorf("network %s is not in cache", name)
+	}
+	if pool.Generation == 0 {
+		pool.Generation = orphanedGeneration(s.cache.ListUsingIPs(), name, pool.Name)
+	}
+	for _, p := range networkCache.Pools {
+		switch {
+		case pool.Name == p.Name:
+			return fmt.Errorf("network %s already has pool %s", name, pool.Name)
+		case s.caseInsensitivePoolNames && strings.EqualFold(pool.Name, p.Name):
+			return fmt.Errorf("network %s already has pool %s differing from %s only in case", name, p.Name, pool.Name)
+		case pool.Overlaps(p):
+			return fmt.Errorf("new pool %+v overlaps old pool %+v in network %s", pool, p, name)
+		}
+	}
+
+	// append pool to network
+	network, err := s.resourceClient.ResourceV1().Networks().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	networkClone := network.DeepCopy()
+	networkClone.Spec.Pools = append(networkClone.Spec.Pools, pool.ToCRD())
+	if s.dryRun {
+		return nil
+	}
+	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UpdatePool replaces the pool of network with the same name, the new range must
+// still contain all live using ips of the pool
+func (s *Store) UpdatePool(name string, pool *types.Pool) error {
+	defer s.networkLocks.LockKey(name)()
+
+	return s.updatePool(name, pool)
+}
+
+// AddOrUpdatePool updates the pool of network with the same name under the rules of UpdatePool
+// if there is one, or else adds pool under the rules of AddPool, for declarative reconcilers
+func (s *Store) AddOrUpdatePool(name string, pool *types.Pool) error {
+	defer s.networkLocks.LockKey(name)()
+
+	networkCache := s.cache.GetNetwork(name)
+	if networkCache == nil {
+		return fmt.Errorf("network %s is not in cache", name)
+	}
+	if networkCache.GetPool(pool.Name) != nil {
+		return s.updatePool(name, pool)
+	}
+	return s.addPool(name, pool)
+}
+
+// updatePool must be called with the network lock held
+func (s *Store) updatePool(name string, pool *types.Pool) error {
+	if err := s.canonicalizePool(pool); err != nil {
+		return err
+	}
+
+	networkCache := s.cache.GetNetwork(name)
+	if networkCache == nil {
+		return fmt.Errorf("network %s is not in cache", name)
+	}
+	old := networkCache.GetPool(pool.Name)
+	if old == nil {
+		return fmt.Errorf("network %s does not have pool %s", name, pool.Name)
+	}
+	// the generation is kept unless it is bumped explicitly
+	if pool.Generation == 0 {
+		pool.Generation = old.Generation
+	} else if pool.Generation < old.Generation {
+		return newValidationError("generation %d of pool %s is older than %d", pool.Generation, pool.Name, old.Generation)
+	}
+	if old.Equal(pool) {
+		return nil
+	}
+	for _, p := range networkCache.Pools {
+		if p.Name != pool.Name && pool.Overlaps(p) {
+			return fmt.Errorf("new pool %+v overlaps old pool %+v in network %s", pool, p, name)
+		}
+	}
+
+	// live using ips must not be dropped by the new range
+	var dropped []string
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.Network == name && old.Contains(usingIP.IP) && !pool.Contains(usingIP.IP) {
+			dropped = append(dropped, usingIP.IP.String())
+		}
+	}
+	if len(dropped) > 0 {
+		return fmt.Errorf("new pool %s drops live using ips %s", pool.Name, strings.Join(dropped, ", "))
+	}
+
+	network, err := s.resourceClient.ResourceV1().Networks().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	networkClone := network.DeepCopy()
+	for i := range networkClone.Spec.Pools {
+		if networkClone.Spec.Pools[i].Name == pool.Name {
+			networkClone.Spec.Pools[i] = pool.ToCRD()
+		}
+	}
+	if s.dryRun {
+		return nil
+	}
+	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// canonicalizePool canonicalizes pool under the options of store, the corrections beyond
+// Canonicalize are logged since they change what users wrote
+func (s *Store) canonicalizePool(pool *types.Pool) error {
+	subnet := pool.Subnet
+	if err := pool.CanonicalizeWithOptions(types.CanonicalizeOptions{MaskHostBits: s.maskSubnetHostBits}); err != nil {
+		return err
+	}
+	if subnet != nil && !subnet.IP.Equal(pool.Subnet.IP) {
+		LoggerStore.Warnf("subnet %s of pool %s has host bits set, corrected to %s", subnet, pool.Name, pool.Subnet)
+	}
+	return nil
+}
+
+// orphanedGeneration returns the generation for a pool added with the name of a deleted one,
+// which is newer than that of any using ip left by the deleted pool, 0 if it left none
+func orphanedGeneration(usingIPs []*types.UsingIP, network, pool string) int64 {
+	var generation int64
+	for _, usingIP := range usingIPs {
+		if usingIP.Network == network && usingIP.Pool == pool && usingIP.PoolGeneration >= generation {
+			generation = usingIP.PoolGeneration + 1
+		}
+	}
+	return generation
+}
+
+// ReleaseStaleGeneration releases the using ips of pool stamped with generations earlier than
+// the one pool is at, which are left by a deleted pool of the same name, the count released is returned
+func (s *Store) ReleaseStaleGeneration(network, pool string) (int, error) {
+	p, err := s.getPool(network, pool)
+	if err != nil {
+		return 0, err
+	}
+
+	released := 0
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.Network != network || usingIP.Pool != pool || usingIP.PoolGeneration >= p.Generation {
+			continue
+		}
+		// quarantined records have been released already
+		if len(usingIP.PodName) == 0 && len(usingIP.Owner) == 0 {
+			continue
+		}
+		if err := s.Release(usingIP.IP); err != nil {
+			if errors.IsNotFound(err) {
+				continue
+			}
+			return released, err
+		}
+		released++
+	}
+	return released, nil
+}
+
+// DelPool deletes pool from network, pools still holding live using ips are refused with a
+// *store.PoolInUseError, quarantined ones do not count, and the capacity freed is returned
+func (s *Store) DelPool(networkName, poolName string) (*store.DelPoolResult, error) {
+	defer s.networkLocks.LockKey(networkName)()
+
+	// get network from kubernetes
+	network, err := s.resourceClient.ResourceV1().Networks().Get(networkName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if len(poolName) > 0 && network.Spec.DefaultPool == poolName {
+		return nil, fmt.Errorf("pool %s is the default pool of network %s, change the default first", poolName, networkName)
+	}
+
+	networkClone := network.DeepCopy()
+
+	// get pool index, judge if pool is empty
+	poolIndex := -1
+	for index, pool := range networkClone.Spec.Pools {
+		if pool.Name == poolName {
+			poolIndex = index
+		}
+	}
+	if poolIndex < 0 {
+		return nil, fmt.Errorf("network %s does not have pool %s", networkName, poolName)
+	}
+	if live := liveUsingIPsOfPool(s.cache.ListUsingIPs(), networkName, poolName); len(live) > 0 {
+		return nil, &store.PoolInUseError{Network: networkName, Pool: poolName, UsingIPs: len(live)}
+	}
+	result := &store.DelPoolResult{}
+	if pool, err := types.PoolFromCRD(networkClone.Spec.Pools[poolIndex]); err == nil {
+		result.Capacity = pool.Capacity()
+	}
+
+	// remove pool from network
+	networkClone.Spec.Pools = append(networkClone.Spec.Pools[:poolIndex], networkClone.Spec.Pools[poolIndex+1:]...)
+	if s.dryRun {
+		return result, nil
+	}
+	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// liveUsingIPsOfPool returns the ips of pool in network held by an owner, quarantined
+// records have no owner and are left out
+func liveUsingIPsOfPool(usingIPs []*types.UsingIP, network, pool string) []string {
+	var live []string
+	for _, usingIP := range usingIPs {
+		if usingIP.Network == network && usingIP.Pool == pool &&
+			(len(usingIP.PodName) > 0 || len(usingIP.Owner) > 0 || len(usingIP.MAC) > 0) {
+			live = append(live, usingIP.IP.String())
+		}
+	}
+	return live
+}
+
+// CountPool returns the count of allocatable ips of pool and how many of them are in use,
+// records on gateways or ips reserved by policy are left out like PoolStats does
+func (s *Store) CountPool(networkName, poolName string) (total, used int, err error) {
+	pool, err := s.getPool(networkName, poolName)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return pool.Capacity(), s.cache.AllocatedCount(networkName, pool.Name), nil
+}
+
+// PoolStats breaks down the ips of pool into used, reserved and free ones,
+// an using ip of the gateway or reserved by policy is only counted as reserved
+func (s *Store) PoolStats(networkName, poolName string) (types.PoolStats, error) {
+	pool, err := s.getPool(networkName, poolName)
+	if err != nil {
+		return types.PoolStats{}, err
+	}
+
+	return poolStats(pool, s.cache.AllocatedCount(networkName, pool.Name)), nil
+}
+
+// SimulateCapacity plans how many ips pool could hand out once added, pool is validated and
+// canonicalized on a copy and nothing is read from or written to the store
+func (s *Store) SimulateCapacity(pool *types.Pool) (store.CapacityPlan, error) {
+	if pool == nil {
+		return store.CapacityPlan{}, newValidationError("pool is required")
+	}
+	p := pool.DeepCopy()
+	if err := p.CanonicalizeWithOptions(types.CanonicalizeOptions{MaskHostBits: s.maskSubnetHostBits}); err != nil {
+		return store.CapacityPlan{}, err
+	}
+
+	stats := poolStats(p, 0)
+	return store.CapacityPlan{Total: stats.Total, Usable: stats.Free, Reserved: stats.Reserved}, nil
+}
+
+// FreeRanges returns the free ips of pool as the minimal list of aligned CIDR blocks in ascending
+// order, which leave out using ips, gateways and ips spared by the reserved-ip policy
+func (s *Store) FreeRanges(networkName, poolName string) ([]*net.IPNet, error) {
+	pool, err := s.getPool(networkName, poolName)
+	if err != nil {
+		return nil, err
+	}
+	used := make(map[string]struct{})
+	if snapshot := s.cache.SnapshotNetwork(networkName); snapshot != nil {
+		used = snapshot.Used
+	}
+	return pool.FreeCIDRs(used), nil
+}
+
+// ListPoolsByLabel returns copies of the pools of network having all labels of selector, sorted by name
+func (s *Store) ListPoolsByLabel(networkName string, selector map[string]string) ([]*types.Pool, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		return nil, fmt.Errorf("network %s is not in cache", networkName)
+	}
+
+	var result []*types.Pool
+	for _, pool := range network.Pools {
+		if pool.MatchesLabels(selector) {
+			result = append(result, pool)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// ListPoolsWithStats returns copies of all pools of network along with their stats, sorted by name
+func (s *Store) ListPoolsWithStats(networkName string) ([]types.PoolStat, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		return nil, fmt.Errorf("network %s is not in cache", networkName)
+	}
+
+	result := make([]types.PoolStat, 0, len(network.Pools))
+	for _, pool := range network.Pools {
+		result = append(result, types.PoolStat{Pool: pool, Stats: poolStats(pool, s.cache.AllocatedCount(networkName, pool.Name))})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Pool.Name < result[j].Pool.Name
+	})
+	return result, nil
+}
+
+// OldestAllocation returns the ip of pool held for the longest time by the creation time of
+// its using ip record, nil is returned without error if nothing is allocated in pool
+func (s *Store) OldestAllocation(networkName, poolName string) (*types.UsingIP, time.Time, error) {
+	if _, err := s.getPool(networkName, poolName); err != nil {
+		return nil, time.Time{}, err
+	}
+	// creation time is not cached, so that the records are listed from apiserver
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("fail to list using ips: %v", err)
+	}
+
+	var oldest *resourcev1.UsingIP
+	for i := range list.Items {
+		usingIP := &list.Items[i]
+		if usingIP.Spec.Network != networkName || usingIP.Spec.Pool != poolName {
+			continue
+		}
+		if _, quarantined := quarantinedAt(usingIP); quarantined {
+			continue
+		}
+		created := usingIP.CreationTimestamp
+		if oldest == nil || created.Before(&oldest.CreationTimestamp) ||
+			created.Equal(&oldest.CreationTimestamp) && usingIP.Name < oldest.Name {
+			oldest = usingIP
+		}
+	}
+	if oldest == nil {
+		return nil, time.Time{}, nil
+	}
+	return types.GetUsingIPFromCRD(oldest), oldest.CreationTimestamp.Time, nil
+}
+
+// poolStats breaks down the ips of pool with used of them allocated
+func poolStats(pool *types.Pool, used int) types.PoolStats {
+	stats := types.PoolStats{Total: pool.Size(), Used: used}
+	stats.Reserved = stats.Total - pool.Capacity()
+	stats.Free = stats.Total - stats.Reserved - stats.Used
+	return stats
+}
+
+// NetworkCapacity sums the stats of all pools in network, total is the count of allocatable
+// ips which is always used plus free, the reserved ones are not counted
+func (s *Store) NetworkCapacity(networkName string) (int, int, int, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		return 0, 0, 0, fmt.Errorf("network %s is not in cache", networkName)
+	}
+
+	total, used, free := 0, 0, 0
+	for _, pool := range network.Pools {
+		stats := poolStats(pool, s.cache.AllocatedCount(networkName, pool.Name))
+		total += stats.Total - stats.Reserved
+		used += stats.Used
+		free += stats.Free
+	}
+	return total, used, free, nil
+}
+
+func (s *Store) Reserve(network, pool, namespace, name string, ip net.IP) (bool, error) {
+	defer s.networkLocks.LockKey(network)()
+
+	if err := s.checkReservable(network, pool, ip); err != nil {
+		return false, err
+	}
+	return s.reserve(network, pool, namespace, name, ip)
+}
+
+// ReserveInPool works like Reserve, but takes the pool already resolved by caller instead of
+// looking it up in cache, ip is checked against the range and gateways of pool
+func (s *Store) ReserveInPool(pool *types.Pool, network, namespace, name string, ip net.IP) (bool, error) {
+	switch {
+	case pool == nil:
+		return false, newValidationError("pool is required to reserve ip %s", ip)
+	case pool.Disabled:
+		return false, &store.PoolDisabledError{Network: network, Pool: pool.Name}
+	case pool.IsGatewayReservable(ip):
+	case pool.IsGateway(ip):
+		return false, newValidationError("ip %s is a gateway of pool %s", ip, pool.Name)
+	case !pool.IsAllocatable(ip):
+		return false, newValidationError("ip %s is not allocatable in pool %s", ip, pool.Name)
+	}
+	defer s.networkLocks.LockKey(network)()
+
+	usingIP := newPodUsingIP(network, pool.Name, namespace, name)
+	reserved, err := s.reserveUsingIP(ip, usingIP)
+	if reserved && !s.dryRun && pool.Strategy.UsesLastReservedIP() {
+		// fail safe
+		_ = s.advanceLastReservedIP(network, pool.Name, ip.String())
+	}
+	return reserved, err
+}
+
+// ValidateReservation checks that ip could be reserved in pool of network without reserving it,
+// the reason of a rejection is told by a *store.ReservationError, or a *store.PoolDisabledError
+// for disabled pools, leases of pools are not checked as they depend on the owner, and the
+// check runs against cache, so a reservation may still lose to one made at the same time
+func (s *Store) ValidateReservation(network, pool string, ip net.IP) error {
+	if ip == nil {
+		return newValidationError("ip is required to validate a reservation")
+	}
+	reject := func(reason store.ReservationRejection) error {
+		return &store.ReservationError{Reason: reason, Network: network, Pool: pool, IP: ip}
+	}
+
+	networkCache := s.cache.GetNetwork(network)
+	if networkCache == nil {
+		return reject(store.RejectNotFound)
+	}
+	p := networkCache.GetPool(pool)
+	switch {
+	case p == nil:
+		return reject(store.RejectNotFound)
+	case p.Disabled:
+		return &store.PoolDisabledError{Network: network, Pool: pool}
+	case p.IsGatewayReservable(ip):
+	case p.IsGateway(ip):
+		return reject(store.RejectGateway)
+	case !p.Contains(ip):
+		return reject(store.RejectOutOfRange)
+	case p.IsReserved(ip):
+		return reject(store.RejectReserved)
+	}
+	if s.cache.IsIPUsing(ip.String()) {
+		return reject(store.RejectInUse)
+	}
+	return nil
+}
+
+func (s *Store) ReserveWithResult(network, pool, namespace, name string, ip net.IP) (*store.ReserveResult, error) {
+	defer s.networkLocks.LockKey(network)()
+
+	if err := s.checkReservable(network, pool, ip); err != nil {
+		return nil, err
+	}
+	reserved, err := s.reserve(network, pool, namespace, name, ip)
+	if err != nil || reserved {
+		return &store.ReserveResult{Reserved: reserved}, err
+	}
+
+	// the create hit an existing record, which is ours if it is owned by the same pod
+	existing, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(ip), metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return &store.ReserveResult{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	already := existing.Spec.Network == network && existing.Spec.Pool == pool &&
+		existing.Spec.PodNamespace == namespace && existing.Spec.PodName == name
+	return &store.ReserveResult{Reserved: already, Already: already}, nil
+}
+
+// ReserveOnNode works like Reserve, and additionally records node where the pod runs
+func (s *Store) ReserveOnNode(network, pool, namespace, name, node string, ip net.IP) (bool, error) {
+	defer s.networkLocks.LockKey(network)()
+
+	if err := s.checkReservable(network, pool, ip); err != nil {
+		return false, err
+	}
+	usingIP := newPodUsingIP(network, pool, namespace, name)
+	usingIP.Spec.NodeName = node
+	return s.reservePod(ip, usingIP)
+}
+
+// ReserveWithContainer works like Reserve, and additionally records the container id and
+// interface name of the CNI ADD, so that CNI DEL can release the ip by ReleaseByContainer
+func (s *Store) ReserveWithContainer(network, pool, namespace, name, containerID, ifName string, ip net.IP) (bool, error) {
+	if len(containerID) == 0 {
+		return false, newValidationError("container id is required to reserve ip %s", ip)
+	}
+	defer s.networkLocks.LockKey(network)()
+
+	if err := s.checkReservable(network, pool, ip); err != nil {
+		return false, err
+	}
+	usingIP := newPodUsingIP(network, pool, namespace, name)
+	usingIP.Spec.ContainerID = containerID
+	usingIP.Spec.IfName = ifName
+	return s.reservePod(ip, usingIP)
+}
+
+// cacheWaitInterval is the interval of polling cache for writes of store to be reflected
+const cacheWaitInterval = 20 * time.Millisecond
+
+// maxMetadataSize is the total size limit of metadata, which is the one of annotations
+const maxMetadataSize = 256 * 1024
+
+// ReserveWithMetadata works like Reserve, and additionally persists metadata along with the ip,
+// keys of metadata must be qualified names like those of annotations
+func (s *Store) ReserveWithMetadata(network, pool, namespace, name string, ip net.IP, metadata map[string]string) (bool, error) {
+	if err := validateMetadata(metadata); err != nil {
+		return false, err
+	}
+	defer s.networkLocks.LockKey(network)()
+
+	if err := s.checkReservable(network, pool, ip); err != nil {
+		return false, err
+	}
+	usingIP := newPodUsingIP(network, pool, namespace, name)
+	if len(metadata) > 0 {
+		// empty metadata is omitted by apiserver
+		usingIP.Spec.Metadata = metadata
+	}
+	return s.reservePod(ip, usingIP)
+}
+
+// validateMetadata checks metadata against the rules of annotations
+func validateMetadata(metadata map[string]string) error {
+	size := 0
+	for k, v := range metadata {
+		if msgs := validation.IsQualifiedName(k); len(msgs) > 0 {
+			return newValidationError("metadata key %q is invalid: %s", k, strings.Join(msgs, ", "))
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return newValidationError("metadata of %d bytes exceeds the limit of %d bytes", size, maxMetadataSize)
+	}
+	return nil
+}
+
+// reserve must be called with the network lock held
+func (s *Store) reserve(network, pool, namespace, name string, ip net.IP) (bool, error) {
+	return s.reservePod(ip, newPodUsingIP(network, pool, namespace, name))
+}
+
+// reservePod reserves ip picked for a pod or nic and moves the last reserved ip of network
+// to it, unless the strategy of the pool never reads the last reserved ip
+func (s *Store) reservePod(ip net.IP, usingIP *resourcev1.UsingIP) (bool, error) {
+	reserved, err := s.reserveUsingIP(ip, usingIP)
+	if reserved && !s.dryRun && s.usesLastReservedIP(usingIP.Spec.Network, usingIP.Spec.Pool) {
+		// fail safe
+		_ = s.advanceLastReservedIP(usingIP.Spec.Network, usingIP.Spec.Pool, ip.String())
+	}
 
-	// non-blocking
-	go func() {
-		<-s.stopEverything
-		LoggerStore.Info("kube store shutting down...")
-	}()
-	return nil
+	return reserved, err
 }
 
-func (s *Store) CreateNetwork(name string) error {
-	s.Lock()
-	defer s.Unlock()
+// usesLastReservedIP checks the strategy of pool, pools missing from cache are
+// taken as sequential
+func (s *Store) usesLastReservedIP(networkName, poolName string) bool {
+	if network := s.cache.GetNetwork(networkName); network != nil {
+		if pool := network.GetPool(poolName); pool != nil {
+			return pool.Strategy.UsesLastReservedIP()
+		}
+	}
+	return true
+}
 
-	if networkCache := s.cache.GetNetwork(name); networkCache != nil {
-		return fmt.Errorf("network %s already exists", name)
+func newOwnerUsingIP(network, pool, owner string) *resourcev1.UsingIP {
+	return &resourcev1.UsingIP{
+		Spec: resourcev1.UsingIPSpec{
+			Network: network,
+			Pool:    pool,
+			Owner:   owner,
+		},
 	}
+}
 
-	// create empty network
-	network := &resourcev1.Network{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: name,
+func newPodUsingIP(network, pool, namespace, name string) *resourcev1.UsingIP {
+	return &resourcev1.UsingIP{
+		Spec: resourcev1.UsingIPSpec{
+			PodName:      name,
+			PodNamespace: namespace,
+			Network:      network,
+			Pool:         pool,
 		},
 	}
-	if _, err := s.resourceClient.ResourceV1().Networks().Create(network); err != nil {
+}
+
+// ReserveStatic reserves ip for an owner which is not a pod, e.g. a VIP,
+// the last reserved ip of network is left untouched
+func (s *Store) ReserveStatic(network, pool string, ip net.IP, owner string) error {
+	defer s.networkLocks.LockKey(network)()
+
+	return s.reserveStatic(ip, newOwnerUsingIP(network, pool, owner))
+}
+
+// reserveStatic reserves ip with usingIP owned by a free-form owner, the network lock must be held
+func (s *Store) reserveStatic(ip net.IP, usingIP *resourcev1.UsingIP) error {
+	network, pool := usingIP.Spec.Network, usingIP.Spec.Pool
+	p, err := s.getAllocatablePool(network, pool)
+	if err != nil {
 		return err
 	}
+	switch {
+	case p.IsGatewayReservable(ip):
+	case !p.Contains(ip):
+		return fmt.Errorf("ip %s is not in pool %s", ip, pool)
+	case p.IsGateway(ip):
+		return fmt.Errorf("ip %s is a gateway of pool %s", ip, pool)
+	case p.IsReserved(ip):
+		return fmt.Errorf("ip %s is reserved by policy of pool %s", ip, pool)
+	}
 
+	reserved, err := s.reserveUsingIP(ip, usingIP)
+	if err != nil {
+		return err
+	}
+	if !reserved {
+		return fmt.Errorf("ip %s is already in use", ip)
+	}
 	return nil
 }
 
-func (s *Store) DeleteNetwork(name string) error {
-	s.Lock()
-	defer s.Unlock()
+// reserveUsingIP creates the using ip record for ip and audits it
+func (s *Store) reserveUsingIP(ip net.IP, usingIP *resourcev1.UsingIP) (bool, error) {
+	spec := usingIP.Spec
+	if err := validateOwner(&spec); err != nil {
+		return false, err
+	}
+	if err := s.checkLease(&spec); err != nil {
+		return false, err
+	}
 
-	networkCache := s.cache.GetNetwork(name)
-	if networkCache == nil {
-		return fmt.Errorf("network %s is not in cache", name)
+	if s.cache.IsIPUsing(ip.String()) {
+		return false, nil
 	}
-	if len(networkCache.Pools) > 0 {
-		return fmt.Errorf("network with %s pools is not allowed to be deleted", len(networkCache.Pools))
+	if err := s.checkNamespaceQuota(&spec); err != nil {
+		return false, err
+	}
+	if s.dryRun {
+		return true, nil
 	}
 
-	if err := s.resourceClient.ResourceV1().Networks().Delete(name, nil); err != nil {
-		if errors.IsNotFound(err) {
-			return nil
+	usingIP.Name = s.names.Encode(ip)
+	if usingIP.Labels == nil {
+		usingIP.Labels = make(map[string]string, 2)
+	}
+	// names too long for label values are left unlabeled instead of failing the reservation
+	if len(validation.IsValidLabelValue(spec.Network)) == 0 {
+		usingIP.Labels[NetworkLabel] = spec.Network
+	}
+	if len(validation.IsValidLabelValue(spec.Pool)) == 0 {
+		usingIP.Labels[PoolLabel] = spec.Pool
+	}
+	if pool, err := s.getPool(spec.Network, spec.Pool); err == nil {
+		usingIP.Spec.PoolGeneration = pool.Generation
+	}
+	reserved, err := s.createUsingIP(usingIP)
+	if reserved && s.postReserve != nil {
+		if err := s.postReserve(types.GetUsingIPFromCRD(usingIP)); err != nil {
+			if rollbackErr := s.deleteUsingIP(usingIP.Name, nil); rollbackErr != nil && !errors.IsNotFound(rollbackErr) {
+				LoggerStore.Errorf("fail to roll back using ip %s after post reserve hook fails: %v", usingIP.Name, rollbackErr)
+			}
+			return false, fmt.Errorf("post reserve hook of ip %s fails: %v", ip, err)
 		}
-		return err
+	}
+	if reserved {
+		s.auditSink.RecordReserve(&store.AuditEntry{
+			Time:         time.Now(),
+			IP:           ip.String(),
+			Network:      spec.Network,
+			Pool:         spec.Pool,
+			PodNamespace: spec.PodNamespace,
+			PodName:      spec.PodName,
+			Owner:        spec.Owner,
+		})
 	}
 
-	return nil
+	return reserved, err
 }
 
-func (s *Store) GetNetwork(name string) (*types.Network, error) {
-	s.RLock()
-	defer s.RUnlock()
-
-	networkCache := s.cache.GetNetwork(name)
-	if networkCache == nil {
-		return nil, fmt.Errorf("network %s is not in cache", name)
+// checkNamespaceQuota refuses another ip for a pod whose namespace holds its quota of ips in the
+// network of spec already, the network lock must be held so that records are counted from
+// apiserver without racing other reservations of store
+func (s *Store) checkNamespaceQuota(spec *resourcev1.UsingIPSpec) error {
+	if s.namespaceQuota <= 0 || len(spec.PodNamespace) == 0 {
+		return nil
 	}
 
-	return networkCache, nil
+	// the cache may not have seen reservations just made, which would let a burst exceed quota
+	var options metav1.ListOptions
+	if len(validation.IsValidLabelValue(spec.Network)) == 0 {
+		options.LabelSelector = NetworkLabel + "=" + spec.Network
+	}
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(options)
+	if err != nil {
+		return fmt.Errorf("fail to list using ips of network %s: %v", spec.Network, err)
+	}
+	count := 0
+	for i := range usingIPs.Items {
+		if other := &usingIPs.Items[i].Spec; other.Network == spec.Network && other.PodNamespace == spec.PodNamespace {
+			count++
+		}
+	}
+	if count >= s.namespaceQuota {
+		return &store.QuotaExceededError{Network: spec.Network, Namespace: spec.PodNamespace, Quota: s.namespaceQuota}
+	}
+	return nil
 }
 
-func (s *Store) GetLastReservedIP(name string) (*types.LastReservedIP, error) {
-	s.RLock()
-	defer s.RUnlock()
-
-	lriCache := s.cache.GetLastReservedIP(name)
-	if lriCache == nil {
-		return nil, fmt.Errorf("last reserved ip %s is not in cache", name)
+// validateOwner ensures an using ip is owned by a pod, a free-form owner or a mac
+func validateOwner(spec *resourcev1.UsingIPSpec) error {
+	switch {
+	case len(spec.PodName) > 0 && len(spec.PodNamespace) > 0:
+		return nil
+	case len(spec.PodName) > 0 || len(spec.PodNamespace) > 0:
+		return newValidationError("both pod namespace and name are required, got %s/%s", spec.PodNamespace, spec.PodName)
+	case len(spec.Owner) == 0 && len(spec.MAC) == 0:
+		return newValidationError("either pod, owner or mac is required to reserve an ip")
 	}
-
-	return lriCache, nil
+	return nil
 }
 
-func (s *Store) AddPool(name string, pool *types.Pool) error {
-	s.Lock()
-	defer s.Unlock()
-
-	// check existing and overlap for network
-	networkCache := s.cache.GetNetwork(name)
-	if networkCache == nil {
-		return fmt.Errorf("network %s is not in cache", name)
+func (s *Store) Release(ip net.IP) error {
+	usingIP := s.cache.GetUsingIP(ip.String())
+	if usingIP != nil && usingIP.Protected {
+		return &store.ProtectedIPError{IPs: []net.IP{ip}}
 	}
-	for _, p := range networkCache.Pools {
-		switch {
-		case pool.Name == p.Name:
-			return fmt.Errorf("network %s already has pool %s", name, pool.Name)
-		case pool.Overlaps(p):
-			return fmt.Errorf("new pool %+v overlaps old pool %+v in network %s", pool, p, name)
+	if s.strictRelease && usingIP == nil && !s.isInAnyPool(ip) {
+		return &store.UnknownIPError{IP: ip}
+	}
+	return s.release(ip, nil)
+}
+
+// isInAnyPool checks if ip is in the range of any cached pool
+func (s *Store) isInAnyPool(ip net.IP) bool {
+	for _, network := range s.cache.ListNetworks() {
+		if _, found := network.FindPoolForIP(ip); found {
+			return true
 		}
 	}
+	return false
+}
 
-	// check and canonicalize pool
-	if err := pool.Canonicalize(); err != nil {
+// ReleaseAndWait releases ip like Release, and then waits until the removal is reflected by cache,
+// so that ip is seen free by the store once it returns, an error is returned if ctx is done before that,
+// with quarantine enabled it waits for the record to be quarantined instead
+func (s *Store) ReleaseAndWait(ctx context.Context, ip net.IP) error {
+	if err := s.Release(ip); err != nil {
 		return err
 	}
 
-	// append pool to network
-	network, err := s.resourceClient.ResourceV1().Networks().Get(name, metav1.GetOptions{})
+	stopCh, returned := s.contextStopCh(ctx)
+	defer returned()
+	err := wait.PollImmediateUntil(cacheWaitInterval, func() (bool, error) {
+		usingIP := s.cache.GetUsingIP(ip.String())
+		return usingIP == nil || s.quarantine > 0 && len(usingIP.PodName) == 0 && len(usingIP.Owner) == 0, nil
+	}, stopCh)
 	if err != nil {
-		return err
+		return fmt.Errorf("fail to wait for release of ip %s to be cached: %v", ip, err)
 	}
-	networkClone := network.DeepCopy()
-	networkClone.Spec.Pools = append(networkClone.Spec.Pools, resourcev1.Pool{
-		Name:      pool.Name,
-		PoolStart: pool.PoolStart.String(),
-		PoolEnd:   pool.PoolEnd.String(),
-		Gateway:   pool.Gateway.String(),
-		Subnet:    pool.Subnet.String(),
-		VlanId:    pool.VlanID,
+	return nil
+}
+
+// ReleaseIfOwnedBy releases ip only if it is reserved by pod namespace/name,
+// false is returned without error if the ip is free or owned by others
+func (s *Store) ReleaseIfOwnedBy(ip net.IP, namespace, name string) (bool, error) {
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(ip), metav1.GetOptions{})
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if usingIP.Spec.PodNamespace != namespace || usingIP.Spec.PodName != name {
+		return false, nil
+	}
+	if usingIP.Spec.Protected {
+		return false, &store.ProtectedIPError{IPs: []net.IP{ip}}
+	}
+
+	// the precondition guards against the ip being re-owned after the get above
+	err = s.release(ip, &metav1.DeleteOptions{
+		Preconditions: &metav1.Preconditions{UID: &usingIP.UID},
 	})
-	if _, err = s.resourceClient.ResourceV1().Networks().Create(networkClone); err != nil {
+	if err != nil {
+		if errors.IsNotFound(err) || errors.IsConflict(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// release releases ip, the using ip is quarantined instead of deleted if configured
+func (s *Store) release(ip net.IP, options *metav1.DeleteOptions) error {
+	return s.releaseUsingIP(ip, options, s.quarantine > 0)
+}
+
+func (s *Store) releaseUsingIP(ip net.IP, options *metav1.DeleteOptions, quarantine bool) error {
+	entry := &store.AuditEntry{IP: ip.String()}
+	if usingIP := s.cache.GetUsingIP(ip.String()); usingIP != nil {
+		entry.Network = usingIP.Network
+		entry.Pool = usingIP.Pool
+		entry.PodNamespace = usingIP.PodNamespace
+		entry.PodName = usingIP.PodName
+		entry.Owner = usingIP.Owner
+	}
+
+	// both deleting and updating an using ip are atomic in apiserver, no network lock is needed
+	if quarantine {
+		if err := s.quarantineUsingIP(s.usingIPName(ip), options); err != nil {
+			return err
+		}
+	} else if err := s.deleteUsingIP(s.usingIPName(ip), options); err != nil {
 		return err
 	}
 
+	entry.Time = time.Now()
+	s.auditSink.RecordRelease(entry)
 	return nil
 }
 
-func (s *Store) DelPool(networkName, poolName string) error {
-	s.Lock()
-	defer s.Unlock()
-
-	// get network from kubernetes
-	network, err := s.resourceClient.ResourceV1().Networks().Get(networkName, metav1.GetOptions{})
+// ForceRelease deletes every using ip record of ip regardless of its owner and name encoding,
+// which is meant for admins to clean up inconsistent records, e.g. those found by CheckDuplicateUsingIPs
+func (s *Store) ForceRelease(ip net.IP) error {
+	byIP, err := s.listUsingIPsByIP()
 	if err != nil {
 		return err
 	}
 
-	networkClone := network.DeepCopy()
+	errs := types.ErrorList{}
+	for _, usingIP := range byIP[ip.String()] {
+		LoggerStore.Warnf("force releasing using ip %s of %s in network %s", usingIP.Name, usingIPOwner(&usingIP.Spec), usingIP.Spec.Network)
+		if err := s.deleteUsingIP(usingIP.Name, nil); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("fail to delete using ip %s: %v", usingIP.Name, err))
+			continue
+		}
+		s.auditSink.RecordRelease(&store.AuditEntry{
+			Time:         time.Now(),
+			IP:           ip.String(),
+			Network:      usingIP.Spec.Network,
+			Pool:         usingIP.Spec.Pool,
+			PodNamespace: usingIP.Spec.PodNamespace,
+			PodName:      usingIP.Spec.PodName,
+			Owner:        usingIP.Spec.Owner,
+		})
+	}
+	return errs.ToError()
+}
 
-	// get pool index, judge if pool is empty
-	poolIndex := -1
-	for index, pool := range networkClone.Spec.Pools {
-		if pool.Name == poolName {
-			poolIndex = index
-			//TODO: check pool count
+// ReleaseByName releases all ips of pool reserved by pod namespace/name, protected ips are
+// skipped and reported by a store.ProtectedIPError
+func (s *Store) ReleaseByName(network, pool, namespace, name string) error {
+	var protected []net.IP
+	for _, ip := range s.cache.IPsForPod(namespace, name) {
+		usingIP := s.cache.GetUsingIP(ip.String())
+		if usingIP == nil || usingIP.Network != network || usingIP.Pool != pool {
+			continue
+		}
+		if usingIP.Protected {
+			protected = append(protected, ip)
+			continue
+		}
+		if err := s.Release(ip); err != nil && !errors.IsNotFound(err) {
+			return err
 		}
 	}
-	if poolIndex < 0 {
-		return fmt.Errorf("network %s does not have pool %s", networkName, poolName)
+	if len(protected) > 0 {
+		return &store.ProtectedIPError{IPs: protected}
 	}
+	return nil
+}
 
-	// remove pool from network
-	networkClone.Spec.Pools = append(networkClone.Spec.Pools[:poolIndex], networkClone.Spec.Pools[poolIndex+1:]...)
-	if _, err = s.resourceClient.ResourceV1().Networks().Update(networkClone); err != nil {
-		return err
+// ReleaseByContainer releases the ips reserved by the interface ifName of container containerID,
+// an empty ifName matches every interface of the container, and it is not an error that nothing matches
+func (s *Store) ReleaseByContainer(containerID, ifName string) error {
+	if len(containerID) == 0 {
+		return newValidationError("container id is required to release by container")
+	}
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.ContainerID != containerID || (len(ifName) > 0 && usingIP.IfName != ifName) {
+			continue
+		}
+		if err := s.Release(usingIP.IP); err != nil && !errors.IsNotFound(err) {
+			return err
+		}
 	}
-
 	return nil
 }
 
-func (*Store) CountPool(network, pool string) (total, used int, err error) {
-	panic("implement me")
+// GetUsingIP returns the cached using ip record of ip, nil is returned without error if ip is free
+func (s *Store) GetUsingIP(ip net.IP) (*types.UsingIP, error) {
+	return s.cache.GetUsingIP(ip.String()), nil
 }
 
-func (s *Store) Reserve(network, pool, namespace, name string, ip net.IP) (bool, error) {
-	s.Lock()
-	defer s.Unlock()
+// ListUsingIPsByNode returns the using ips reserved on node, sorted by ip
+func (s *Store) ListUsingIPsByNode(node string) ([]*types.UsingIP, error) {
+	result := make([]*types.UsingIP, 0)
+	for _, usingIP := range s.cache.ListUsingIPs() {
+		if usingIP.NodeName == node {
+			result = append(result, usingIP)
+		}
+	}
+	return result, nil
+}
 
-	if s.cache.IsIPUsing(utils.ToKubeName(ip.String())) {
-		return false, nil
+// StreamUsingIPs emits copies of all using ips in cache sorted by ip one at a time, so that exports of
+// large networks never hold all of them, ips released during the walk are skipped, the channel is
+// closed once all are emitted, ctx is done or store stops, and the consumer must drain it or cancel ctx
+func (s *Store) StreamUsingIPs(ctx context.Context) <-chan *types.UsingIP {
+	ch := make(chan *types.UsingIP)
+	select {
+	case <-s.stopEverything:
+		close(ch)
+		return ch
+	default:
 	}
 
-	reserved, err := s.createUsingIP(network, pool, namespace, name, ip.String())
-	if reserved {
-		// fail safe
-		_ = s.updateLastReservedIP(network, pool, ip.String())
+	// the producer is not spawned, since streams may be started while Close waits for
+	// goroutines of Run, it exits on its own once store stops
+	keys := s.cache.usingIPKeys()
+	go func() {
+		defer close(ch)
+		stopCh, returned := s.contextStopCh(ctx)
+		defer returned()
+		for _, key := range keys {
+			usingIP := s.cache.GetUsingIP(key)
+			if usingIP == nil {
+				continue
+			}
+			select {
+			case ch <- usingIP:
+			case <-stopCh:
+				return
+			}
+		}
+	}()
+	return ch
+}
+
+// IPsForPod returns all ips reserved by pod namespace/name
+func (s *Store) IPsForPod(namespace, name string) ([]net.IP, error) {
+	return s.cache.IPsForPod(namespace, name), nil
+}
+
+// ResolveIP returns a copy of the pool in network which contains ip
+func (s *Store) ResolveIP(networkName string, ip net.IP) (*types.Pool, error) {
+	network := s.cache.GetNetwork(networkName)
+	if network == nil {
+		return nil, fmt.Errorf("network %s is not in cache", networkName)
 	}
 
-	return reserved, err
+	pool, found := network.FindPoolForIP(ip)
+	if !found {
+		return nil, fmt.Errorf("ip %s is not in any pool of network %s", ip, networkName)
+	}
+	return pool, nil
 }
 
-func (s *Store) Release(ip net.IP) error {
-	s.Lock()
-	defer s.Unlock()
+// LookupIP describes ip across all networks, an ip in no pool is described with empty network
+func (s *Store) LookupIP(ip net.IP) (*types.IPInfo, error) {
+	if ip == nil {
+		return nil, fmt.Errorf("ip can not be empty")
+	}
+
+	info := &types.IPInfo{IP: ip, UsingIP: s.cache.GetUsingIP(ip.String())}
+	for _, network := range s.cache.ListNetworks() {
+		pool := lookupPool(network, ip, info.UsingIP)
+		if pool == nil {
+			continue
+		}
 
-	return s.deleteUsingIP(ip.String())
+		info.Network, info.Pool = network.Name, pool.Name
+		info.Gateway = pool.IsGateway(ip)
+		info.Reserved = pool.IsReserved(ip)
+		break
+	}
+	if info.UsingIP != nil && len(info.Network) == 0 {
+		info.Network, info.Pool = info.UsingIP.Network, info.UsingIP.Pool
+	}
+	return info, nil
 }
 
-func (*Store) ReleaseByName(network, pool, namespace, name string) error {
-	panic("implement me")
+// lookupPool finds the pool of network where ip belongs, which is the pool of its using ip record,
+// the first pool containing it, or the first pool taking it as gateway
+func lookupPool(network *types.Network, ip net.IP, usingIP *types.UsingIP) *types.Pool {
+	if usingIP != nil {
+		if usingIP.Network != network.Name {
+			return nil
+		}
+		return network.GetPool(usingIP.Pool)
+	}
+	if pool, found := network.FindPoolForIP(ip); found {
+		return pool
+	}
+	for _, pool := range network.Pools {
+		if pool.IsGateway(ip) {
+			return pool
+		}
+	}
+	return nil
 }
 
 func (s *Store) addNetworkToCache(obj interface{}) {
 	network, ok := obj.(*resourcev1.Network)
 	if !ok {
+		s.unexpectedObject("networks", obj)
+		return
+	}
+	if s.initialLoad.buffer(network) {
 		return
 	}
 
-	s.cache.addNetwork(network)
+	s.events.Do("network/"+network.Name, func() {
+		s.cache.addNetwork(network)
+	})
 }
 
 func (s *Store) updateNetworkInCache(oldObj, newObj interface{}) {
 	oldNetwork, ok := oldObj.(*resourcev1.Network)
 	if !ok {
+		s.unexpectedObject("networks", oldObj)
 		return
 	}
 	newNetwork, ok := newObj.(*resourcev1.Network)
 	if !ok {
+		s.unexpectedObject("networks", newObj)
 		return
 	}
 	if oldNetwork.ResourceVersion == newNetwork.ResourceVersion {
 		return
 	}
 
-	s.cache.updateNetwork(newNetwork)
+	s.flushInitialLoad()
+	s.events.Do("network/"+newNetwork.Name, func() {
+		s.cache.updateNetwork(newNetwork)
+	})
 }
 
 func (s *Store) deleteNetworkFromCache(obj interface{}) {
@@ -336,38 +1625,54 @@ func (s *Store) deleteNetworkFromCache(obj interface{}) {
 		var ok bool
 		network, ok = t.Obj.(*resourcev1.Network)
 		if !ok {
+			s.unexpectedObject("networks", t.Obj)
 			return
 		}
 	default:
+		s.unexpectedObject("networks", obj)
 		return
 	}
 
-	s.cache.deleteNetwork(network)
+	s.flushInitialLoad()
+	s.events.Do("network/"+network.Name, func() {
+		s.cache.deleteNetwork(network)
+	})
 }
 
 func (s *Store) addLastReservedIPToCache(obj interface{}) {
 	lastReservedIP, ok := obj.(*resourcev1.LastReservedIP)
 	if !ok {
+		s.unexpectedObject("lastreservedips", obj)
+		return
+	}
+	if s.initialLoad.buffer(lastReservedIP) {
 		return
 	}
 
-	s.cache.addLastReservedIP(lastReservedIP)
+	s.events.Do("lastreservedip/"+lastReservedIP.Name, func() {
+		s.cache.addLastReservedIP(lastReservedIP)
+	})
 }
 
 func (s *Store) updateLastReservedIPInCache(oldObj, newObj interface{}) {
 	oldLastReservedIP, ok := oldObj.(*resourcev1.LastReservedIP)
 	if !ok {
+		s.unexpectedObject("lastreservedips", oldObj)
 		return
 	}
 	newLastReservedIP, ok := newObj.(*resourcev1.LastReservedIP)
 	if !ok {
+		s.unexpectedObject("lastreservedips", newObj)
 		return
 	}
 	if oldLastReservedIP.ResourceVersion == newLastReservedIP.ResourceVersion {
 		return
 	}
 
-	s.cache.updateLastReservedIP(newLastReservedIP)
+	s.flushInitialLoad()
+	s.events.Do("lastreservedip/"+newLastReservedIP.Name, func() {
+		s.cache.updateLastReservedIP(newLastReservedIP)
+	})
 }
 
 func (s *Store) deleteLastReservedIPFromCache(obj interface{}) {
@@ -379,38 +1684,65 @@ func (s *Store) deleteLastReservedIPFromCache(obj interface{}) {
 		var ok bool
 		lastReservedIP, ok = t.Obj.(*resourcev1.LastReservedIP)
 		if !ok {
+			s.unexpectedObject("lastreservedips", t.Obj)
 			return
 		}
 	default:
+		s.unexpectedObject("lastreservedips", obj)
 		return
 	}
 
-	s.cache.deleteLastReservedIP(lastReservedIP)
+	s.flushInitialLoad()
+	s.events.Do("lastreservedip/"+lastReservedIP.Name, func() {
+		s.cache.deleteLastReservedIP(lastReservedIP)
+	})
 }
 
 func (s *Store) addUsingIPToCache(obj interface{}) {
 	usingIP, ok := obj.(*resourcev1.UsingIP)
 	if !ok {
+		s.unexpectedObject("usingips", obj)
+		return
+	}
+	if s.initialLoad.buffer(usingIP) {
 		return
 	}
 
-	s.cache.addUsingIP(usingIP)
+	s.events.Do("usingip/"+usingIP.Name, func() {
+		if s.cache.addUsingIP(usingIP) {
+			s.broadcastUsingIP(store.AllocationReserved, usingIP)
+		}
+	})
 }
 
 func (s *Store) updateUsingIPInCache(oldObj, newObj interface{}) {
 	oldUsingIP, ok := oldObj.(*resourcev1.UsingIP)
 	if !ok {
+		s.unexpectedObject("usingips", oldObj)
 		return
 	}
 	newUsingIP, ok := newObj.(*resourcev1.UsingIP)
 	if !ok {
+		s.unexpectedObject("usingips", newObj)
 		return
 	}
 	if oldUsingIP.ResourceVersion == newUsingIP.ResourceVersion {
 		return
 	}
 
-	s.cache.updateUsingIP(newUsingIP)
+	s.flushInitialLoad()
+	s.events.Do("usingip/"+newUsingIP.Name, func() {
+		if !s.cache.updateUsingIP(newUsingIP) {
+			return
+		}
+		// a quarantined update is the release of the ip as far as watchers are concerned
+		_, wasQuarantined := quarantinedAt(oldUsingIP)
+		if _, quarantined := quarantinedAt(newUsingIP); quarantined && !wasQuarantined {
+			s.broadcastUsingIP(store.AllocationReleased, newUsingIP)
+		} else if !quarantined {
+			s.broadcastUsingIP(store.AllocationUpdated, newUsingIP)
+		}
+	})
 }
 
 func (s *Store) deleteUsingIPFromCache(obj interface{}) {
@@ -422,32 +1754,70 @@ func (s *Store) deleteUsingIPFromCache(obj interface{}) {
 		var ok bool
 		usingIP, ok = t.Obj.(*resourcev1.UsingIP)
 		if !ok {
+			s.unexpectedObject("usingips", t.Obj)
 			return
 		}
 	default:
+		s.unexpectedObject("usingips", obj)
 		return
 	}
 
-	s.cache.deleteUsingIP(usingIP)
+	s.flushInitialLoad()
+	s.events.Do("usingip/"+usingIP.Name, func() {
+		s.cache.deleteUsingIP(usingIP)
+		if _, quarantined := quarantinedAt(usingIP); !quarantined {
+			s.broadcastUsingIP(store.AllocationReleased, usingIP)
+		}
+	})
 }
 
-func (s *Store) createUsingIP(network, pool, namespace, name, ip string) (bool, error) {
-	usingIP := &resourcev1.UsingIP{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: utils.ToKubeName(ip),
-		},
-		Spec: resourcev1.UsingIPSpec{
-			PodName:      name,
-			PodNamespace: namespace,
-			Network:      network,
-			Pool:         pool,
-		},
-	}
+// unexpectedObject counts and warns about obj which the informer of resource handed over
+// with an unexpected type, it is dropped rather than applied to cache
+func (s *Store) unexpectedObject(resource string, obj interface{}) {
+	s.unexpectedObjects.inc(resource)
+	LoggerStore.Warnf("informer of %s handed over unexpected object of type %T, dropped", resource, obj)
+}
+
+func (s *Store) broadcastUsingIP(eventType store.AllocationEventType, usingIP *resourcev1.UsingIP) {
+	s.watchers.broadcast(store.AllocationEvent{Type: eventType, UsingIP: types.GetUsingIPFromCRD(usingIP)})
+	s.utilization.evaluate(usingIP.Spec.Network, s.poolUtilization)
+}
+
+// createUsingIPBackoff bounds the retries of creating an using ip on transient api errors
+var createUsingIPBackoff = wait.Backoff{
+	Duration: 10 * time.Millisecond,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    4,
+}
+
+func (s *Store) createUsingIP(usingIP *resourcev1.UsingIP) (bool, error) {
+	var lastErr error
+	attempts := 0
+	err := wait.ExponentialBackoff(createUsingIPBackoff, func() (bool, error) {
+		attempts++
+		_, lastErr = s.resourceClient.ResourceV1().UsingIPs().Create(usingIP)
+		switch {
+		case lastErr == nil:
+			return true, nil
+		case isRetryableError(lastErr):
+			LoggerStore.Warnf("fail to create using ip %s at attempt %d, retrying: %v", usingIP.Name, attempts, lastErr)
+			return false, nil
+		default:
+			return false, lastErr
+		}
+	})
 
-	_, err := s.resourceClient.ResourceV1().UsingIPs().Create(usingIP)
-	if err != nil && errors.IsAlreadyExists(err) {
+	if errors.IsAlreadyExists(lastErr) {
+		// an earlier attempt may have succeeded in apiserver without a response
+		if attempts > 1 {
+			return s.isCreatedUsingIP(usingIP)
+		}
 		return false, nil
 	}
+	if err == wait.ErrWaitTimeout {
+		err = lastErr
+	}
 	if err != nil {
 		return false, err
 	}
@@ -455,20 +1825,52 @@ func (s *Store) createUsingIP(network, pool, namespace, name, ip string) (bool,
 	return true, nil
 }
 
-func (s *Store) deleteUsingIP(ip string) error {
-	return s.resourceClient.ResourceV1().UsingIPs().Delete(utils.ToKubeName(ip), nil)
+// isCreatedUsingIP checks if the existing using ip of the same name is the one of usingIP
+func (s *Store) isCreatedUsingIP(usingIP *resourcev1.UsingIP) (bool, error) {
+	existing, err := s.resourceClient.ResourceV1().UsingIPs().Get(usingIP.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return reflect.DeepEqual(existing.Spec, usingIP.Spec), nil
+}
+
+// isRetryableError checks if err is transient so that the request may succeed if retried
+func isRetryableError(err error) bool {
+	return errors.IsServerTimeout(err) ||
+		errors.IsTimeout(err) ||
+		errors.IsInternalError(err) ||
+		errors.IsServiceUnavailable(err) ||
+		errors.IsTooManyRequests(err) ||
+		errors.IsConflict(err)
+}
+
+// usingIPName returns the name of the existing using ip record of ip,
+// which may be encoded by another scheme than the current one
+func (s *Store) usingIPName(ip net.IP) string {
+	if usingIP := s.cache.GetUsingIP(ip.String()); usingIP != nil && len(usingIP.Name) > 0 {
+		return usingIP.Name
+	}
+	return s.names.Encode(ip)
+}
+
+func (s *Store) deleteUsingIP(name string, options *metav1.DeleteOptions) error {
+	return s.resourceClient.ResourceV1().UsingIPs().Delete(name, options)
 }
 
-func (s *Store) createLastReservedIP(networkName, poolName, ip string) error {
+func (s *Store) createLastReservedIP(networkName string, pools map[string]string) error {
 	lri := &resourcev1.LastReservedIP{
 		ObjectMeta: metav1.ObjectMeta{
 			Name: networkName,
 		},
 		Spec: resourcev1.LastReservedIPSpec{
-			IP:       ip,
-			PoolName: poolName,
+			Pools:   make(map[string]string, len(pools)),
+			Network: networkName,
 		},
 	}
+	setLastReservedIPs(lri, pools)
 
 	if _, err := s.resourceClient.ResourceV1().LastReservedIPs().Create(lri); err != nil {
 		return err
@@ -476,18 +1878,48 @@ func (s *Store) createLastReservedIP(networkName, poolName, ip string) error {
 	return nil
 }
 
+// lastReservedIPRetries bounds the get-and-update retries of updateLastReservedIP
+const lastReservedIPRetries = 3
+
+// cursorFlushJitter spreads periodic flushes of last reserved ips by up to this fraction of the period
+const cursorFlushJitter = 0.2
+
+// updateLastReservedIP retries when another writer creates or updates the last reserved ip
+// between its get and write, e.g. another store replica, the network lock must be held so
+// that writers of this store never race each other
 func (s *Store) updateLastReservedIP(networkName, poolName, ip string) error {
+	return s.updateLastReservedIPs(networkName, map[string]string{poolName: ip})
+}
+
+// updateLastReservedIPs works like updateLastReservedIP for cursors of many pools in one write
+func (s *Store) updateLastReservedIPs(networkName string, pools map[string]string) error {
+	var err error
+	for i := 0; i < lastReservedIPRetries; i++ {
+		if err = s.tryUpdateLastReservedIPs(networkName, pools); !errors.IsAlreadyExists(err) && !errors.IsConflict(err) {
+			return err
+		}
+		LoggerStore.Debugf("last reserved ip of network %s is written concurrently, retry: %v", networkName, err)
+	}
+	return err
+}
+
+func (s *Store) tryUpdateLastReservedIPs(networkName string, pools map[string]string) error {
 	odlLri, err := s.resourceClient.ResourceV1().LastReservedIPs().Get(networkName, metav1.GetOptions{})
 	if err != nil {
 		if errors.IsNotFound(err) {
-			return s.createLastReservedIP(networkName, poolName, ip)
+			return s.createLastReservedIP(networkName, pools)
 		}
 		return err
 	}
 
+	if err := checkLastReservedIPNetwork(odlLri, networkName); err != nil {
+		return err
+	}
+
 	newLri := odlLri.DeepCopy()
-	newLri.Spec.IP = ip
-	newLri.Spec.PoolName = poolName
+	migrateLastReservedIP(newLri)
+	newLri.Spec.Network = networkName
+	setLastReservedIPs(newLri, pools)
 
 	if _, err := s.resourceClient.ResourceV1().LastReservedIPs().Update(newLri); err != nil {
 		return err
@@ -495,6 +1927,41 @@ func (s *Store) updateLastReservedIP(networkName, poolName, ip string) error {
 	return nil
 }
 
+// checkLastReservedIPNetwork refuses to take over a last reserved ip written for another network
+// whose record has the same name, legacy records without network are adopted
+func checkLastReservedIPNetwork(lri *resourcev1.LastReservedIP, networkName string) error {
+	if len(lri.Spec.Network) == 0 || lri.Spec.Network == networkName {
+		return nil
+	}
+	return newValidationError("last reserved ip %s belongs to network %s instead of %s", lri.Name, lri.Spec.Network, networkName)
+}
+
+// setLastReservedIPs sets the cursors of pools, the legacy single cursor is set to one of
+// them in order of pool names so that it is still deterministic
+func setLastReservedIPs(lri *resourcev1.LastReservedIP, pools map[string]string) {
+	names := make([]string, 0, len(pools))
+	for pool := range pools {
+		names = append(names, pool)
+	}
+	sort.Strings(names)
+	for _, pool := range names {
+		lri.Spec.IP = pools[pool]
+		lri.Spec.PoolName = pool
+		lri.Spec.Pools[pool] = pools[pool]
+	}
+}
+
+// migrateLastReservedIP turns the single cursor of a legacy record into the cursor of its pool
+func migrateLastReservedIP(lri *resourcev1.LastReservedIP) {
+	if lri.Spec.Pools != nil {
+		return
+	}
+	lri.Spec.Pools = make(map[string]string)
+	if len(lri.Spec.PoolName) > 0 && len(lri.Spec.IP) > 0 {
+		lri.Spec.Pools[lri.Spec.PoolName] = lri.Spec.IP
+	}
+}
+
 func (s *Store) deleteLastReservedIP(networkName string) error {
 	return s.resourceClient.ResourceV1().LastReservedIPs().Delete(networkName, nil)
 }
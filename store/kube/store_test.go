@@ -0,0 +1,2100 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"path/filepath"
+	"reflect"
+	goruntime "runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/scheme"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newTestStore returns a running store backed by a fake clientset seeded with objects
+func newTestStore(t testing.TB, objects ...runtime.Object) (*Store, func()) {
+	return newTestStoreWithOptions(t, nil, objects...)
+}
+
+func newTestStoreWithOptions(t testing.TB, opts []Option, objects ...runtime.Object) (*Store, func()) {
+	stopCh := make(chan struct{})
+	s := newStore(newTestClientset(objects...), stopCh, opts...)
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	return s, func() {
+		close(stopCh)
+		s.Close()
+	}
+}
+
+// newTestClientset returns a fake clientset which bumps resource versions on writes like
+// apiserver does, otherwise informers drop updates as resyncs
+func newTestClientset(objects ...runtime.Object) *fake.Clientset {
+	tracker := k8stesting.NewObjectTracker(scheme.Scheme, scheme.Codecs.UniversalDecoder())
+	for _, obj := range objects {
+		if err := tracker.Add(obj); err != nil {
+			panic(err)
+		}
+	}
+
+	var resourceVersion uint64
+	react := k8stesting.ObjectReaction(tracker)
+	client := &fake.Clientset{}
+	client.AddReactor("*", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		// create and update actions share the same interface
+		if a, ok := action.(k8stesting.CreateAction); ok {
+			if accessor, err := meta.Accessor(a.GetObject()); err == nil {
+				accessor.SetResourceVersion(fmt.Sprintf("%d", atomic.AddUint64(&resourceVersion, 1)))
+			}
+		}
+		return react(action)
+	})
+	client.AddWatchReactor("*", func(action k8stesting.Action) (bool, watch.Interface, error) {
+		w, err := tracker.Watch(action.GetResource(), action.GetNamespace())
+		return err == nil, w, err
+	})
+	return client
+}
+
+// waitForCache polls until condition is satisfied by the informer driven cache
+func waitForCache(t testing.TB, condition func() bool) {
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return condition(), nil
+	})
+	if err != nil {
+		t.Fatalf("cache does not converge: %v", err)
+	}
+}
+
+func newNetwork(name string, pools ...v1.Pool) *v1.Network {
+	return &v1.Network{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.NetworkSpec{
+			Pools: pools,
+		},
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	k := newKeyedMutex()
+	unlock := k.LockKey("network1")
+
+	locked := make(chan struct{})
+	go func() {
+		defer k.LockKey("network2")()
+		close(locked)
+	}()
+
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Errorf("lock of network2 is blocked by network1")
+	}
+
+	// a waiter keeps the mutex of network1 until it is released as well
+	acquired := make(chan struct{})
+	go func() {
+		defer k.LockKey("network1")()
+		close(acquired)
+	}()
+	waitForCache(t, func() bool {
+		k.Lock()
+		defer k.Unlock()
+		return k.locks["network1"].refs == 2
+	})
+	unlock()
+	<-acquired
+	waitForCache(t, func() bool {
+		k.Lock()
+		defer k.Unlock()
+		return len(k.locks) == 0
+	})
+}
+
+func TestStore_ReserveConcurrently(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	var (
+		wg       sync.WaitGroup
+		reserved int32
+		ip       = net.ParseIP("192.168.0.10")
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ok, err := s.Reserve("network", "pool", "default", fmt.Sprintf("pod%d", i), ip)
+			if err != nil {
+				t.Errorf("fail to reserve: %v", err)
+				return
+			}
+			if ok {
+				atomic.AddInt32(&reserved, 1)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if reserved != 1 {
+		t.Errorf("ip %s is reserved %d times", ip, reserved)
+	}
+}
+
+func benchmarkReserve(b *testing.B, networks int) {
+	// informers are not started, the fake watcher can not keep up with a benchmark
+	s := newStore(fake.NewSimpleClientset(), nil)
+
+	var counter uint32
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := atomic.AddUint32(&counter, 1)
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, 10<<24+n)
+			if _, err := s.Reserve(fmt.Sprintf("network%d", n%uint32(networks)), "pool", "default", "pod", ip); err != nil {
+				b.Errorf("fail to reserve: %v", err)
+			}
+		}
+	})
+}
+
+func BenchmarkStore_ReserveOneNetwork(b *testing.B) {
+	benchmarkReserve(b, 1)
+}
+
+func BenchmarkStore_ReserveMultiNetworks(b *testing.B) {
+	benchmarkReserve(b, 8)
+}
+
+func TestStore_CountPool(t *testing.T) {
+	network := newNetwork("network",
+		v1.Pool{
+			Name:      "inside",
+			PoolStart: "192.168.0.1",
+			PoolEnd:   "192.168.0.200",
+			Gateway:   "192.168.0.100",
+			Subnet:    "192.168.0.0/24",
+			// 192.168.0.1 is reserved by policy
+			ReserveFirst: 1,
+		},
+		v1.Pool{
+			Name:      "outside",
+			PoolStart: "192.168.1.1",
+			PoolEnd:   "192.168.1.200",
+			Gateway:   "192.168.1.254",
+			Subnet:    "192.168.1.0/24",
+		},
+	)
+	// using ips are counted by the pools they are recorded in, and records on the gateway
+	// or an ip reserved by policy are not counted as they are not in capacity either
+	pod1, pod2 := newUsingIP("192-168-0-10", "pod1"), newUsingIP("192-168-0-11", "pod2")
+	gateway, reserved := newUsingIP("192-168-0-100", "pod3"), newUsingIP("192-168-0-1", "pod4")
+	for _, usingIP := range []*v1.UsingIP{pod1, pod2, gateway, reserved} {
+		usingIP.Spec.Network, usingIP.Spec.Pool = "network", "inside"
+	}
+	s, stop := newTestStore(t, network, pod1, pod2, gateway, reserved)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.UsedCount("network", "inside") == 4 })
+
+	tests := []struct {
+		pool  string
+		total int
+		used  int
+	}{
+		{"inside", 198, 2},
+		{"outside", 200, 0},
+	}
+	for _, test := range tests {
+		total, used, err := s.CountPool("network", test.pool)
+		if err != nil {
+			t.Errorf("fail to count pool %s: %v", test.pool, err)
+			continue
+		}
+		if total != test.total || used != test.used {
+			t.Errorf("pool %s expects total %d used %d but got %d %d", test.pool, test.total, test.used, total, used)
+		}
+		stats, err := s.PoolStats("network", test.pool)
+		if err != nil || stats.Used != used || stats.Used+stats.Free != total {
+			t.Errorf("pool %s has stats %+v disagreeing with count %d/%d: %v", test.pool, stats, used, total, err)
+		}
+	}
+
+	if _, _, err := s.CountPool("network", "missing"); err == nil {
+		t.Errorf("count of missing pool should fail")
+	}
+}
+
+func TestStore_AddPoolAggregatedValidation(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network"))
+	defer stop()
+
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	vlanID := int32(5000)
+	err := s.AddPool("network", &types.Pool{
+		Name:      "pool",
+		PoolStart: net.ParseIP("192.168.1.10"),
+		PoolEnd:   net.ParseIP("192.168.0.100"),
+		Gateway:   net.ParseIP("192.168.2.1"),
+		Subnet:    subnet,
+		VlanID:    &vlanID,
+	})
+
+	errs, ok := err.(types.ErrorList)
+	if !ok {
+		t.Fatalf("expected an error list but got %v", err)
+	}
+	// bad vlan, bad gateway, out-of-range start and end
+	if len(errs) != 4 {
+		t.Errorf("expected 4 problems but got %d: %v", len(errs), errs)
+	}
+}
+
+func TestStore_ListNetworks(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	names := []string{"network3", "network1", "network2"}
+	for _, name := range names {
+		if err := s.CreateNetwork(name); err != nil {
+			t.Fatalf("fail to create network %s: %v", name, err)
+		}
+	}
+	waitForCache(t, func() bool {
+		networks, _ := s.ListNetworks()
+		return len(networks) == len(names)
+	})
+
+	networks, err := s.ListNetworks()
+	if err != nil {
+		t.Fatalf("fail to list networks: %v", err)
+	}
+	for i, expected := range []string{"network1", "network2", "network3"} {
+		if networks[i].Name != expected {
+			t.Errorf("expected network %s at %d but got %s", expected, i, networks[i].Name)
+		}
+	}
+}
+
+type recordingAuditSink struct {
+	sync.Mutex
+
+	reserves []*store.AuditEntry
+	releases []*store.AuditEntry
+}
+
+func (r *recordingAuditSink) RecordReserve(entry *store.AuditEntry) {
+	r.Lock()
+	defer r.Unlock()
+	r.reserves = append(r.reserves, entry)
+}
+
+func (r *recordingAuditSink) RecordRelease(entry *store.AuditEntry) {
+	r.Lock()
+	defer r.Unlock()
+	r.releases = append(r.releases, entry)
+}
+
+func TestStore_Audit(t *testing.T) {
+	sink := &recordingAuditSink{}
+	s, stop := newTestStoreWithOptions(t, []Option{WithAuditSink(sink)})
+	defer stop()
+
+	ip := net.ParseIP("192.168.0.10")
+	if _, err := s.Reserve("network", "pool", "default", "pod", ip); err != nil {
+		t.Fatalf("fail to reserve: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing("192.168.0.10")
+	})
+	if err := s.Release(ip); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+
+	expected := store.AuditEntry{IP: "192.168.0.10", Network: "network", Pool: "pool", PodNamespace: "default", PodName: "pod"}
+	for action, entries := range map[string][]*store.AuditEntry{"reserve": sink.reserves, "release": sink.releases} {
+		if len(entries) != 1 {
+			t.Errorf("expected 1 %s entry but got %d", action, len(entries))
+			continue
+		}
+		entry := *entries[0]
+		if entry.Time.IsZero() {
+			t.Errorf("%s entry has no timestamp", action)
+		}
+		entry.Time = time.Time{}
+		if entry != expected {
+			t.Errorf("expected %s entry %+v but got %+v", action, expected, entry)
+		}
+	}
+}
+
+func TestStore_ReserveStatic(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+
+	vip := net.ParseIP("192.168.0.10")
+	if err := s.ReserveStatic("network", "pool", vip, "ingress-vip"); err != nil {
+		t.Fatalf("fail to reserve vip: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing("192.168.0.10")
+	})
+
+	if usingIP := s.cache.GetUsingIP("192.168.0.10"); usingIP.Owner != "ingress-vip" || len(usingIP.PodName) > 0 {
+		t.Errorf("unexpected vip record %+v", usingIP)
+	}
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", vip); err != nil || reserved {
+		t.Errorf("vip should not be reserved by a pod: %v %v", reserved, err)
+	}
+	if ip, err := s.Allocate("network", "pool", "default", "pod"); err != nil || ip.Equal(vip) {
+		t.Errorf("allocation should skip vip, got %s %v", ip, err)
+	}
+
+	errorCases := []struct {
+		ip    string
+		owner string
+	}{
+		{"192.168.0.10", "another-vip"},
+		{"192.168.0.100", "out-of-pool"},
+		{"192.168.0.12", ""},
+	}
+	for _, c := range errorCases {
+		if err := s.ReserveStatic("network", "pool", net.ParseIP(c.ip), c.owner); err == nil {
+			t.Errorf("static reservation of %s by %q should fail", c.ip, c.owner)
+		}
+	}
+}
+
+func TestStore_ReleaseByName(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+
+	for i := 0; i < 3; i++ {
+		if _, err := s.Allocate("network", "pool", "default", "pod"); err != nil {
+			t.Fatalf("fail to allocate: %v", err)
+		}
+		// wait for each reservation to reach the cache
+		waitForCache(t, func() bool {
+			return len(s.cache.IPsForPod("default", "pod")) == i+1
+		})
+	}
+
+	if err := s.ReleaseByName("network", "pool", "default", "pod"); err != nil {
+		t.Fatalf("fail to release by name: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return len(s.cache.IPsForPod("default", "pod")) == 0
+	})
+}
+
+func TestStore_DryRun(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+
+	dryRun := s.DryRun()
+	ip, err := dryRun.Allocate("network", "pool", "default", "pod")
+	if err != nil {
+		t.Fatalf("fail to allocate in dry run: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("expected dry run to pick 192.168.0.10 but got %s", ip)
+	}
+
+	if reserved, err := dryRun.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.11")); err != nil || !reserved {
+		t.Errorf("expected dry run to reserve 192.168.0.11 but got %v: %v", reserved, err)
+	}
+
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+	if err = dryRun.AddPool("network", &types.Pool{Name: "new", Gateway: net.ParseIP("192.168.1.1"), Subnet: subnet}); err != nil {
+		t.Errorf("fail to add pool in dry run: %v", err)
+	}
+
+	usingIPs, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("fail to list using ips: %v", err)
+	}
+	if len(usingIPs.Items) != 0 {
+		t.Errorf("dry run should not create using ips but got %d", len(usingIPs.Items))
+	}
+	if _, err = s.resourceClient.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{}); err == nil {
+		t.Errorf("dry run should not create last reserved ip")
+	}
+	network, err := s.resourceClient.ResourceV1().Networks().Get("network", metav1.GetOptions{})
+	if err != nil || len(network.Spec.Pools) != 1 {
+		t.Errorf("dry run should not update network: %+v %v", network, err)
+	}
+}
+
+func TestStore_ReleaseIfOwnedBy(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	ip := net.ParseIP("192.168.0.10")
+	if _, err := s.Reserve("network", "pool", "default", "pod1", ip); err != nil {
+		t.Fatalf("fail to reserve: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ip       net.IP
+		pod      string
+		released bool
+	}{
+		{"mismatched owner", ip, "pod2", false},
+		{"missing record", net.ParseIP("192.168.0.11"), "pod1", false},
+		{"matching owner", ip, "pod1", true},
+		{"already released", ip, "pod1", false},
+	}
+	for _, test := range tests {
+		released, err := s.ReleaseIfOwnedBy(test.ip, "default", test.pod)
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+		}
+		if released != test.released {
+			t.Errorf("test %s fails: expected released %v but got %v", test.name, test.released, released)
+		}
+	}
+}
+
+func TestStore_ReleaseStrict(t *testing.T) {
+	orphan := newUsingIP("10-0-0-5", "pod")
+	orphan.Spec.Network, orphan.Spec.Pool = "network", "deleted"
+	objs := []runtime.Object{newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")), orphan}
+
+	for _, strict := range []bool{false, true} {
+		var opts []Option
+		if strict {
+			opts = append(opts, WithStrictRelease())
+		}
+		s, stop := newTestStoreWithOptions(t, opts, objs...)
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("10.0.0.5") })
+
+		// orphans out of any pool are cleaned up either way
+		if err := s.Release(net.ParseIP("10.0.0.5")); err != nil {
+			t.Errorf("strict %v: fail to release orphan: %v", strict, err)
+		}
+		// free ips of pools fall through to apiserver either way
+		if _, unknown := s.Release(net.ParseIP("192.168.0.15")).(*store.UnknownIPError); unknown {
+			t.Errorf("strict %v: expected free ip of pool not reported unknown", strict)
+		}
+		_, unknown := s.Release(net.ParseIP("10.0.0.6")).(*store.UnknownIPError)
+		if unknown != strict {
+			t.Errorf("strict %v: expected unknown ip reported %v but got %v", strict, strict, unknown)
+		}
+		stop()
+	}
+}
+
+func TestStore_ReserveGateway(t *testing.T) {
+	infra := newTestPool("infra", "192.168.0.1", "192.168.0.2")
+	infra.AllowGatewayAllocation = true
+	// ips are unique across networks, so the networks use different subnets
+	plain := v1.Pool{Name: "plain", PoolStart: "192.168.1.1", PoolEnd: "192.168.1.2", Gateway: "192.168.1.1", Subnet: "192.168.1.0/24"}
+	s, stop := newTestStore(t, newNetwork("infra", infra), newNetwork("plain", plain))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("infra") != nil && s.cache.GetNetwork("plain") != nil })
+
+	if err := s.ValidateReservation("plain", "plain", net.ParseIP("192.168.1.1")); err == nil {
+		t.Errorf("gateway should not be reservable without gateway allocation")
+	}
+	if reserved, err := s.Reserve("plain", "plain", "default", "router", net.ParseIP("192.168.1.1")); err == nil || reserved {
+		t.Errorf("reserving gateway without gateway allocation should fail but got %v %v", reserved, err)
+	}
+
+	gateway := net.ParseIP("192.168.0.1")
+	if err := s.ValidateReservation("infra", "infra", gateway); err != nil {
+		t.Errorf("gateway should be reservable with gateway allocation: %v", err)
+	}
+	if reserved, err := s.Reserve("infra", "infra", "default", "router", gateway); err != nil || !reserved {
+		t.Fatalf("fail to reserve gateway: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.1") })
+
+	// allocation never picks the gateway, reserved or not
+	for network, expected := range map[string]string{"infra": "192.168.0.2", "plain": "192.168.1.2"} {
+		if ip, err := s.Allocate(network, network, "default", "pod"); err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Errorf("expected %s allocated from %s but got %s %v", expected, network, ip, err)
+		}
+		if ip, err := s.Allocate(network, network, "default", "pod"); err != store.ErrPoolExhausted {
+			t.Errorf("expected pool %s exhausted but got %s %v", network, ip, err)
+		}
+	}
+}
+
+func TestStore_ValidateReservation(t *testing.T) {
+	policy := newTestPool("policy", "192.168.0.30", "192.168.0.40")
+	policy.ReserveFirst = 32
+	disabled := newTestPool("disabled", "192.168.0.50", "192.168.0.60")
+	disabled.Disabled = true
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20"), policy, disabled))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP("192.168.0.10")); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.10") })
+
+	testCases := []struct {
+		name    string
+		network string
+		pool    string
+		ip      string
+		reason  store.ReservationRejection
+	}{
+		{"allocatable", "network", "pool", "192.168.0.11", ""},
+		{"missing network", "missing", "pool", "192.168.0.11", store.RejectNotFound},
+		{"missing pool", "network", "missing", "192.168.0.11", store.RejectNotFound},
+		{"out of range", "network", "pool", "192.168.0.21", store.RejectOutOfRange},
+		{"out of subnet", "network", "pool", "10.0.0.11", store.RejectOutOfRange},
+		{"gateway", "network", "pool", "192.168.0.1", store.RejectGateway},
+		{"reserved by policy", "network", "policy", "192.168.0.31", store.RejectReserved},
+		{"allocatable after policy", "network", "policy", "192.168.0.33", ""},
+		{"in use", "network", "pool", "192.168.0.10", store.RejectInUse},
+	}
+	for _, tc := range testCases {
+		err := s.ValidateReservation(tc.network, tc.pool, net.ParseIP(tc.ip))
+		if len(tc.reason) == 0 {
+			if err != nil {
+				t.Errorf("test %s fails: expected no error but got %v", tc.name, err)
+			}
+			continue
+		}
+		if rejection, ok := err.(*store.ReservationError); !ok || rejection.Reason != tc.reason {
+			t.Errorf("test %s fails: expected rejection %s but got %v", tc.name, tc.reason, err)
+		}
+		if failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation failure but got %s", tc.name, failureReason(err))
+		}
+	}
+
+	if _, ok := s.ValidateReservation("network", "disabled", net.ParseIP("192.168.0.50")).(*store.PoolDisabledError); !ok {
+		t.Errorf("disabled pool should be rejected as disabled")
+	}
+	if err := s.ValidateReservation("network", "pool", nil); failureReason(err) != FailureValidation {
+		t.Errorf("nil ip should be a validation error but got %v", err)
+	}
+	if s.cache.IsIPUsing("192.168.0.11") {
+		t.Errorf("validating should not reserve anything")
+	}
+}
+
+func TestStore_ReserveWithResult(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	ip := net.ParseIP("192.168.0.10")
+	result, err := s.ReserveWithResult("network", "pool", "default", "pod", ip)
+	if err != nil || !result.Reserved || result.Already {
+		t.Fatalf("first reservation should be new: %+v %v", result, err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing(ip.String())
+	})
+
+	testCases := []struct {
+		name     string
+		pod      string
+		expected store.ReserveResult
+	}{
+		{"retry of the same pod", "pod", store.ReserveResult{Reserved: true, Already: true}},
+		{"another pod", "pod2", store.ReserveResult{}},
+	}
+	for _, tc := range testCases {
+		result, err := s.ReserveWithResult("network", "pool", "default", tc.pod, ip)
+		if err != nil || *result != tc.expected {
+			t.Errorf("test %s fails: expected %+v but got %+v %v", tc.name, tc.expected, result, err)
+		}
+	}
+}
+
+func TestStore_WithNameEncoder(t *testing.T) {
+	legacy := newUsingIP("192-168-0-10", "pod1")
+	s, stop := newTestStoreWithOptions(t, []Option{WithNameEncoder(utils.HexNameEncoder{})}, legacy)
+	defer stop()
+
+	waitForCache(t, func() bool {
+		return s.cache.IsIPUsing("192.168.0.10")
+	})
+	if reserved, err := s.Reserve("network", "pool", "default", "pod2", net.ParseIP("192.168.0.10")); err != nil || reserved {
+		t.Errorf("ip with a legacy record should not be reserved again: %v %v", reserved, err)
+	}
+
+	ip := net.ParseIP("192.168.0.11")
+	if reserved, err := s.Reserve("network", "pool", "default", "pod2", ip); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	name := utils.HexNameEncoder{}.Encode(ip)
+	if _, err := s.resourceClient.ResourceV1().UsingIPs().Get(name, metav1.GetOptions{}); err != nil {
+		t.Errorf("using ip should be named %s: %v", name, err)
+	}
+
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Errorf("fail to release ip with a legacy record: %v", err)
+	}
+}
+
+func TestStore_UpdateLastReservedIPRace(t *testing.T) {
+	// another writer has created the last reserved ip right after our get misses it
+	client := fake.NewSimpleClientset(&v1.LastReservedIP{
+		ObjectMeta: metav1.ObjectMeta{Name: "network"},
+		Spec:       v1.LastReservedIPSpec{IP: "192.168.0.10", PoolName: "pool"},
+	})
+	s := newStore(client, nil)
+
+	raced := false
+	client.PrependReactor("get", "lastreservedips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if raced {
+			return false, nil, nil
+		}
+		raced = true
+		return true, nil, errors.NewNotFound(v1.Resource("lastreservedips"), "network")
+	})
+
+	if err := s.updateLastReservedIP("network", "pool", "192.168.0.11"); err != nil {
+		t.Fatalf("fail to update last reserved ip: %v", err)
+	}
+	lri, err := client.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get last reserved ip: %v", err)
+	}
+	if lri.Spec.IP != "192.168.0.11" {
+		t.Errorf("expected last reserved ip 192.168.0.11 but got %s", lri.Spec.IP)
+	}
+}
+
+// TestStore_IPAMStoreConformance exercises reverse lookup through the IPAMStore interface
+func TestStore_IPAMStoreConformance(t *testing.T) {
+	backends := map[string]func(t *testing.T) (store.IPAMStore, func()){
+		"kube": func(t *testing.T) (store.IPAMStore, func()) {
+			return newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+		},
+	}
+
+	for backend, newBackend := range backends {
+		s, stop := newBackend(t)
+
+		for _, ip := range []string{"192.168.0.12", "192.168.0.10"} {
+			if reserved, err := s.Reserve("network", "pool", "default", "pod", net.ParseIP(ip)); err != nil || !reserved {
+				t.Fatalf("backend %s fails: fail to reserve %s: %v %v", backend, ip, reserved, err)
+			}
+		}
+		expected := []net.IP{net.ParseIP("192.168.0.10"), net.ParseIP("192.168.0.12")}
+		if _, err := s.Reserve("network", "pool", "default", "other", net.ParseIP("192.168.0.11")); err != nil {
+			t.Fatalf("backend %s fails: fail to reserve: %v", backend, err)
+		}
+
+		var ips []net.IP
+		waitForCache(t, func() bool {
+			var err error
+			ips, err = s.IPsForPod("default", "pod")
+			return err == nil && len(ips) == len(expected)
+		})
+		for i := range expected {
+			if !ips[i].Equal(expected[i]) {
+				t.Errorf("backend %s fails: expected ips %v but got %v", backend, expected, ips)
+				break
+			}
+		}
+
+		if err := s.ReleaseByName("network", "pool", "default", "pod"); err != nil {
+			t.Fatalf("backend %s fails: fail to release by name: %v", backend, err)
+		}
+		waitForCache(t, func() bool {
+			ips, err := s.IPsForPod("default", "pod")
+			return err == nil && len(ips) == 0
+		})
+		stop()
+	}
+}
+
+func TestStore_ListLastReservedIPs(t *testing.T) {
+	newLastReservedIP := func(network, pool, ip string) *v1.LastReservedIP {
+		return &v1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: network},
+			Spec:       v1.LastReservedIPSpec{Pools: map[string]string{pool: ip}, Network: network},
+		}
+	}
+	s, stop := newTestStore(t,
+		newLastReservedIP("network1", "pool1", "192.168.0.15"),
+		newLastReservedIP("network2", "pool2", "10.0.0.20"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetLastReservedIP("network1") != nil && s.cache.GetLastReservedIP("network2") != nil
+	})
+
+	lris, err := s.ListLastReservedIPs()
+	if err != nil {
+		t.Fatalf("fail to list last reserved ips: %v", err)
+	}
+	expected := map[string][2]string{"network1": {"pool1", "192.168.0.15"}, "network2": {"pool2", "10.0.0.20"}}
+	if len(lris) != len(expected) {
+		t.Errorf("expected last reserved ips of %d networks but got %v", len(expected), lris)
+	}
+	for network, cursor := range expected {
+		lri, ok := lris[network]
+		if !ok {
+			t.Errorf("last reserved ip of network %s is missing", network)
+			continue
+		}
+		if !lri.Pools[cursor[0]].Equal(net.ParseIP(cursor[1])) || lri.Network != network {
+			t.Errorf("expected cursor %s of pool %s in network %s but got %+v", cursor[1], cursor[0], network, lri)
+		}
+	}
+}
+
+func TestStore_CompactLastReservedIP(t *testing.T) {
+	legacy := &v1.LastReservedIP{
+		ObjectMeta: metav1.ObjectMeta{Name: "network"},
+		Spec:       v1.LastReservedIPSpec{IP: "192.168.0.15", PoolName: "pool1"},
+	}
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool1", "192.168.0.10", "192.168.0.20")), legacy)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil
+	})
+
+	if err := s.CompactLastReservedIP("network"); err != nil {
+		t.Fatalf("fail to compact: %v", err)
+	}
+	lri, err := s.resourceClient.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get last reserved ip: %v", err)
+	}
+	if !reflect.DeepEqual(lri.Spec.Pools, map[string]string{"pool1": "192.168.0.15"}) {
+		t.Errorf("legacy record is not migrated: %+v", lri.Spec)
+	}
+
+	// cursors of removed pools are dropped
+	lri.Spec.Pools["removed"] = "192.168.1.10"
+	if _, err := s.resourceClient.ResourceV1().LastReservedIPs().Update(lri); err != nil {
+		t.Fatalf("fail to update last reserved ip: %v", err)
+	}
+	if err := s.CompactLastReservedIP("network"); err != nil {
+		t.Fatalf("fail to compact: %v", err)
+	}
+	if lri, _ = s.resourceClient.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{}); len(lri.Spec.Pools) != 1 {
+		t.Errorf("expected only cursor of pool1 but got %+v", lri.Spec.Pools)
+	}
+}
+
+func TestStore_Close(t *testing.T) {
+	before := goruntime.NumGoroutine()
+
+	s := newStore(newTestClientset(), nil, WithSnapshotFile(filepath.Join(t.TempDir(), "snapshot"), time.Hour))
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("fail to close store: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Errorf("fail to close store twice: %v", err)
+	}
+
+	// goroutines of fake watches exit asynchronously after informers stop,
+	// poll by hand since pollers of wait run goroutines themselves
+	for deadline := time.Now().Add(5 * time.Second); goruntime.NumGoroutine() > before; time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("goroutines leak after close, %d before but %d now:\n%s", before, goruntime.NumGoroutine(), buf[:goruntime.Stack(buf, true)])
+		}
+	}
+}
+
+func TestStore_SnapshotPeriodMustBePositive(t *testing.T) {
+	for _, period := range []time.Duration{0, -time.Second} {
+		stopCh := make(chan struct{})
+		s := newStore(newTestClientset(), stopCh, WithSnapshotFile(filepath.Join(t.TempDir(), "snapshot"), period))
+		if err := s.Run(); err == nil {
+			t.Errorf("expected snapshot period %s refused", period)
+		}
+		close(stopCh)
+	}
+}
+
+func TestStore_Done(t *testing.T) {
+	stopCh := make(chan struct{})
+	s := newStore(newTestClientset(), stopCh)
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	defer s.Close()
+
+	select {
+	case <-s.Done():
+		t.Fatalf("done should not be closed before stop")
+	default:
+	}
+
+	close(stopCh)
+	select {
+	case <-s.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatalf("done should be closed after stop")
+	}
+}
+
+func TestStore_UpdatePool(t *testing.T) {
+	live := newUsingIP("192-168-0-12", "pod")
+	live.Spec.Network = "network"
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")), live)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.12")
+	})
+
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(start, end string) *types.Pool {
+		return &types.Pool{
+			Name:      "pool",
+			PoolStart: net.ParseIP(start),
+			PoolEnd:   net.ParseIP(end),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+	}
+
+	if err := s.UpdatePool("network", newPool("192.168.0.10", "192.168.0.30")); err != nil {
+		t.Errorf("expanding the range should succeed: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network").Pools[0].PoolEnd.Equal(net.ParseIP("192.168.0.30"))
+	})
+
+	err := s.UpdatePool("network", newPool("192.168.0.15", "192.168.0.40"))
+	if err == nil || !strings.Contains(err.Error(), "192.168.0.12") {
+		t.Errorf("shift dropping a live ip should be rejected with it listed, got %v", err)
+	}
+	if err := s.UpdatePool("network", &types.Pool{Name: "missing", Gateway: net.ParseIP("192.168.0.1"), Subnet: subnet}); err == nil {
+		t.Errorf("updating a missing pool should be rejected")
+	}
+}
+
+func TestStore_DelPool(t *testing.T) {
+	usingIP := newUsingIP("192-168-0-10", "pod")
+	usingIP.Spec.PodNamespace = "default"
+	usingIP.Spec.Network = "network"
+	usingIP.Spec.Pool = "used"
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("used", "192.168.0.10", "192.168.0.20"), newTestPool("empty", "192.168.0.30", "192.168.0.39")),
+		usingIP)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.10") })
+
+	_, err := s.DelPool("network", "used")
+	if inUse, ok := err.(*store.PoolInUseError); !ok || inUse.Pool != "used" || inUse.UsingIPs != 1 {
+		t.Errorf("expected pool in use error of 1 using ip but got %v", err)
+	}
+
+	result, err := s.DelPool("network", "empty")
+	if err != nil {
+		t.Fatalf("fail to delete empty pool: %v", err)
+	}
+	if result.Capacity != 10 {
+		t.Errorf("expected capacity 10 freed but got %d", result.Capacity)
+	}
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network").GetPool("empty") == nil })
+	if _, err := s.DelPool("network", "empty"); err == nil {
+		t.Errorf("deleting a missing pool should fail")
+	}
+}
+
+func TestStore_ReleaseStaleGeneration(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(start, end string, generation int64) *types.Pool {
+		return &types.Pool{
+			Name:       "pool",
+			PoolStart:  net.ParseIP(start),
+			PoolEnd:    net.ParseIP(end),
+			Gateway:    net.ParseIP("192.168.0.1"),
+			Subnet:     subnet,
+			Generation: generation,
+		}
+	}
+	generation := func() int64 {
+		if pool := s.cache.GetNetwork("network").GetPool("pool"); pool != nil {
+			return pool.Generation
+		}
+		return -1
+	}
+	reserve := func(ips ...string) {
+		for _, ip := range ips {
+			if reserved, err := s.Reserve("network", "pool", "default", "pod-"+ip, net.ParseIP(ip)); err != nil || !reserved {
+				t.Fatalf("fail to reserve %s: %v %v", ip, reserved, err)
+			}
+		}
+		waitForCache(t, func() bool { return s.cache.IsIPUsing(ips[len(ips)-1]) })
+	}
+	releaseStale := func(name string, expected int, kept, released []string) {
+		count, err := s.ReleaseStaleGeneration("network", "pool")
+		if err != nil || count != expected {
+			t.Fatalf("test %s fails: expected %d released but got %d %v", name, expected, count, err)
+		}
+		waitForCache(t, func() bool { return !s.cache.IsIPUsing(released[len(released)-1]) })
+		for _, ip := range released {
+			if s.cache.IsIPUsing(ip) {
+				t.Errorf("test %s fails: ip %s of an earlier generation should be released", name, ip)
+			}
+		}
+		for _, ip := range kept {
+			if usingIP := s.cache.GetUsingIP(ip); usingIP == nil || usingIP.PoolGeneration != generation() {
+				t.Errorf("test %s fails: ip %s of the current generation should be kept: %+v", name, ip, usingIP)
+			}
+		}
+	}
+
+	reserve("192.168.0.10", "192.168.0.11")
+	if count, err := s.ReleaseStaleGeneration("network", "pool"); err != nil || count != 0 {
+		t.Errorf("nothing should be stale in the first generation: %d %v", count, err)
+	}
+
+	// the recreated pool is a new generation of the using ips left behind, the pool is deleted
+	// behind the back of store since DelPool refuses pools with live using ips
+	network, err := s.resourceClient.ResourceV1().Networks().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get network: %v", err)
+	}
+	network.Spec.Pools = nil
+	if _, err := s.resourceClient.ResourceV1().Networks().Update(network); err != nil {
+		t.Fatalf("fail to delete pool: %v", err)
+	}
+	waitForCache(t, func() bool { return generation() < 0 })
+	if err := s.AddPool("network", newPool("192.168.0.10", "192.168.0.30", 0)); err != nil {
+		t.Fatalf("fail to recreate pool: %v", err)
+	}
+	waitForCache(t, func() bool { return generation() == 1 })
+	reserve("192.168.0.25")
+	releaseStale("recreated pool", 2, []string{"192.168.0.25"}, []string{"192.168.0.10", "192.168.0.11"})
+
+	// updates keep the generation unless it is bumped
+	if err := s.UpdatePool("network", newPool("192.168.0.10", "192.168.0.40", 0)); err != nil {
+		t.Fatalf("fail to update pool: %v", err)
+	}
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network").GetPool("pool").PoolEnd.Equal(net.ParseIP("192.168.0.40"))
+	})
+	if generation() != 1 {
+		t.Errorf("update should keep generation 1 but got %d", generation())
+	}
+	if err := s.UpdatePool("network", newPool("192.168.0.10", "192.168.0.40", 2)); err != nil {
+		t.Fatalf("fail to bump generation: %v", err)
+	}
+	waitForCache(t, func() bool { return generation() == 2 })
+	reserve("192.168.0.35")
+	releaseStale("bumped generation", 1, []string{"192.168.0.35"}, []string{"192.168.0.25"})
+
+	if err := s.UpdatePool("network", newPool("192.168.0.10", "192.168.0.40", 1)); failureReason(err) != FailureValidation {
+		t.Errorf("generation going backwards should be a validation error but got %v", err)
+	}
+	if _, err := s.ReleaseStaleGeneration("network", "missing"); err == nil {
+		t.Errorf("missing pool should be an error")
+	}
+}
+
+func TestStore_AddOrUpdatePool(t *testing.T) {
+	live := newUsingIP("192-168-0-12", "pod")
+	live.Spec.Network = "network"
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")), live)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.12")
+	})
+
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(name, start, end string) *types.Pool {
+		return &types.Pool{
+			Name:      name,
+			PoolStart: net.ParseIP(start),
+			PoolEnd:   net.ParseIP(end),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+	}
+	poolEnd := func(name string) net.IP {
+		if pool := s.cache.GetNetwork("network").GetPool(name); pool != nil {
+			return pool.PoolEnd
+		}
+		return nil
+	}
+
+	testCases := []struct {
+		name string
+		pool *types.Pool
+		ok   bool
+		end  string
+	}{
+		{"create", newPool("new", "192.168.0.50", "192.168.0.60"), true, "192.168.0.60"},
+		{"safe update", newPool("pool", "192.168.0.10", "192.168.0.30"), true, "192.168.0.30"},
+		{"unsafe update", newPool("pool", "192.168.0.15", "192.168.0.30"), false, "192.168.0.30"},
+		{"overlapping create", newPool("other", "192.168.0.55", "192.168.0.70"), false, ""},
+	}
+	for _, tc := range testCases {
+		err := s.AddOrUpdatePool("network", tc.pool)
+		if (err == nil) != tc.ok {
+			t.Errorf("test %s fails: unexpected error %v", tc.name, err)
+			continue
+		}
+		if len(tc.end) == 0 {
+			if end := poolEnd(tc.pool.Name); end != nil {
+				t.Errorf("test %s fails: pool should not be created", tc.name)
+			}
+			continue
+		}
+		waitForCache(t, func() bool { return poolEnd(tc.pool.Name).Equal(net.ParseIP(tc.end)) })
+	}
+}
+
+func TestStore_LookupIP(t *testing.T) {
+	usingIP := newUsingIP("192-168-0-10", "pod")
+	usingIP.Spec.PodNamespace = "default"
+	usingIP.Spec.Network = "a"
+	usingIP.Spec.Pool = "pool"
+	s, stop := newTestStore(t,
+		newNetwork("a", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newNetwork("b", v1.Pool{Name: "pool", Gateway: "10.0.0.254", Subnet: "10.0.0.0/24", ReserveFirst: 1}),
+		usingIP)
+	defer stop()
+	waitForCache(t, func() bool {
+		return len(s.cache.ListNetworks()) == 2 && s.cache.IsIPUsing("192.168.0.10")
+	})
+
+	tests := []struct {
+		name     string
+		ip       string
+		network  string
+		pool     string
+		pod      string
+		gateway  bool
+		reserved bool
+	}{
+		{name: "allocated", ip: "192.168.0.10", network: "a", pool: "pool", pod: "pod"},
+		{name: "free in pool", ip: "10.0.0.100", network: "b", pool: "pool"},
+		{name: "gateway", ip: "192.168.0.1", network: "a", pool: "pool", gateway: true},
+		{name: "reserved", ip: "10.0.0.1", network: "b", pool: "pool", reserved: true},
+		{name: "in no pool", ip: "172.16.0.1"},
+	}
+	for _, test := range tests {
+		info, err := s.LookupIP(net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if info.Network != test.network || info.Pool != test.pool {
+			t.Errorf("test %s fails: expected %s/%s but got %s/%s", test.name, test.network, test.pool, info.Network, info.Pool)
+		}
+		if info.Gateway != test.gateway || info.Reserved != test.reserved {
+			t.Errorf("test %s fails: expected gateway %v reserved %v but got %v %v",
+				test.name, test.gateway, test.reserved, info.Gateway, info.Reserved)
+		}
+		switch {
+		case len(test.pod) == 0 && info.UsingIP != nil:
+			t.Errorf("test %s fails: expected free but got %+v", test.name, info.UsingIP)
+		case len(test.pod) > 0 && (info.UsingIP == nil || info.UsingIP.PodName != test.pod):
+			t.Errorf("test %s fails: expected pod %s but got %+v", test.name, test.pod, info.UsingIP)
+		}
+	}
+
+	if _, err := s.LookupIP(nil); err == nil {
+		t.Errorf("looking up an empty ip should fail")
+	}
+}
+
+func TestStore_ResolveIP(t *testing.T) {
+	second := v1.Pool{Name: "second", Gateway: "10.0.0.1", Subnet: "10.0.0.0/24"}
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("first", "192.168.0.10", "192.168.0.20"), second))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	tests := []struct {
+		ip      string
+		pool    string
+		gateway string
+	}{
+		{"192.168.0.10", "first", "192.168.0.1"},
+		{"192.168.0.20", "first", "192.168.0.1"},
+		{"10.0.0.100", "second", "10.0.0.1"},
+	}
+	for _, test := range tests {
+		pool, err := s.ResolveIP("network", net.ParseIP(test.ip))
+		if err != nil {
+			t.Fatalf("test %s fails: %v", test.ip, err)
+		}
+		if pool.Name != test.pool || !pool.Gateway.Equal(net.ParseIP(test.gateway)) {
+			t.Errorf("test %s fails: expected pool %s with gateway %s but got %s with %s",
+				test.ip, test.pool, test.gateway, pool.Name, pool.Gateway)
+		}
+	}
+
+	for _, ip := range []string{"192.168.0.21", "172.16.0.1"} {
+		if _, err := s.ResolveIP("network", net.ParseIP(ip)); err == nil {
+			t.Errorf("test %s fails: ip in no pool should not be resolved", ip)
+		}
+	}
+	if _, err := s.ResolveIP("missing", net.ParseIP("192.168.0.10")); err == nil {
+		t.Errorf("ip of a missing network should not be resolved")
+	}
+}
+
+func TestStore_CreateUsingIPRetry(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	var attempts int32
+	var failures []error
+	s.resourceClient.(*fake.Clientset).PrependReactor("create", "usingips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		n := int(atomic.AddInt32(&attempts, 1))
+		if n <= len(failures) {
+			return true, nil, failures[n-1]
+		}
+		return false, nil, nil
+	})
+
+	tests := []struct {
+		name     string
+		failures []error
+		ip       string
+		attempts int32
+		fails    bool
+	}{
+		{
+			name: "transient",
+			failures: []error{
+				errors.NewInternalError(fmt.Errorf("etcd is unavailable")),
+				errors.NewServerTimeout(v1.Resource("usingips"), "create", 1),
+			},
+			ip:       "192.168.0.10",
+			attempts: 3,
+		},
+		{
+			name:     "forbidden",
+			failures: []error{errors.NewForbidden(v1.Resource("usingips"), "192-168-0-11", fmt.Errorf("denied"))},
+			ip:       "192.168.0.11",
+			attempts: 1,
+			fails:    true,
+		},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(&attempts, 0)
+		failures = test.failures
+		err := s.ReserveStatic("network", "pool", net.ParseIP(test.ip), "owner")
+		if (err != nil) != test.fails {
+			t.Errorf("test %s fails: unexpected error %v", test.name, err)
+		}
+		if n := atomic.LoadInt32(&attempts); n != test.attempts {
+			t.Errorf("test %s fails: expected %d attempts but got %d", test.name, test.attempts, n)
+		}
+	}
+}
+
+func TestStore_PoolStats(t *testing.T) {
+	pool := newTestPool("pool", "192.168.0.1", "192.168.0.20")
+	pool.Gateway = "192.168.0.5"
+	pool.ReserveFirst = 2
+	newPoolUsingIP := func(name string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = "pool"
+		return usingIP
+	}
+	// 192.168.0.1 is reserved before the policy is set, which is counted as reserved only
+	s, stop := newTestStore(t, newNetwork("network", pool),
+		newPoolUsingIP("192-168-0-1"), newPoolUsingIP("192-168-0-10"), newPoolUsingIP("192-168-0-11"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && len(s.cache.ListUsingIPs()) == 3
+	})
+
+	stats, err := s.PoolStats("network", "pool")
+	if err != nil {
+		t.Fatalf("fail to get stats of pool: %v", err)
+	}
+	expected := types.PoolStats{Total: 20, Used: 2, Reserved: 3, Free: 15}
+	if stats != expected {
+		t.Errorf("expected stats %+v but got %+v", expected, stats)
+	}
+	if stats.Used+stats.Reserved+stats.Free != stats.Total {
+		t.Errorf("stats %+v do not sum up", stats)
+	}
+
+	if _, err := s.PoolStats("network", "missing"); err == nil {
+		t.Errorf("stats of a missing pool should fail")
+	}
+}
+
+func TestStore_SimulateCapacity(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(start, end string, mutate func(*types.Pool)) *types.Pool {
+		pool := &types.Pool{
+			Name:      "pool",
+			PoolStart: net.ParseIP(start),
+			PoolEnd:   net.ParseIP(end),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+		if mutate != nil {
+			mutate(pool)
+		}
+		return pool
+	}
+
+	tests := []struct {
+		name     string
+		pool     *types.Pool
+		expected store.CapacityPlan
+	}{
+		{"gateway out of range", newPool("192.168.0.10", "192.168.0.20", nil), store.CapacityPlan{Total: 11, Usable: 11}},
+		{"gateway in range", newPool("192.168.0.1", "192.168.0.20", nil), store.CapacityPlan{Total: 20, Usable: 19, Reserved: 1}},
+		{"whole subnet", newPool("", "", nil), store.CapacityPlan{Total: 254, Usable: 253, Reserved: 1}},
+		{"secondary gateway", newPool("", "", func(p *types.Pool) {
+			p.SecondaryGateways = []net.IP{net.ParseIP("192.168.0.100")}
+		}), store.CapacityPlan{Total: 254, Usable: 252, Reserved: 2}},
+		{"reserved-ip policy", newPool("", "", func(p *types.Pool) {
+			p.ReserveFirst, p.ReserveLast = 2, 1
+		}), store.CapacityPlan{Total: 254, Usable: 251, Reserved: 3}},
+	}
+	for _, test := range tests {
+		plan, err := s.SimulateCapacity(test.pool)
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if plan != test.expected {
+			t.Errorf("test %s fails: expected %+v but got %+v", test.name, test.expected, plan)
+		}
+	}
+
+	// the given pool is canonicalized on a copy only
+	pool := newPool("", "", nil)
+	if _, err := s.SimulateCapacity(pool); err != nil || pool.PoolStart != nil || pool.PoolEnd != nil {
+		t.Errorf("expected pool untouched but got %+v: %v", pool, err)
+	}
+
+	invalid := newPool("", "", func(p *types.Pool) { p.Gateway = net.ParseIP("10.0.0.1") })
+	for name, pool := range map[string]*types.Pool{"nil pool": nil, "invalid pool": invalid} {
+		if plan, err := s.SimulateCapacity(pool); err == nil {
+			t.Errorf("test %s fails: unexpected plan %+v", name, plan)
+		}
+	}
+}
+
+func TestStore_DeleteNetworkInUse(t *testing.T) {
+	usingIP := newUsingIP("192-168-0-10", "pod")
+	usingIP.Spec.PodNamespace = "default"
+	usingIP.Spec.Network = "network"
+	usingIP.Spec.Pool = "pool"
+	s, stop := newTestStore(t, newNetwork("network"), usingIP)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && s.cache.IsIPUsing("192.168.0.10")
+	})
+
+	err := s.DeleteNetwork("network")
+	inUse, ok := err.(*store.NetworkInUseError)
+	if !ok || inUse.Network != "network" || inUse.UsingIPs != 1 {
+		t.Fatalf("deleting a network with live allocation should be refused, got %v", err)
+	}
+
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Fatalf("fail to release: %v", err)
+	}
+	waitForCache(t, func() bool { return !s.cache.IsIPUsing("192.168.0.10") })
+	if err := s.DeleteNetwork("network"); err != nil {
+		t.Errorf("deleting an unused network should succeed: %v", err)
+	}
+}
+
+func TestStore_DeleteNetworkWithLastReservedIP(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network"), newNetwork("other"),
+		&v1.LastReservedIP{
+			ObjectMeta: metav1.ObjectMeta{Name: "network"},
+			Spec:       v1.LastReservedIPSpec{Pools: map[string]string{"pool": "192.168.0.11"}},
+		})
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil && s.cache.GetNetwork("other") != nil })
+
+	client := s.resourceClient.ResourceV1()
+	if err := s.DeleteNetwork("network"); err != nil {
+		t.Fatalf("fail to delete network: %v", err)
+	}
+	if _, err := client.LastReservedIPs().Get("network", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("last reserved ip should be deleted along with its network, got %v", err)
+	}
+
+	// a network never reserving any ip has no last reserved ip to delete
+	if err := s.DeleteNetwork("other"); err != nil {
+		t.Errorf("fail to delete network without last reserved ip: %v", err)
+	}
+}
+
+func TestStore_NetworkCapacity(t *testing.T) {
+	newPoolUsingIP := func(name, pool string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = pool
+		return usingIP
+	}
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("pool1", "192.168.0.1", "192.168.0.10"),
+		newTestPool("pool2", "192.168.0.20", "192.168.0.29")),
+		newPoolUsingIP("192-168-0-5", "pool1"),
+		newPoolUsingIP("192-168-0-20", "pool2"),
+		newPoolUsingIP("192-168-0-21", "pool2"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && len(s.cache.ListUsingIPs()) == 3
+	})
+
+	total, used, free, err := s.NetworkCapacity("network")
+	if err != nil {
+		t.Fatalf("fail to get capacity of network: %v", err)
+	}
+	expectedTotal, expectedUsed, expectedFree := 0, 0, 0
+	for _, pool := range []string{"pool1", "pool2"} {
+		stats, err := s.PoolStats("network", pool)
+		if err != nil {
+			t.Fatalf("fail to get stats of pool %s: %v", pool, err)
+		}
+		expectedTotal += stats.Total - stats.Reserved
+		expectedUsed += stats.Used
+		expectedFree += stats.Free
+	}
+	// the gateway takes one ip of pool1
+	if total != 19 || used != 3 || free != 16 {
+		t.Errorf("expected 19 total, 3 used and 16 free but got %d, %d and %d", total, used, free)
+	}
+	if total != expectedTotal || used != expectedUsed || free != expectedFree {
+		t.Errorf("capacity of network %d/%d/%d does not sum up pools %d/%d/%d",
+			total, used, free, expectedTotal, expectedUsed, expectedFree)
+	}
+
+	if _, _, _, err := s.NetworkCapacity("missing"); err == nil {
+		t.Errorf("capacity of a missing network should fail")
+	}
+}
+
+func TestStore_AddPoolCaseInsensitiveNames(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	prod := func(name, start, end string) *types.Pool {
+		return &types.Pool{
+			Name:      name,
+			PoolStart: net.ParseIP(start),
+			PoolEnd:   net.ParseIP(end),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		opts     []Option
+		rejected bool
+	}{
+		// uppercase is no DNS-1123 label, so a case variant is rejected either way
+		{"case sensitive", nil, true},
+		{"case insensitive", []Option{WithCaseInsensitivePoolNames()}, true},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, test.opts, newNetwork("network", newTestPool("prod", "192.168.0.10", "192.168.0.20")))
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+		err := s.AddPool("network", prod("Prod", "192.168.0.30", "192.168.0.40"))
+		if rejected := err != nil; rejected != test.rejected {
+			t.Errorf("test %s fails: expected rejected %v but got %v", test.name, test.rejected, err)
+		}
+		stop()
+	}
+}
+
+func TestStore_AddPoolSubnetHostBits(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     []Option
+		rejected bool
+	}{
+		{"strict", nil, true},
+		{"masked", []Option{WithSubnetHostBitsMasked()}, false},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, test.opts, newNetwork("network"))
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+		pool := &types.Pool{
+			Name:    "pool",
+			Gateway: net.ParseIP("192.168.0.1"),
+			Subnet:  &net.IPNet{IP: net.ParseIP("192.168.0.5").To4(), Mask: net.CIDRMask(24, 32)},
+		}
+		err := s.AddPool("network", pool)
+		if rejected := err != nil; rejected != test.rejected {
+			t.Errorf("test %s fails: expected rejected %v but got %v", test.name, test.rejected, err)
+		}
+		if !test.rejected && pool.Subnet.String() != "192.168.0.0/24" {
+			t.Errorf("test %s fails: expected subnet masked to 192.168.0.0/24 but got %s", test.name, pool.Subnet)
+		}
+		stop()
+	}
+}
+
+func TestStore_ListPoolsWithStats(t *testing.T) {
+	newPoolUsingIP := func(name, pool string) *v1.UsingIP {
+		usingIP := newUsingIP(name, "pod")
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = pool
+		return usingIP
+	}
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("pool-c", "192.168.0.40", "192.168.0.49"),
+		newTestPool("pool-a", "192.168.0.1", "192.168.0.10"),
+		newTestPool("pool-b", "192.168.0.20", "192.168.0.29")),
+		newPoolUsingIP("192-168-0-5", "pool-a"),
+		newPoolUsingIP("192-168-0-20", "pool-b"),
+		newPoolUsingIP("192-168-0-21", "pool-b"),
+		newPoolUsingIP("192-168-0-22", "pool-b"))
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && len(s.cache.ListUsingIPs()) == 4
+	})
+
+	pools, err := s.ListPoolsWithStats("network")
+	if err != nil {
+		t.Fatalf("fail to list pools with stats: %v", err)
+	}
+	// the gateway takes one ip of pool-a
+	expected := []struct {
+		name  string
+		stats types.PoolStats
+	}{
+		{"pool-a", types.PoolStats{Total: 10, Used: 1, Reserved: 1, Free: 8}},
+		{"pool-b", types.PoolStats{Total: 10, Used: 3, Free: 7}},
+		{"pool-c", types.PoolStats{Total: 10, Free: 10}},
+	}
+	if len(pools) != len(expected) {
+		t.Fatalf("expected %d pools but got %d", len(expected), len(pools))
+	}
+	for i, pool := range pools {
+		if pool.Pool.Name != expected[i].name || pool.Stats != expected[i].stats {
+			t.Errorf("expected pool %s with %+v but got pool %s with %+v",
+				expected[i].name, expected[i].stats, pool.Pool.Name, pool.Stats)
+		}
+	}
+
+	if _, err := s.ListPoolsWithStats("missing"); err == nil {
+		t.Errorf("listing pools of a missing network should fail")
+	}
+}
+
+func TestStore_FreeRanges(t *testing.T) {
+	pool := newTestPool("pool", "", "")
+	pool.ReserveLast = 4
+	usingIPs := []runtime.Object{newNetwork("network", pool)}
+	used := map[string]bool{}
+	for _, addr := range []string{"192.168.0.2", "192.168.0.3", "192.168.0.10", "192.168.0.64", "192.168.0.200"} {
+		usingIP := newUsingIP(utils.ToKubeName(addr), "pod")
+		usingIP.Spec.PodNamespace, usingIP.Spec.Network, usingIP.Spec.Pool = "default", "network", "pool"
+		usingIPs = append(usingIPs, usingIP)
+		used[addr] = true
+	}
+	s, stop := newTestStore(t, usingIPs...)
+	defer stop()
+	waitForCache(t, func() bool {
+		return s.cache.GetNetwork("network") != nil && len(s.cache.ListUsingIPs()) == len(used)
+	})
+
+	ranges, err := s.FreeRanges("network", "pool")
+	if err != nil {
+		t.Fatalf("fail to get free ranges: %v", err)
+	}
+	typed := s.cache.GetNetwork("network").Pools[0]
+	covered := 0
+	for i, cidr := range ranges {
+		ones, bits := cidr.Mask.Size()
+		covered += 1 << uint(bits-ones)
+		if i > 0 && binary.BigEndian.Uint32(ranges[i-1].IP.To4()) >= binary.BigEndian.Uint32(cidr.IP.To4()) {
+			t.Errorf("free ranges %v are not in ascending order", ranges)
+		}
+	}
+	if expected := typed.Capacity() - len(used); covered != expected {
+		t.Errorf("free ranges %v cover %d ips but %d are free", ranges, covered, expected)
+	}
+	for i := 0; i < 256; i++ {
+		addr := net.IPv4(192, 168, 0, byte(i)).To4()
+		inRanges := false
+		for _, cidr := range ranges {
+			inRanges = inRanges || cidr.Contains(addr)
+		}
+		if free := typed.IsAllocatable(addr) && !used[addr.String()]; inRanges != free {
+			t.Errorf("%s is in free ranges %v but free %v", addr, inRanges, free)
+		}
+	}
+
+	if _, err := s.FreeRanges("network", "missing"); err == nil {
+		t.Errorf("free ranges of a missing pool should fail")
+	}
+}
+
+func TestStore_ListPoolsByLabel(t *testing.T) {
+	newLabeledPool := func(name, start, end string, labels map[string]string) v1.Pool {
+		pool := newTestPool(name, start, end)
+		pool.Labels = labels
+		return pool
+	}
+	s, stop := newTestStore(t, newNetwork("network",
+		newLabeledPool("pool-c", "192.168.0.40", "192.168.0.49", map[string]string{"zone": "a", "rack": "r2"}),
+		newLabeledPool("pool-a", "192.168.0.1", "192.168.0.10", map[string]string{"zone": "a", "rack": "r1"}),
+		newLabeledPool("pool-b", "192.168.0.20", "192.168.0.29", map[string]string{"zone": "b", "rack": "r1"}),
+		newTestPool("pool-d", "192.168.0.60", "192.168.0.69")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	tests := []struct {
+		name     string
+		selector map[string]string
+		expected []string
+	}{
+		{"all", nil, []string{"pool-a", "pool-b", "pool-c", "pool-d"}},
+		{"zone", map[string]string{"zone": "a"}, []string{"pool-a", "pool-c"}},
+		{"zone and rack", map[string]string{"zone": "a", "rack": "r1"}, []string{"pool-a"}},
+		{"rack", map[string]string{"rack": "r1"}, []string{"pool-a", "pool-b"}},
+		{"no match", map[string]string{"zone": "c"}, nil},
+	}
+	for _, test := range tests {
+		pools, err := s.ListPoolsByLabel("network", test.selector)
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		var names []string
+		for _, pool := range pools {
+			names = append(names, pool.Name)
+		}
+		if !reflect.DeepEqual(names, test.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.expected, names)
+		}
+	}
+
+	if _, err := s.ListPoolsByLabel("missing", nil); err == nil {
+		t.Errorf("listing pools of a missing network should fail")
+	}
+}
+
+func TestStore_UpdateLastReservedIPConcurrently(t *testing.T) {
+	sink := &recordingAuditSink{}
+	s, stop := newTestStoreWithOptions(t, []Option{WithAuditSink(sink)},
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.50")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	// another replica updates the record between our get and update once in a while
+	var updates int32
+	s.resourceClient.(*fake.Clientset).PrependReactor("update", "lastreservedips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if atomic.AddInt32(&updates, 1)%5 == 0 {
+			return true, nil, errors.NewConflict(v1.Resource("lastreservedips"), "network", nil)
+		}
+		return false, nil, nil
+	})
+
+	wg := &sync.WaitGroup{}
+	for i := 10; i < 40; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ip := net.ParseIP(fmt.Sprintf("192.168.0.%d", i))
+			if _, err := s.Reserve("network", "pool", "default", fmt.Sprintf("pod%d", i), ip); err != nil {
+				t.Errorf("fail to reserve %s: %v", ip, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	lri, err := s.resourceClient.ResourceV1().LastReservedIPs().Get("network", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("fail to get last reserved ip: %v", err)
+	}
+	// reservations are serialized by the network lock, so the last audited one is the latest
+	latest := sink.reserves[len(sink.reserves)-1].IP
+	if len(sink.reserves) != 30 || lri.Spec.IP != latest || lri.Spec.Pools["pool"] != latest {
+		t.Errorf("expected last reserved ip %s after 30 reservations but got %+v after %d", latest, lri.Spec, len(sink.reserves))
+	}
+}
+
+func TestStore_OldestAllocation(t *testing.T) {
+	now := time.Now()
+	newPoolUsingIP := func(name, pool string, age time.Duration) *v1.UsingIP {
+		usingIP := newUsingIP(name, name)
+		usingIP.Spec.Network, usingIP.Spec.Pool, usingIP.Spec.PodNamespace = "network", pool, "default"
+		usingIP.CreationTimestamp = metav1.NewTime(now.Add(-age))
+		return usingIP
+	}
+	quarantined := newPoolUsingIP("192-168-0-13", "pool", 3*time.Hour)
+	quarantined.Annotations = map[string]string{QuarantinedAtAnnotation: now.Format(time.RFC3339Nano)}
+
+	s, stop := newTestStore(t,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20"), newTestPool("other", "192.168.0.30", "192.168.0.40"),
+			newTestPool("empty", "192.168.0.50", "192.168.0.60")),
+		newPoolUsingIP("192-168-0-10", "pool", time.Minute),
+		newPoolUsingIP("192-168-0-11", "pool", time.Hour),
+		newPoolUsingIP("192-168-0-12", "pool", time.Second),
+		newPoolUsingIP("192-168-0-30", "other", 2*time.Hour),
+		quarantined,
+	)
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	testCases := []struct {
+		name     string
+		pool     string
+		expected string
+		age      time.Duration
+	}{
+		{"oldest of pool", "pool", "192.168.0.11", time.Hour},
+		{"oldest of another pool", "other", "192.168.0.30", 2 * time.Hour},
+	}
+	for _, tc := range testCases {
+		usingIP, created, err := s.OldestAllocation("network", tc.pool)
+		if err != nil || usingIP == nil || usingIP.IP.String() != tc.expected || !created.Equal(metav1.NewTime(now.Add(-tc.age)).Time) {
+			t.Errorf("test %s fails: expected %s created at %v but got %+v at %v: %v", tc.name, tc.expected, now.Add(-tc.age), usingIP, created, err)
+		}
+	}
+
+	if usingIP, _, err := s.OldestAllocation("network", "empty"); err != nil || usingIP != nil {
+		t.Errorf("nothing should be allocated in empty pool: %+v %v", usingIP, err)
+	}
+}
+
+func TestStore_StreamUsingIPs(t *testing.T) {
+	s, stop := newTestStore(t,
+		newUsingIP("192-168-0-12", "pod3"),
+		newUsingIP("192-168-0-10", "pod1"),
+		newUsingIP("192-168-0-11", "pod2"))
+	defer stop()
+	waitForCache(t, func() bool { return len(s.cache.ListUsingIPs()) == 3 })
+
+	pods := make([]string, 0, 3)
+	for usingIP := range s.StreamUsingIPs(context.Background()) {
+		pods = append(pods, usingIP.PodName)
+	}
+	if !reflect.DeepEqual(pods, []string{"pod1", "pod2", "pod3"}) {
+		t.Errorf("expected all using ips emitted in order but got %v", pods)
+	}
+
+	// nothing more is emitted once ctx is cancelled, and the channel is closed
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := s.StreamUsingIPs(ctx)
+	if usingIP := <-ch; usingIP == nil || usingIP.PodName != "pod1" {
+		t.Fatalf("expected the first using ip but got %+v", usingIP)
+	}
+	cancel()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("stream is not closed after cancel")
+		}
+	}
+}
+
+func TestStore_StreamUsingIPsAfterClose(t *testing.T) {
+	s := newStore(newTestClientset(newUsingIP("192-168-0-10", "pod1")), nil)
+	if err := s.Run(); err != nil {
+		t.Fatalf("fail to run store: %v", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("fail to close store: %v", err)
+	}
+
+	if _, ok := <-s.StreamUsingIPs(context.Background()); ok {
+		t.Errorf("stream of a closed store should be closed at once")
+	}
+}
+
+func TestStore_ListUsingIPsByNode(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if reserved, err := s.ReserveOnNode("network", "pool", "default", "pod1", "node1", net.ParseIP("192.168.0.10")); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	if _, err := s.AllocateOnNode("network", "pool", "default", "pod2", "node2"); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if _, err := s.AllocateOnNode("network", "pool", "default", "pod3", "node1"); err != nil {
+		t.Fatalf("fail to allocate: %v", err)
+	}
+	if reserved, err := s.Reserve("network", "pool", "default", "pod4", net.ParseIP("192.168.0.20")); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return len(s.cache.ListUsingIPs()) == 4 })
+
+	testCases := []struct {
+		name     string
+		node     string
+		expected []string
+	}{
+		{"node with two pods", "node1", []string{"pod1", "pod3"}},
+		{"node with one pod", "node2", []string{"pod2"}},
+		{"unknown node", "node3", []string{}},
+	}
+	for _, tc := range testCases {
+		usingIPs, err := s.ListUsingIPsByNode(tc.node)
+		pods := make([]string, 0, len(usingIPs))
+		for _, usingIP := range usingIPs {
+			pods = append(pods, usingIP.PodName)
+		}
+		if err != nil || !reflect.DeepEqual(pods, tc.expected) {
+			t.Errorf("test %s fails: expected pods %v but got %v: %v", tc.name, tc.expected, pods, err)
+		}
+	}
+}
+
+func TestStore_ReserveInPool(t *testing.T) {
+	// the pool is not in cache, everything comes from the one passed
+	s, stop := newTestStore(t, newNetwork("network"))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	pool, err := types.PoolFromCRD(newTestPool("pool", "192.168.0.10", "192.168.0.20"))
+	if err != nil {
+		t.Fatalf("fail to convert pool: %v", err)
+	}
+	pool.SecondaryGateways = []net.IP{net.ParseIP("192.168.0.15")}
+	disabled := pool.DeepCopy()
+	disabled.Disabled = true
+
+	testCases := []struct {
+		name     string
+		pool     *types.Pool
+		ip       string
+		reserved bool
+		reason   string
+	}{
+		{"in range", pool, "192.168.0.10", true, ""},
+		{"already reserved", pool, "192.168.0.10", false, ""},
+		{"out of range", pool, "192.168.0.30", false, FailureValidation},
+		{"gateway", pool, "192.168.0.15", false, FailureValidation},
+		{"no pool", nil, "192.168.0.11", false, FailureValidation},
+		{"disabled", disabled, "192.168.0.11", false, FailureValidation},
+	}
+	for _, tc := range testCases {
+		reserved, err := s.ReserveInPool(tc.pool, "network", "default", "pod", net.ParseIP(tc.ip))
+		if reserved != tc.reserved || (err == nil) != (tc.reason == "") || err != nil && failureReason(err) != tc.reason {
+			t.Errorf("test %s fails: expected %v %q but got %v %v", tc.name, tc.reserved, tc.reason, reserved, err)
+		}
+		if reserved {
+			waitForCache(t, func() bool { return s.cache.IsIPUsing(tc.ip) })
+		}
+	}
+
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-10", metav1.GetOptions{})
+	if err != nil || usingIP.Spec.Network != "network" || usingIP.Spec.Pool != "pool" || usingIP.Spec.PodName != "pod" {
+		t.Errorf("unexpected using ip %+v: %v", usingIP, err)
+	}
+}
+
+func TestStore_ReserveWithMetadata(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	metadata := map[string]string{"interface": "eth1", "example.com/container-id": "abc"}
+	if reserved, err := s.ReserveWithMetadata("network", "pool", "default", "pod", net.ParseIP("192.168.0.10"), metadata); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing("192.168.0.10") })
+
+	usingIP, err := s.GetUsingIP(net.ParseIP("192.168.0.10"))
+	if err != nil || usingIP == nil || !reflect.DeepEqual(usingIP.Metadata, metadata) {
+		t.Fatalf("metadata should round trip: %+v %v", usingIP, err)
+	}
+	usingIP.Metadata["interface"] = "eth2"
+	if again, _ := s.GetUsingIP(net.ParseIP("192.168.0.10")); again.Metadata["interface"] != "eth1" {
+		t.Errorf("metadata of cache should not be shared with callers")
+	}
+	if usingIP, err := s.GetUsingIP(net.ParseIP("192.168.0.11")); err != nil || usingIP != nil {
+		t.Errorf("free ip should have no using ip record: %+v %v", usingIP, err)
+	}
+
+	testCases := []struct {
+		name     string
+		metadata map[string]string
+	}{
+		{"invalid key", map[string]string{"bad key": "value"}},
+		{"too large", map[string]string{"key": strings.Repeat("x", maxMetadataSize)}},
+	}
+	for _, tc := range testCases {
+		_, err := s.ReserveWithMetadata("network", "pool", "default", "other", net.ParseIP("192.168.0.11"), tc.metadata)
+		if failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation error but got %v", tc.name, err)
+		}
+	}
+}
+
+func TestStore_ReleaseByContainer(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.30")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	reservations := []struct {
+		pod, containerID, ifName, ip string
+	}{
+		{"pod1", "container1", "eth0", "192.168.0.10"},
+		{"pod1", "container1", "eth1", "192.168.0.11"},
+		{"pod2", "container2", "eth0", "192.168.0.12"},
+	}
+	for _, r := range reservations {
+		if reserved, err := s.ReserveWithContainer("network", "pool", "default", r.pod, r.containerID, r.ifName, net.ParseIP(r.ip)); err != nil || !reserved {
+			t.Fatalf("fail to reserve %s: %v %v", r.ip, reserved, err)
+		}
+	}
+	waitForCache(t, func() bool { return len(s.cache.ListUsingIPs()) == len(reservations) })
+	if usingIP, _ := s.GetUsingIP(net.ParseIP("192.168.0.11")); usingIP == nil || usingIP.ContainerID != "container1" || usingIP.IfName != "eth1" {
+		t.Fatalf("container id and interface name should round trip: %+v", usingIP)
+	}
+
+	testCases := []struct {
+		name        string
+		containerID string
+		ifName      string
+		released    []string
+		kept        []string
+	}{
+		{"no match", "container3", "eth0", nil, []string{"192.168.0.10", "192.168.0.11", "192.168.0.12"}},
+		{"interface of container", "container1", "eth1", []string{"192.168.0.11"}, []string{"192.168.0.10", "192.168.0.12"}},
+		{"every interface of container", "container2", "", []string{"192.168.0.12"}, []string{"192.168.0.10"}},
+	}
+	for _, tc := range testCases {
+		if err := s.ReleaseByContainer(tc.containerID, tc.ifName); err != nil {
+			t.Fatalf("test %s fails: %v", tc.name, err)
+		}
+		waitForCache(t, func() bool { return len(s.cache.ListUsingIPs()) == len(tc.kept) })
+		for _, ip := range tc.released {
+			if s.cache.IsIPUsing(ip) {
+				t.Errorf("test %s fails: expected %s released", tc.name, ip)
+			}
+		}
+		for _, ip := range tc.kept {
+			if !s.cache.IsIPUsing(ip) {
+				t.Errorf("test %s fails: expected %s kept", tc.name, ip)
+			}
+		}
+	}
+
+	if err := s.ReleaseByContainer("", "eth0"); failureReason(err) != FailureValidation {
+		t.Errorf("empty container id should be a validation error but got %v", err)
+	}
+	if _, err := s.ReserveWithContainer("network", "pool", "default", "pod3", "", "eth0", net.ParseIP("192.168.0.13")); failureReason(err) != FailureValidation {
+		t.Errorf("empty container id should be a validation error but got %v", err)
+	}
+}
+
+func TestStore_UsingIPLabels(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network",
+		newTestPool("pool1", "192.168.0.10", "192.168.0.20"), newTestPool("pool2", "192.168.0.30", "192.168.0.40")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if reserved, err := s.Reserve("network", "pool1", "default", "pod", net.ParseIP("192.168.0.10")); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	if _, _, err := s.ReconcileReservations([]store.Reservation{
+		{Network: "network", Pool: "pool2", IP: net.ParseIP("192.168.0.30"), Owner: "vip"},
+	}); err != nil {
+		t.Fatalf("fail to reconcile reservations: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		selector string
+		expected []string
+	}{
+		{"by network", NetworkLabel + "=network", []string{"192-168-0-10", "192-168-0-30"}},
+		{"by pool", PoolLabel + "=pool1", []string{"192-168-0-10"}},
+		{"managed only", ManagedByLabel + "=" + ManagedByReconciler, []string{"192-168-0-30"}},
+	}
+	for _, tc := range testCases {
+		list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{LabelSelector: tc.selector})
+		if err != nil {
+			t.Fatalf("test %s fails: %v", tc.name, err)
+		}
+		names := make([]string, 0, len(list.Items))
+		for _, usingIP := range list.Items {
+			names = append(names, usingIP.Name)
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, tc.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", tc.name, tc.expected, names)
+		}
+	}
+}
+
+func TestStore_CreateNetworkValidatesName(t *testing.T) {
+	s, stop := newTestStore(t)
+	defer stop()
+
+	testCases := []struct {
+		name    string
+		network string
+		valid   bool
+	}{
+		{"valid", "network-1", true},
+		{"subdomain", "net.example", true},
+		{"uppercase", "Network", false},
+		{"underscore", "my_network", false},
+		{"empty", "", false},
+		{"too long", strings.Repeat("a", 254), false},
+	}
+	for _, tc := range testCases {
+		err := s.CreateNetwork(tc.network)
+		if tc.valid && err != nil {
+			t.Errorf("test %s fails: %v", tc.name, err)
+		}
+		if !tc.valid && failureReason(err) != FailureValidation {
+			t.Errorf("test %s fails: expected validation error but got %v", tc.name, err)
+		}
+	}
+}
+
+func TestStore_ReleaseAndWait(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	ip := net.ParseIP("192.168.0.10")
+	if reserved, err := s.Reserve("network", "pool", "default", "pod", ip); err != nil || !reserved {
+		t.Fatalf("fail to reserve: %v %v", reserved, err)
+	}
+	waitForCache(t, func() bool { return s.cache.IsIPUsing(ip.String()) })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.ReleaseAndWait(ctx, ip); err != nil {
+		t.Fatalf("fail to release and wait: %v", err)
+	}
+	if s.cache.IsIPUsing(ip.String()) {
+		t.Errorf("ip should be free in cache once released and waited")
+	}
+
+	// informers are not running, so that the removal is never cached
+	lagging := newStore(newTestClientset(newUsingIP("192-168-0-11", "pod")), nil)
+	lagging.cache.addUsingIP(newUsingIP("192-168-0-11", "pod"))
+	short, cancelShort := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancelShort()
+	if err := lagging.ReleaseAndWait(short, net.ParseIP("192.168.0.11")); err == nil {
+		t.Errorf("expected error once context expires before cache reflects the removal")
+	}
+	if _, err := lagging.resourceClient.ResourceV1().UsingIPs().Get("192-168-0-11", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("using ip should be deleted even if waiting fails: %v", err)
+	}
+}
+
+func TestStore_WaitForNetworks(t *testing.T) {
+	client := newTestClientset(newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+	// using ips can not be listed until released, so that their informer lags behind
+	release := make(chan struct{})
+	client.PrependReactor("list", "usingips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		<-release
+		return false, nil, nil
+	})
+	stopCh := make(chan struct{})
+	s := newStore(client, stopCh)
+	defer func() {
+		close(stopCh)
+		s.Close()
+	}()
+
+	ran := make(chan error, 1)
+	go func() { ran <- s.Run() }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.WaitForNetworks(ctx); err != nil {
+		t.Fatalf("fail to wait for networks: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+	select {
+	case <-ran:
+		t.Errorf("run should still wait for using ips")
+	default:
+	}
+
+	close(release)
+	if err := <-ran; err != nil {
+		t.Errorf("fail to run store: %v", err)
+	}
+
+	// a done context gives up waiting
+	canceled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+	lagging := newStore(newTestClientset(), nil)
+	if err := lagging.WaitForNetworks(canceled); err == nil {
+		t.Errorf("expected error for canceled context without informers running")
+	}
+}
+
+func TestStore_ResourceClient(t *testing.T) {
+	client := newTestClientset(newNetwork("network"))
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	s := newStore(client, stopCh)
+
+	if s.ResourceClient() != versioned.Interface(client) {
+		t.Fatalf("expected the client of store but got %v", s.ResourceClient())
+	}
+	if _, err := s.ResourceClient().ResourceV1().Networks().Get("network", metav1.GetOptions{}); err != nil {
+		t.Errorf("fail to get network through the client of store: %v", err)
+	}
+}
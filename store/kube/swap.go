@@ -0,0 +1,121 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"time"
+
+	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/store"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SwapIPs exchanges the owners of ipA and ipB, so that each pod gets the ip of the other,
+// networks and pools of the ips are kept, the first update is rolled back if the second fails,
+// and resource versions guard both against concurrent changes without the network locks
+func (s *Store) SwapIPs(ipA, ipB net.IP) error {
+	if ipA.Equal(ipB) {
+		return newValidationError("ip %s can not be swapped with itself", ipA)
+	}
+
+	client := s.resourceClient.ResourceV1().UsingIPs()
+	a, err := s.getSwappable(ipA)
+	if err != nil {
+		return err
+	}
+	b, err := s.getSwappable(ipB)
+	if err != nil {
+		return err
+	}
+	if s.dryRun {
+		return nil
+	}
+
+	swappedA := a.DeepCopy()
+	setUsingIPOwner(swappedA, b)
+	updatedA, err := client.Update(swappedA)
+	if err != nil {
+		return fmt.Errorf("fail to swap ip %s with %s: %v", ipA, ipB, err)
+	}
+
+	swappedB := b.DeepCopy()
+	setUsingIPOwner(swappedB, a)
+	if _, err := client.Update(swappedB); err != nil {
+		reverted := updatedA.DeepCopy()
+		setUsingIPOwner(reverted, a)
+		if _, rollbackErr := client.Update(reverted); rollbackErr != nil {
+			LoggerStore.Errorf("fail to roll back swapping ip %s with %s: %v", ipA, ipB, rollbackErr)
+		}
+		return fmt.Errorf("fail to swap ip %s with %s: %v", ipA, ipB, err)
+	}
+
+	// each ip is released by its former owner and reserved by the other one
+	now := time.Now()
+	s.auditSink.RecordRelease(swapAuditEntry(now, ipA, a, a))
+	s.auditSink.RecordReserve(swapAuditEntry(now, ipA, a, b))
+	s.auditSink.RecordRelease(swapAuditEntry(now, ipB, b, b))
+	s.auditSink.RecordReserve(swapAuditEntry(now, ipB, b, a))
+	LoggerStore.Infof("ip %s of %s/%s swapped with ip %s of %s/%s",
+		ipA, a.Spec.PodNamespace, a.Spec.PodName, ipB, b.Spec.PodNamespace, b.Spec.PodName)
+	return nil
+}
+
+// swapAuditEntry returns the audit entry of ip held by usingIP for the pod or owner of owner,
+// the network and pool of usingIP are kept by swapping
+func swapAuditEntry(now time.Time, ip net.IP, usingIP, owner *resourcev1.UsingIP) *store.AuditEntry {
+	return &store.AuditEntry{
+		Time:         now,
+		IP:           ip.String(),
+		Network:      usingIP.Spec.Network,
+		Pool:         usingIP.Spec.Pool,
+		PodNamespace: owner.Spec.PodNamespace,
+		PodName:      owner.Spec.PodName,
+		Owner:        owner.Spec.Owner,
+	}
+}
+
+// getSwappable gets the using ip of ip, which must be in use and not managed by ReconcileReservations
+func (s *Store) getSwappable(ip net.IP) (*resourcev1.UsingIP, error) {
+	usingIP, err := s.resourceClient.ResourceV1().UsingIPs().Get(s.usingIPName(ip), metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("fail to get using ip %s: %v", ip, err)
+	}
+	if _, quarantined := quarantinedAt(usingIP); quarantined {
+		return nil, newValidationError("ip %s is quarantined and has no owner", ip)
+	}
+	if usingIP.Labels[ManagedByLabel] == ManagedByReconciler {
+		return nil, newValidationError("ip %s is managed by reservations and can not be swapped", ip)
+	}
+	return usingIP, nil
+}
+
+// setUsingIPOwner copies every field identifying the owner from src to dst
+func setUsingIPOwner(dst, src *resourcev1.UsingIP) {
+	dst.Spec.PodNamespace = src.Spec.PodNamespace
+	dst.Spec.PodName = src.Spec.PodName
+	dst.Spec.Owner = src.Spec.Owner
+	dst.Spec.MAC = src.Spec.MAC
+	dst.Spec.NodeName = src.Spec.NodeName
+	dst.Spec.Metadata = src.Spec.DeepCopy().Metadata
+	dst.Spec.ContainerID = src.Spec.ContainerID
+	dst.Spec.IfName = src.Spec.IfName
+	dst.Spec.Priority = src.Spec.Priority
+	dst.Spec.Protected = src.Spec.Protected
+}
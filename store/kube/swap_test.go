@@ -0,0 +1,130 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/client/clientset/versioned/fake"
+	"github.com/mars1024/kube-ipam/store"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newSwapTestStore(t *testing.T, opts ...Option) (*Store, func()) {
+	newOwnedUsingIP := func(name, podName, node string) *v1.UsingIP {
+		usingIP := newUsingIP(name, podName)
+		usingIP.Spec.PodNamespace = "default"
+		usingIP.Spec.Network = "network"
+		usingIP.Spec.Pool = "pool"
+		usingIP.Spec.NodeName = node
+		return usingIP
+	}
+	return newTestStoreWithOptions(t, opts,
+		newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")),
+		newOwnedUsingIP("192-168-0-10", "pod1", "node1"),
+		newOwnedUsingIP("192-168-0-11", "pod2", "node2"))
+}
+
+// podsOf returns the pod and node of each using ip by name
+func podsOf(t *testing.T, s *Store) map[string]string {
+	list, err := s.resourceClient.ResourceV1().UsingIPs().List(metav1.ListOptions{})
+	if err != nil {
+		t.Fatalf("fail to list using ips: %v", err)
+	}
+	pods := make(map[string]string, len(list.Items))
+	for _, usingIP := range list.Items {
+		pods[usingIP.Name] = usingIP.Spec.PodName + "@" + usingIP.Spec.NodeName
+	}
+	return pods
+}
+
+func TestStore_SwapIPs(t *testing.T) {
+	sink := &recordingAuditSink{}
+	s, stop := newSwapTestStore(t, WithAuditSink(sink))
+	defer stop()
+
+	if err := s.SwapIPs(net.ParseIP("192.168.0.10"), net.ParseIP("192.168.0.11")); err != nil {
+		t.Fatalf("fail to swap ips: %v", err)
+	}
+
+	// each ip is released by its former pod and reserved by the other one
+	audited := func(entries []*store.AuditEntry) map[string]string {
+		result := make(map[string]string, len(entries))
+		for _, entry := range entries {
+			result[entry.IP] = entry.PodName
+		}
+		return result
+	}
+	if released := audited(sink.releases); len(sink.releases) != 2 || released["192.168.0.10"] != "pod1" || released["192.168.0.11"] != "pod2" {
+		t.Errorf("expected releases of pod1 and pod2 but got %v", released)
+	}
+	if reserved := audited(sink.reserves); len(sink.reserves) != 2 || reserved["192.168.0.10"] != "pod2" || reserved["192.168.0.11"] != "pod1" {
+		t.Errorf("expected reserves of pod2 and pod1 but got %v", reserved)
+	}
+
+	expected := map[string]string{"192-168-0-10": "pod2@node2", "192-168-0-11": "pod1@node1"}
+	for name, pod := range podsOf(t, s) {
+		if expected[name] != pod {
+			t.Errorf("test %s fails: expected pod %s but got %s", name, expected[name], pod)
+		}
+	}
+
+	testCases := []struct {
+		name string
+		ipA  string
+		ipB  string
+	}{
+		{"same ip", "192.168.0.10", "192.168.0.10"},
+		{"free ip", "192.168.0.10", "192.168.0.12"},
+	}
+	for _, tc := range testCases {
+		if err := s.SwapIPs(net.ParseIP(tc.ipA), net.ParseIP(tc.ipB)); err == nil {
+			t.Errorf("test %s fails: expected error", tc.name)
+		}
+	}
+}
+
+func TestStore_SwapIPsRollback(t *testing.T) {
+	s, stop := newSwapTestStore(t)
+	defer stop()
+
+	// updating the second using ip fails, reverting the first one still works
+	s.resourceClient.(*fake.Clientset).PrependReactor("update", "usingips", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		usingIP := action.(k8stesting.UpdateAction).GetObject().(*v1.UsingIP)
+		if usingIP.Name == "192-168-0-11" {
+			return true, nil, errors.NewInternalError(fmt.Errorf("etcd is unavailable"))
+		}
+		return false, nil, nil
+	})
+
+	if err := s.SwapIPs(net.ParseIP("192.168.0.10"), net.ParseIP("192.168.0.11")); err == nil {
+		t.Fatalf("swapping should fail")
+	}
+
+	expected := map[string]string{"192-168-0-10": "pod1@node1", "192-168-0-11": "pod2@node2"}
+	for name, pod := range podsOf(t, s) {
+		if expected[name] != pod {
+			t.Errorf("test %s fails: expected pod %s but got %s", name, expected[name], pod)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+
+	"github.com/mars1024/kube-ipam/types"
+)
+
+// utilizationWatcher remembers which side of threshold pool was on when last evaluated
+type utilizationWatcher struct {
+	network   string
+	pool      string
+	threshold float64
+	fn        func(above bool)
+	above     bool
+}
+
+// utilizationHub fires callbacks of watchers whose pool crosses its threshold
+type utilizationHub struct {
+	sync.Mutex
+
+	// evaluating serializes evaluations, so callbacks of a watcher fire in the order of crossings
+	evaluating sync.Mutex
+	watchers   []*utilizationWatcher
+}
+
+func newUtilizationHub() *utilizationHub {
+	return &utilizationHub{}
+}
+
+func (h *utilizationHub) add(w *utilizationWatcher) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.watchers = append(h.watchers, w)
+}
+
+// evaluate recomputes the utilization of every watched pool of network and fires the callbacks
+// of pools which have crossed their thresholds, callbacks are called without holding the hub
+func (h *utilizationHub) evaluate(networkName string, utilization func(network, pool string) float64) {
+	h.evaluating.Lock()
+	defer h.evaluating.Unlock()
+
+	h.Lock()
+	var fired []func()
+	for _, w := range h.watchers {
+		if w.network != networkName {
+			continue
+		}
+		above := utilization(w.network, w.pool) >= w.threshold
+		if above == w.above {
+			continue
+		}
+		w.above = above
+		fn := w.fn
+		fired = append(fired, func() { fn(above) })
+	}
+	h.Unlock()
+
+	for _, fire := range fired {
+		fire()
+	}
+}
+
+// poolUtilization returns the ratio of allocated ips to the capacity of pool in cache,
+// it is 0 if the pool is not in cache or has no allocatable ip
+func (s *Store) poolUtilization(networkName, poolName string) float64 {
+	pool, err := s.getPool(networkName, poolName)
+	if err != nil {
+		return 0
+	}
+	return utilizationOf(pool, s.cache.AllocatedCount(networkName, pool.Name))
+}
+
+func utilizationOf(pool *types.Pool, allocated int) float64 {
+	capacity := pool.Capacity()
+	if capacity <= 0 {
+		return 0
+	}
+	return float64(allocated) / float64(capacity)
+}
+
+// OnUtilization registers fn to be called once pool of network crosses threshold in either
+// direction, with above telling whether utilization is now at or above threshold, the side
+// of threshold pool is on at registration does not fire fn, and fn is called from the
+// informer event handlers of store so it should not block
+func (s *Store) OnUtilization(network, pool string, threshold float64, fn func(above bool)) {
+	s.utilization.add(&utilizationWatcher{
+		network:   network,
+		pool:      pool,
+		threshold: threshold,
+		fn:        fn,
+		above:     s.poolUtilization(network, pool) >= threshold,
+	})
+}
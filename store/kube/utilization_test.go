@@ -0,0 +1,101 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func nextCrossing(t *testing.T, crossings <-chan bool) bool {
+	select {
+	case above := <-crossings:
+		return above
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no crossing arrives")
+	}
+	return false
+}
+
+func TestStore_OnUtilization(t *testing.T) {
+	// 4 allocatable ips, so the threshold of 0.5 is crossed by the second reservation
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.13"),
+		newTestPool("other", "192.168.0.20", "192.168.0.21")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	crossings := make(chan bool, 16)
+	s.OnUtilization("network", "pool", 0.5, func(above bool) { crossings <- above })
+
+	steps := []struct {
+		name    string
+		do      func() error
+		crosses bool
+		above   bool
+	}{
+		{"reserve below threshold", func() error { return reserveIP(s, "pool", "pod-1", "192.168.0.10") }, false, false},
+		{"reserve in other pool", func() error { return reserveIP(s, "other", "pod-2", "192.168.0.20") }, false, false},
+		{"reserve reaching threshold", func() error { return reserveIP(s, "pool", "pod-3", "192.168.0.11") }, true, true},
+		{"reserve above threshold", func() error { return reserveIP(s, "pool", "pod-4", "192.168.0.12") }, false, false},
+		{"release staying above", func() error { return s.Release(net.ParseIP("192.168.0.12")) }, false, false},
+		{"release below threshold", func() error { return s.Release(net.ParseIP("192.168.0.11")) }, true, false},
+		{"reserve again", func() error { return reserveIP(s, "pool", "pod-5", "192.168.0.13") }, true, true},
+	}
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("test %s fails: %v", step.name, err)
+		}
+		if step.crosses {
+			if above := nextCrossing(t, crossings); above != step.above {
+				t.Errorf("test %s fails: expected crossing with above %v but got %v", step.name, step.above, above)
+			}
+			continue
+		}
+		// events are applied to cache asynchronously, give a spurious crossing the time to show up
+		select {
+		case above := <-crossings:
+			t.Errorf("test %s fails: expected no crossing but got one with above %v", step.name, above)
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func TestStore_OnUtilizationAboveAtRegistration(t *testing.T) {
+	s, stop := newTestStore(t, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.11")))
+	defer stop()
+	waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+
+	if err := reserveIP(s, "pool", "pod-1", "192.168.0.10"); err != nil {
+		t.Fatalf("test fails: %v", err)
+	}
+	waitForCache(t, func() bool { return s.cache.GetUsingIP("192.168.0.10") != nil })
+
+	crossings := make(chan bool, 16)
+	s.OnUtilization("network", "pool", 0.5, func(above bool) { crossings <- above })
+	if err := s.Release(net.ParseIP("192.168.0.10")); err != nil {
+		t.Fatalf("test fails: %v", err)
+	}
+	if above := nextCrossing(t, crossings); above {
+		t.Errorf("test fails: expected crossing below threshold")
+	}
+}
+
+func reserveIP(s *Store, pool, pod, ip string) error {
+	_, err := s.Reserve("network", pool, "default", pod, net.ParseIP(ip))
+	return err
+}
@@ -0,0 +1,101 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"sync"
+
+	"github.com/mars1024/kube-ipam/store"
+)
+
+// watchBufferSize is how many events a watcher may fall behind before events are dropped
+const watchBufferSize = 128
+
+// watchHub fans out allocation events to watchers without ever blocking the sender
+type watchHub struct {
+	sync.RWMutex
+
+	nextID   int
+	watchers map[int]chan store.AllocationEvent
+	closed   bool
+}
+
+func newWatchHub() *watchHub {
+	return &watchHub{
+		watchers: make(map[int]chan store.AllocationEvent),
+	}
+}
+
+// subscribe adds a watcher, the returned func removes it and closes its channel
+func (h *watchHub) subscribe() (<-chan store.AllocationEvent, func()) {
+	h.Lock()
+	defer h.Unlock()
+
+	ch := make(chan store.AllocationEvent, watchBufferSize)
+	if h.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	id := h.nextID
+	h.nextID++
+	h.watchers[id] = ch
+
+	once := &sync.Once{}
+	return ch, func() {
+		once.Do(func() {
+			h.Lock()
+			defer h.Unlock()
+			if _, exists := h.watchers[id]; exists {
+				delete(h.watchers, id)
+				close(ch)
+			}
+		})
+	}
+}
+
+// broadcast sends event to every watcher, it is dropped for watchers whose buffer is full
+func (h *watchHub) broadcast(event store.AllocationEvent) {
+	h.RLock()
+	defer h.RUnlock()
+
+	for id, ch := range h.watchers {
+		select {
+		case ch <- event:
+		default:
+			LoggerStore.Warnf("watcher %d is too slow, drop %s event of %s", id, event.Type, event.UsingIP.IP)
+		}
+	}
+}
+
+// close closes all watchers, and watchers subscribing later get a closed channel
+func (h *watchHub) close() {
+	h.Lock()
+	defer h.Unlock()
+
+	for id, ch := range h.watchers {
+		delete(h.watchers, id)
+		close(ch)
+	}
+	h.closed = true
+}
+
+// Watch subscribes to reservations and releases seen by store, events are dropped
+// rather than blocking store if the consumer falls behind, the returned func cancels
+// the subscription, and the channel is closed on cancel or once store shuts down
+func (s *Store) Watch() (<-chan store.AllocationEvent, func()) {
+	return s.watchers.subscribe()
+}
@@ -0,0 +1,123 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package kube
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mars1024/kube-ipam/store"
+	"github.com/mars1024/kube-ipam/types"
+)
+
+func nextEvent(t *testing.T, events <-chan store.AllocationEvent) store.AllocationEvent {
+	select {
+	case event, ok := <-events:
+		if !ok {
+			t.Fatalf("watch channel is closed")
+		}
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no event arrives")
+	}
+	return store.AllocationEvent{}
+}
+
+func TestStore_Watch(t *testing.T) {
+	tests := []struct {
+		name string
+		opts []Option
+	}{
+		{"release", nil},
+		{"quarantined release", []Option{WithReleaseQuarantine(time.Hour)}},
+	}
+	for _, test := range tests {
+		s, stop := newTestStoreWithOptions(t, test.opts, newNetwork("network", newTestPool("pool", "192.168.0.10", "192.168.0.20")))
+		waitForCache(t, func() bool { return s.cache.GetNetwork("network") != nil })
+		events, cancel := s.Watch()
+
+		ip := net.ParseIP("192.168.0.10")
+		if _, err := s.Reserve("network", "pool", "default", "pod", ip); err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if event := nextEvent(t, events); event.Type != store.AllocationReserved || !event.UsingIP.IP.Equal(ip) ||
+			event.UsingIP.PodName != "pod" {
+			t.Errorf("test %s fails: expected reserved event of %s but got %s event %+v", test.name, ip, event.Type, event.UsingIP)
+		}
+		if err := s.Release(ip); err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if event := nextEvent(t, events); event.Type != store.AllocationReleased || !event.UsingIP.IP.Equal(ip) {
+			t.Errorf("test %s fails: expected released event of %s but got %s event %+v", test.name, ip, event.Type, event.UsingIP)
+		}
+
+		cancel()
+		if _, ok := <-events; ok {
+			t.Errorf("test %s fails: expected channel closed on cancel", test.name)
+		}
+		cancel()
+		stop()
+	}
+}
+
+func TestStore_WatchClosedOnShutdown(t *testing.T) {
+	s, stop := newTestStore(t)
+	events, cancel := s.Watch()
+	defer cancel()
+
+	stop()
+	<-s.Done()
+	if _, ok := <-events; ok {
+		t.Errorf("expected channel closed on shutdown")
+	}
+	late, _ := s.Watch()
+	if _, ok := <-late; ok {
+		t.Errorf("expected channel closed when watching a shut down store")
+	}
+}
+
+func TestWatchHub_SlowWatcher(t *testing.T) {
+	hub := newWatchHub()
+	slow, cancelSlow := hub.subscribe()
+	defer cancelSlow()
+
+	// the hub must never block on a watcher which does not read at all
+	event := store.AllocationEvent{Type: store.AllocationReserved, UsingIP: &types.UsingIP{IP: net.ParseIP("192.168.0.10")}}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < watchBufferSize*2; i++ {
+			hub.broadcast(event)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("broadcast blocks on a slow watcher")
+	}
+	if len(slow) != watchBufferSize {
+		t.Errorf("expected %d buffered events but got %d", watchBufferSize, len(slow))
+	}
+
+	fast, cancelFast := hub.subscribe()
+	defer cancelFast()
+	hub.broadcast(event)
+	if got := nextEvent(t, fast); got.Type != event.Type {
+		t.Errorf("expected %s event but got %s", event.Type, got.Type)
+	}
+}
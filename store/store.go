@@ -17,7 +17,9 @@
 package store
 
 import (
+	"context"
 	"net"
+	"time"
 
 	"github.com/mars1024/kube-ipam/types"
 )
@@ -27,16 +29,177 @@ type IPAMStore interface {
 	// Network
 	CreateNetwork(name string) error
 	DeleteNetwork(name string) error
+	RenameNetwork(oldName, newName string) error
 	GetNetwork(name string) (*types.Network, error)
+	ListNetworks() ([]*types.Network, error)
 	GetLastReservedIP(name string) (*types.LastReservedIP, error)
+	// ListLastReservedIPs returns the last reserved ips of all networks keyed by network name
+	ListLastReservedIPs() (map[string]*types.LastReservedIP, error)
+	CompactLastReservedIP(name string) error
+	SnapshotNetwork(name string) (*types.NetworkSnapshot, error)
+	// SetDefaultPool makes pool the default of network for allocations naming no pool
+	SetDefaultPool(network, pool string) error
 
 	// Pool
 	AddPool(network string, pool *types.Pool) error
-	DelPool(network, pool string) error
+	UpdatePool(network string, pool *types.Pool) error
+	AddOrUpdatePool(network string, pool *types.Pool) error
+	// DelPool deletes pool which must have no live using ips, and tells what it freed
+	DelPool(network, pool string) (*DelPoolResult, error)
+	// ReconcileNetwork makes the pools of network those of desired with a single write
+	ReconcileNetwork(desired *types.Network) error
+	// ReleaseStaleGeneration releases the using ips of pool left by earlier generations of it
+	ReleaseStaleGeneration(network, pool string) (int, error)
 	CountPool(network, pool string) (total, used int, err error)
+	PoolStats(network, pool string) (types.PoolStats, error)
+	NetworkCapacity(network string) (total, used, free int, err error)
+	// SimulateCapacity plans the ips of pool as if it were added, the store is not touched
+	SimulateCapacity(pool *types.Pool) (CapacityPlan, error)
+	ListPoolsWithStats(network string) ([]types.PoolStat, error)
+	// FreeRanges returns the free ips of pool as CIDRs
+	FreeRanges(network, pool string) ([]*net.IPNet, error)
+	// ListPoolsByLabel returns the pools of network having all labels of selector
+	ListPoolsByLabel(network string, selector map[string]string) ([]*types.Pool, error)
+	// OldestAllocation returns the ip of pool held for the longest time along with when it was reserved
+	OldestAllocation(network, pool string) (*types.UsingIP, time.Time, error)
+	// ResolveIP finds the pool of network containing ip, along with its gateway and subnet
+	ResolveIP(network string, ip net.IP) (*types.Pool, error)
 
 	// IP
+	Allocate(network, pool, namespace, name string) (net.IP, error)
+	AllocateWithFilter(network, pool, namespace, name string, blocked func(net.IP) bool) (net.IP, error)
+	AllocateFromNetwork(network, namespace, name string) (pool string, ip net.IP, err error)
+	// Hold reserves an ip of pool tentatively under token until it is committed, dropped or expires
+	Hold(network, pool, token string) (net.IP, error)
+	// Commit hands the ip held under token over to pod namespace/name
+	Commit(token, namespace, name string) error
+	// Drop releases the ip held under token
+	Drop(token string) error
+	// AllocatePreferFamily works like AllocateFromNetwork with the pools of the preferred ip family tried first
+	AllocatePreferFamily(network, namespace, name string, prefer FamilyPreference) (net.IP, string, error)
+	AllocateBlock(network, pool string, prefixLen int, owner string) (*net.IPNet, error)
+	AllocateFromRange(network, pool string, start, end net.IP, owner string) (net.IP, error)
+	// AllocateInCIDR reserves an ip inside cidr from a pool of network overlapping it, and returns its pool
+	AllocateInCIDR(network string, cidr *net.IPNet, owner string) (net.IP, string, error)
+	AllocateSticky(network, pool, namespace, name string, previous net.IP) (net.IP, error)
+	AllocateByMAC(network, pool, mac string) (net.IP, error)
+	AllocateOnNode(network, pool, namespace, name, node string) (net.IP, error)
+	// PeekNext returns the ip which the next Allocate from pool would pick without reserving it
+	PeekNext(network, pool string) (net.IP, error)
 	Reserve(network, pool, namespace, name string, ip net.IP) (bool, error)
+	// ReserveIdempotent allocates an ip for pod, retries with the same key return the same ip
+	ReserveIdempotent(network, pool, key, namespace, name string) (net.IP, error)
+	// ReserveWithPreemption allocates an ip for pod, and preempts a pod of lower priority if pool is exhausted
+	ReserveWithPreemption(network, pool, namespace, name string, priority int32) (net.IP, *types.UsingIP, error)
+	// ReserveInPool works like Reserve with the pool resolved by caller, ip is checked against it
+	ReserveInPool(pool *types.Pool, network, namespace, name string, ip net.IP) (bool, error)
+	// ValidateReservation checks that ip could be reserved in pool without reserving it
+	ValidateReservation(network, pool string, ip net.IP) error
+	// ReserveWithResult works like Reserve, and tells a retried reservation of the same pod apart
+	ReserveWithResult(network, pool, namespace, name string, ip net.IP) (*ReserveResult, error)
+	ReserveOnNode(network, pool, namespace, name, node string, ip net.IP) (bool, error)
+	ReserveWithMetadata(network, pool, namespace, name string, ip net.IP, metadata map[string]string) (bool, error)
+	// ReserveWithContainer works like Reserve, and records the CNI container id and interface name
+	ReserveWithContainer(network, pool, namespace, name, containerID, ifName string, ip net.IP) (bool, error)
+	ReserveStatic(network, pool string, ip net.IP, owner string) error
 	Release(ip net.IP) error
+	// ReleaseAndWait releases ip and waits until the store sees it free or ctx is done
+	ReleaseAndWait(ctx context.Context, ip net.IP) error
+	ReleaseIfOwnedBy(ip net.IP, namespace, name string) (bool, error)
+	// ReleaseByName releases the ips of pool reserved by pod, protected ips are skipped
 	ReleaseByName(network, pool, namespace, name string) error
+	// ReleaseAll releases every ip held in pool, protected ips are skipped unless force is set
+	ReleaseAll(network, pool string, force bool) (int, error)
+	// SetProtected marks ip as protected from release or not
+	SetProtected(ip net.IP, protected bool) error
+	// ReleaseByContainer releases the ips reserved by interface ifName of CNI container containerID
+	ReleaseByContainer(containerID, ifName string) error
+	// ReserveWholePool leases pool exclusively to owner, the owner of using ips or namespace of pods
+	ReserveWholePool(network, pool, owner string) error
+	// ReleaseWholePool ends the lease of pool held by owner
+	ReleaseWholePool(network, pool, owner string) error
+	// RecanonicalizeNetwork rewrites the pools of network in canonical form, pools which would
+	// drop live using ips are skipped and reported
+	RecanonicalizeNetwork(name string) error
+	// DrainPool disables pool and moves its using ips to the targets picked by target
+	DrainPool(network, pool string, target func(ip net.IP) (toNetwork, toPool string, ok bool)) (*DrainReport, error)
+	// Rebalance moves at most maxMoves allocations from the most utilized pools of network to the least
+	Rebalance(network string, maxMoves int) (*RebalanceReport, error)
+	// SwapIPs exchanges the owners of two ips, neither is changed on failure
+	SwapIPs(ipA, ipB net.IP) error
+	ReconcileReservations(desired []Reservation) (created, deleted int, err error)
+	IPsForPod(namespace, name string) ([]net.IP, error)
+	// MigrateNames renames using ip records named by other schemes than the current one
+	MigrateNames() (int, error)
+	// GetUsingIP returns the using ip record of ip, nil if ip is free
+	GetUsingIP(ip net.IP) (*types.UsingIP, error)
+	// StreamUsingIPs emits all using ips one at a time until they are all emitted or ctx is done
+	StreamUsingIPs(ctx context.Context) <-chan *types.UsingIP
+	// ListUsingIPsByNode returns the using ips reserved on node
+	ListUsingIPsByNode(node string) ([]*types.UsingIP, error)
+	// LookupIP describes ip across all networks for debugging
+	LookupIP(ip net.IP) (*types.IPInfo, error)
+}
+
+// FamilyPreference is the ip family whose pools are tried first by allocations accepting either
+type FamilyPreference string
+
+const (
+	PreferIPv4 FamilyPreference = "IPv4"
+	PreferIPv6 FamilyPreference = "IPv6"
+)
+
+// Reservation is a desired static reservation of ip for a free-form owner
+type Reservation struct {
+	Network string
+	Pool    string
+	IP      net.IP
+	Owner   string
+}
+
+// CapacityPlan is the outcome of simulating a pool, Usable and Reserved sum up to Total
+type CapacityPlan struct {
+	// Total is the count of all ips in range of pool
+	Total int
+	// Usable is the count of ips pods could hold
+	Usable int
+	// Reserved is the count of gateways and ips spared by the reserved-ip policy in range
+	Reserved int
+}
+
+// DrainReport is the outcome of draining a pool, ips failed to migrate are left in the pool
+type DrainReport struct {
+	// Migrated are the ips whose using ips are moved to their targets
+	Migrated []net.IP
+	// Failed maps ips left in the pool to why they are not migrated
+	Failed map[string]string
+}
+
+// RebalanceMove is an allocation moved to another pool, along with a new ip
+type RebalanceMove struct {
+	FromPool string
+	FromIP   net.IP
+	ToPool   string
+	ToIP     net.IP
+}
+
+// RebalanceReport is the outcome of rebalancing a network
+type RebalanceReport struct {
+	// Moved are the allocations moved, in the order they are moved
+	Moved []RebalanceMove
+	// Failed maps ips which fail to move to why, they are left in their pools
+	Failed map[string]string
+}
+
+// DelPoolResult is the outcome of deleting a pool
+type DelPoolResult struct {
+	// Capacity is the count of allocatable ips the pool had, which are freed for other pools
+	Capacity int
+}
+
+// ReserveResult is the outcome of reserving an ip for a pod, Already is set when the ip
+// was reserved for the same pod before, e.g. by a retried CNI ADD
+type ReserveResult struct {
+	Reserved bool
+	Already  bool
 }
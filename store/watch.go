@@ -0,0 +1,34 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package store
+
+import "github.com/mars1024/kube-ipam/types"
+
+// AllocationEventType tells what happened to an allocated ip
+type AllocationEventType string
+
+const (
+	AllocationReserved AllocationEventType = "reserved"
+	AllocationUpdated  AllocationEventType = "updated"
+	AllocationReleased AllocationEventType = "released"
+)
+
+// AllocationEvent is a change of an using ip seen by store
+type AllocationEvent struct {
+	Type    AllocationEventType
+	UsingIP *types.UsingIP
+}
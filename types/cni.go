@@ -0,0 +1,186 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+
+	cnitypes "github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/plugins/pkg/ip"
+)
+
+// cniRange is a range of host-local ipam configuration
+type cniRange struct {
+	Subnet     string `json:"subnet"`
+	RangeStart string `json:"rangeStart,omitempty"`
+	RangeEnd   string `json:"rangeEnd,omitempty"`
+	Gateway    string `json:"gateway,omitempty"`
+}
+
+// cniIPAM is the host-local style ipam block, with either the legacy single range
+// or the ranges form, which is an array of range sets
+type cniIPAM struct {
+	cniRange
+	Ranges [][]cniRange `json:"ranges,omitempty"`
+}
+
+type cniNetConf struct {
+	Name string   `json:"name,omitempty"`
+	IPAM *cniIPAM `json:"ipam"`
+}
+
+// defaultCNINetworkName names the network and its pools validated by Validate
+// when the configuration is a bare ipam block without a name
+const defaultCNINetworkName = "network"
+
+// GetPoolsFromCNIConfig parses pools from a host-local style CNI network configuration,
+// data can be either the whole netconf or its ipam block, pools are named after name
+// with the index of their ranges, and all problems found are reported as an ErrorList
+func GetPoolsFromCNIConfig(data []byte, name string) ([]*Pool, error) {
+	conf := cniNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("fail to parse cni config: %v", err)
+	}
+	ipam := conf.IPAM
+	if ipam == nil {
+		ipam = &cniIPAM{}
+		if err := json.Unmarshal(data, ipam); err != nil {
+			return nil, fmt.Errorf("fail to parse cni ipam config: %v", err)
+		}
+	}
+
+	// the legacy single range goes first like host-local does
+	var ranges []cniRange
+	if len(ipam.Subnet) > 0 {
+		ranges = append(ranges, ipam.cniRange)
+	}
+	for _, rangeSet := range ipam.Ranges {
+		ranges = append(ranges, rangeSet...)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("cni ipam config has no range")
+	}
+
+	pools := make([]*Pool, 0, len(ranges))
+	errs := ErrorList{}
+	for idx, r := range ranges {
+		pool, err := getPoolFromCNIRange(&r, fmt.Sprintf("%s-%d", name, idx))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("range %d is invalid: %v", idx, err))
+			continue
+		}
+		pools = append(pools, pool)
+	}
+
+	return pools, errs.ToError()
+}
+
+// Validate parses a host-local style CNI configuration from r like GetPoolsFromCNIConfig, and checks
+// its pools as a network without applying anything, all problems found are returned at once, and
+// the error is only for a configuration which can not be read or parsed at all
+func Validate(r io.Reader) ([]error, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("fail to read cni config: %v", err)
+	}
+	conf := cniNetConf{}
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, fmt.Errorf("fail to parse cni config: %v", err)
+	}
+	name := conf.Name
+	if len(name) == 0 {
+		name = defaultCNINetworkName
+	}
+
+	problems := ErrorList{}
+	pools, err := GetPoolsFromCNIConfig(data, name)
+	problems = appendErrors(problems, err)
+	network := &Network{Name: name, Pools: pools}
+	problems = appendErrors(problems, network.Validate())
+	return problems, nil
+}
+
+// appendErrors appends err to errs, an ErrorList is flattened
+func appendErrors(errs ErrorList, err error) ErrorList {
+	if list, ok := err.(ErrorList); ok {
+		return append(errs, list...)
+	}
+	if err != nil {
+		return append(errs, err)
+	}
+	return errs
+}
+
+// getPoolFromCNIRange converts a host-local range to pool, the gateway
+// defaults to the first ip of subnet like host-local does
+func getPoolFromCNIRange(r *cniRange, name string) (*Pool, error) {
+	_, subnet, err := net.ParseCIDR(r.Subnet)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &Pool{
+		Name:    name,
+		Subnet:  subnet,
+		Gateway: ip.NextIP(subnet.IP),
+	}
+	if len(r.RangeStart) > 0 {
+		pool.PoolStart = net.ParseIP(r.RangeStart)
+	}
+	if len(r.RangeEnd) > 0 {
+		pool.PoolEnd = net.ParseIP(r.RangeEnd)
+	}
+	if len(r.Gateway) > 0 {
+		pool.Gateway = net.ParseIP(r.Gateway)
+	}
+
+	if err = pool.Canonicalize(); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// GetCNIResultFromIP converts an allocation result to the CNI IPAM result, with a default
+// route via the gateway of pool, so that it can be returned by an ipam plugin directly
+func GetCNIResultFromIP(addr *IP) *current.Result {
+	version, bits, address := "4", 8*net.IPv4len, addr.IP.To4()
+	if address == nil {
+		version, bits, address = "6", 8*net.IPv6len, addr.IP.To16()
+	}
+
+	ipConfig := &current.IPConfig{
+		Version: version,
+		Address: net.IPNet{IP: address, Mask: addr.Subnet.Mask},
+		Gateway: addr.Gateway,
+	}
+	result := &current.Result{
+		CNIVersion: current.ImplementedSpecVersion,
+		IPs:        []*current.IPConfig{ipConfig},
+	}
+	if addr.Gateway != nil {
+		result.Routes = []*cnitypes.Route{{
+			Dst: net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)},
+			GW:  addr.Gateway,
+		}}
+	}
+	return result
+}
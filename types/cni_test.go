@@ -0,0 +1,178 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package types
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestGetPoolsFromCNIConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []Pool
+		invalid  bool
+	}{
+		{
+			name: "legacy single range",
+			config: `{
+				"cniVersion": "0.3.1",
+				"name": "mynet",
+				"type": "bridge",
+				"ipam": {
+					"type": "host-local",
+					"subnet": "10.10.0.0/16",
+					"rangeStart": "10.10.1.20",
+					"rangeEnd": "10.10.3.50",
+					"gateway": "10.10.0.254"
+				}
+			}`,
+			expected: []Pool{
+				{Name: "mynet-0", PoolStart: net.ParseIP("10.10.1.20"), PoolEnd: net.ParseIP("10.10.3.50"), Gateway: net.ParseIP("10.10.0.254")},
+			},
+		},
+		{
+			name: "multiple ranges of ipam block",
+			config: `{
+				"type": "host-local",
+				"ranges": [
+					[
+						{"subnet": "10.10.0.0/24"},
+						{"subnet": "10.10.1.0/24", "rangeStart": "10.10.1.100", "gateway": "10.10.1.254"}
+					],
+					[
+						{"subnet": "192.168.0.0/24", "rangeEnd": "192.168.0.100"}
+					]
+				]
+			}`,
+			expected: []Pool{
+				{Name: "mynet-0", PoolStart: net.ParseIP("10.10.0.1"), PoolEnd: net.ParseIP("10.10.0.254"), Gateway: net.ParseIP("10.10.0.1")},
+				{Name: "mynet-1", PoolStart: net.ParseIP("10.10.1.100"), PoolEnd: net.ParseIP("10.10.1.254"), Gateway: net.ParseIP("10.10.1.254")},
+				{Name: "mynet-2", PoolStart: net.ParseIP("192.168.0.1"), PoolEnd: net.ParseIP("192.168.0.100"), Gateway: net.ParseIP("192.168.0.1")},
+			},
+		},
+		{
+			name:    "range out of subnet",
+			config:  `{"ipam": {"subnet": "10.10.0.0/24", "rangeStart": "10.10.1.10"}}`,
+			invalid: true,
+		},
+		{
+			name:    "no range",
+			config:  `{"ipam": {"type": "host-local"}}`,
+			invalid: true,
+		},
+	}
+
+	for _, test := range tests {
+		pools, err := GetPoolsFromCNIConfig([]byte(test.config), "mynet")
+		if test.invalid {
+			if err == nil {
+				t.Errorf("test %s fails: expected error but got pools %+v", test.name, pools)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if len(pools) != len(test.expected) {
+			t.Errorf("test %s fails: expected %d pools but got %d", test.name, len(test.expected), len(pools))
+			continue
+		}
+		for i, pool := range pools {
+			expected := test.expected[i]
+			if pool.Name != expected.Name || !pool.PoolStart.Equal(expected.PoolStart) ||
+				!pool.PoolEnd.Equal(expected.PoolEnd) || !pool.Gateway.Equal(expected.Gateway) {
+				t.Errorf("test %s fails: expected pool %+v but got %+v", test.name, expected, pool)
+			}
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	// two ranges are invalid and the two valid ones overlap
+	config := `{
+		"name": "mynet",
+		"ipam": {
+			"type": "host-local",
+			"ranges": [
+				[
+					{"subnet": "10.10.0.0/24", "rangeStart": "10.10.1.10"},
+					{"subnet": "10.10.1.0/24", "gateway": "10.10.2.1"}
+				],
+				[
+					{"subnet": "192.168.0.0/24"},
+					{"subnet": "192.168.0.0/25"}
+				]
+			]
+		}
+	}`
+	problems, err := Validate(strings.NewReader(config))
+	if err != nil {
+		t.Fatalf("fail to validate: %v", err)
+	}
+	if len(problems) != 3 {
+		t.Fatalf("expected 3 problems but got %v", problems)
+	}
+	for i, expected := range []string{"range 0", "range 1", "overlaps"} {
+		if !strings.Contains(problems[i].Error(), expected) {
+			t.Errorf("problem %d expected about %q but got %v", i, expected, problems[i])
+		}
+	}
+
+	problems, err = Validate(strings.NewReader(`{"ipam": {"subnet": "10.10.0.0/24"}}`))
+	if err != nil || len(problems) != 0 {
+		t.Errorf("expected valid config but got %v %v", problems, err)
+	}
+	if _, err := Validate(strings.NewReader(`{"ipam": `)); err == nil {
+		t.Errorf("expected error of malformed config")
+	}
+}
+
+func TestGetCNIResultFromIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		subnet  string
+		ip      string
+		gateway string
+		address string
+		route   string
+	}{
+		{"ipv4", "192.168.0.0/24", "192.168.0.10", "192.168.0.1", "192.168.0.10/24", "0.0.0.0/0"},
+		{"ipv6", "fd00::/64", "fd00::10", "fd00::1", "fd00::10/64", "::/0"},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		pool := &Pool{Name: "pool", Subnet: subnet, Gateway: net.ParseIP(test.gateway)}
+		result := GetCNIResultFromIP(NewIP("network", pool, net.ParseIP(test.ip)))
+
+		if len(result.IPs) != 1 {
+			t.Fatalf("test %s fails: expected 1 ip but got %d", test.name, len(result.IPs))
+		}
+		if address := result.IPs[0].Address.String(); address != test.address {
+			t.Errorf("test %s fails: expected address %s but got %s", test.name, test.address, address)
+		}
+		if !result.IPs[0].Gateway.Equal(net.ParseIP(test.gateway)) {
+			t.Errorf("test %s fails: expected gateway %s but got %s", test.name, test.gateway, result.IPs[0].Gateway)
+		}
+		if len(result.Routes) != 1 || result.Routes[0].Dst.String() != test.route || !result.Routes[0].GW.Equal(net.ParseIP(test.gateway)) {
+			t.Errorf("test %s fails: expected default route %s via %s but got %v", test.name, test.route, test.gateway, result.Routes)
+		}
+	}
+}
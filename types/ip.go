@@ -16,8 +16,15 @@
 
 package types
 
-import "net"
+import (
+	"net"
+	"time"
 
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+)
+
+// IP is the result of an allocation, with everything needed to configure an interface
 type IP struct {
 	Network string     `json:"network"`
 	Pool    string     `json:"pool"`
@@ -25,4 +32,110 @@ type IP struct {
 	Subnet  *net.IPNet `json:"subnet"`
 	Gateway net.IP     `json:"gateway"`
 	VlanID  *int32     `json:"vlanID"`
+	MTU     int32      `json:"mtu,omitempty"`
+	// SecondaryGateways are gateways of HA setups besides Gateway
+	SecondaryGateways []net.IP `json:"secondaryGateways,omitempty"`
+}
+
+// NewIP makes the allocation result of addr reserved from pool of network
+func NewIP(network string, pool *Pool, addr net.IP) *IP {
+	p := pool.DeepCopy()
+	return &IP{
+		Network: network,
+		Pool:    p.Name,
+		IP:      copyIP(addr),
+		Subnet:  p.Subnet,
+		Gateway: p.Gateway,
+		VlanID:  p.VlanID,
+		MTU:     p.MTU,
+
+		SecondaryGateways: p.SecondaryGateways,
+	}
+}
+
+// UsingIP is an ip which has been reserved by a pod or a free-form owner
+type UsingIP struct {
+	// Name is the name of the using ip record, which depends on the name encoding scheme
+	Name         string `json:"name"`
+	IP           net.IP `json:"ip"`
+	Network      string `json:"network"`
+	Pool         string `json:"pool"`
+	PodNamespace string `json:"podNamespace"`
+	PodName      string `json:"podName"`
+	Owner        string `json:"owner"`
+	MAC          string `json:"mac,omitempty"`
+	NodeName     string `json:"nodeName,omitempty"`
+	// Metadata is opaque context of the owner, e.g. interface name or container id
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ContainerID and IfName identify the CNI attachment holding the ip
+	ContainerID string `json:"containerID,omitempty"`
+	IfName      string `json:"ifName,omitempty"`
+	// PoolGeneration is the generation of pool when ip was reserved
+	PoolGeneration int64 `json:"poolGeneration,omitempty"`
+	// Priority is the preemption priority of the owner, higher ones preempt lower ones
+	Priority int32 `json:"priority,omitempty"`
+	// Protected keeps the ip from being released unless forced
+	Protected bool `json:"protected,omitempty"`
+	// CreationTimestamp is when the using ip record was created, which is when ip was allocated
+	CreationTimestamp time.Time `json:"creationTimestamp,omitempty"`
+}
+
+// IPInfo describes everything known about an ip regardless of network
+type IPInfo struct {
+	IP net.IP `json:"ip"`
+	// Network and Pool are where the ip belongs, by its using ip record
+	// if reserved, or else by the first pool whose range contains it
+	Network string `json:"network"`
+	Pool    string `json:"pool"`
+	// UsingIP is the record of the owner, nil if the ip is free
+	UsingIP  *UsingIP `json:"usingIP"`
+	Gateway  bool     `json:"gateway"`
+	Reserved bool     `json:"reserved"`
+}
+
+// DeepCopy returns a copy of usingIP which shares no memory with it
+func (u *UsingIP) DeepCopy() *UsingIP {
+	if u == nil {
+		return nil
+	}
+
+	out := *u
+	out.IP = copyIP(u.IP)
+	out.Metadata = copyMetadata(u.Metadata)
+	return &out
+}
+
+func copyMetadata(metadata map[string]string) map[string]string {
+	if metadata == nil {
+		return nil
+	}
+	out := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		out[k] = v
+	}
+	return out
+}
+
+// GetUsingIPFromCRD can help get typed usingIP from usingIP CRD,
+// the ip is nil if the name can not be decoded
+func GetUsingIPFromCRD(ip *v1.UsingIP) *UsingIP {
+	addr, _ := utils.DecodeName(ip.Name)
+	return &UsingIP{
+		Name:              ip.Name,
+		IP:                addr,
+		Network:           ip.Spec.Network,
+		Pool:              ip.Spec.Pool,
+		PodNamespace:      ip.Spec.PodNamespace,
+		PodName:           ip.Spec.PodName,
+		Owner:             ip.Spec.Owner,
+		MAC:               ip.Spec.MAC,
+		NodeName:          ip.Spec.NodeName,
+		Metadata:          copyMetadata(ip.Spec.Metadata),
+		ContainerID:       ip.Spec.ContainerID,
+		IfName:            ip.Spec.IfName,
+		PoolGeneration:    ip.Spec.PoolGeneration,
+		Priority:          ip.Spec.Priority,
+		Protected:         ip.Spec.Protected,
+		CreationTimestamp: ip.CreationTimestamp.Time,
+	}
 }
@@ -0,0 +1,73 @@
+/*
+ Copyright 2019 Bruce Ma
+
+ Licensed under the Apache License, Version 2.0 (the "License");
+ you may not use this file except in compliance with the License.
+ You may obtain a copy of the License at
+
+     http://www.apache.org/licenses/LICENSE-2.0
+
+ Unless required by applicable law or agreed to in writing, software
+ distributed under the License is distributed on an "AS IS" BASIS,
+ WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ See the License for the specific language governing permissions and
+ limitations under the License.
+*/
+
+package types
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestNewIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	vlanID := int32(100)
+	pool := &Pool{
+		Name:    "pool",
+		Gateway: net.ParseIP("192.168.0.1"),
+		Subnet:  subnet,
+		VlanID:  &vlanID,
+		MTU:     1450,
+	}
+
+	result := NewIP("network", pool, net.ParseIP("192.168.0.10"))
+	if result.Network != "network" || result.Pool != "pool" || !result.IP.Equal(net.ParseIP("192.168.0.10")) {
+		t.Errorf("unexpected result %+v", result)
+	}
+	if result.MTU != 1450 || !result.Gateway.Equal(pool.Gateway) || result.Subnet.String() != "192.168.0.0/24" {
+		t.Errorf("unexpected interface configuration of result %+v", result)
+	}
+	if result.VlanID == nil || *result.VlanID != vlanID || result.VlanID == pool.VlanID {
+		t.Errorf("vlan id of result should be a copy of pool")
+	}
+}
+
+func TestGetUsingIPFromCRD(t *testing.T) {
+	created := time.Date(2019, 6, 1, 8, 0, 0, 0, time.UTC)
+	usingIP := GetUsingIPFromCRD(&v1.UsingIP{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:              "192-168-0-10",
+			CreationTimestamp: metav1.NewTime(created),
+		},
+		Spec: v1.UsingIPSpec{
+			Network: "network",
+			Pool:    "pool",
+			PodName: "pod",
+		},
+	})
+	if !usingIP.IP.Equal(net.ParseIP("192.168.0.10")) || usingIP.Pool != "pool" || usingIP.PodName != "pod" {
+		t.Errorf("unexpected using ip %+v", usingIP)
+	}
+	if !usingIP.CreationTimestamp.Equal(created) {
+		t.Errorf("expected creation time %s but got %s", created, usingIP.CreationTimestamp)
+	}
+	if copied := usingIP.DeepCopy(); !copied.CreationTimestamp.Equal(created) {
+		t.Errorf("creation time is lost by copy: %s", copied.CreationTimestamp)
+	}
+}
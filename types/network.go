@@ -20,58 +20,336 @@ import (
 	"fmt"
 	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
 	"net"
+	"sort"
+	"strings"
 )
 
 type Network struct {
 	Name  string  `json:"name"`
 	Pools []*Pool `json:"pools"`
+	// DefaultPool is the pool allocations without a pool name are made from, none if empty
+	DefaultPool string `json:"defaultPool,omitempty"`
+	// PoolPolicy decides the order network-scoped allocation tries pools in
+	PoolPolicy PoolPolicy `json:"poolPolicy,omitempty"`
+}
+
+// PoolPolicy decides which pools of a network are tried first by network-scoped allocation,
+// the default pool is always tried before the others
+type PoolPolicy string
+
+const (
+	// PoolPolicyWeighted tries pools of higher weight first
+	PoolPolicyWeighted PoolPolicy = ""
+	// PoolPolicyLeastUtilized tries pools of the most free ips first, which spreads ips over pools
+	PoolPolicyLeastUtilized PoolPolicy = "LeastUtilized"
+)
+
+// IsKnown checks if p is one of the defined policies
+func (p PoolPolicy) IsKnown() bool {
+	return p == PoolPolicyWeighted || p == PoolPolicyLeastUtilized
+}
+
+// DeepCopy returns a copy of network which shares no memory with it
+func (n *Network) DeepCopy() *Network {
+	if n == nil {
+		return nil
+	}
+
+	out := &Network{
+		Name:        n.Name,
+		Pools:       make([]*Pool, 0, len(n.Pools)),
+		DefaultPool: n.DefaultPool,
+		PoolPolicy:  n.PoolPolicy,
+	}
+	for _, pool := range n.Pools {
+		out.Pools = append(out.Pools, pool.DeepCopy())
+	}
+	return out
+}
+
+// FindPoolForIP returns the first pool in network which contains ip
+func (n *Network) FindPoolForIP(ip net.IP) (*Pool, bool) {
+	for _, pool := range n.Pools {
+		if pool.Contains(ip) {
+			return pool, true
+		}
+	}
+	return nil, false
+}
+
+// GetPool returns the pool in network with name, nil if there is no such pool
+func (n *Network) GetPool(name string) *Pool {
+	for _, pool := range n.Pools {
+		if pool.Name == name {
+			return pool
+		}
+	}
+	return nil
+}
+
+// PoolByName returns a copy of the pool in network with name, so that callers never
+// mutate the network through it, false if there is no such pool
+func (n *Network) PoolByName(name string) (*Pool, bool) {
+	if pool := n.GetPool(name); pool != nil {
+		return pool.DeepCopy(), true
+	}
+	return nil, false
+}
+
+// PoolsByFamily splits the pools of network by the ip family of their subnets,
+// pools without subnet are in neither
+func (n *Network) PoolsByFamily() (v4, v6 []*Pool) {
+	for _, pool := range n.Pools {
+		switch {
+		case pool.Subnet == nil:
+		case pool.Subnet.IP.To4() != nil:
+			v4 = append(v4, pool)
+		default:
+			v6 = append(v6, pool)
+		}
+	}
+	return v4, v6
+}
+
+// IsDualStack checks if network has pools of both ipv4 and ipv6
+func (n *Network) IsDualStack() bool {
+	v4, v6 := n.PoolsByFamily()
+	return len(v4) > 0 && len(v6) > 0
+}
+
+// ValidateOptions tunes the checks of ValidateWithOptions
+type ValidateOptions struct {
+	// CaseInsensitiveNames makes pool names differing only in case duplicates
+	CaseInsensitiveNames bool
+	// StrictFamilies makes a dual-stack network require pools of both ip families on each
+	// of its vlans, a vlan left with one family is usually a misconfigured pool
+	StrictFamilies bool
+}
+
+// Validate checks all pools of network, and that pool names are unique and pools
+// do not conflict with each other, all problems found are reported as an ErrorList
+func (n *Network) Validate() error {
+	return n.ValidateWithOptions(ValidateOptions{})
+}
+
+// ValidateWithOptions is Validate tuned by opts
+func (n *Network) ValidateWithOptions(opts ValidateOptions) error {
+	errs := ErrorList{}
+	names := make(map[string]bool, len(n.Pools))
+	valid := make([]*Pool, 0, len(n.Pools))
+	for _, pool := range n.Pools {
+		name := pool.Name
+		if opts.CaseInsensitiveNames {
+			name = strings.ToLower(name)
+		}
+		if names[name] {
+			errs = append(errs, fmt.Errorf("network %s has duplicate pool %s", n.Name, pool.Name))
+		}
+		names[name] = true
+
+		if err := pool.Validate(); err != nil {
+			if list, ok := err.(ErrorList); ok {
+				errs = append(errs, list...)
+			} else {
+				errs = append(errs, err)
+			}
+			continue
+		}
+
+		// only valid pools are checked for conflicts, whose ranges can be trusted
+		for _, p := range valid {
+			if pool.Overlaps(p) {
+				errs = append(errs, fmt.Errorf("pool %s overlaps pool %s in network %s", pool.Name, p.Name, n.Name))
+			}
+		}
+		valid = append(valid, pool)
+	}
+	if len(n.DefaultPool) > 0 && n.GetPool(n.DefaultPool) == nil {
+		errs = append(errs, fmt.Errorf("network %s has default pool %s which does not exist", n.Name, n.DefaultPool))
+	}
+	if !n.PoolPolicy.IsKnown() {
+		errs = append(errs, fmt.Errorf("network %s has unknown pool policy %s", n.Name, n.PoolPolicy))
+	}
+	if opts.StrictFamilies {
+		errs = append(errs, checkFamilyGroups(n.Name, valid)...)
+	}
+	return errs.ToError()
+}
+
+// checkFamilyGroups groups pools by vlan, and reports the groups of a dual-stack network
+// which hold pools of one ip family only, in order of vlans
+func checkFamilyGroups(networkName string, pools []*Pool) ErrorList {
+	type group struct {
+		v4, v6 []string
+	}
+	groups := make(map[string]*group)
+	var vlans []string
+	hasV4, hasV6 := false, false
+	for _, pool := range pools {
+		vlan := "untagged"
+		if pool.VlanID != nil {
+			vlan = fmt.Sprintf("%d", *pool.VlanID)
+		}
+		g, exists := groups[vlan]
+		if !exists {
+			g = &group{}
+			groups[vlan] = g
+			vlans = append(vlans, vlan)
+		}
+		if pool.Subnet.IP.To4() != nil {
+			g.v4, hasV4 = append(g.v4, pool.Name), true
+		} else {
+			g.v6, hasV6 = append(g.v6, pool.Name), true
+		}
+	}
+	if !hasV4 || !hasV6 {
+		return nil
+	}
+
+	errs := ErrorList{}
+	sort.Strings(vlans)
+	for _, vlan := range vlans {
+		g := groups[vlan]
+		switch {
+		case len(g.v6) == 0:
+			errs = append(errs, fmt.Errorf("network %s is dual-stack but vlan %s has ipv4 pools %s only",
+				networkName, vlan, strings.Join(g.v4, ", ")))
+		case len(g.v4) == 0:
+			errs = append(errs, fmt.Errorf("network %s is dual-stack but vlan %s has ipv6 pools %s only",
+				networkName, vlan, strings.Join(g.v6, ", ")))
+		}
+	}
+	return errs
+}
+
+// NetworkSnapshot is a consistent view of a network and its used ips
+type NetworkSnapshot struct {
+	Network *Network
+	// Used is the set of used ips of network in string form
+	Used map[string]struct{}
 }
 
 type LastReservedIP struct {
 	IP       net.IP `json:"ip"`
 	PoolName string `json:"pool"`
+	// Pools is the cursor of each pool keyed by pool name
+	Pools map[string]net.IP `json:"pools"`
+	// Network is the network the record is written for, empty for legacy records
+	Network string `json:"network,omitempty"`
 }
 
-func (l *LastReservedIP) Index(n *Network) (int, error) {
-	poolIndex := -1
-	for idx, pool := range n.Pools {
-		if pool.Name == l.PoolName {
-			poolIndex = idx
-			break
-		}
+// DeepCopy returns a copy of last reserved ip which shares no memory with it
+func (l *LastReservedIP) DeepCopy() *LastReservedIP {
+	if l == nil {
+		return nil
+	}
+
+	out := &LastReservedIP{
+		IP:       copyIP(l.IP),
+		PoolName: l.PoolName,
+		Pools:    make(map[string]net.IP, len(l.Pools)),
+		Network:  l.Network,
+	}
+	for pool, ip := range l.Pools {
+		out.Pools[pool] = copyIP(ip)
 	}
+	return out
+}
+
+// ForPool returns the last reserved ip of pool, nil if the pool has not reserved any ip
+func (l *LastReservedIP) ForPool(pool string) net.IP {
+	return l.Pools[pool]
+}
 
+func (l *LastReservedIP) Index(n *Network) (int, error) {
+	pool, ok := n.PoolByName(l.PoolName)
 	switch {
-	case poolIndex < 0:
+	case !ok:
 		return -1, fmt.Errorf("last reserved ip's pool is not in network")
-	case !n.Pools[poolIndex].Contains(l.IP):
+	case !pool.Contains(l.IP):
 		return -1, fmt.Errorf("last reserved ip is not in pool %s", l.PoolName)
 	}
-	return poolIndex, nil
+
+	for idx := range n.Pools {
+		if n.Pools[idx].Name == l.PoolName {
+			return idx, nil
+		}
+	}
+	return -1, nil
 }
 
-// GetNetworkFromCRD can help get typed network from network CRD
+// GetNetworkFromCRD can help get typed network from network CRD,
+// invalid pools are skipped so that they never hide the valid ones,
+// the network is always returned along with an ErrorList of skipped pools
 func GetNetworkFromCRD(n *v1.Network) (*Network, error) {
 	network := &Network{
-		Name:  n.Name,
-		Pools: make([]*Pool, 0),
+		Name:        n.Name,
+		Pools:       make([]*Pool, 0),
+		DefaultPool: n.Spec.DefaultPool,
+		PoolPolicy:  PoolPolicy(n.Spec.PoolPolicy),
 	}
 
+	errs := ErrorList{}
 	for _, pool := range n.Spec.Pools {
-		pl, err := GetPoolFromCRD(&pool)
+		pl, err := PoolFromCRD(pool)
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Errorf("pool %s is skipped: %v", pool.Name, err))
+			continue
 		}
 		network.Pools = append(network.Pools, pl)
 	}
 
-	return network, nil
+	return network, errs.ToError()
+}
+
+// ValidateNetworkCRD checks the fields of network CRD which are taken as is when users
+// edit it directly, e.g. for an admission webhook, the fields are reported by their json paths
+func ValidateNetworkCRD(n *v1.Network) []*FieldError {
+	var errs []*FieldError
+	defaultFound := len(n.Spec.DefaultPool) == 0
+	for i, pool := range n.Spec.Pools {
+		defaultFound = defaultFound || pool.Name == n.Spec.DefaultPool
+		// vlan 0 is untagged, see PoolFromCRD
+		if pool.VlanId != nil && *pool.VlanId != 0 && !IsValidVlanID(*pool.VlanId) {
+			errs = append(errs, &FieldError{
+				Field:  fmt.Sprintf("spec.pools[%d].vlanId", i),
+				Value:  fmt.Sprintf("%d", *pool.VlanId),
+				Reason: "must be in [1, 4094] but not in [1006, 1024]",
+			})
+		}
+	}
+	if !defaultFound {
+		errs = append(errs, &FieldError{Field: "spec.defaultPool", Value: n.Spec.DefaultPool, Reason: "names no pool of network"})
+	}
+	if !PoolPolicy(n.Spec.PoolPolicy).IsKnown() {
+		errs = append(errs, &FieldError{Field: "spec.poolPolicy", Value: n.Spec.PoolPolicy, Reason: "is unknown"})
+	}
+	return errs
 }
 
-// GetLastReservedIPFromCRD can help get typed lastReservedIP from lastReservedIP CRD
-func GetLastReservedIPFromCRD(ip *v1.LastReservedIP) *LastReservedIP {
-	return &LastReservedIP{
-		IP:       net.ParseIP(ip.Spec.IP),
+// GetLastReservedIPFromCRD can help get typed lastReservedIP from lastReservedIP CRD,
+// a legacy record without per-pool cursors is migrated as the cursor of its pool,
+// an error is returned if any ip of the record is malformed
+func GetLastReservedIPFromCRD(ip *v1.LastReservedIP) (*LastReservedIP, error) {
+	lri := &LastReservedIP{
 		PoolName: ip.Spec.PoolName,
+		Pools:    make(map[string]net.IP, len(ip.Spec.Pools)),
+		Network:  ip.Spec.Network,
+	}
+	if len(ip.Spec.IP) > 0 {
+		if lri.IP = net.ParseIP(ip.Spec.IP); lri.IP == nil {
+			return nil, fmt.Errorf("last reserved ip %s has malformed ip %q", ip.Name, ip.Spec.IP)
+		}
+	}
+	for pool, addr := range ip.Spec.Pools {
+		parsed := net.ParseIP(addr)
+		if parsed == nil {
+			return nil, fmt.Errorf("last reserved ip %s has malformed ip %q for pool %s", ip.Name, addr, pool)
+		}
+		lri.Pools[pool] = parsed
+	}
+	if len(ip.Spec.Pools) == 0 && len(lri.PoolName) > 0 && lri.IP != nil {
+		lri.Pools[lri.PoolName] = lri.IP
 	}
+	return lri, nil
 }
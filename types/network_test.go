@@ -18,7 +18,12 @@ package types
 
 import (
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestLastReservedIP_Index(t *testing.T) {
@@ -85,3 +90,398 @@ func TestLastReservedIP_Index(t *testing.T) {
 		}
 	}
 }
+
+func TestNetwork_FindPoolForIP(t *testing.T) {
+	_, subnet1, _ := net.ParseCIDR("192.168.0.0/24")
+	_, subnet2, _ := net.ParseCIDR("192.168.1.0/24")
+	network := &Network{
+		Pools: []*Pool{
+			{
+				Name:      "pool1",
+				PoolStart: net.ParseIP("192.168.0.10"),
+				PoolEnd:   net.ParseIP("192.168.0.100"),
+				Subnet:    subnet1,
+			},
+			{
+				Name:      "pool2",
+				PoolStart: net.ParseIP("192.168.0.101"),
+				PoolEnd:   net.ParseIP("192.168.0.200"),
+				Subnet:    subnet1,
+			},
+			{
+				Name:   "pool3",
+				Subnet: subnet2,
+			},
+		},
+	}
+
+	tests := []struct {
+		ip    net.IP
+		pool  string
+		found bool
+	}{
+		{net.ParseIP("192.168.0.10"), "pool1", true},
+		{net.ParseIP("192.168.0.150"), "pool2", true},
+		{net.ParseIP("192.168.1.1"), "pool3", true},
+		{net.ParseIP("192.168.0.250"), "", false},
+		{net.ParseIP("10.0.0.1"), "", false},
+	}
+
+	for _, test := range tests {
+		pool, found := network.FindPoolForIP(test.ip)
+		if found != test.found {
+			t.Errorf("ip %s expects found %v but got %v", test.ip, test.found, found)
+			continue
+		}
+		if found && pool.Name != test.pool {
+			t.Errorf("ip %s expects pool %s but got %s", test.ip, test.pool, pool.Name)
+		}
+	}
+}
+
+func TestNetwork_DeepCopy(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	vlanID := int32(10)
+	network := &Network{
+		Name: "network",
+		Pools: []*Pool{
+			{
+				Name:      "pool",
+				PoolStart: net.ParseIP("192.168.0.10"),
+				PoolEnd:   net.ParseIP("192.168.0.100"),
+				Gateway:   net.ParseIP("192.168.0.1"),
+				Subnet:    subnet,
+				VlanID:    &vlanID,
+			},
+		},
+	}
+
+	clone := network.DeepCopy()
+	clone.Pools[0].PoolStart[15] = 20
+	clone.Pools[0].Subnet.IP[2] = 1
+	*clone.Pools[0].VlanID = 20
+
+	pool := network.Pools[0]
+	if !pool.PoolStart.Equal(net.ParseIP("192.168.0.10")) || !pool.Subnet.IP.Equal(net.ParseIP("192.168.0.0")) || *pool.VlanID != 10 {
+		t.Errorf("original network is mutated by its copy: %+v", pool)
+	}
+}
+
+func TestGetNetworkFromCRD(t *testing.T) {
+	network, err := GetNetworkFromCRD(&v1.Network{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "network",
+		},
+		Spec: v1.NetworkSpec{
+			Pools: []v1.Pool{
+				{
+					Name:        "good",
+					Gateway:     "192.168.0.1",
+					Subnet:      "192.168.0.0/24",
+					Description: "pods of team a",
+				},
+				{
+					Name:    "malformed",
+					Gateway: "192.168.1.1",
+					Subnet:  "192.168.1.0/33",
+				},
+			},
+		},
+	})
+
+	errs, ok := err.(ErrorList)
+	if !ok || len(errs) != 1 {
+		t.Errorf("expected one pool error but got %v", err)
+	}
+	if network == nil || len(network.Pools) != 1 || network.Pools[0].Name != "good" {
+		t.Fatalf("expected network with the good pool only but got %+v", network)
+	}
+	if pool := network.GetPool("good"); pool == nil || pool.Description != "pods of team a" {
+		t.Errorf("expected description of pool good carried over but got %+v", pool)
+	}
+}
+
+func TestValidateNetworkCRD(t *testing.T) {
+	vlan := func(id int32) *int32 { return &id }
+	tests := []struct {
+		name   string
+		vlanID *int32
+		field  string
+	}{
+		{"untagged", nil, ""},
+		{"valid", vlan(100), ""},
+		{"reserved", vlan(1010), "spec.pools[1].vlanId"},
+		{"zero as untagged", vlan(0), ""},
+		{"negative", vlan(-1), "spec.pools[1].vlanId"},
+		{"too large", vlan(4095), "spec.pools[1].vlanId"},
+	}
+	for _, test := range tests {
+		errs := ValidateNetworkCRD(&v1.Network{
+			Spec: v1.NetworkSpec{
+				Pools: []v1.Pool{
+					{Name: "good", VlanId: vlan(200)},
+					{Name: "pool", VlanId: test.vlanID},
+				},
+			},
+		})
+		switch {
+		case len(test.field) == 0 && len(errs) != 0:
+			t.Errorf("test %s fails: expected no error but got %v", test.name, errs)
+		case len(test.field) > 0 && (len(errs) != 1 || errs[0].Field != test.field):
+			t.Errorf("test %s fails: expected an error of %s but got %v", test.name, test.field, errs)
+		}
+	}
+
+	for defaultPool, valid := range map[string]bool{"": true, "good": true, "missing": false} {
+		errs := ValidateNetworkCRD(&v1.Network{
+			Spec: v1.NetworkSpec{Pools: []v1.Pool{{Name: "good"}}, DefaultPool: defaultPool},
+		})
+		if valid && len(errs) != 0 || !valid && (len(errs) != 1 || errs[0].Field != "spec.defaultPool") {
+			t.Errorf("test default pool %q fails: expected valid %v but got %v", defaultPool, valid, errs)
+		}
+	}
+	for policy, valid := range map[string]bool{"": true, "LeastUtilized": true, "leastUtilized": false} {
+		errs := ValidateNetworkCRD(&v1.Network{Spec: v1.NetworkSpec{PoolPolicy: policy}})
+		if valid && len(errs) != 0 || !valid && (len(errs) != 1 || errs[0].Field != "spec.poolPolicy") {
+			t.Errorf("test pool policy %q fails: expected valid %v but got %v", policy, valid, errs)
+		}
+	}
+}
+
+func TestGetLastReservedIPFromCRD(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     v1.LastReservedIPSpec
+		expected map[string]string
+	}{
+		{
+			name:     "legacy record",
+			spec:     v1.LastReservedIPSpec{IP: "192.168.0.10", PoolName: "pool1"},
+			expected: map[string]string{"pool1": "192.168.0.10"},
+		},
+		{
+			name: "per-pool record",
+			spec: v1.LastReservedIPSpec{IP: "192.168.1.10", PoolName: "pool2", Pools: map[string]string{
+				"pool1": "192.168.0.10",
+				"pool2": "192.168.1.10",
+			}},
+			expected: map[string]string{"pool1": "192.168.0.10", "pool2": "192.168.1.10"},
+		},
+		{
+			name:     "empty record",
+			spec:     v1.LastReservedIPSpec{},
+			expected: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		lri, err := GetLastReservedIPFromCRD(&v1.LastReservedIP{Spec: test.spec})
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if len(lri.Pools) != len(test.expected) {
+			t.Errorf("test %s fails: expected cursors %v but got %v", test.name, test.expected, lri.Pools)
+			continue
+		}
+		for pool, ip := range test.expected {
+			if !lri.ForPool(pool).Equal(net.ParseIP(ip)) {
+				t.Errorf("test %s fails: expected cursor %s of pool %s but got %s", test.name, ip, pool, lri.ForPool(pool))
+			}
+		}
+	}
+}
+
+func TestGetLastReservedIPFromCRDMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		spec v1.LastReservedIPSpec
+	}{
+		{"malformed legacy ip", v1.LastReservedIPSpec{IP: "192.168.0.300", PoolName: "pool1"}},
+		{"malformed cursor", v1.LastReservedIPSpec{IP: "192.168.0.10", PoolName: "pool1", Pools: map[string]string{
+			"pool1": "192.168.0.10",
+			"pool2": "not an ip",
+		}}},
+	}
+	for _, test := range tests {
+		lri, err := GetLastReservedIPFromCRD(&v1.LastReservedIP{ObjectMeta: metav1.ObjectMeta{Name: "network"}, Spec: test.spec})
+		if err == nil || lri != nil {
+			t.Errorf("test %s fails: expected the record rejected but got %+v %v", test.name, lri, err)
+		}
+	}
+}
+
+func TestNetwork_PoolByName(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	network := &Network{
+		Name: "network",
+		Pools: []*Pool{
+			{Name: "pool1", Subnet: subnet, Gateway: net.ParseIP("192.168.0.1")},
+			{Name: "pool2", Subnet: subnet, Gateway: net.ParseIP("192.168.0.1")},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		found bool
+	}{
+		{"pool1", true},
+		{"pool2", true},
+		{"pool3", false},
+	}
+	for _, test := range tests {
+		pool, ok := network.PoolByName(test.name)
+		if ok != test.found || ok && pool.Name != test.name || !ok && pool != nil {
+			t.Errorf("test %s fails: expected found %v but got %+v %v", test.name, test.found, pool, ok)
+		}
+	}
+
+	pool, _ := network.PoolByName("pool1")
+	pool.Disabled = true
+	pool.Gateway[len(pool.Gateway)-1] = 254
+	if network.Pools[0].Disabled || !network.Pools[0].Gateway.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("pool returned should be a copy, network is mutated to %+v", network.Pools[0])
+	}
+}
+
+func TestNetwork_Validate(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(name, start, end string) *Pool {
+		return &Pool{
+			Name:      name,
+			PoolStart: net.ParseIP(start),
+			PoolEnd:   net.ParseIP(end),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		pools   []*Pool
+		opts    ValidateOptions
+		errors  int
+		message string
+	}{
+		{"valid", []*Pool{newPool("pool1", "192.168.0.10", "192.168.0.20"), newPool("pool2", "192.168.0.30", "192.168.0.40")}, ValidateOptions{}, 0, ""},
+		{"duplicate names", []*Pool{newPool("pool", "192.168.0.10", "192.168.0.20"), newPool("pool", "192.168.0.30", "192.168.0.40")}, ValidateOptions{}, 1, "duplicate pool pool"},
+		{"overlapping", []*Pool{newPool("pool1", "192.168.0.10", "192.168.0.20"), newPool("pool2", "192.168.0.15", "192.168.0.40")}, ValidateOptions{}, 1, "pool pool2 overlaps pool pool1"},
+		{"overlapping defaults", []*Pool{newPool("pool1", "192.168.0.10", "192.168.0.20"), newPool("pool2", "", "")}, ValidateOptions{}, 1, "pool pool2 overlaps pool pool1"},
+		{"invalid pool", []*Pool{newPool("pool1", "192.168.0.10", "192.168.0.20"), newPool("pool2", "192.168.0.30", "192.168.1.20")}, ValidateOptions{}, 1, "poolEnd 192.168.1.20 is not in subnet"},
+		{"case-variant names", []*Pool{newPool("prod", "192.168.0.10", "192.168.0.20"), newPool("Prod", "192.168.0.30", "192.168.0.40")}, ValidateOptions{}, 1, "is not a valid DNS-1123 label"},
+		{"case-variant names insensitive", []*Pool{newPool("prod", "192.168.0.10", "192.168.0.20"), newPool("Prod", "192.168.0.30", "192.168.0.40")}, ValidateOptions{CaseInsensitiveNames: true}, 2, "duplicate pool Prod"},
+	}
+	for _, test := range tests {
+		network := &Network{Name: "network", Pools: test.pools}
+		err := network.ValidateWithOptions(test.opts)
+		if test.errors == 0 {
+			if err != nil {
+				t.Errorf("test %s fails: %v", test.name, err)
+			}
+			continue
+		}
+		errs, ok := err.(ErrorList)
+		if !ok || len(errs) != test.errors || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("test %s fails: expected %d errors with %q but got %v", test.name, test.errors, test.message, err)
+		}
+	}
+
+	network := &Network{Name: "network", Pools: []*Pool{newPool("pool1", "192.168.0.10", "192.168.0.20")}, DefaultPool: "pool1"}
+	if err := network.Validate(); err != nil {
+		t.Errorf("default pool of network should be valid: %v", err)
+	}
+	network.DefaultPool = "pool2"
+	if err := network.Validate(); err == nil || !strings.Contains(err.Error(), "default pool pool2 which does not exist") {
+		t.Errorf("missing default pool should be rejected but got %v", err)
+	}
+	network.DefaultPool, network.PoolPolicy = "", "MostUtilized"
+	if err := network.Validate(); err == nil || !strings.Contains(err.Error(), "unknown pool policy MostUtilized") {
+		t.Errorf("unknown pool policy should be rejected but got %v", err)
+	}
+}
+
+func TestNetwork_PoolsByFamily(t *testing.T) {
+	newPool := func(name, subnet string) *Pool {
+		_, ipNet, _ := net.ParseCIDR(subnet)
+		return &Pool{Name: name, Subnet: ipNet}
+	}
+
+	tests := []struct {
+		name      string
+		pools     []*Pool
+		v4, v6    []string
+		dualStack bool
+	}{
+		{"empty", nil, nil, nil, false},
+		{"ipv4 only", []*Pool{newPool("a", "192.168.0.0/24"), newPool("b", "10.0.0.0/8")}, []string{"a", "b"}, nil, false},
+		{"ipv6 only", []*Pool{newPool("a", "fd00::/64")}, nil, []string{"a"}, false},
+		{"mixed", []*Pool{newPool("a", "fd00::/64"), newPool("b", "192.168.0.0/24"), newPool("c", "fd00:1::/64")},
+			[]string{"b"}, []string{"a", "c"}, true},
+		{"without subnet", []*Pool{newPool("a", "192.168.0.0/24"), {Name: "b"}}, []string{"a"}, nil, false},
+	}
+	names := func(pools []*Pool) []string {
+		var result []string
+		for _, pool := range pools {
+			result = append(result, pool.Name)
+		}
+		return result
+	}
+	for _, test := range tests {
+		network := &Network{Name: "network", Pools: test.pools}
+		v4, v6 := network.PoolsByFamily()
+		if !reflect.DeepEqual(names(v4), test.v4) || !reflect.DeepEqual(names(v6), test.v6) {
+			t.Errorf("test %s fails: expected %v %v but got %v %v", test.name, test.v4, test.v6, names(v4), names(v6))
+		}
+		if dualStack := network.IsDualStack(); dualStack != test.dualStack {
+			t.Errorf("test %s fails: expected dual-stack %v but got %v", test.name, test.dualStack, dualStack)
+		}
+	}
+}
+
+func TestNetwork_ValidateStrictFamilies(t *testing.T) {
+	newPool := func(name, subnet, gateway string, vlanID int32) *Pool {
+		_, ipNet, _ := net.ParseCIDR(subnet)
+		pool := &Pool{Name: name, Gateway: net.ParseIP(gateway), Subnet: ipNet}
+		if vlanID != 0 {
+			pool.VlanID = &vlanID
+		}
+		return pool
+	}
+
+	tests := []struct {
+		name    string
+		pools   []*Pool
+		errors  int
+		message string
+	}{
+		{"single stack", []*Pool{newPool("v4-a", "192.168.0.0/24", "192.168.0.1", 10), newPool("v4-b", "192.168.1.0/24", "192.168.1.1", 20)}, 0, ""},
+		{"clean dual stack", []*Pool{
+			newPool("v4-a", "192.168.0.0/24", "192.168.0.1", 10), newPool("v6-a", "fd00:a::/64", "fd00:a::1", 10),
+			newPool("v4-b", "192.168.1.0/24", "192.168.1.1", 20), newPool("v6-b", "fd00:b::/64", "fd00:b::1", 20),
+		}, 0, ""},
+		{"clean untagged dual stack", []*Pool{newPool("v4", "192.168.0.0/24", "192.168.0.1", 0), newPool("v6", "fd00::/64", "fd00::1", 0)}, 0, ""},
+		{"vlan with ipv6 only", []*Pool{
+			newPool("v4-a", "192.168.0.0/24", "192.168.0.1", 10), newPool("v6-a", "fd00:a::/64", "fd00:a::1", 10),
+			newPool("v6-b", "fd00:b::/64", "fd00:b::1", 20),
+		}, 1, "vlan 20 has ipv6 pools v6-b only"},
+		{"pool on the wrong vlan", []*Pool{
+			newPool("v4-a", "192.168.0.0/24", "192.168.0.1", 10), newPool("v6-a", "fd00:a::/64", "fd00:a::1", 11),
+		}, 2, "vlan 10 has ipv4 pools v4-a only"},
+	}
+	for _, test := range tests {
+		network := &Network{Name: "network", Pools: test.pools}
+		if err := network.Validate(); err != nil {
+			t.Errorf("test %s fails: expected valid without strict mode but got %v", test.name, err)
+		}
+		err := network.ValidateWithOptions(ValidateOptions{StrictFamilies: true})
+		if test.errors == 0 {
+			if err != nil {
+				t.Errorf("test %s fails: %v", test.name, err)
+			}
+			continue
+		}
+		errs, ok := err.(ErrorList)
+		if !ok || len(errs) != test.errors || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("test %s fails: expected %d errors with %q but got %v", test.name, test.errors, test.message, err)
+		}
+	}
+}
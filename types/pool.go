@@ -17,102 +17,463 @@
 package types
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
+	"math"
+	"math/big"
+	"math/rand"
 	"net"
+	"sort"
 
 	"github.com/containernetworking/plugins/pkg/ip"
 	resourcev1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
+	"github.com/mars1024/kube-ipam/pkg/utils"
+	"k8s.io/apimachinery/pkg/util/validation"
 )
 
+// AllocationStrategy decides how candidate ips of a pool are picked
+type AllocationStrategy string
+
+const (
+	// StrategySequential picks ips one by one after the last reserved ip
+	StrategySequential AllocationStrategy = ""
+	// StrategyStableHash picks the ip hashed from owner identity first and
+	// falls back to sequential on collision, which is only for ipv6 pools
+	StrategyStableHash AllocationStrategy = "StableHash"
+	// StrategyRandom picks a random ip first and falls back to sequential on collision
+	StrategyRandom AllocationStrategy = "Random"
+)
+
+// UsesLastReservedIP tells if the strategy starts scanning after the last reserved ip,
+// the last reserved ip is not worth recording for the strategies which do not
+func (s AllocationStrategy) UsesLastReservedIP() bool {
+	return s != StrategyStableHash && s != StrategyRandom
+}
+
 type Pool struct {
-	Name      string     `json:"name"`
-	PoolStart net.IP     `json:"poolStart"`
-	PoolEnd   net.IP     `json:"poolEnd"`
-	Gateway   net.IP     `json:"gateway"`
-	Subnet    *net.IPNet `json:"subnet"`
-	VlanID    *int32     `json:"vlanID"`
+	Name      string             `json:"name"`
+	PoolStart net.IP             `json:"poolStart"`
+	PoolEnd   net.IP             `json:"poolEnd"`
+	Gateway   net.IP             `json:"gateway"`
+	Subnet    *net.IPNet         `json:"subnet"`
+	VlanID    *int32             `json:"vlanID"`
+	Weight    int32              `json:"weight"`
+	Strategy  AllocationStrategy `json:"strategy"`
+	// ReserveFirst and ReserveLast are counts of usable ips at the head
+	// and tail of subnet which are never allocated
+	ReserveFirst int32 `json:"reserveFirst"`
+	ReserveLast  int32 `json:"reserveLast"`
+	// MTU is the mtu of interfaces configured with ips of pool, unset if zero
+	MTU int32 `json:"mtu"`
+	// SecondaryGateways are gateways of HA setups besides Gateway, which is the primary one
+	SecondaryGateways []net.IP `json:"secondaryGateways"`
+	// Disabled stops new allocations from pool, the ips in use are kept
+	Disabled bool `json:"disabled"`
+	// PointToPoint makes a /31 or /127 subnet allocate both of its ips as in RFC 3021
+	// and RFC 6164, the gateway is optional for such pools
+	PointToPoint bool `json:"pointToPoint"`
+	// Descending makes allocation scan from the end of range down to its start, e.g. for two
+	// consumers of one subnet to allocate from both ends without colliding during a migration
+	Descending bool `json:"descending,omitempty"`
+	// AllowGatewayAllocation lets gateways be reserved explicitly for infra designs where the
+	// gateway is itself a pod, e.g. a router pod, while Allocate still never picks them
+	AllowGatewayAllocation bool `json:"allowGatewayAllocation,omitempty"`
+	// ExclusiveOwner leases the whole pool to one tenant, which is either the owner of using ips
+	// or the namespace of pods, no one else can allocate from pool while it is set
+	ExclusiveOwner string `json:"exclusiveOwner,omitempty"`
+	// Labels group pools for selection, e.g. by rack or zone, keys and values follow the
+	// syntax of kubernetes labels but they are not labels of any object
+	Labels map[string]string `json:"labels,omitempty"`
+	// Description tells humans what pool is for, e.g. its purpose and owner team,
+	// it never affects allocation
+	Description string `json:"description,omitempty"`
+	// Generation is bumped when pool is recreated with the same name, using ips stamped
+	// with an earlier generation belong to the old pool, see ReleaseStaleGeneration of store
+	Generation int64 `json:"generation,omitempty"`
+}
+
+const (
+	// MinMTU is the minimum mtu of a pool, which is the minimum ipv4 datagram size
+	MinMTU = 576
+	// MaxMTU is the maximum mtu of a pool, which is a common jumbo frame size
+	MaxMTU = 9216
+)
+
+// DeepCopy returns a copy of pool which shares no memory with it
+func (p *Pool) DeepCopy() *Pool {
+	if p == nil {
+		return nil
+	}
+
+	out := &Pool{
+		Name:      p.Name,
+		PoolStart: copyIP(p.PoolStart),
+		PoolEnd:   copyIP(p.PoolEnd),
+		Gateway:   copyIP(p.Gateway),
+		Weight:    p.Weight,
+		Strategy:  p.Strategy,
+
+		ReserveFirst: p.ReserveFirst,
+		ReserveLast:  p.ReserveLast,
+		MTU:          p.MTU,
+		Disabled:     p.Disabled,
+		PointToPoint: p.PointToPoint,
+		Descending:   p.Descending,
+
+		AllowGatewayAllocation: p.AllowGatewayAllocation,
+		ExclusiveOwner:         p.ExclusiveOwner,
+		Labels:                 copyMetadata(p.Labels),
+		Description:            p.Description,
+		Generation:             p.Generation,
+	}
+	if p.Subnet != nil {
+		out.Subnet = &net.IPNet{
+			IP:   copyIP(p.Subnet.IP),
+			Mask: append(net.IPMask(nil), p.Subnet.Mask...),
+		}
+	}
+	if p.VlanID != nil {
+		vlanID := *p.VlanID
+		out.VlanID = &vlanID
+	}
+	for _, gateway := range p.SecondaryGateways {
+		out.SecondaryGateways = append(out.SecondaryGateways, copyIP(gateway))
+	}
+	return out
+}
+
+// Equal checks if pool is identical to other in all fields
+func (p *Pool) Equal(other *Pool) bool {
+	if p == nil || other == nil {
+		return p == other
+	}
+	return len(p.Diff(other)) == 0
+}
+
+// MatchesLabels checks if pool has all labels of selector, an empty selector matches every pool
+func (p *Pool) MatchesLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if got, ok := p.Labels[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// labelsEqual checks if two label sets are identical, nil and empty are the same
+func labelsEqual(a, b map[string]string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, value := range a {
+		if got, ok := b[key]; !ok || got != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Diff returns json names of the fields in which pool differs from other
+func (p *Pool) Diff(other *Pool) []string {
+	var fields []string
+	if p.Name != other.Name {
+		fields = append(fields, "name")
+	}
+	if !p.PoolStart.Equal(other.PoolStart) {
+		fields = append(fields, "poolStart")
+	}
+	if !p.PoolEnd.Equal(other.PoolEnd) {
+		fields = append(fields, "poolEnd")
+	}
+	if !p.Gateway.Equal(other.Gateway) {
+		fields = append(fields, "gateway")
+	}
+	if !subnetEqual(p.Subnet, other.Subnet) {
+		fields = append(fields, "subnet")
+	}
+	if !vlanEqual(p.VlanID, other.VlanID) {
+		fields = append(fields, "vlanID")
+	}
+	if p.Weight != other.Weight {
+		fields = append(fields, "weight")
+	}
+	if p.Strategy != other.Strategy {
+		fields = append(fields, "strategy")
+	}
+	if p.ReserveFirst != other.ReserveFirst {
+		fields = append(fields, "reserveFirst")
+	}
+	if p.ReserveLast != other.ReserveLast {
+		fields = append(fields, "reserveLast")
+	}
+	if p.MTU != other.MTU {
+		fields = append(fields, "mtu")
+	}
+	if !ipsEqual(p.SecondaryGateways, other.SecondaryGateways) {
+		fields = append(fields, "secondaryGateways")
+	}
+	if p.Disabled != other.Disabled {
+		fields = append(fields, "disabled")
+	}
+	if p.PointToPoint != other.PointToPoint {
+		fields = append(fields, "pointToPoint")
+	}
+	if p.Descending != other.Descending {
+		fields = append(fields, "descending")
+	}
+	if p.AllowGatewayAllocation != other.AllowGatewayAllocation {
+		fields = append(fields, "allowGatewayAllocation")
+	}
+	if p.ExclusiveOwner != other.ExclusiveOwner {
+		fields = append(fields, "exclusiveOwner")
+	}
+	if !labelsEqual(p.Labels, other.Labels) {
+		fields = append(fields, "labels")
+	}
+	if p.Description != other.Description {
+		fields = append(fields, "description")
+	}
+	if p.Generation != other.Generation {
+		fields = append(fields, "generation")
+	}
+	return fields
+}
+
+func subnetEqual(a, b *net.IPNet) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
+
+func ipsEqual(a, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func vlanEqual(a, b *int32) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// CanonicalizeOptions tunes CanonicalizeWithOptions
+type CanonicalizeOptions struct {
+	// MaskHostBits masks a subnet written with host bits set, e.g. 192.168.0.5/24, to its network
+	// address instead of rejecting it, which is almost always what users mean
+	MaskHostBits bool
 }
 
 // Canonicalize takes a given pool and ensures that all information is consistent,
-// filling out Start, End, and Gateway with sane values if missing
+// filling out Start, End, and Gateway with sane values if missing. It is idempotent, a pool
+// canonicalized already is validated again and left as is, and it is left untouched on error.
 func (p *Pool) Canonicalize() error {
-	if err := p.Validate(); err != nil {
+	return p.CanonicalizeWithOptions(CanonicalizeOptions{})
+}
+
+// CanonicalizeWithOptions is Canonicalize tuned by opts
+func (p *Pool) CanonicalizeWithOptions(opts CanonicalizeOptions) error {
+	// fields are only replaced, never modified in place, so that a shallow copy keeps p intact on error
+	canonical := *p
+	if opts.MaskHostBits && canonical.Subnet != nil {
+		if networkIP := canonical.Subnet.IP.Mask(canonical.Subnet.Mask); networkIP != nil {
+			canonical.Subnet = &net.IPNet{IP: networkIP, Mask: canonical.Subnet.Mask}
+		}
+	}
+	if err := canonical.Validate(); err != nil {
 		return err
 	}
 
-	if p.PoolStart == nil {
-		p.PoolStart = ip.NextIP(p.Subnet.IP)
+	first, last := canonical.subnetBounds()
+	if canonical.PoolStart == nil {
+		canonical.PoolStart = first
 	}
-	if p.PoolEnd == nil {
-		p.PoolEnd = lastIP(p.Subnet)
+	if canonical.PoolEnd == nil {
+		canonical.PoolEnd = last
 	}
 
+	*p = canonical
 	return nil
 }
 
-// Validate can ensure that all necessary information are valid
+// Validate can ensure that all necessary information are valid,
+// all problems found are reported together as an ErrorList,
+// each of which is prefixed with the pool name and subnet
 func (p *Pool) Validate() error {
+	fieldErrs := p.ValidateFields()
+	if len(fieldErrs) == 0 {
+		return nil
+	}
+
+	subnet := "<nil>"
+	if p.Subnet != nil {
+		subnet = p.Subnet.String()
+	}
+	errs := make(ErrorList, 0, len(fieldErrs))
+	for _, fieldErr := range fieldErrs {
+		errs = append(errs, fmt.Errorf("pool %s (%s): %v", p.Name, subnet, fieldErr))
+	}
+	return errs
+}
+
+// ValidateFields works like Validate, and reports problems tagged with their fields
+func (p *Pool) ValidateFields() []*FieldError {
+	var errs []*FieldError
+
 	// Basic validations
-	switch {
-	case len(p.Name) == 0:
-		return fmt.Errorf("pool name %s can not be empty", p.Name)
-	case p.VlanID != nil && (*p.VlanID <= 0 || (*p.VlanID > 1005 && *p.VlanID < 1025) || *p.VlanID > 4094):
-		return fmt.Errorf("pool vlanID %d is invalid", *p.VlanID)
-	case p.Gateway == nil:
-		return fmt.Errorf("pool gateway is invalid")
-	case p.Subnet == nil:
-		return fmt.Errorf("pool subnet is invalid")
+	if len(p.Name) == 0 {
+		errs = append(errs, &FieldError{Field: "name", Reason: "can not be empty"})
+	} else if !utils.IsKubeName(p.Name) {
+		errs = append(errs, &FieldError{Field: "name", Value: p.Name, Reason: "is not a valid DNS-1123 label"})
+	}
+	if p.VlanID != nil && !IsValidVlanID(*p.VlanID) {
+		errs = append(errs, &FieldError{Field: "vlanID", Value: fmt.Sprintf("%d", *p.VlanID), Reason: "is invalid"})
+	}
+	if p.Weight < 0 {
+		errs = append(errs, &FieldError{Field: "weight", Value: fmt.Sprintf("%d", p.Weight), Reason: "can not be negative"})
+	}
+	if p.Generation < 0 {
+		errs = append(errs, &FieldError{Field: "generation", Value: fmt.Sprintf("%d", p.Generation), Reason: "can not be negative"})
+	}
+	if p.ReserveFirst < 0 {
+		errs = append(errs, &FieldError{Field: "reserveFirst", Value: fmt.Sprintf("%d", p.ReserveFirst), Reason: "can not be negative"})
+	}
+	if p.ReserveLast < 0 {
+		errs = append(errs, &FieldError{Field: "reserveLast", Value: fmt.Sprintf("%d", p.ReserveLast), Reason: "can not be negative"})
+	}
+	if p.MTU != 0 && (p.MTU < MinMTU || p.MTU > MaxMTU) {
+		errs = append(errs, &FieldError{Field: "mtu", Value: fmt.Sprintf("%d", p.MTU),
+			Reason: fmt.Sprintf("is out of range [%d, %d]", MinMTU, MaxMTU)})
+	}
+	for key, value := range p.Labels {
+		if msgs := validation.IsQualifiedName(key); len(msgs) > 0 {
+			errs = append(errs, &FieldError{Field: "labels", Value: key, Reason: "is not a valid label key"})
+		}
+		if msgs := validation.IsValidLabelValue(value); len(msgs) > 0 {
+			errs = append(errs, &FieldError{Field: "labels", Value: value, Reason: "is not a valid label value"})
+		}
+	}
+	if p.Gateway == nil && !p.PointToPoint {
+		errs = append(errs, &FieldError{Field: "gateway", Reason: "is invalid"})
+	}
+	if p.Subnet == nil {
+		return append(errs, &FieldError{Field: "subnet", Reason: "is invalid"})
 	}
 
 	// Enhanced validations
-	if err := canonicalizeIP(&p.Subnet.IP); err != nil {
-		return err
+	subnet, err := canonicalizeSubnet(p.Subnet)
+	if err != nil {
+		return append(errs, &FieldError{Field: "subnet", Value: p.Subnet.String(), Reason: err.Error()})
+	}
+	p.Subnet = subnet
+
+	if len(p.Subnet.IP) != len(p.Subnet.Mask) {
+		return append(errs, &FieldError{Field: "subnet", Value: p.Subnet.String(), Reason: "has mismatched IP and Mask versions"})
 	}
 
 	// Can't create an allocator for a network with no addresses
 	ones, masklen := p.Subnet.Mask.Size()
-	if ones > masklen-2 {
-		return fmt.Errorf("pool subnet %s too small to allocate from", p.Subnet.String())
+	switch {
+	case p.PointToPoint && ones != masklen-1:
+		errs = append(errs, &FieldError{Field: "pointToPoint", Value: p.Subnet.String(), Reason: "is only for /31 and /127 subnets"})
+	case !p.PointToPoint && ones > masklen-2:
+		errs = append(errs, &FieldError{Field: "subnet", Value: p.Subnet.String(), Reason: "is too small to allocate from"})
 	}
 
-	if len(p.Subnet.IP) != len(p.Subnet.Mask) {
-		return fmt.Errorf("pool subnet %s IP and Mask version mismatch", p.Subnet.String())
+	switch p.Strategy {
+	case StrategySequential, StrategyRandom:
+	case StrategyStableHash:
+		if p.Subnet.IP.To4() != nil {
+			errs = append(errs, &FieldError{Field: "strategy", Value: string(p.Strategy), Reason: "is only for ipv6 subnets"})
+		}
+	default:
+		errs = append(errs, &FieldError{Field: "strategy", Value: string(p.Strategy), Reason: "is unknown"})
 	}
 
 	// Ensure Subnet IP is the network address, not some other address
 	networkIP := p.Subnet.IP.Mask(p.Subnet.Mask)
 	if !p.Subnet.IP.Equal(networkIP) {
-		return fmt.Errorf("pool subnet has host bits set because a subnet mask of length %d the network address is %s", ones, networkIP.String())
+		errs = append(errs, &FieldError{Field: "subnet", Value: p.Subnet.String(),
+			Reason: fmt.Sprintf("has host bits set, the network address is %s", networkIP)})
 	}
 
 	// Gateway must in subnet
-	if !p.Subnet.Contains(p.Gateway) {
-		return fmt.Errorf("gateway %s not in subnet %s", p.Gateway.String(), p.Subnet.String())
+	if p.Gateway != nil {
+		if reason := familyMismatch(p.Gateway, p.Subnet); len(reason) > 0 {
+			errs = append(errs, &FieldError{Field: "gateway", Value: p.Gateway.String(), Reason: reason})
+		} else if !p.Subnet.Contains(p.Gateway) {
+			errs = append(errs, &FieldError{Field: "gateway", Value: p.Gateway.String(), Reason: "is not in subnet"})
+		}
+	}
+
+	// Secondary gateways must in subnet and distinct from all other gateways
+	seen := map[string]bool{p.Gateway.String(): p.Gateway != nil}
+	for _, gateway := range p.SecondaryGateways {
+		switch {
+		case gateway == nil:
+			errs = append(errs, &FieldError{Field: "secondaryGateways", Reason: "has an invalid gateway"})
+		case len(familyMismatch(gateway, p.Subnet)) > 0:
+			errs = append(errs, &FieldError{Field: "secondaryGateways", Value: gateway.String(), Reason: familyMismatch(gateway, p.Subnet)})
+		case !p.Subnet.Contains(gateway):
+			errs = append(errs, &FieldError{Field: "secondaryGateways", Value: gateway.String(), Reason: "is not in subnet"})
+		case seen[gateway.String()]:
+			errs = append(errs, &FieldError{Field: "secondaryGateways", Value: gateway.String(), Reason: "is duplicate"})
+		default:
+			seen[gateway.String()] = true
+		}
 	}
 
 	// PoolStart must in subnet
 	if p.PoolStart != nil {
 		if err := canonicalizeIP(&p.PoolStart); err != nil {
-			return err
-		}
-
-		if !p.Contains(p.PoolStart) {
-			return fmt.Errorf("poolStart %s not in subnet %s", p.PoolStart.String(), p.Subnet.String())
+			errs = append(errs, &FieldError{Field: "poolStart", Value: p.PoolStart.String(), Reason: err.Error()})
+		} else if reason := familyMismatch(p.PoolStart, p.Subnet); len(reason) > 0 {
+			errs = append(errs, &FieldError{Field: "poolStart", Value: p.PoolStart.String(), Reason: reason})
+		} else if !p.Contains(p.PoolStart) {
+			errs = append(errs, &FieldError{Field: "poolStart", Value: p.PoolStart.String(), Reason: "is not in subnet"})
 		}
 	}
 
-	// PoolStart must in subnet
+	// PoolEnd must in subnet
 	if p.PoolEnd != nil {
 		if err := canonicalizeIP(&p.PoolEnd); err != nil {
-			return err
+			errs = append(errs, &FieldError{Field: "poolEnd", Value: p.PoolEnd.String(), Reason: err.Error()})
+		} else if reason := familyMismatch(p.PoolEnd, p.Subnet); len(reason) > 0 {
+			errs = append(errs, &FieldError{Field: "poolEnd", Value: p.PoolEnd.String(), Reason: reason})
+		} else if !p.Contains(p.PoolEnd) {
+			errs = append(errs, &FieldError{Field: "poolEnd", Value: p.PoolEnd.String(), Reason: "is not in subnet"})
 		}
+	}
 
-		if !p.Contains(p.PoolEnd) {
-			return fmt.Errorf("poolEnd %s not in subnet %s", p.PoolEnd.String(), p.Subnet.String())
-		}
+	// a range boundary may be a gateway, which is skipped by allocation and capacity,
+	// but a range of nothing else can never allocate
+	if len(errs) == 0 && p.PoolStart != nil && p.PoolEnd != nil && ip.Cmp(p.PoolStart, p.PoolEnd) <= 0 &&
+		p.Size() <= p.gatewaysBetween(p.PoolStart, p.PoolEnd) {
+		errs = append(errs, &FieldError{Field: "poolStart", Value: p.PoolStart.String(),
+			Reason: fmt.Sprintf("makes a range of gateways only up to %s", p.PoolEnd)})
 	}
 
-	return nil
+	// the reserved-ip policy must leave something to allocate, missing ends count as their defaults
+	if len(errs) == 0 && (p.ReserveFirst > 0 || p.ReserveLast > 0) && p.withEffectiveRange().BigCapacity().Sign() <= 0 {
+		errs = append(errs, &FieldError{Field: "reserveFirst", Value: fmt.Sprintf("%d", p.ReserveFirst),
+			Reason: fmt.Sprintf("and reserveLast %d leave no allocatable ip in range", p.ReserveLast)})
+	}
+
+	// gateways may take every usable ip of a small subnet, e.g. a /30 with a secondary gateway
+	if len(errs) == 0 && p.withEffectiveRange().BigCapacity().Sign() <= 0 {
+		errs = append(errs, &FieldError{Field: "subnet", Value: p.Subnet.String(), Reason: "leaves no allocatable ip besides gateways"})
+	}
+
+	return errs
 }
 
 // Contains check if a given ip is in a pool
@@ -142,41 +503,506 @@ func (p *Pool) Contains(addr net.IP) bool {
 	return true
 }
 
-// Overlaps returns true if there is any overlap between ranges
+// IsValidVlanID checks if id is in [1, 4094] and not one of the reserved 1006-1024
+func IsValidVlanID(id int32) bool {
+	return id > 0 && (id <= 1005 || id >= 1025) && id <= 4094
+}
+
+// Next returns the ip after addr in the allocatable range of pool,
+// wrapping around to the start of range after its end
+func (p *Pool) Next(addr net.IP) net.IP {
+	start, end := p.allocatableRange()
+	if addr == nil || ip.Cmp(addr, start) < 0 || ip.Cmp(addr, end) >= 0 {
+		return start
+	}
+	return ip.NextIP(addr)
+}
+
+// Prev returns the ip before addr in the allocatable range of pool,
+// wrapping around to the end of range before its start
+func (p *Pool) Prev(addr net.IP) net.IP {
+	start, end := p.allocatableRange()
+	if addr == nil || ip.Cmp(addr, start) <= 0 || ip.Cmp(addr, end) > 0 {
+		return end
+	}
+	return ip.PrevIP(addr)
+}
+
+// Following returns the ip scanned after addr by allocation from pool, which is
+// Prev for descending pools and Next for the others
+func (p *Pool) Following(addr net.IP) net.IP {
+	if p.Descending {
+		return p.Prev(addr)
+	}
+	return p.Next(addr)
+}
+
+// IsReserved checks if addr is one of the usable ips reserved by ReserveFirst or ReserveLast
+func (p *Pool) IsReserved(addr net.IP) bool {
+	if p.ReserveFirst <= 0 && p.ReserveLast <= 0 {
+		return false
+	}
+	n := ipToInt(addr)
+	first, last := p.usableBounds()
+	return n.Cmp(first) < 0 || n.Cmp(last) > 0
+}
+
+// IsGatewayReservable checks if addr is a gateway of pool which may be reserved explicitly,
+// see AllowGatewayAllocation, gateways are never allocatable regardless
+func (p *Pool) IsGatewayReservable(addr net.IP) bool {
+	return p.AllowGatewayAllocation && p.IsGateway(addr)
+}
+
+// IsAllocatable checks if addr can ever be handed out by pool, that is inside the range
+// and neither a gateway nor reserved by the reserved-ip policy
+func (p *Pool) IsAllocatable(addr net.IP) bool {
+	return p.Contains(addr) && !p.IsGateway(addr) && !p.IsReserved(addr)
+}
+
+// forEachAllocatable calls fn with every allocatable ip of pool in order which is not in used,
+// used is keyed by the string form of ips, the iteration stops once fn returns false
+func (p *Pool) forEachAllocatable(used map[string]struct{}, fn func(net.IP) bool) {
+	// the range is inside the pool already, the rest of IsAllocatable applies
+	start, end := p.allocatableRange()
+	for cur := start; ip.Cmp(cur, end) <= 0; cur = ip.NextIP(cur) {
+		if _, using := used[cur.String()]; using || p.IsGateway(cur) || p.IsReserved(cur) {
+			continue
+		}
+		if !fn(cur) {
+			return
+		}
+	}
+}
+
+// usableBounds returns the lowest and highest usable ips of subnet left by the reserved-ip policy
+func (p *Pool) usableBounds() (*big.Int, *big.Int) {
+	firstIP, lastIP := p.subnetBounds()
+	first := ipToInt(firstIP)
+	first.Add(first, big.NewInt(int64(p.ReserveFirst)))
+	last := ipToInt(lastIP)
+	last.Sub(last, big.NewInt(int64(p.ReserveLast)))
+	return first, last
+}
+
+// subnetBounds returns the lowest and highest usable ips of subnet, which are all of
+// them for point-to-point pools
+func (p *Pool) subnetBounds() (net.IP, net.IP) {
+	if p.PointToPoint {
+		return copyIP(p.Subnet.IP), broadcastIP(p.Subnet)
+	}
+	return ip.NextIP(p.Subnet.IP), lastIP(p.Subnet)
+}
+
+// IntersectCIDR returns the part of [PoolStart, PoolEnd] inside cidr, false if they do not overlap
+func (p *Pool) IntersectCIDR(cidr *net.IPNet) (net.IP, net.IP, bool) {
+	if cidr == nil || p.PoolStart == nil || p.PoolEnd == nil {
+		return nil, nil, false
+	}
+	first := cidr.IP.Mask(cidr.Mask)
+	if first == nil || (first.To4() != nil) != (p.PoolStart.To4() != nil) {
+		return nil, nil, false
+	}
+	last := broadcastIP(&net.IPNet{IP: first, Mask: cidr.Mask})
+
+	start, end := p.PoolStart, p.PoolEnd
+	if ipToInt(first).Cmp(ipToInt(start)) > 0 {
+		start = first
+	}
+	if ipToInt(last).Cmp(ipToInt(end)) < 0 {
+		end = last
+	}
+	if ipToInt(start).Cmp(ipToInt(end)) > 0 {
+		return nil, nil, false
+	}
+	return copyIP(start), copyIP(end), true
+}
+
+// allocatableRange returns [PoolStart, PoolEnd] narrowed by the reserved-ip policy,
+// start is after end if nothing is left
+func (p *Pool) allocatableRange() (net.IP, net.IP) {
+	if p.ReserveFirst <= 0 && p.ReserveLast <= 0 {
+		return p.PoolStart, p.PoolEnd
+	}
+
+	start, end := p.PoolStart, p.PoolEnd
+	first, last := p.usableBounds()
+	if ipToInt(start).Cmp(first) < 0 {
+		start = intToIP(first, len(p.PoolStart))
+	}
+	if ipToInt(end).Cmp(last) > 0 {
+		end = intToIP(last, len(p.PoolEnd))
+	}
+	return start, end
+}
+
+// Overlaps returns true if there is any overlap between ranges,
+// missing ends are taken as the defaults of Canonicalize so that pools need not be canonicalized
 func (p *Pool) Overlaps(p1 *Pool) bool {
-	return p.Contains(p1.PoolStart) ||
-		p.Contains(p1.PoolEnd) ||
-		p1.Contains(p.PoolStart) ||
-		p1.Contains(p.PoolEnd)
+	q, q1 := p.withEffectiveRange(), p1.withEffectiveRange()
+	return q.Contains(q1.PoolStart) ||
+		q.Contains(q1.PoolEnd) ||
+		q1.Contains(q.PoolStart) ||
+		q1.Contains(q.PoolEnd)
 }
 
-// Sums returns the count of all available IPs in this pool
+// withEffectiveRange returns a shallow copy of p whose missing ends are filled like Canonicalize does,
+// p itself is returned if any given end is not of the ip family of subnet
+func (p *Pool) withEffectiveRange() *Pool {
+	if p.PoolStart != nil && p.PoolEnd != nil {
+		return p
+	}
+	for _, end := range []net.IP{p.PoolStart, p.PoolEnd} {
+		if end != nil && len(familyMismatch(end, p.Subnet)) > 0 {
+			return p
+		}
+	}
+
+	out := *p
+	first, last := p.subnetBounds()
+	if out.PoolStart == nil {
+		out.PoolStart = first
+	}
+	if out.PoolEnd == nil {
+		out.PoolEnd = last
+	}
+	return &out
+}
+
+// Sum returns the count of all available IPs in this pool
+//
+// Deprecated: use Capacity instead
 func (p *Pool) Sum() int {
-	count := 0
-	for cur := p.PoolStart; !cur.Equal(p.PoolEnd); cur = ip.NextIP(cur) {
-		if !cur.Equal(p.Gateway) {
-			count++
+	return p.Capacity()
+}
+
+// Size returns the count of all IPs in [PoolStart, PoolEnd], allocatable or not
+func (p *Pool) Size() int {
+	if ip.Cmp(p.PoolEnd, p.PoolStart) < 0 {
+		return 0
+	}
+
+	size := new(big.Int).Sub(ipToInt(p.PoolEnd), ipToInt(p.PoolStart))
+	if !size.IsInt64() || size.Int64() >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(size.Int64()) + 1
+}
+
+// familyMismatch explains why addr is not of the ip family of subnet, empty if it is
+func familyMismatch(addr net.IP, subnet *net.IPNet) string {
+	isV4, subnetIsV4 := addr.To4() != nil, subnet.IP.To4() != nil
+	switch {
+	case isV4 && !subnetIsV4:
+		return "is ipv4 but subnet is ipv6"
+	case !isV4 && subnetIsV4:
+		return "is ipv6 but subnet is ipv4"
+	}
+	return ""
+}
+
+// RangeAsCIDRs returns the minimal list of aligned CIDR blocks covering exactly
+// [PoolStart, PoolEnd] in ascending order, pool must be canonicalized
+func (p *Pool) RangeAsCIDRs() []*net.IPNet {
+	return cidrsBetween(p.PoolStart, p.PoolEnd, nil)
+}
+
+// ToIPSetEntries returns the allocatable ips of pool as CIDR entries of an ipset of type
+// hash:net in ascending order, which leave out gateways and ips spared by the reserved-ip
+// policy, pool must be canonicalized
+func (p *Pool) ToIPSetEntries() []string {
+	cidrs := p.FreeCIDRs(nil)
+	entries := make([]string, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		entries = append(entries, cidr.String())
+	}
+	return entries
+}
+
+// FreeCIDRs returns the allocatable ips of pool which are not in used as the minimal list
+// of aligned CIDR blocks in ascending order, used is keyed by the string form of ips,
+// pool must be canonicalized
+func (p *Pool) FreeCIDRs(used map[string]struct{}) []*net.IPNet {
+	start, end := p.allocatableRange()
+	if ip.Cmp(start, end) > 0 {
+		return nil
+	}
+
+	// gateways and used ips inside the range split it into runs of free ips
+	excluded := make([]*big.Int, 0, len(used)+1+len(p.SecondaryGateways))
+	for _, gateway := range append([]net.IP{p.Gateway}, p.SecondaryGateways...) {
+		if gateway != nil {
+			excluded = append(excluded, ipToInt(gateway))
+		}
+	}
+	for addr := range used {
+		if parsed := net.ParseIP(addr); parsed != nil {
+			excluded = append(excluded, ipToInt(parsed))
+		}
+	}
+	sort.Slice(excluded, func(i, j int) bool { return excluded[i].Cmp(excluded[j]) < 0 })
+
+	length := net.IPv6len
+	if start.To4() != nil {
+		length = net.IPv4len
+	}
+	var cidrs []*net.IPNet
+	first, last := ipToInt(start), ipToInt(end)
+	for _, n := range excluded {
+		// duplicates and ips out of range are behind first or beyond last
+		if n.Cmp(first) < 0 || n.Cmp(last) > 0 {
+			continue
+		}
+		if first.Cmp(n) < 0 {
+			prev := new(big.Int).Sub(n, big.NewInt(1))
+			cidrs = cidrsBetween(intToIP(first, length), intToIP(prev, length), cidrs)
+		}
+		first = new(big.Int).Add(n, big.NewInt(1))
+	}
+	if first.Cmp(last) <= 0 {
+		cidrs = cidrsBetween(intToIP(first, length), end, cidrs)
+	}
+	return cidrs
+}
+
+// cidrsBetween appends the minimal list of aligned CIDR blocks covering exactly [first, last] to cidrs
+func cidrsBetween(first, last net.IP, cidrs []*net.IPNet) []*net.IPNet {
+	bits, length := 8*net.IPv6len, net.IPv6len
+	if first.To4() != nil {
+		bits, length = 8*net.IPv4len, net.IPv4len
+	}
+
+	one := big.NewInt(1)
+	start, end := ipToInt(first), ipToInt(last)
+	for start.Cmp(end) <= 0 {
+		// grow the block while start stays aligned to its size and it ends within range
+		hostBits := 0
+		for hostBits < bits && start.Bit(hostBits) == 0 {
+			last := new(big.Int).Lsh(one, uint(hostBits+1))
+			last.Add(last, start).Sub(last, one)
+			if last.Cmp(end) > 0 {
+				break
+			}
+			hostBits++
+		}
+		cidrs = append(cidrs, &net.IPNet{IP: intToIP(start, length), Mask: net.CIDRMask(bits-hostBits, bits)})
+		start.Add(start, new(big.Int).Lsh(one, uint(hostBits)))
+	}
+	return cidrs
+}
+
+// Capacity returns the count of allocatable IPs in [PoolStart, PoolEnd] left by the reserved-ip policy,
+// the gateway is excluded only if it falls inside the range, the count is capped at math.MaxInt32
+// for large ipv6 pools, see BigCapacity for the exact count
+func (p *Pool) Capacity() int {
+	capacity := p.BigCapacity()
+	if !capacity.IsInt64() || capacity.Int64() >= math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int(capacity.Int64())
+}
+
+// BigCapacity works like Capacity without capping, e.g. it is 2^64-2 for a /64 pool
+func (p *Pool) BigCapacity() *big.Int {
+	start, end := p.allocatableRange()
+	if ip.Cmp(end, start) < 0 {
+		return new(big.Int)
+	}
+
+	count := new(big.Int).Sub(ipToInt(end), ipToInt(start))
+	return count.Add(count, big.NewInt(int64(1-p.gatewaysInRange())))
+}
+
+// IsGateway checks if addr is the primary or one of the secondary gateways of pool
+func (p *Pool) IsGateway(addr net.IP) bool {
+	if addr.Equal(p.Gateway) {
+		return true
+	}
+	for _, gateway := range p.SecondaryGateways {
+		if addr.Equal(gateway) {
+			return true
 		}
 	}
+	return false
+}
 
-	return count + 1
+// GatewayInRange checks if the primary gateway falls inside [PoolStart, PoolEnd], missing ends
+// taken as the bounds of subnet. Such a gateway is skipped by allocation, see IsAllocatable, while
+// a gateway outside the range is never reached by it
+func (p *Pool) GatewayInRange() bool {
+	if p.Gateway == nil || p.Subnet == nil {
+		return false
+	}
+	r := p.withEffectiveRange()
+	if r.PoolStart == nil || r.PoolEnd == nil {
+		return false
+	}
+	return ip.Cmp(p.Gateway, r.PoolStart) >= 0 && ip.Cmp(p.Gateway, r.PoolEnd) <= 0
 }
 
-// canonicalizeIP makes sure a provided ip is in ipv4 standard form
+// gatewaysInRange returns the count of distinct gateways inside the allocatable range
+func (p *Pool) gatewaysInRange() int {
+	start, end := p.allocatableRange()
+	return p.gatewaysBetween(start, end)
+}
+
+// gatewaysBetween returns the count of distinct gateways inside [start, end]
+func (p *Pool) gatewaysBetween(start, end net.IP) int {
+	inRange := map[string]bool{}
+	for _, gateway := range append([]net.IP{p.Gateway}, p.SecondaryGateways...) {
+		if gateway != nil && ip.Cmp(gateway, start) >= 0 && ip.Cmp(gateway, end) <= 0 {
+			inRange[gateway.String()] = true
+		}
+	}
+	return len(inRange)
+}
+
+func copyIP(addr net.IP) net.IP {
+	if addr == nil {
+		return nil
+	}
+	return append(net.IP(nil), addr...)
+}
+
+// StableIP hashes identity into an ip within range of pool, the same identity always gets the same ip
+func (p *Pool) StableIP(identity string) net.IP {
+	startIP, endIP := p.allocatableRange()
+	start := ipToInt(startIP)
+	size := new(big.Int).Sub(ipToInt(endIP), start)
+	size.Add(size, big.NewInt(1))
+
+	sum := sha256.Sum256([]byte(identity))
+	offset := new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), size)
+	return intToIP(offset.Add(offset, start), len(startIP))
+}
+
+// RandomIP picks an ip within range of pool from r, the same source always yields the same ips
+func (p *Pool) RandomIP(r *rand.Rand) net.IP {
+	startIP, endIP := p.allocatableRange()
+	start := ipToInt(startIP)
+	size := new(big.Int).Sub(ipToInt(endIP), start)
+	size.Add(size, big.NewInt(1))
+
+	offset := new(big.Int).Rand(r, size)
+	return intToIP(offset.Add(offset, start), len(startIP))
+}
+
+func intToIP(n *big.Int, length int) net.IP {
+	b := n.Bytes()
+	addr := make(net.IP, length)
+	copy(addr[length-len(b):], b)
+	return addr
+}
+
+// AddressAt returns the ip at offset from PoolStart, offsets beyond PoolEnd are refused
+func (p *Pool) AddressAt(offset int) (net.IP, error) {
+	if offset < 0 {
+		return nil, fmt.Errorf("offset %d can not be negative", offset)
+	}
+	n := new(big.Int).Add(ipToInt(p.PoolStart), big.NewInt(int64(offset)))
+	if n.Cmp(ipToInt(p.PoolEnd)) > 0 {
+		return nil, fmt.Errorf("offset %d is beyond pool end %s", offset, p.PoolEnd)
+	}
+	return intToIP(n, len(p.PoolStart)), nil
+}
+
+// ipToInt converts an ip to a big integer regardless of its form
+func ipToInt(addr net.IP) *big.Int {
+	if v4 := addr.To4(); v4 != nil {
+		return new(big.Int).SetBytes(v4)
+	}
+	return new(big.Int).SetBytes(addr.To16())
+}
+
+// PoolStats breaks down the ips of a pool, Used, Reserved and Free sum up to Total
+type PoolStats struct {
+	// Total is the count of all ips in range of pool
+	Total int `json:"total"`
+	// Used is the count of ips reserved by owners, not including reserved ones
+	Used int `json:"used"`
+	// Reserved is the count of the gateway and ips reserved by policy in range
+	Reserved int `json:"reserved"`
+	// Free is the count of ips left to allocate
+	Free int `json:"free"`
+}
+
+// PoolStat is a pool along with its stats
+type PoolStat struct {
+	Pool  *Pool     `json:"pool"`
+	Stats PoolStats `json:"stats"`
+}
+
+// FragReport describes how the free ips of a pool are scattered
+type FragReport struct {
+	// FreeSegments is the count of contiguous free ranges
+	FreeSegments int `json:"freeSegments"`
+	// LargestFreeBlock is the size of the largest contiguous free range
+	LargestFreeBlock int `json:"largestFreeBlock"`
+	// TotalFree is the count of all free ips
+	TotalFree int `json:"totalFree"`
+}
+
+// Fragmentation reports free segments of pool, used is keyed by the string form of ips,
+// gateway and reserved ips are never free
+func (p *Pool) Fragmentation(used map[string]struct{}) FragReport {
+	report := FragReport{}
+
+	// a segment ends wherever the free ips are not contiguous
+	var prev net.IP
+	block := 0
+	p.forEachAllocatable(used, func(cur net.IP) bool {
+		if prev == nil || !ip.NextIP(prev).Equal(cur) {
+			report.FreeSegments++
+			block = 0
+		}
+		prev = cur
+		block++
+		report.TotalFree++
+		if block > report.LargestFreeBlock {
+			report.LargestFreeBlock = block
+		}
+		return true
+	})
+
+	return report
+}
+
+// canonicalizeIP makes sure a provided ip is in ipv4 standard form, or ipv6 form if not ipv4,
+// ipv4-mapped ipv6 addresses like ::ffff:192.168.0.1 are taken as ipv4 and normalized to 4 bytes,
+// since net.ParseIP returns ipv4 addresses in that form as well
 func canonicalizeIP(ip *net.IP) error {
-	if ip.To4() == nil {
-		return fmt.Errorf("IP %s is not ipv4 standard form", *ip)
+	if v4 := ip.To4(); v4 != nil {
+		*ip = v4
+		return nil
+	}
+	if ip.To16() == nil {
+		return fmt.Errorf("IP %s is neither ipv4 nor ipv6 standard form", *ip)
 	}
 	return nil
 }
 
-// Determine the last IP of a subnet, excluding the broadcast if IPv4
-func lastIP(subnet *net.IPNet) net.IP {
-	var end net.IP
-	for i := 0; i < len(subnet.IP); i++ {
-		end = append(end, subnet.IP[i]|^subnet.Mask[i])
+// canonicalizeSubnet works like canonicalizeIP for subnet, an ipv4-mapped ipv6 subnet
+// like ::ffff:192.168.0.0/120 is normalized to its ipv4 form along with its mask. subnet
+// may be shared and is never modified, a normalized copy is returned instead
+func canonicalizeSubnet(subnet *net.IPNet) (*net.IPNet, error) {
+	canonical := &net.IPNet{IP: subnet.IP, Mask: subnet.Mask}
+	if err := canonicalizeIP(&canonical.IP); err != nil {
+		return nil, err
+	}
+	if len(canonical.IP) == net.IPv4len && len(canonical.Mask) == net.IPv6len {
+		if !bytes.Equal(canonical.Mask[:12], net.CIDRMask(96, 128)[:12]) {
+			return nil, fmt.Errorf("has an ipv4 address with an ipv6 mask shorter than the mapped prefix")
+		}
+		canonical.Mask = canonical.Mask[12:]
 	}
+	if len(canonical.IP) == len(subnet.IP) && len(canonical.Mask) == len(subnet.Mask) {
+		return subnet, nil
+	}
+	return canonical, nil
+}
 
+// Determine the last IP of a subnet, excluding the broadcast if IPv4
+func lastIP(subnet *net.IPNet) net.IP {
+	end := broadcastIP(subnet)
 	if subnet.IP.To4() != nil {
 		end[3]--
 	}
@@ -184,23 +1010,83 @@ func lastIP(subnet *net.IPNet) net.IP {
 	return end
 }
 
-// GetPoolFromCRD can help get typed pool from pool CRD
-func GetPoolFromCRD(p *resourcev1.Pool) (*Pool, error) {
-	pool := &Pool{
-		Name:   p.Name,
-		VlanID: p.VlanId,
+// broadcastIP returns the highest ip of subnet
+func broadcastIP(subnet *net.IPNet) net.IP {
+	var end net.IP
+	for i := 0; i < len(subnet.IP); i++ {
+		end = append(end, subnet.IP[i]|^subnet.Mask[i])
 	}
+	return end
+}
 
-	if len(p.PoolStart) > 0 {
-		pool.PoolStart = net.ParseIP(p.PoolStart)
-	}
+// ToCRD converts pool into the string fields of pool CRD, nil ips are left empty
+func (p *Pool) ToCRD() resourcev1.Pool {
+	out := resourcev1.Pool{
+		Name:      p.Name,
+		PoolStart: ipToString(p.PoolStart),
+		PoolEnd:   ipToString(p.PoolEnd),
+		Gateway:   ipToString(p.Gateway),
+		Weight:    p.Weight,
+		Strategy:  string(p.Strategy),
+
+		ReserveFirst: p.ReserveFirst,
+		ReserveLast:  p.ReserveLast,
+		MTU:          p.MTU,
+		Disabled:     p.Disabled,
+		PointToPoint: p.PointToPoint,
+		Descending:   p.Descending,
 
-	if len(p.PoolEnd) > 0 {
-		pool.PoolEnd = net.ParseIP(p.PoolEnd)
+		AllowGatewayAllocation: p.AllowGatewayAllocation,
+		ExclusiveOwner:         p.ExclusiveOwner,
+		Labels:                 copyMetadata(p.Labels),
+		Description:            p.Description,
+		Generation:             p.Generation,
+	}
+	if p.Subnet != nil {
+		out.Subnet = p.Subnet.String()
+	}
+	// the vlan id is copied so that the crd never aliases pool, vlan 0 is untagged as well
+	if p.VlanID != nil && *p.VlanID != 0 {
+		vlanID := *p.VlanID
+		out.VlanId = &vlanID
 	}
+	for _, gateway := range p.SecondaryGateways {
+		out.SecondaryGateways = append(out.SecondaryGateways, gateway.String())
+	}
+	return out
+}
+
+// PoolFromCRD converts pool CRD into a canonicalized typed pool, a vlan id of 0 is
+// taken as untagged the same as an unset one
+func PoolFromCRD(p resourcev1.Pool) (*Pool, error) {
+	pool := &Pool{
+		Name:      p.Name,
+		PoolStart: parseIP(p.PoolStart),
+		PoolEnd:   parseIP(p.PoolEnd),
+		Gateway:   parseIP(p.Gateway),
+		Weight:    p.Weight,
+		Strategy:  AllocationStrategy(p.Strategy),
 
-	if len(p.Gateway) > 0 {
-		pool.Gateway = net.ParseIP(p.Gateway)
+		ReserveFirst: p.ReserveFirst,
+		ReserveLast:  p.ReserveLast,
+		MTU:          p.MTU,
+		Disabled:     p.Disabled,
+		PointToPoint: p.PointToPoint,
+		Descending:   p.Descending,
+
+		AllowGatewayAllocation: p.AllowGatewayAllocation,
+		ExclusiveOwner:         p.ExclusiveOwner,
+		Labels:                 copyMetadata(p.Labels),
+		Description:            p.Description,
+		Generation:             p.Generation,
+	}
+	// vlan 0 of crd is indistinguishable from unset for users, both are untagged
+	if p.VlanId != nil && *p.VlanId != 0 {
+		vlanID := *p.VlanId
+		pool.VlanID = &vlanID
+	}
+	for _, gateway := range p.SecondaryGateways {
+		pool.SecondaryGateways = append(pool.SecondaryGateways, net.ParseIP(gateway))
 	}
 
 	_, subnet, err := net.ParseCIDR(p.Subnet)
@@ -215,3 +1101,17 @@ func GetPoolFromCRD(p *resourcev1.Pool) (*Pool, error) {
 
 	return pool, nil
 }
+
+func ipToString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+func parseIP(s string) net.IP {
+	if len(s) == 0 {
+		return nil
+	}
+	return net.ParseIP(s)
+}
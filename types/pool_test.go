@@ -17,8 +17,16 @@
 package types
 
 import (
+	"math"
+	"math/big"
+	"math/rand"
 	"net"
+	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/containernetworking/plugins/pkg/ip"
+	v1 "github.com/mars1024/kube-ipam/pkg/apis/resource/v1"
 )
 
 func TestPool_Validate(t *testing.T) {
@@ -156,6 +164,98 @@ func TestPool_Canonicalize(t *testing.T) {
 	//t.Logf("canonicalize pool to %+v", pool)
 }
 
+func TestPool_CanonicalizeTwice(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{Name: "test", Subnet: subnet, Gateway: net.ParseIP("192.168.0.1")}
+	if err := pool.Canonicalize(); err != nil {
+		t.Fatalf("fail to canonicalize pool: %v", err)
+	}
+	canonical := pool.DeepCopy()
+	if err := pool.Canonicalize(); err != nil {
+		t.Fatalf("fail to canonicalize pool again: %v", err)
+	}
+	if !reflect.DeepEqual(pool, canonical) {
+		t.Errorf("canonicalizing again should change nothing but got %+v from %+v", pool, canonical)
+	}
+
+	// mutations after canonicalization are validated again, and pool is left as mutated
+	pool.PoolEnd = net.ParseIP("192.168.1.10")
+	if err := pool.Canonicalize(); err == nil {
+		t.Errorf("pool end out of subnet should be rejected")
+	}
+	if !pool.PoolEnd.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("rejected pool should be untouched but got pool end %s", pool.PoolEnd)
+	}
+
+	hostBits := &net.IPNet{IP: net.ParseIP("192.168.0.5").To4(), Mask: net.CIDRMask(24, 32)}
+	pool = &Pool{Name: "test", Subnet: hostBits, Gateway: net.ParseIP("10.0.0.1")}
+	if err := pool.CanonicalizeWithOptions(CanonicalizeOptions{MaskHostBits: true}); err == nil {
+		t.Errorf("gateway out of subnet should be rejected")
+	}
+	if pool.Subnet != hostBits || pool.PoolStart != nil {
+		t.Errorf("rejected pool should be untouched but got %+v", pool)
+	}
+
+	// a shared ipv4-mapped subnet is not normalized in place when validation fails
+	_, mapped, _ := net.ParseCIDR("::ffff:192.168.0.0/120")
+	pool = &Pool{Name: "test", Subnet: mapped, Gateway: net.ParseIP("10.0.0.1")}
+	if err := pool.Canonicalize(); err == nil {
+		t.Errorf("gateway out of subnet should be rejected")
+	}
+	if pool.Subnet != mapped || len(mapped.IP) != net.IPv6len || len(mapped.Mask) != net.IPv6len {
+		t.Errorf("rejected pool should keep its subnet untouched but got %s", mapped)
+	}
+}
+
+func TestPool_CanonicalizeWithOptions(t *testing.T) {
+	newPool := func() *Pool {
+		return &Pool{
+			Name:    "test",
+			Subnet:  &net.IPNet{IP: net.ParseIP("192.168.0.5"), Mask: net.CIDRMask(24, 32)},
+			Gateway: net.ParseIP("192.168.0.1"),
+		}
+	}
+
+	// host bits are rejected by default
+	if err := newPool().Canonicalize(); err == nil || !strings.Contains(err.Error(), "host bits") {
+		t.Errorf("subnet with host bits should be rejected but got %v", err)
+	}
+	if err := newPool().CanonicalizeWithOptions(CanonicalizeOptions{}); err == nil {
+		t.Errorf("subnet with host bits should be rejected without MaskHostBits")
+	}
+
+	pool := newPool()
+	if err := pool.CanonicalizeWithOptions(CanonicalizeOptions{MaskHostBits: true}); err != nil {
+		t.Fatalf("fail to canonicalize pool with host bits masked: %v", err)
+	}
+	if pool.Subnet.String() != "192.168.0.0/24" || !pool.PoolStart.Equal(net.ParseIP("192.168.0.1")) {
+		t.Errorf("expected subnet 192.168.0.0/24 starting at 192.168.0.1 but got %s from %s", pool.Subnet, pool.PoolStart)
+	}
+}
+
+func TestPool_IntersectCIDR(t *testing.T) {
+	pool := &Pool{PoolStart: net.ParseIP("192.168.0.10"), PoolEnd: net.ParseIP("192.168.0.100")}
+	tests := []struct {
+		cidr  string
+		start string
+		end   string
+	}{
+		{"192.168.0.64/26", "192.168.0.64", "192.168.0.100"},
+		{"192.168.0.0/28", "192.168.0.10", "192.168.0.15"},
+		{"192.168.0.32/27", "192.168.0.32", "192.168.0.63"},
+		{"192.168.0.0/16", "192.168.0.10", "192.168.0.100"},
+		{"192.168.0.200/29", "", ""},
+		{"fd00::/8", "", ""},
+	}
+	for _, test := range tests {
+		_, cidr, _ := net.ParseCIDR(test.cidr)
+		start, end, ok := pool.IntersectCIDR(cidr)
+		if ok != (len(test.start) > 0) || ok && (!start.Equal(net.ParseIP(test.start)) || !end.Equal(net.ParseIP(test.end))) {
+			t.Errorf("cidr %s expects [%s, %s] but got [%s, %s] %v", test.cidr, test.start, test.end, start, end, ok)
+		}
+	}
+}
+
 func TestPool_Contains(t *testing.T) {
 	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
 	gateway := net.ParseIP("192.168.0.254")
@@ -211,6 +311,8 @@ func TestPool_Contains(t *testing.T) {
 
 func TestPool_Overlaps(t *testing.T) {
 	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	_, wide, _ := net.ParseCIDR("192.168.0.0/16")
+	_, other, _ := net.ParseCIDR("192.168.1.0/24")
 	tests := []struct {
 		pool1   *Pool
 		pool2   *Pool
@@ -253,6 +355,39 @@ func TestPool_Overlaps(t *testing.T) {
 			},
 			overlap: false,
 		},
+		{
+			// defaults of nested subnets overlap though no end is given
+			pool1: &Pool{
+				Subnet: wide,
+			},
+			pool2: &Pool{
+				Subnet: subnet,
+			},
+			overlap: true,
+		},
+		{
+			pool1: &Pool{
+				PoolStart: net.ParseIP("192.168.0.10"),
+				PoolEnd:   net.ParseIP("192.168.0.20"),
+				Subnet:    subnet,
+			},
+			pool2: &Pool{
+				PoolEnd: net.ParseIP("192.168.0.15"),
+				Subnet:  subnet,
+			},
+			overlap: true,
+		},
+		{
+			pool1: &Pool{
+				PoolStart: net.ParseIP("192.168.0.10"),
+				PoolEnd:   net.ParseIP("192.168.0.20"),
+				Subnet:    subnet,
+			},
+			pool2: &Pool{
+				Subnet: other,
+			},
+			overlap: false,
+		},
 	}
 
 	for _, test := range tests {
@@ -288,3 +423,1080 @@ func TestPool_Sum(t *testing.T) {
 		})
 	}
 }
+
+func TestPool_GatewayBoundary(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(start, end string, secondary ...net.IP) *Pool {
+		return &Pool{
+			Name:              "pool",
+			PoolStart:         net.ParseIP(start),
+			PoolEnd:           net.ParseIP(end),
+			Gateway:           net.ParseIP("192.168.0.10"),
+			SecondaryGateways: secondary,
+			Subnet:            subnet,
+		}
+	}
+
+	tests := []struct {
+		name     string
+		pool     *Pool
+		valid    bool
+		capacity int
+		first    string
+	}{
+		{"start is gateway", newPool("192.168.0.10", "192.168.0.20"), true, 10, "192.168.0.11"},
+		{"end is gateway", newPool("192.168.0.5", "192.168.0.10"), true, 5, "192.168.0.5"},
+		{"gateway only", newPool("192.168.0.10", "192.168.0.10"), false, 0, ""},
+		{"gateways only", newPool("192.168.0.10", "192.168.0.11", net.ParseIP("192.168.0.11")), false, 0, ""},
+	}
+	for _, test := range tests {
+		err := test.pool.Validate()
+		if (err == nil) != test.valid {
+			t.Errorf("test %s fails: expected valid %v but got %v", test.name, test.valid, err)
+		}
+		if capacity := test.pool.Capacity(); capacity != test.capacity {
+			t.Errorf("test %s fails: expected capacity %d but got %d", test.name, test.capacity, capacity)
+		}
+
+		var first net.IP
+		test.pool.forEachAllocatable(nil, func(addr net.IP) bool {
+			first = addr
+			return false
+		})
+		if test.capacity > 0 && !first.Equal(net.ParseIP(test.first)) {
+			t.Errorf("test %s fails: expected first allocatable %s but got %v", test.name, test.first, first)
+		}
+		if test.pool.IsAllocatable(test.pool.Gateway) {
+			t.Errorf("test %s fails: gateway should never be allocatable", test.name)
+		}
+	}
+}
+
+func TestPool_ToIPSetEntries(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(start, end string) *Pool {
+		return &Pool{
+			PoolStart: net.ParseIP(start).To4(),
+			PoolEnd:   net.ParseIP(end).To4(),
+			Gateway:   net.ParseIP("192.168.0.1").To4(),
+			Subnet:    subnet,
+		}
+	}
+	withSecondary := newPool("192.168.0.8", "192.168.0.23")
+	withSecondary.SecondaryGateways = []net.IP{net.ParseIP("192.168.0.16").To4()}
+	reserved := newPool("192.168.0.1", "192.168.0.254")
+	reserved.ReserveFirst, reserved.ReserveLast = 9, 2
+
+	tests := []struct {
+		name    string
+		pool    *Pool
+		entries []string
+	}{
+		{"custom range", newPool("192.168.0.10", "192.168.0.20"),
+			[]string{"192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/30", "192.168.0.20/32"}},
+		{"starting at gateway", newPool("192.168.0.1", "192.168.0.7"),
+			[]string{"192.168.0.2/31", "192.168.0.4/30"}},
+		{"split by secondary gateway", withSecondary,
+			[]string{"192.168.0.8/29", "192.168.0.17/32", "192.168.0.18/31", "192.168.0.20/30"}},
+		{"narrowed by reserved ips", reserved,
+			[]string{"192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/28", "192.168.0.32/27", "192.168.0.64/26",
+				"192.168.0.128/26", "192.168.0.192/27", "192.168.0.224/28", "192.168.0.240/29", "192.168.0.248/30", "192.168.0.252/32"}},
+	}
+	for _, test := range tests {
+		entries := test.pool.ToIPSetEntries()
+		if strings.Join(entries, ",") != strings.Join(test.entries, ",") {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.entries, entries)
+		}
+
+		// the entries cover every allocatable ip of the subnet and nothing else
+		covered := 0
+		for _, entry := range entries {
+			_, cidr, err := net.ParseCIDR(entry)
+			if err != nil {
+				t.Fatalf("test %s fails: invalid entry %s", test.name, entry)
+			}
+			ones, bits := cidr.Mask.Size()
+			covered += 1 << uint(bits-ones)
+		}
+		if covered != test.pool.Capacity() {
+			t.Errorf("test %s fails: entries cover %d ips but capacity is %d", test.name, covered, test.pool.Capacity())
+		}
+		for addr := subnet.IP.To4(); subnet.Contains(addr); addr = ip.NextIP(addr) {
+			inEntries := false
+			for _, entry := range entries {
+				if _, cidr, _ := net.ParseCIDR(entry); cidr.Contains(addr) {
+					inEntries = true
+				}
+			}
+			if inEntries != test.pool.IsAllocatable(addr) {
+				t.Errorf("test %s fails: %s is in entries %v but allocatable %v", test.name, addr, inEntries, test.pool.IsAllocatable(addr))
+			}
+		}
+	}
+}
+
+func TestPool_GatewayInRange(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	tests := []struct {
+		name    string
+		start   string
+		end     string
+		inRange bool
+	}{
+		{"whole subnet", "", "", true},
+		{"window starting at gateway", "192.168.0.1", "192.168.0.5", true},
+		{"window after gateway", "192.168.0.10", "192.168.0.20", false},
+		{"window ending before gateway", "", "192.168.0.0", false},
+	}
+	for _, test := range tests {
+		pool := &Pool{Name: "pool", Subnet: subnet, Gateway: net.ParseIP("192.168.0.1"),
+			PoolStart: net.ParseIP(test.start), PoolEnd: net.ParseIP(test.end)}
+		if inRange := pool.GatewayInRange(); inRange != test.inRange {
+			t.Errorf("test %s fails: expected gateway in range %v but got %v", test.name, test.inRange, inRange)
+		}
+	}
+	if (&Pool{Subnet: subnet}).GatewayInRange() {
+		t.Errorf("pool without gateway has no gateway in range")
+	}
+}
+
+func TestPool_Capacity(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	tests := []struct {
+		name  string
+		pool  *Pool
+		count int
+	}{
+		{
+			"gateway inside range",
+			&Pool{
+				PoolStart: net.ParseIP("192.168.0.1"),
+				PoolEnd:   net.ParseIP("192.168.0.200"),
+				Gateway:   net.ParseIP("192.168.0.1"),
+				Subnet:    subnet,
+			},
+			199,
+		},
+		{
+			"gateway outside range",
+			&Pool{
+				PoolStart: net.ParseIP("192.168.0.1"),
+				PoolEnd:   net.ParseIP("192.168.0.200"),
+				Gateway:   net.ParseIP("192.168.0.254"),
+				Subnet:    subnet,
+			},
+			200,
+		},
+		{
+			"gateway at range end",
+			&Pool{
+				PoolStart: net.ParseIP("192.168.0.10"),
+				PoolEnd:   net.ParseIP("192.168.0.20"),
+				Gateway:   net.ParseIP("192.168.0.20"),
+				Subnet:    subnet,
+			},
+			10,
+		},
+		{
+			"reserved first and last",
+			&Pool{
+				PoolStart:    net.ParseIP("192.168.0.1"),
+				PoolEnd:      net.ParseIP("192.168.0.254"),
+				Gateway:      net.ParseIP("192.168.0.1"),
+				Subnet:       subnet,
+				ReserveFirst: 1,
+				ReserveLast:  2,
+			},
+			251,
+		},
+		{
+			"reserved outside range",
+			&Pool{
+				PoolStart:    net.ParseIP("192.168.0.10"),
+				PoolEnd:      net.ParseIP("192.168.0.20"),
+				Gateway:      net.ParseIP("192.168.0.1"),
+				Subnet:       subnet,
+				ReserveFirst: 1,
+				ReserveLast:  2,
+			},
+			11,
+		},
+		{
+			"all reserved",
+			&Pool{
+				PoolStart:   net.ParseIP("192.168.0.250"),
+				PoolEnd:     net.ParseIP("192.168.0.254"),
+				Gateway:     net.ParseIP("192.168.0.1"),
+				Subnet:      subnet,
+				ReserveLast: 5,
+			},
+			0,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if count := test.pool.Capacity(); count != test.count {
+				t.Errorf("test %s fails: expected %d but got %d", test.name, test.count, count)
+			}
+		})
+	}
+}
+
+func TestPool_ValidateAggregated(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	vlanID := int32(1010)
+
+	pool := Pool{
+		Name:      "test",
+		PoolStart: net.ParseIP("192.168.1.10"),
+		PoolEnd:   net.ParseIP("192.168.1.100"),
+		Gateway:   net.ParseIP("192.168.2.1"),
+		Subnet:    subnet,
+		VlanID:    &vlanID,
+	}
+
+	err := pool.Validate()
+	errs, ok := err.(ErrorList)
+	if !ok {
+		t.Fatalf("validation of pool %+v should return an error list but got %v", pool, err)
+	}
+
+	// bad vlan, bad gateway, out-of-range start and end
+	if len(errs) != 4 {
+		t.Errorf("expected 4 problems but got %d: %v", len(errs), errs)
+	}
+}
+
+func TestPool_Next(t *testing.T) {
+	pool := &Pool{
+		PoolStart: net.ParseIP("192.168.0.10"),
+		PoolEnd:   net.ParseIP("192.168.0.20"),
+	}
+
+	tests := map[string]string{
+		"":              "192.168.0.10",
+		"192.168.0.10":  "192.168.0.11",
+		"192.168.0.20":  "192.168.0.10",
+		"192.168.0.100": "192.168.0.10",
+	}
+	for addr, next := range tests {
+		if got := pool.Next(net.ParseIP(addr)); !got.Equal(net.ParseIP(next)) {
+			t.Errorf("next of %q expects %s but got %s", addr, next, got)
+		}
+	}
+}
+
+func TestPool_Prev(t *testing.T) {
+	pool := &Pool{
+		PoolStart:  net.ParseIP("192.168.0.10"),
+		PoolEnd:    net.ParseIP("192.168.0.20"),
+		Descending: true,
+	}
+
+	tests := map[string]string{
+		"":              "192.168.0.20",
+		"192.168.0.20":  "192.168.0.19",
+		"192.168.0.10":  "192.168.0.20",
+		"192.168.0.100": "192.168.0.20",
+	}
+	for addr, prev := range tests {
+		if got := pool.Prev(net.ParseIP(addr)); !got.Equal(net.ParseIP(prev)) {
+			t.Errorf("prev of %q expects %s but got %s", addr, prev, got)
+		}
+		if got := pool.Following(net.ParseIP(addr)); !got.Equal(net.ParseIP(prev)) {
+			t.Errorf("following of %q in descending pool expects %s but got %s", addr, prev, got)
+		}
+	}
+}
+
+func TestPool_ForEachAllocatable(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{
+		PoolStart:         net.ParseIP("192.168.0.1").To4(),
+		PoolEnd:           net.ParseIP("192.168.0.8").To4(),
+		Gateway:           net.ParseIP("192.168.0.4").To4(),
+		SecondaryGateways: []net.IP{net.ParseIP("192.168.0.1").To4()},
+		Subnet:            subnet,
+		ReserveFirst:      2,
+	}
+
+	tests := []struct {
+		name     string
+		used     map[string]struct{}
+		expected []string
+	}{
+		{"nothing used", nil, []string{"192.168.0.3", "192.168.0.5", "192.168.0.6", "192.168.0.7", "192.168.0.8"}},
+		{"some used", map[string]struct{}{"192.168.0.5": {}, "192.168.0.8": {}}, []string{"192.168.0.3", "192.168.0.6", "192.168.0.7"}},
+	}
+	for _, test := range tests {
+		var got []string
+		pool.forEachAllocatable(test.used, func(addr net.IP) bool {
+			if !pool.IsAllocatable(addr) {
+				t.Errorf("test %s fails: %s is not allocatable", test.name, addr)
+			}
+			got = append(got, addr.String())
+			return true
+		})
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.expected, got)
+		}
+	}
+
+	// the range is counted and iterated by the same exclusion
+	if count := pool.Capacity(); count != len(tests[0].expected) {
+		t.Errorf("capacity %d disagrees with allocatable ips %v", count, tests[0].expected)
+	}
+	for _, addr := range []string{"192.168.0.1", "192.168.0.2", "192.168.0.4", "192.168.0.9"} {
+		if pool.IsAllocatable(net.ParseIP(addr)) {
+			t.Errorf("%s should not be allocatable", addr)
+		}
+	}
+
+	// iteration stops once fn returns false
+	count := 0
+	pool.forEachAllocatable(nil, func(net.IP) bool {
+		count++
+		return count < 2
+	})
+	if count != 2 {
+		t.Errorf("iteration should stop after 2 ips but got %d", count)
+	}
+}
+
+func TestPool_Fragmentation(t *testing.T) {
+	pool := &Pool{
+		PoolStart: net.ParseIP("192.168.0.1"),
+		PoolEnd:   net.ParseIP("192.168.0.10"),
+		Gateway:   net.ParseIP("192.168.0.1"),
+	}
+	usedSet := func(ips ...string) map[string]struct{} {
+		used := make(map[string]struct{})
+		for _, addr := range ips {
+			used[addr] = struct{}{}
+		}
+		return used
+	}
+
+	tests := []struct {
+		name   string
+		used   map[string]struct{}
+		report FragReport
+	}{
+		{"empty", usedSet(), FragReport{1, 9, 9}},
+		{"full", usedSet("192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6",
+			"192.168.0.7", "192.168.0.8", "192.168.0.9", "192.168.0.10"), FragReport{0, 0, 0}},
+		{"alternate", usedSet("192.168.0.3", "192.168.0.5", "192.168.0.7", "192.168.0.9"), FragReport{5, 1, 5}},
+		{"split", usedSet("192.168.0.4"), FragReport{2, 6, 8}},
+	}
+	for _, test := range tests {
+		if report := pool.Fragmentation(test.used); report != test.report {
+			t.Errorf("test %s fails: expected %+v but got %+v", test.name, test.report, report)
+		}
+	}
+}
+
+func TestPool_Diff(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	vlan10, vlan20 := int32(10), int32(20)
+	newPool := func(gateway string, vlanID *int32) *Pool {
+		return &Pool{
+			Name:      "pool",
+			PoolStart: net.ParseIP("192.168.0.10"),
+			PoolEnd:   net.ParseIP("192.168.0.20"),
+			Gateway:   net.ParseIP(gateway),
+			Subnet:    subnet,
+			VlanID:    vlanID,
+		}
+	}
+	shortForm := newPool("192.168.0.1", &vlan10)
+	shortForm.PoolStart = shortForm.PoolStart.To4()
+	labeled := newPool("192.168.0.1", nil)
+	labeled.Labels = map[string]string{"zone": "a"}
+	emptyLabels := newPool("192.168.0.1", nil)
+	emptyLabels.Labels = map[string]string{}
+	described := newPool("192.168.0.1", nil)
+	described.Description = "pods of team a"
+	recreated := newPool("192.168.0.1", nil)
+	recreated.Generation = 1
+
+	tests := []struct {
+		name   string
+		pool1  *Pool
+		pool2  *Pool
+		fields []string
+	}{
+		{"identical", newPool("192.168.0.1", &vlan10), newPool("192.168.0.1", &vlan10), nil},
+		{"identical in different ip forms", newPool("192.168.0.1", &vlan10), shortForm, nil},
+		{"vlan only", newPool("192.168.0.1", &vlan10), newPool("192.168.0.1", &vlan20), []string{"vlanID"}},
+		{"vlan set and unset", newPool("192.168.0.1", &vlan10), newPool("192.168.0.1", nil), []string{"vlanID"}},
+		{"gateway only", newPool("192.168.0.1", nil), newPool("192.168.0.254", nil), []string{"gateway"}},
+		{"labels only", newPool("192.168.0.1", nil), labeled, []string{"labels"}},
+		{"empty and nil labels", newPool("192.168.0.1", nil), emptyLabels, nil},
+		{"description only", newPool("192.168.0.1", nil), described, []string{"description"}},
+		{"generation only", newPool("192.168.0.1", nil), recreated, []string{"generation"}},
+	}
+	for _, test := range tests {
+		fields := test.pool1.Diff(test.pool2)
+		if !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("test %s fails: expected diff %v but got %v", test.name, test.fields, fields)
+		}
+		if test.pool1.Equal(test.pool2) != (len(test.fields) == 0) {
+			t.Errorf("test %s fails: expected equal %v", test.name, len(test.fields) == 0)
+		}
+	}
+}
+
+func TestPool_ValidateName(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	tests := []struct {
+		name  string
+		valid bool
+	}{
+		{"pool", true},
+		{"pool-1", true},
+		{strings.Repeat("a", 63), true},
+		{"Pool1", false},
+		{"pool-", false},
+		{"pool_1", false},
+		{"Pool.A", false},
+		{"-pool", false},
+		{strings.Repeat("a", 64), false},
+	}
+	for _, test := range tests {
+		pool := Pool{
+			Name:    test.name,
+			Gateway: net.ParseIP("192.168.0.1"),
+			Subnet:  subnet,
+		}
+		if err := pool.Validate(); (err == nil) != test.valid {
+			t.Errorf("test %s fails: expected valid %v but got %v", test.name, test.valid, err)
+		}
+	}
+}
+
+func TestPool_StableIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("fd00::/64")
+	pool := &Pool{
+		Name:      "pool",
+		PoolStart: net.ParseIP("fd00::10"),
+		PoolEnd:   net.ParseIP("fd00::ffff"),
+		Gateway:   net.ParseIP("fd00::1"),
+		Subnet:    subnet,
+		Strategy:  StrategyStableHash,
+	}
+	if err := pool.Validate(); err != nil {
+		t.Fatalf("stable hash ipv6 pool should be valid: %v", err)
+	}
+
+	ip1, ip2 := pool.StableIP("default/pod1"), pool.StableIP("default/pod2")
+	if !ip1.Equal(pool.StableIP("default/pod1")) {
+		t.Errorf("the same identity gets different ips")
+	}
+	if ip1.Equal(ip2) {
+		t.Errorf("different identities get the same ip %s", ip1)
+	}
+	for _, addr := range []net.IP{ip1, ip2} {
+		if !pool.Contains(addr) {
+			t.Errorf("stable ip %s is out of pool", addr)
+		}
+	}
+
+	_, v4Subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	v4Pool := &Pool{Name: "pool", Gateway: net.ParseIP("192.168.0.1"), Subnet: v4Subnet, Strategy: StrategyStableHash}
+	if err := v4Pool.Validate(); err == nil {
+		t.Errorf("stable hash strategy should be rejected for ipv4 pools")
+	}
+}
+
+func TestPool_RandomIP(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{
+		Name:         "pool",
+		PoolStart:    net.ParseIP("192.168.0.10").To4(),
+		PoolEnd:      net.ParseIP("192.168.0.20").To4(),
+		Gateway:      net.ParseIP("192.168.0.1"),
+		Subnet:       subnet,
+		Strategy:     StrategyRandom,
+		ReserveFirst: 12,
+	}
+	if err := pool.Validate(); err != nil {
+		t.Fatalf("random pool should be valid: %v", err)
+	}
+	if pool.Strategy.UsesLastReservedIP() {
+		t.Errorf("random strategy should not use the last reserved ip")
+	}
+
+	r1, r2 := rand.New(rand.NewSource(1)), rand.New(rand.NewSource(1))
+	for i := 0; i < 100; i++ {
+		ip := pool.RandomIP(r1)
+		if !ip.Equal(pool.RandomIP(r2)) {
+			t.Fatalf("the same source yields different ips at pick %d", i)
+		}
+		// ips spared by the reserved-ip policy are never picked
+		if !pool.IsAllocatable(ip) {
+			t.Errorf("random ip %s is not allocatable", ip)
+		}
+	}
+}
+
+func TestPool_ValidateFields(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	_, small, _ := net.ParseCIDR("192.168.0.0/31")
+	hostBits := &net.IPNet{IP: net.ParseIP("192.168.0.1").To4(), Mask: net.CIDRMask(24, 32)}
+	vlanID, weight := int32(5000), int32(-1)
+	newPool := func(mutate func(p *Pool)) *Pool {
+		p := &Pool{
+			Name:    "pool",
+			Gateway: net.ParseIP("192.168.0.1"),
+			Subnet:  &net.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		}
+		mutate(p)
+		return p
+	}
+
+	tests := []struct {
+		field string
+		pool  *Pool
+	}{
+		{"name", newPool(func(p *Pool) { p.Name = "" })},
+		{"name", newPool(func(p *Pool) { p.Name = "pool_1" })},
+		{"vlanID", newPool(func(p *Pool) { p.VlanID = &vlanID })},
+		{"weight", newPool(func(p *Pool) { p.Weight = weight })},
+		{"generation", newPool(func(p *Pool) { p.Generation = -1 })},
+		{"gateway", newPool(func(p *Pool) { p.Gateway = nil })},
+		{"gateway", newPool(func(p *Pool) { p.Gateway = net.ParseIP("192.168.1.1") })},
+		{"subnet", newPool(func(p *Pool) { p.Subnet = nil })},
+		{"subnet", newPool(func(p *Pool) { p.Subnet = small; p.Gateway = net.ParseIP("192.168.0.0") })},
+		{"subnet", newPool(func(p *Pool) { p.Subnet = hostBits })},
+		{"strategy", newPool(func(p *Pool) { p.Strategy = "Spiral" })},
+		{"poolStart", newPool(func(p *Pool) { p.PoolStart = net.ParseIP("192.168.1.10") })},
+		{"poolEnd", newPool(func(p *Pool) { p.PoolEnd = net.ParseIP("192.168.1.10") })},
+		{"mtu", newPool(func(p *Pool) { p.MTU = MinMTU - 1 })},
+		{"mtu", newPool(func(p *Pool) { p.MTU = MaxMTU + 1 })},
+		{"reserveFirst", newPool(func(p *Pool) { p.ReserveFirst, p.ReserveLast = 200, 54 })},
+		{"reserveFirst", newPool(func(p *Pool) {
+			p.PoolStart, p.PoolEnd = net.ParseIP("192.168.0.2"), net.ParseIP("192.168.0.5")
+			p.ReserveFirst = 5
+		})},
+		{"reserveFirst", newPool(func(p *Pool) {
+			// the only ip left by policy is a gateway
+			p.PoolStart, p.PoolEnd = net.ParseIP("192.168.0.10"), net.ParseIP("192.168.0.20")
+			p.SecondaryGateways = []net.IP{net.ParseIP("192.168.0.20")}
+			p.ReserveFirst = 19
+		})},
+	}
+	for _, test := range tests {
+		errs := test.pool.ValidateFields()
+		if len(errs) != 1 || errs[0].Field != test.field {
+			t.Errorf("test %s fails: expected a single error of field %s but got %v", test.field, test.field, errs)
+		}
+	}
+
+	err := newPool(func(p *Pool) { p.PoolEnd = net.ParseIP("192.168.1.10") }).Validate()
+	if err == nil || !strings.Contains(err.Error(), "pool pool (192.168.0.0/24): poolEnd 192.168.1.10 is not in subnet") {
+		t.Errorf("unexpected error message %v", err)
+	}
+
+	// a single ip left by the reserved-ip policy is enough
+	if err := newPool(func(p *Pool) { p.ReserveFirst, p.ReserveLast = 200, 53 }).Validate(); err != nil {
+		t.Errorf("pool with one allocatable ip should be valid: %v", err)
+	}
+}
+
+func TestPool_IsReserved(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{
+		PoolStart:    net.ParseIP("192.168.0.1").To4(),
+		PoolEnd:      net.ParseIP("192.168.0.254").To4(),
+		Gateway:      net.ParseIP("192.168.0.254"),
+		Subnet:       subnet,
+		ReserveFirst: 1,
+		ReserveLast:  2,
+	}
+	tests := map[string]bool{
+		"192.168.0.1":   true,
+		"192.168.0.2":   false,
+		"192.168.0.252": false,
+		"192.168.0.253": true,
+		"192.168.0.254": true,
+	}
+	for addr, reserved := range tests {
+		if pool.IsReserved(net.ParseIP(addr)) != reserved {
+			t.Errorf("test %s fails: expected reserved %v", addr, reserved)
+		}
+	}
+
+	if next := pool.Next(nil); !next.Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("expected next ip 192.168.0.2 but got %s", next)
+	}
+	if next := pool.Next(net.ParseIP("192.168.0.252").To4()); !next.Equal(net.ParseIP("192.168.0.2")) {
+		t.Errorf("expected next ip wrapping to 192.168.0.2 but got %s", next)
+	}
+}
+
+func TestPool_ValidateMTU(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	for _, mtu := range []int32{0, MinMTU, 1500, MaxMTU} {
+		pool := &Pool{Name: "pool", Gateway: net.ParseIP("192.168.0.1"), Subnet: subnet, MTU: mtu}
+		if err := pool.Validate(); err != nil {
+			t.Errorf("test %d fails: %v", mtu, err)
+		}
+	}
+}
+
+func TestPool_IPv4Mapped(t *testing.T) {
+	_, mapped, err := net.ParseCIDR("::ffff:192.168.0.0/120")
+	if err != nil {
+		t.Fatalf("fail to parse mapped subnet: %v", err)
+	}
+	pool := &Pool{
+		Name:      "pool",
+		PoolStart: net.ParseIP("::ffff:192.168.0.10"),
+		PoolEnd:   net.ParseIP("::ffff:192.168.0.20"),
+		Gateway:   net.ParseIP("::ffff:192.168.0.1"),
+		Subnet:    mapped,
+	}
+
+	// mapped addresses are normalized to their 4-byte ipv4 form
+	if err := pool.Canonicalize(); err != nil {
+		t.Fatalf("mapped pool should be valid: %v", err)
+	}
+	if len(pool.Subnet.IP) != net.IPv4len || len(pool.Subnet.Mask) != net.IPv4len || pool.Subnet.String() != "192.168.0.0/24" {
+		t.Errorf("expected subnet normalized to 192.168.0.0/24 but got %v", pool.Subnet)
+	}
+	if len(pool.PoolStart) != net.IPv4len || len(pool.PoolEnd) != net.IPv4len {
+		t.Errorf("expected range normalized to ipv4 but got %v-%v", []byte(pool.PoolStart), []byte(pool.PoolEnd))
+	}
+	if !pool.Contains(net.ParseIP("::ffff:192.168.0.15")) || !pool.Contains(net.ParseIP("192.168.0.15").To4()) {
+		t.Errorf("mapped and plain forms of an ipv4 address should both be contained")
+	}
+
+	v4 := &Pool{Name: "v4", PoolStart: net.ParseIP("192.168.0.15"), PoolEnd: net.ParseIP("192.168.0.30"),
+		Gateway: net.ParseIP("192.168.0.1"), Subnet: &net.IPNet{IP: net.IPv4(192, 168, 0, 0), Mask: net.CIDRMask(24, 32)}}
+	if err := v4.Canonicalize(); err != nil {
+		t.Fatalf("fail to canonicalize pool: %v", err)
+	}
+	if !pool.Overlaps(v4) {
+		t.Errorf("mapped pool should overlap the ipv4 pool of the same range")
+	}
+
+	// a real ipv6 address is never taken as ipv4
+	if pool.Contains(net.ParseIP("::192.168.0.15")) {
+		t.Errorf("ipv4-compatible ipv6 address should not be contained")
+	}
+}
+
+func TestPool_SecondaryGateways(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	newPool := func(gateways ...string) *Pool {
+		pool := &Pool{
+			Name:      "pool",
+			PoolStart: net.ParseIP("192.168.0.1"),
+			PoolEnd:   net.ParseIP("192.168.0.10"),
+			Gateway:   net.ParseIP("192.168.0.1"),
+			Subnet:    subnet,
+		}
+		for _, gateway := range gateways {
+			pool.SecondaryGateways = append(pool.SecondaryGateways, net.ParseIP(gateway))
+		}
+		return pool
+	}
+
+	tests := []struct {
+		name  string
+		pool  *Pool
+		field string
+	}{
+		{"valid", newPool("192.168.0.2"), ""},
+		{"not in subnet", newPool("192.168.1.2"), "secondaryGateways"},
+		{"duplicate of primary", newPool("192.168.0.1"), "secondaryGateways"},
+		{"duplicate", newPool("192.168.0.2", "192.168.0.2"), "secondaryGateways"},
+	}
+	for _, test := range tests {
+		errs := test.pool.ValidateFields()
+		switch {
+		case len(test.field) == 0 && len(errs) > 0:
+			t.Errorf("test %s fails: %v", test.name, errs)
+		case len(test.field) > 0 && (len(errs) != 1 || errs[0].Field != test.field):
+			t.Errorf("test %s fails: expected a single error of field %s but got %v", test.name, test.field, errs)
+		}
+	}
+
+	pool := newPool("192.168.0.2", "192.168.0.200")
+	if !pool.IsGateway(net.ParseIP("192.168.0.1")) || !pool.IsGateway(net.ParseIP("192.168.0.2")) || pool.IsGateway(net.ParseIP("192.168.0.3")) {
+		t.Errorf("unexpected gateways of pool %v %v", pool.Gateway, pool.SecondaryGateways)
+	}
+	// only the gateways inside range take capacity
+	if capacity := pool.Capacity(); capacity != 8 {
+		t.Errorf("expected capacity 8 but got %d", capacity)
+	}
+}
+
+func TestPool_CRDRoundTrip(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	_, mapped, _ := net.ParseCIDR("::ffff:10.0.0.0/120")
+	vlanID := int32(100)
+
+	tests := []struct {
+		name string
+		pool *Pool
+	}{
+		{"minimal", &Pool{Name: "minimal", Gateway: net.ParseIP("192.168.0.1"), Subnet: subnet}},
+		{"full", &Pool{
+			Name:              "full",
+			PoolStart:         net.ParseIP("192.168.0.10"),
+			PoolEnd:           net.ParseIP("192.168.0.20"),
+			Gateway:           net.ParseIP("192.168.0.1"),
+			SecondaryGateways: []net.IP{net.ParseIP("192.168.0.2")},
+			Subnet:            subnet,
+			VlanID:            &vlanID,
+			Weight:            3,
+			ReserveFirst:      1,
+			ReserveLast:       2,
+			MTU:               1450,
+			Disabled:          true,
+			Labels:            map[string]string{"zone": "a"},
+			Description:       "web tier of team a",
+		}},
+		{"mapped", &Pool{Name: "mapped", Gateway: net.ParseIP("::ffff:10.0.0.1"), Subnet: mapped}},
+	}
+	for _, test := range tests {
+		if err := test.pool.Canonicalize(); err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		crd := test.pool.ToCRD()
+		pool, err := PoolFromCRD(crd)
+		if err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if diff := test.pool.Diff(pool); len(diff) > 0 {
+			t.Errorf("test %s fails: round trip differs in %v", test.name, diff)
+		}
+		if !reflect.DeepEqual(pool.ToCRD(), crd) {
+			t.Errorf("test %s fails: expected crd %+v but got %+v", test.name, crd, pool.ToCRD())
+		}
+		if test.pool.VlanID != nil && (crd.VlanId == test.pool.VlanID || pool.VlanID == crd.VlanId) {
+			t.Errorf("test %s fails: vlan id should be copied instead of shared", test.name)
+		}
+	}
+}
+
+func TestPool_CRDZeroVlan(t *testing.T) {
+	zero := int32(0)
+	pool, err := PoolFromCRD(v1.Pool{Name: "pool", Gateway: "192.168.0.1", Subnet: "192.168.0.0/24", VlanId: &zero})
+	if err != nil {
+		t.Fatalf("fail to convert: %v", err)
+	}
+	if pool.VlanID != nil {
+		t.Errorf("vlan 0 of crd should be untagged but got %d", *pool.VlanID)
+	}
+	if err := pool.Validate(); err != nil {
+		t.Errorf("untagged pool should be valid: %v", err)
+	}
+	// an untagged pool is written back without vlan, which reads as 0 again
+	if crd := pool.ToCRD(); crd.VlanId != nil {
+		t.Errorf("untagged pool should have no vlan in crd but got %d", *crd.VlanId)
+	}
+
+	pool.VlanID = &zero
+	if crd := pool.ToCRD(); crd.VlanId != nil {
+		t.Errorf("vlan 0 should be written as untagged but got %d", *crd.VlanId)
+	}
+}
+
+func TestPool_AddressAt(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	_, subnet6, _ := net.ParseCIDR("2001:db8::/64")
+	pool := &Pool{PoolStart: net.ParseIP("192.168.0.10").To4(), PoolEnd: net.ParseIP("192.168.0.20").To4(), Subnet: subnet}
+	pool6 := &Pool{PoolStart: net.ParseIP("2001:db8::ff"), PoolEnd: net.ParseIP("2001:db8::ffff"), Subnet: subnet6}
+
+	tests := []struct {
+		name     string
+		pool     *Pool
+		offset   int
+		expected string
+	}{
+		{"start", pool, 0, "192.168.0.10"},
+		{"mid-range", pool, 5, "192.168.0.15"},
+		{"end", pool, 10, "192.168.0.20"},
+		{"beyond end", pool, 11, ""},
+		{"negative", pool, -1, ""},
+		{"ipv6 carry", pool6, 1, "2001:db8::100"},
+	}
+	for _, test := range tests {
+		addr, err := test.pool.AddressAt(test.offset)
+		if len(test.expected) == 0 {
+			if err == nil {
+				t.Errorf("test %s fails: expected error but got %s", test.name, addr)
+			}
+			continue
+		}
+		if err != nil || !addr.Equal(net.ParseIP(test.expected)) || len(addr) != len(test.pool.PoolStart) {
+			t.Errorf("test %s fails: expected %s but got %s: %v", test.name, test.expected, addr, err)
+		}
+	}
+}
+
+func TestPool_RangeAsCIDRs(t *testing.T) {
+	tests := []struct {
+		name     string
+		subnet   string
+		start    string
+		end      string
+		expected []string
+	}{
+		{"single ip", "192.168.0.0/24", "192.168.0.10", "192.168.0.10", []string{"192.168.0.10/32"}},
+		{"aligned block", "192.168.0.0/24", "192.168.0.16", "192.168.0.31", []string{"192.168.0.16/28"}},
+		{"unaligned range", "192.168.0.0/24", "192.168.0.10", "192.168.0.20",
+			[]string{"192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/30", "192.168.0.20/32"}},
+		{"whole subnet", "10.0.0.0/24", "10.0.0.1", "10.0.0.254",
+			[]string{"10.0.0.1/32", "10.0.0.2/31", "10.0.0.4/30", "10.0.0.8/29", "10.0.0.16/28", "10.0.0.32/27",
+				"10.0.0.64/26", "10.0.0.128/26", "10.0.0.192/27", "10.0.0.224/28", "10.0.0.240/29", "10.0.0.248/30",
+				"10.0.0.252/31", "10.0.0.254/32"}},
+		{"ipv6", "fd00::/64", "fd00::10", "fd00::2f", []string{"fd00::10/124", "fd00::20/124"}},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		pool := &Pool{Name: "pool", PoolStart: net.ParseIP(test.start), PoolEnd: net.ParseIP(test.end), Subnet: subnet}
+		var got []string
+		for _, cidr := range pool.RangeAsCIDRs() {
+			got = append(got, cidr.String())
+		}
+		if !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestPool_ValidateFamily(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("192.168.0.0/24")
+	_, v6, _ := net.ParseCIDR("fd00::/64")
+	newPool := func(subnet *net.IPNet, gateway string, mutate func(p *Pool)) *Pool {
+		p := &Pool{
+			Name:    "pool",
+			Gateway: net.ParseIP(gateway),
+			Subnet:  &net.IPNet{IP: subnet.IP, Mask: subnet.Mask},
+		}
+		mutate(p)
+		return p
+	}
+
+	tests := []struct {
+		name    string
+		pool    *Pool
+		field   string
+		message string
+	}{
+		{"ipv6 gateway", newPool(v4, "fd00::1", func(p *Pool) {}), "gateway", "gateway fd00::1 is ipv6 but subnet is ipv4"},
+		{"ipv4 gateway", newPool(v6, "192.168.0.1", func(p *Pool) {}), "gateway", "gateway 192.168.0.1 is ipv4 but subnet is ipv6"},
+		{"ipv6 start", newPool(v4, "192.168.0.1", func(p *Pool) { p.PoolStart = net.ParseIP("fd00::10") }),
+			"poolStart", "poolStart fd00::10 is ipv6 but subnet is ipv4"},
+		{"ipv4 end", newPool(v6, "fd00::1", func(p *Pool) { p.PoolEnd = net.ParseIP("192.168.0.10") }),
+			"poolEnd", "poolEnd 192.168.0.10 is ipv4 but subnet is ipv6"},
+		{"ipv4 secondary gateway", newPool(v6, "fd00::1", func(p *Pool) { p.SecondaryGateways = []net.IP{net.ParseIP("192.168.0.2")} }),
+			"secondaryGateways", "secondaryGateways 192.168.0.2 is ipv4 but subnet is ipv6"},
+	}
+	for _, test := range tests {
+		errs := test.pool.ValidateFields()
+		if len(errs) != 1 || errs[0].Field != test.field || errs[0].Error() != test.message {
+			t.Errorf("test %s fails: expected %q but got %v", test.name, test.message, errs)
+		}
+	}
+}
+
+func TestPool_PointToPoint(t *testing.T) {
+	tests := []struct {
+		name         string
+		subnet       string
+		pointToPoint bool
+		field        string
+		start, end   string
+	}{
+		{"ipv4 /31", "192.168.0.0/31", true, "", "192.168.0.0", "192.168.0.1"},
+		{"ipv6 /127", "fd00::/127", true, "", "fd00::", "fd00::1"},
+		{"/31 without mode", "192.168.0.0/31", false, "subnet", "", ""},
+		{"mode on larger subnet", "192.168.0.0/30", true, "pointToPoint", "", ""},
+		{"mode on host subnet", "192.168.0.0/32", true, "pointToPoint", "", ""},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		pool := &Pool{Name: "pool", Subnet: subnet, PointToPoint: test.pointToPoint}
+		if len(test.field) > 0 {
+			// gateway is only optional for point-to-point pools
+			if !test.pointToPoint {
+				pool.Gateway = subnet.IP
+			}
+			errs := pool.ValidateFields()
+			if len(errs) != 1 || errs[0].Field != test.field {
+				t.Errorf("test %s fails: expected a single error of field %s but got %v", test.name, test.field, errs)
+			}
+			continue
+		}
+
+		if err := pool.Canonicalize(); err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+			continue
+		}
+		if !pool.PoolStart.Equal(net.ParseIP(test.start)) || !pool.PoolEnd.Equal(net.ParseIP(test.end)) {
+			t.Errorf("test %s fails: expected range %s-%s but got %s-%s", test.name, test.start, test.end, pool.PoolStart, pool.PoolEnd)
+		}
+		if pool.Capacity() != 2 {
+			t.Errorf("test %s fails: expected capacity 2 but got %d", test.name, pool.Capacity())
+		}
+	}
+}
+
+func TestPool_BigCapacity(t *testing.T) {
+	huge, _ := new(big.Int).SetString("18446744073709551614", 10)
+	tests := []struct {
+		name     string
+		subnet   string
+		gateway  string
+		expected *big.Int
+		capped   int
+	}{
+		{"/64", "fd00::/64", "fd00::1", huge, math.MaxInt32},
+		{"/120", "fd00::/120", "fd00::1", big.NewInt(254), 254},
+		{"/24", "192.168.0.0/24", "192.168.0.1", big.NewInt(253), 253},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		pool := &Pool{Name: "pool", Gateway: net.ParseIP(test.gateway), Subnet: subnet}
+		if err := pool.Canonicalize(); err != nil {
+			t.Fatalf("test %s fails: %v", test.name, err)
+		}
+		if capacity := pool.BigCapacity(); capacity.Cmp(test.expected) != 0 {
+			t.Errorf("test %s fails: expected capacity %s but got %s", test.name, test.expected, capacity)
+		}
+		if capacity := pool.Capacity(); capacity != test.capped {
+			t.Errorf("test %s fails: expected capped capacity %d but got %d", test.name, test.capped, capacity)
+		}
+	}
+}
+
+func TestPool_Labels(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{
+		Name:    "pool",
+		Gateway: net.ParseIP("192.168.0.1"),
+		Subnet:  subnet,
+		Labels:  map[string]string{"zone": "a", "example.com/rack": "r1"},
+	}
+	if err := pool.Validate(); err != nil {
+		t.Fatalf("labeled pool should be valid: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		selector map[string]string
+		matches  bool
+	}{
+		{"empty selector", nil, true},
+		{"one label", map[string]string{"zone": "a"}, true},
+		{"all labels", map[string]string{"zone": "a", "example.com/rack": "r1"}, true},
+		{"other value", map[string]string{"zone": "b"}, false},
+		{"missing label", map[string]string{"zone": "a", "row": "1"}, false},
+	}
+	for _, test := range tests {
+		if matches := pool.MatchesLabels(test.selector); matches != test.matches {
+			t.Errorf("test %s fails: expected matches %v but got %v", test.name, test.matches, matches)
+		}
+	}
+
+	copied := pool.DeepCopy()
+	copied.Labels["zone"] = "b"
+	if pool.Labels["zone"] != "a" {
+		t.Errorf("labels should be copied instead of shared")
+	}
+
+	for _, labels := range []map[string]string{{"bad key!": "a"}, {"zone": "bad value!"}} {
+		pool.Labels = labels
+		if err := pool.Validate(); err == nil {
+			t.Errorf("labels %v should be invalid", labels)
+		}
+	}
+}
+
+func TestPool_FreeCIDRs(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.0.0/24")
+	pool := &Pool{
+		Name:              "pool",
+		PoolStart:         net.ParseIP("192.168.0.1"),
+		PoolEnd:           net.ParseIP("192.168.0.16"),
+		Gateway:           net.ParseIP("192.168.0.1"),
+		SecondaryGateways: []net.IP{net.ParseIP("192.168.0.8")},
+		Subnet:            subnet,
+	}
+
+	tests := []struct {
+		name     string
+		used     []string
+		expected []string
+	}{
+		{"nothing used", nil, []string{"192.168.0.2/31", "192.168.0.4/30", "192.168.0.9/32", "192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/32"}},
+		{"used ips split ranges", []string{"192.168.0.4", "192.168.0.12"},
+			[]string{"192.168.0.2/31", "192.168.0.5/32", "192.168.0.6/31", "192.168.0.9/32", "192.168.0.10/31", "192.168.0.13/32", "192.168.0.14/31", "192.168.0.16/32"}},
+		{"used gateway and ips out of range", []string{"192.168.0.1", "192.168.0.100", "not an ip"},
+			[]string{"192.168.0.2/31", "192.168.0.4/30", "192.168.0.9/32", "192.168.0.10/31", "192.168.0.12/30", "192.168.0.16/32"}},
+		{"all used", []string{"192.168.0.2", "192.168.0.3", "192.168.0.4", "192.168.0.5", "192.168.0.6", "192.168.0.7",
+			"192.168.0.9", "192.168.0.10", "192.168.0.11", "192.168.0.12", "192.168.0.13", "192.168.0.14", "192.168.0.15", "192.168.0.16"}, nil},
+	}
+	for _, test := range tests {
+		used := make(map[string]struct{}, len(test.used))
+		for _, addr := range test.used {
+			used[addr] = struct{}{}
+		}
+		var cidrs []string
+		for _, cidr := range pool.FreeCIDRs(used) {
+			cidrs = append(cidrs, cidr.String())
+		}
+		if !reflect.DeepEqual(cidrs, test.expected) {
+			t.Errorf("test %s fails: expected %v but got %v", test.name, test.expected, cidrs)
+		}
+	}
+}
+
+func TestPool_ValidateAllocatableLeft(t *testing.T) {
+	tests := []struct {
+		name         string
+		subnet       string
+		pointToPoint bool
+		gateways     []string
+		capacity     int
+	}{
+		{"/30 with gateway", "192.168.0.0/30", false, []string{"192.168.0.1"}, 1},
+		{"/30 with both usable ips as gateways", "192.168.0.0/30", false, []string{"192.168.0.1", "192.168.0.2"}, 0},
+		{"/31 point-to-point without gateway", "192.168.0.0/31", true, nil, 2},
+		{"/31 point-to-point with gateway", "192.168.0.0/31", true, []string{"192.168.0.0"}, 1},
+		{"/31 point-to-point with both ips as gateways", "192.168.0.0/31", true, []string{"192.168.0.0", "192.168.0.1"}, 0},
+	}
+	for _, test := range tests {
+		_, subnet, _ := net.ParseCIDR(test.subnet)
+		pool := &Pool{Name: "pool", Subnet: subnet, PointToPoint: test.pointToPoint}
+		for i, gateway := range test.gateways {
+			if i == 0 {
+				pool.Gateway = net.ParseIP(gateway)
+			} else {
+				pool.SecondaryGateways = append(pool.SecondaryGateways, net.ParseIP(gateway))
+			}
+		}
+
+		errs := pool.ValidateFields()
+		if test.capacity == 0 {
+			if len(errs) != 1 || errs[0].Field != "subnet" {
+				t.Errorf("test %s fails: expected a single error of field subnet but got %v", test.name, errs)
+			}
+			continue
+		}
+		if len(errs) != 0 {
+			t.Errorf("test %s fails: %v", test.name, errs)
+			continue
+		}
+		if err := pool.Canonicalize(); err != nil {
+			t.Errorf("test %s fails: %v", test.name, err)
+		} else if pool.Capacity() != test.capacity {
+			t.Errorf("test %s fails: expected capacity %d but got %d", test.name, test.capacity, pool.Capacity())
+		}
+	}
+}